@@ -0,0 +1,148 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+)
+
+// Warning describes a potentially risky strategy configuration found by AnalyzeChain.
+type Warning struct {
+	// Strategy describes the strategy the warning applies to, as from its String method.
+	Strategy string
+	// Message is a human-readable description of the risk.
+	Message string
+}
+
+// String returns the warning in a form suitable for logging.
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Strategy, w.Message)
+}
+
+// AnalyzeChain statically checks strat, which may be a ChainStrategy, for configurations
+// that are commonly mistakes or that leave the result open to spoofing. It returns a
+// warning for each one found, suitable for surfacing in startup logs or CI. An empty
+// result does not mean the configuration is correct for your network -- only that none
+// of the known risky patterns were found.
+// Custom strategies are not analyzed.
+func AnalyzeChain(strat Strategy) []Warning {
+	var warnings []Warning
+	analyzeStrategy(strat, &warnings)
+	return warnings
+}
+
+// analyzeStrategy appends the warnings for strat to warnings.
+func analyzeStrategy(strat Strategy, warnings *[]Warning) {
+	warn := func(msg string) {
+		*warnings = append(*warnings, Warning{Strategy: describeStrategy(strat), Message: msg})
+	}
+
+	switch s := strat.(type) {
+	case ChainStrategy:
+		analyzeChainStrategy(s, warnings)
+	case LeftmostNonPrivateStrategy, LeftmostNonPrivateWithinStrategy, LeftmostNonPrivateTrustedStrategy, ForwardedLeftmostTrustedStrategy:
+		warn("leftmost is client-controlled; the result can be trivially spoofed and must not be used for security purposes")
+	case SingleIPHeaderStrategy:
+		if !s.opts.requirePublic && s.opts.allowedRanges() == nil {
+			warn(fmt.Sprintf("%s is only safe if it is always set or overwritten by a trusted reverse proxy; consider also using WithRequirePublic or WithAllowedRanges", s.headerName))
+		} else {
+			warn(fmt.Sprintf("%s is only safe if it is always set or overwritten by a trusted reverse proxy", s.headerName))
+		}
+	case ProxyProtocolHeaderStrategy:
+		warn(fmt.Sprintf("%s is only safe if it is always set or overwritten by a trusted reverse proxy", s.headerName))
+	case RightmostTrustedRangeStrategy:
+		if len(s.trustedRanges.load()) == 0 {
+			warn("there are no trusted ranges, so the rightmost IP is always used")
+		}
+	case ContiguousTrustedRangeStrategy:
+		if len(s.trustedRanges) == 0 {
+			warn("there are no trusted ranges, so the header is never used")
+		}
+	}
+}
+
+// analyzeChainStrategy appends the warnings for chain and its strategies to warnings.
+func analyzeChainStrategy(chain ChainStrategy, warnings *[]Warning) {
+	var headerNames []string
+	afterRemoteAddr := false
+	for _, subStrat := range chain.strategies {
+		if afterRemoteAddr {
+			*warnings = append(*warnings, Warning{
+				Strategy: describeStrategy(subStrat),
+				Message:  "follows RemoteAddrStrategy in a chain, so it is only used if RemoteAddr is invalid",
+			})
+		}
+
+		if headerName := strategyHeaderName(subStrat); headerName != "" && !containsString(headerNames, headerName) {
+			headerNames = append(headerNames, headerName)
+		}
+
+		if _, ok := subStrat.(RemoteAddrStrategy); ok {
+			afterRemoteAddr = true
+		}
+
+		analyzeStrategy(subStrat, warnings)
+	}
+
+	if len(headerNames) > 1 {
+		*warnings = append(*warnings, Warning{
+			Strategy: describeStrategy(chain),
+			Message:  fmt.Sprintf("checks multiple headers %v; there is likely only one header that your reverse proxy sets, and checking others allows spoofing", headerNames),
+		})
+	}
+}
+
+// strategyHeaderName returns the header name used by strat, or empty string if it doesn't
+// use a header or is unknown. For a strategy that wraps another, like ExactProxyStrategy,
+// it is the header used by the wrapped strategy.
+func strategyHeaderName(strat Strategy) string {
+	switch s := strat.(type) {
+	case SingleIPHeaderStrategy:
+		return s.headerName
+	case LeftmostNonPrivateStrategy:
+		return s.headerName
+	case LeftmostNonPrivateWithinStrategy:
+		return s.headerName
+	case LeftmostNonPrivateTrustedStrategy:
+		return s.headerName
+	case ForwardedLeftmostTrustedStrategy:
+		return forwardedHdr
+	case ForwardedByMarkerStrategy:
+		return forwardedHdr
+	case RightmostNonPrivateStrategy:
+		return s.headerName
+	case RightmostNonPrivateWithRemoteAddrStrategy:
+		return s.rightmost.headerName
+	case RightmostTrustedCountStrategy:
+		return s.headerName
+	case RightmostTrustedRangeStrategy:
+		return s.headerName
+	case ContiguousTrustedRangeStrategy:
+		return s.headerName
+	case ProxyProtocolHeaderStrategy:
+		return s.headerName
+	case RightmostTrustedCountByHeaderStrategy:
+		for _, subStrat := range s.strategies {
+			// They all use the same header
+			return subStrat.headerName
+		}
+	case ExactProxyStrategy:
+		return strategyHeaderName(s.inner)
+	case MemoizedStrategy:
+		return strategyHeaderName(s.inner)
+	case CrossCheckStrategy:
+		// The verifier's header is only used for checking
+		return strategyHeaderName(s.primary)
+	}
+	return ""
+}
+
+// containsString reports whether ss contains s.
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
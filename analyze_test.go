@@ -0,0 +1,77 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeChain(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
+	tests := []struct {
+		name         string
+		strat        Strategy
+		wantMessages []string
+	}{
+		{
+			name:  "Gated rightmost-trusted-range",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)),
+		},
+		{
+			name: "Rightmost chain with fallback",
+			strat: NewChainStrategy(
+				Must(NewRightmostTrustedCountStrategy("Forwarded", 1)),
+				RemoteAddrStrategy{},
+			),
+		},
+		{
+			name:         "Leftmost",
+			strat:        Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			wantMessages: []string{"leftmost is client-controlled"},
+		},
+		{
+			name:         "Leftmost within a chain",
+			strat:        NewChainStrategy(Must(NewLeftmostNonPrivateWithinStrategy("X-Forwarded-For", 2)), RemoteAddrStrategy{}),
+			wantMessages: []string{"leftmost is client-controlled"},
+		},
+		{
+			name:         "Single-IP header",
+			strat:        Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			wantMessages: []string{"X-Real-Ip is only safe if"},
+		},
+		{
+			name:         "Rightmost-trusted-range without ranges",
+			strat:        Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", nil)),
+			wantMessages: []string{"no trusted ranges"},
+		},
+		{
+			name: "Multiple headers and unreachable strategy",
+			strat: NewChainStrategy(
+				Must(NewRightmostNonPrivateStrategy("Forwarded")),
+				RemoteAddrStrategy{},
+				Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			),
+			wantMessages: []string{"follows RemoteAddrStrategy", "checks multiple headers"},
+		},
+		{
+			name:  "Custom strategy",
+			strat: unstringableStrategy{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AnalyzeChain(tt.strat)
+			if len(got) != len(tt.wantMessages) {
+				t.Fatalf("AnalyzeChain() = %v, want %d warnings", got, len(tt.wantMessages))
+			}
+
+			for i, w := range got {
+				if !strings.Contains(w.String(), tt.wantMessages[i]) {
+					t.Fatalf("AnalyzeChain()[%d] = %q, want it to contain %q", i, w.String(), tt.wantMessages[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Candidate is a possible client IP found in a request, as returned by
+// ClientIPCandidates.
+type Candidate struct {
+	// Addr is the IP, in the same form that the strategies return.
+	Addr string
+	// Source describes where Addr was found, like "RemoteAddr", "X-Real-Ip", or
+	// "X-Forwarded-For[2]" (the index being that of the entry in the header list).
+	Source string
+	// TrustScore is a relative measure of how hard it would be for a client to spoof
+	// Addr. It is only meaningful for comparing candidates; higher is more trustworthy.
+	TrustScore int
+}
+
+// Trust scores of the candidate sources. List header entries start at
+// listHeaderTrustScore for the rightmost entry, and lose listHeaderTrustStep for each
+// step to the left, down to minTrustScore.
+const (
+	remoteAddrTrustScore = 100
+	listHeaderTrustScore = 90
+	listHeaderTrustStep  = 10
+	singleIPTrustScore   = 50
+	minTrustScore        = 10
+)
+
+// candidateSingleIPHeaders are the single-IP headers that ClientIPCandidates checks, in
+// order.
+var candidateSingleIPHeaders = []string{
+	HeaderXRealIP, HeaderCFConnectingIP, HeaderCFConnectingIPv6, HeaderTrueClientIP,
+	HeaderFastlyClientIP, HeaderXAzureClientIP, HeaderXAzureSocketIP,
+}
+
+// ClientIPCandidates returns every valid IP in RemoteAddr, the list headers
+// (X-Forwarded-For, Forwarded, and X-Original-Forwarded-For), and the common single-IP
+// headers (like X-Real-IP), ranked from most to least trustworthy. It is intended for logging and forensics, to give a view of all
+// of the IPs that a request claims, and MUST NOT be used to choose the client IP; use a
+// Strategy for that.
+// RemoteAddr is ranked highest, as it can't be spoofed. List header entries are ranked
+// from right to left, as entries further left were added by parties further from this
+// server; the leftmost can be trivially spoofed. Single-IP headers are ranked in between,
+// as they are only trustworthy if set by a reverse proxy. Private addresses are included.
+// Candidates with the same score are in the order of the sources above, and list header
+// entries from right to left.
+func ClientIPCandidates(headers http.Header, remoteAddr string) []Candidate {
+	var candidates []Candidate
+	opts := &options{}
+
+	if ipAddr := remoteAddrIPAddr(remoteAddr, opts); ipAddr != nil {
+		candidates = append(candidates, Candidate{Addr: ipAddr.String(), Source: "RemoteAddr", TrustScore: remoteAddrTrustScore})
+	}
+
+	for _, headerName := range []string{xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr} {
+		ipAddrs := getIPAddrList(headers, headerName, opts)
+
+		// Go from right to left, so that the order is right if the scores bottom out
+		for i := len(ipAddrs) - 1; i >= 0; i-- {
+			ipAddr := ipAddrs[i]
+			if ipAddr == nil {
+				continue
+			}
+
+			score := listHeaderTrustScore - listHeaderTrustStep*(len(ipAddrs)-1-i)
+			if score < minTrustScore {
+				score = minTrustScore
+			}
+			candidates = append(candidates, Candidate{Addr: ipAddr.String(), Source: fmt.Sprintf("%s[%d]", headerName, i), TrustScore: score})
+		}
+	}
+
+	for _, headerName := range candidateSingleIPHeaders {
+		if ipAddr := headerIPAddr(lastHeader(headers, headerName), opts); ipAddr != nil {
+			candidates = append(candidates, Candidate{Addr: ipAddr.String(), Source: headerName, TrustScore: singleIPTrustScore})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].TrustScore > candidates[j].TrustScore
+	})
+
+	return candidates
+}
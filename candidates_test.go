@@ -0,0 +1,49 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestClientIPCandidates(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For":          []string{"1.1.1.1, nope, 2.2.2.2", "3.3.3.3, 4.4.4.4, 5.5.5.5, 6.6.6.6, 7.7.7.7, 8.8.8.8, 9.9.9.9, 10.0.0.1"},
+		"Forwarded":                []string{`For="[2607:f8b0:4004:83f::200e]:4711", For=10.0.0.2`},
+		"X-Original-Forwarded-For": []string{"13.13.13.13, 10.0.0.4"},
+		"X-Real-Ip":                []string{"11.11.11.11"},
+		"True-Client-Ip":           []string{"12.12.12.12"},
+	}
+
+	want := []Candidate{
+		{Addr: "10.0.0.3", Source: "RemoteAddr", TrustScore: 100},
+		{Addr: "10.0.0.1", Source: "X-Forwarded-For[10]", TrustScore: 90},
+		{Addr: "10.0.0.2", Source: "Forwarded[1]", TrustScore: 90},
+		{Addr: "10.0.0.4", Source: "X-Original-Forwarded-For[1]", TrustScore: 90},
+		{Addr: "9.9.9.9", Source: "X-Forwarded-For[9]", TrustScore: 80},
+		{Addr: "2607:f8b0:4004:83f::200e", Source: "Forwarded[0]", TrustScore: 80},
+		{Addr: "13.13.13.13", Source: "X-Original-Forwarded-For[0]", TrustScore: 80},
+		{Addr: "8.8.8.8", Source: "X-Forwarded-For[8]", TrustScore: 70},
+		{Addr: "7.7.7.7", Source: "X-Forwarded-For[7]", TrustScore: 60},
+		{Addr: "6.6.6.6", Source: "X-Forwarded-For[6]", TrustScore: 50},
+		{Addr: "11.11.11.11", Source: "X-Real-Ip", TrustScore: 50},
+		{Addr: "12.12.12.12", Source: "True-Client-Ip", TrustScore: 50},
+		{Addr: "5.5.5.5", Source: "X-Forwarded-For[5]", TrustScore: 40},
+		{Addr: "4.4.4.4", Source: "X-Forwarded-For[4]", TrustScore: 30},
+		{Addr: "3.3.3.3", Source: "X-Forwarded-For[3]", TrustScore: 20},
+		{Addr: "2.2.2.2", Source: "X-Forwarded-For[2]", TrustScore: 10},
+		{Addr: "1.1.1.1", Source: "X-Forwarded-For[0]", TrustScore: 10},
+	}
+
+	got := ClientIPCandidates(headers, "10.0.0.3:4711")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ClientIPCandidates() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// No IPs at all
+	if got := ClientIPCandidates(http.Header{}, "@"); len(got) != 0 {
+		t.Fatalf("ClientIPCandidates() = %+v, want none", got)
+	}
+}
@@ -0,0 +1,83 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ChainBuilder accumulates strategies for a ChainStrategy. Errors from constructing the
+// strategies are collected and returned by Build, so that a chain can be assembled
+// without checking an error at each step or panicking via Must. For example:
+//
+//	var b ChainBuilder
+//	strat, err := b.AddSingleHeader("Cf-Connecting-IP").AddRemoteAddr().Build()
+//
+// The zero value is ready to use. A ChainBuilder must not be used concurrently.
+type ChainBuilder struct {
+	strategies []Strategy
+	errs       []error
+}
+
+// Add appends strat to the chain.
+func (b *ChainBuilder) Add(strat Strategy) *ChainBuilder {
+	if strat == nil {
+		b.errs = append(b.errs, fmt.Errorf("strategy %d is nil", len(b.strategies)+len(b.errs)))
+		return b
+	}
+
+	b.strategies = append(b.strategies, strat)
+	return b
+}
+
+// AddRemoteAddr appends a RemoteAddrStrategy to the chain.
+func (b *ChainBuilder) AddRemoteAddr(opts ...Option) *ChainBuilder {
+	return b.Add(NewRemoteAddrStrategy(opts...))
+}
+
+// AddSingleHeader appends a SingleIPHeaderStrategy that uses headerName to the chain.
+// Any construction error is returned by Build.
+func (b *ChainBuilder) AddSingleHeader(headerName string, opts ...Option) *ChainBuilder {
+	strat, err := NewSingleIPHeaderStrategy(headerName, opts...)
+	return b.addOrErr(strat, err)
+}
+
+// AddRightmostTrustedRange appends a RightmostTrustedRangeStrategy that uses headerName
+// and trustedRanges to the chain. Any construction error is returned by Build.
+func (b *ChainBuilder) AddRightmostTrustedRange(headerName string, trustedRanges []net.IPNet, opts ...Option) *ChainBuilder {
+	strat, err := NewRightmostTrustedRangeStrategy(headerName, trustedRanges, opts...)
+	return b.addOrErr(strat, err)
+}
+
+// addOrErr appends strat to the chain if err is nil, and otherwise records err.
+func (b *ChainBuilder) addOrErr(strat Strategy, err error) *ChainBuilder {
+	if err != nil {
+		b.errs = append(b.errs, err)
+		return b
+	}
+	return b.Add(strat)
+}
+
+// Build returns a ChainStrategy of the strategies that were added, in order. If any of
+// them failed to be constructed, an error describing all of the failures is returned
+// instead; it wraps the first failure. An error is also returned if no strategies were
+// added.
+func (b *ChainBuilder) Build() (ChainStrategy, error) {
+	switch len(b.errs) {
+	case 0:
+		if len(b.strategies) == 0 {
+			return ChainStrategy{}, fmt.Errorf("ChainBuilder has no strategies")
+		}
+		return NewChainStrategy(b.strategies...), nil
+	case 1:
+		return ChainStrategy{}, fmt.Errorf("ChainBuilder failed: %w", b.errs[0])
+	}
+
+	msgs := make([]string, len(b.errs))
+	for i, err := range b.errs {
+		msgs[i] = err.Error()
+	}
+	return ChainStrategy{}, fmt.Errorf("ChainBuilder failed with %d errors: %w; %s", len(b.errs), b.errs[0], strings.Join(msgs[1:], "; "))
+}
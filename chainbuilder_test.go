@@ -0,0 +1,75 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChainBuilder(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	headers := http.Header{
+		"Cf-Connecting-Ip": []string{"1.1.1.1"},
+		"X-Forwarded-For":  []string{"2.2.2.2, 10.0.0.1"},
+	}
+
+	t.Run("Valid chain", func(t *testing.T) {
+		var b ChainBuilder
+		strat, err := b.
+			AddRightmostTrustedRange("X-Forwarded-For", trustedRanges).
+			AddSingleHeader("Cf-Connecting-IP").
+			Add(Must(NewRightmostNonPrivateStrategy("Forwarded"))).
+			AddRemoteAddr().
+			Build()
+		if err != nil {
+			t.Fatalf("Build error = %v", err)
+		}
+
+		want := "ChainStrategy{[RightmostTrustedRangeStrategy{header=X-Forwarded-For, ranges=1}, SingleIPHeaderStrategy{header=Cf-Connecting-Ip}, RightmostNonPrivateStrategy{header=Forwarded}, RemoteAddrStrategy{}]}"
+		if strat.String() != want {
+			t.Fatalf("String() = %q, want %q", strat.String(), want)
+		}
+
+		if got := strat.ClientIP(headers, "10.0.0.1:4711"); got != "2.2.2.2" {
+			t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+		}
+		if got := strat.ClientIP(http.Header{}, "3.3.3.3:4711"); got != "3.3.3.3" {
+			t.Fatalf("ClientIP = %q, want %q", got, "3.3.3.3")
+		}
+	})
+
+	t.Run("Bad header", func(t *testing.T) {
+		var b ChainBuilder
+		_, err := b.
+			AddSingleHeader("X-Forwarded-For").
+			AddRemoteAddr().
+			Build()
+		if err == nil {
+			t.Fatalf("Build succeeded, want error")
+		}
+		if !strings.Contains(err.Error(), "SingleIPHeaderStrategy") {
+			t.Fatalf("Build error = %q, want it to mention SingleIPHeaderStrategy", err)
+		}
+	})
+
+	t.Run("Multiple errors", func(t *testing.T) {
+		var b ChainBuilder
+		_, err := b.
+			AddSingleHeader("").
+			AddRightmostTrustedRange("X-Real-IP", trustedRanges).
+			Add(nil).
+			Build()
+		if err == nil || !strings.Contains(err.Error(), "3 errors") {
+			t.Fatalf("Build error = %v, want 3 errors", err)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		var b ChainBuilder
+		if _, err := b.Build(); err == nil {
+			t.Fatalf("Build succeeded, want error")
+		}
+	})
+}
@@ -0,0 +1,36 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderCFIPCountry is the canonicalized name of the header in which Cloudflare sends the
+// two-letter country code of the client, when IP geolocation is enabled.
+const HeaderCFIPCountry = "Cf-Ipcountry"
+
+// ClientInfo is the client information derived by CloudflareClientInfo.
+type ClientInfo struct {
+	// IP is the client IP, as derived by the strategy. It is empty string if no valid IP
+	// could be derived.
+	IP string
+	// Country is the ISO 3166-1 alpha-2 country code of the client, as sent by Cloudflare,
+	// like "CA". It may also be "XX" for unknown or "T1" for Tor. It is empty string if
+	// the header is absent.
+	Country string
+}
+
+// CloudflareClientInfo derives the client IP using strat, and also reads the client
+// country from the CF-IPCountry header. strat would usually be a SingleIPHeaderStrategy
+// with HeaderCFConnectingIP.
+// Like CF-Connecting-IP, the CF-IPCountry header can be trivially spoofed by a client
+// unless all requests are guaranteed to pass through Cloudflare. headers is expected to
+// be like http.Request.Header, and remoteAddr like http.Request.RemoteAddr.
+func CloudflareClientInfo(strat Strategy, headers http.Header, remoteAddr string) ClientInfo {
+	return ClientInfo{
+		IP:      strat.ClientIP(headers, remoteAddr),
+		Country: strings.TrimSpace(lastHeader(headers, HeaderCFIPCountry)),
+	}
+}
@@ -0,0 +1,48 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCloudflareClientInfo(t *testing.T) {
+	strat := Must(NewSingleIPHeaderStrategy(HeaderCFConnectingIP))
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    ClientInfo
+	}{
+		{
+			name: "IP and country",
+			headers: http.Header{
+				"Cf-Connecting-Ip": []string{"2607:f8b0:4004:83f::200e"},
+				"Cf-Ipcountry":     []string{"CA"},
+			},
+			want: ClientInfo{IP: "2607:f8b0:4004:83f::200e", Country: "CA"},
+		},
+		{
+			name: "Only IP",
+			headers: http.Header{
+				"Cf-Connecting-Ip": []string{"1.1.1.1"},
+			},
+			want: ClientInfo{IP: "1.1.1.1"},
+		},
+		{
+			name: "Only country",
+			headers: http.Header{
+				"Cf-Ipcountry": []string{"XX"},
+			},
+			want: ClientInfo{Country: "XX"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CloudflareClientInfo(strat, tt.headers, "10.0.0.1:4711"); got != tt.want {
+				t.Fatalf("CloudflareClientInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/realclientip/realclientip-go/ranges"
+)
+
+// StrategyConfig describes a strategy in a form suitable for loading from a configuration
+// file. It is used with StrategyFromConfig. Which fields are required depends on Type;
+// unused fields are ignored.
+type StrategyConfig struct {
+	// Type is the kind of strategy. It must be one of "remote-addr", "single-ip-header",
+	// "leftmost-non-private", "leftmost-non-private-within",
+	// "leftmost-non-private-trusted", "rightmost-non-private", "rightmost-trusted-count",
+	// "rightmost-trusted-range", "contiguous-trusted-range", "proxy-protocol-header", or
+	// "chain".
+	Type string `json:"type" yaml:"type"`
+
+	// Header is the name of the header the strategy uses.
+	Header string `json:"header" yaml:"header"`
+
+	// TrustedCount is the number of trusted reverse proxies, for "rightmost-trusted-count".
+	TrustedCount int `json:"trustedCount" yaml:"trustedCount"`
+
+	// MaxDepth is the search depth for "leftmost-non-private-within".
+	MaxDepth int `json:"maxDepth" yaml:"maxDepth"`
+
+	// Ranges are the trusted ranges for the strategies that take them. Each element is
+	// either the name of a known range set (see StrategyFromConfig), an IP range like
+	// "10.0.0.0/8", or a single IP address.
+	Ranges []string `json:"ranges" yaml:"ranges"`
+
+	// Strategies are the strategies to try in order, for "chain".
+	Strategies []StrategyConfig `json:"strategies" yaml:"strategies"`
+}
+
+// strategyBuilders maps StrategyConfig.Type values to functions that construct the
+// corresponding strategy. "chain" is handled separately by StrategyFromConfig, as it
+// recurses.
+var strategyBuilders = map[string]func(cfg StrategyConfig, opts []Option) (Strategy, error){
+	"remote-addr": func(_ StrategyConfig, opts []Option) (Strategy, error) {
+		return NewRemoteAddrStrategy(opts...), nil
+	},
+	"single-ip-header": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		return NewSingleIPHeaderStrategy(cfg.Header, opts...)
+	},
+	"leftmost-non-private": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		return NewLeftmostNonPrivateStrategy(cfg.Header, opts...)
+	},
+	"leftmost-non-private-within": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		return NewLeftmostNonPrivateWithinStrategy(cfg.Header, cfg.MaxDepth, opts...)
+	},
+	"leftmost-non-private-trusted": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		trustedRanges, err := configRanges(cfg.Ranges)
+		if err != nil {
+			return nil, err
+		}
+		return NewLeftmostNonPrivateTrustedStrategy(cfg.Header, trustedRanges, opts...)
+	},
+	"rightmost-non-private": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		return NewRightmostNonPrivateStrategy(cfg.Header, opts...)
+	},
+	"rightmost-trusted-count": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		return NewRightmostTrustedCountStrategy(cfg.Header, cfg.TrustedCount, opts...)
+	},
+	"rightmost-trusted-range": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		trustedRanges, err := configRanges(cfg.Ranges)
+		if err != nil {
+			return nil, err
+		}
+		return NewRightmostTrustedRangeStrategy(cfg.Header, trustedRanges, opts...)
+	},
+	"contiguous-trusted-range": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		trustedRanges, err := configRanges(cfg.Ranges)
+		if err != nil {
+			return nil, err
+		}
+		return NewContiguousTrustedRangeStrategy(cfg.Header, trustedRanges, opts...)
+	},
+	"proxy-protocol-header": func(cfg StrategyConfig, opts []Option) (Strategy, error) {
+		return NewProxyProtocolHeaderStrategy(cfg.Header, opts...)
+	},
+}
+
+// StrategyFromConfig creates the strategy described by cfg, passing opts to its
+// constructor. This centralizes the wiring and validation of strategies that are
+// configured from a file.
+// The elements of cfg.Ranges may be the names of these known range sets (case-insensitive):
+// "cloudflare" (ranges.Cloudflare), "aws" or "cloudfront" (ranges.CloudFront),
+// "azure-front-door" (ranges.AzureFrontDoor), and "private" (the private and local
+// ranges that the non-private strategies skip).
+func StrategyFromConfig(cfg StrategyConfig, opts ...Option) (Strategy, error) {
+	stratType := strings.ToLower(cfg.Type)
+	if stratType == "chain" {
+		return chainFromConfig(cfg, opts)
+	}
+
+	build, ok := strategyBuilders[stratType]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy type %q", cfg.Type)
+	}
+
+	strat, err := build(cfg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("building %s strategy: %w", cfg.Type, err)
+	}
+
+	return strat, nil
+}
+
+// chainFromConfig creates a ChainStrategy from cfg.Strategies.
+func chainFromConfig(cfg StrategyConfig, opts []Option) (Strategy, error) {
+	if len(cfg.Strategies) == 0 {
+		return nil, fmt.Errorf("chain strategy config must have at least one strategy")
+	}
+
+	strategies := make([]Strategy, len(cfg.Strategies))
+	for i, subCfg := range cfg.Strategies {
+		strat, err := StrategyFromConfig(subCfg, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("chain strategy config at index %d: %w", i, err)
+		}
+		strategies[i] = strat
+	}
+
+	return NewChainStrategy(strategies...), nil
+}
+
+// ConfigFromStrategy returns the StrategyConfig that describes strat, such that
+// StrategyFromConfig would create an equivalent strategy. Trusted ranges are given as CIDR
+// strings. Options passed to the strategy's constructor are not captured, so the same
+// options must be passed to StrategyFromConfig. An error is returned if strat can't be
+// described by a StrategyConfig, such as a custom strategy or a fail-closed chain.
+func ConfigFromStrategy(strat Strategy) (StrategyConfig, error) {
+	switch s := strat.(type) {
+	case RemoteAddrStrategy:
+		if s.defaultIP != "" {
+			return StrategyConfig{}, fmt.Errorf("RemoteAddrStrategy with a default can't be described by a StrategyConfig")
+		}
+		return StrategyConfig{Type: "remote-addr"}, nil
+	case SingleIPHeaderStrategy:
+		return StrategyConfig{Type: "single-ip-header", Header: s.headerName}, nil
+	case LeftmostNonPrivateStrategy:
+		return StrategyConfig{Type: "leftmost-non-private", Header: s.headerName}, nil
+	case LeftmostNonPrivateWithinStrategy:
+		return StrategyConfig{Type: "leftmost-non-private-within", Header: s.headerName, MaxDepth: s.maxDepth}, nil
+	case LeftmostNonPrivateTrustedStrategy:
+		return StrategyConfig{Type: "leftmost-non-private-trusted", Header: s.headerName, Ranges: ipNetStrings(s.trustedRanges)}, nil
+	case RightmostNonPrivateStrategy:
+		return StrategyConfig{Type: "rightmost-non-private", Header: s.headerName}, nil
+	case RightmostTrustedCountStrategy:
+		return StrategyConfig{Type: "rightmost-trusted-count", Header: s.headerName, TrustedCount: s.trustedCount}, nil
+	case RightmostTrustedRangeStrategy:
+		return StrategyConfig{Type: "rightmost-trusted-range", Header: s.headerName, Ranges: ipNetStrings(s.trustedRanges.load())}, nil
+	case ContiguousTrustedRangeStrategy:
+		return StrategyConfig{Type: "contiguous-trusted-range", Header: s.headerName, Ranges: ipNetStrings(s.trustedRanges)}, nil
+	case ProxyProtocolHeaderStrategy:
+		return StrategyConfig{Type: "proxy-protocol-header", Header: s.headerName}, nil
+	case ChainStrategy:
+		if s.failClosed {
+			return StrategyConfig{}, fmt.Errorf("fail-closed ChainStrategy can't be described by a StrategyConfig")
+		}
+		cfg := StrategyConfig{Type: "chain", Strategies: make([]StrategyConfig, len(s.strategies))}
+		for i, subStrat := range s.strategies {
+			subCfg, err := ConfigFromStrategy(subStrat)
+			if err != nil {
+				return StrategyConfig{}, fmt.Errorf("chain strategy at index %d: %w", i, err)
+			}
+			cfg.Strategies[i] = subCfg
+		}
+		return cfg, nil
+	}
+
+	return StrategyConfig{}, fmt.Errorf("%s can't be described by a StrategyConfig", describeStrategy(strat))
+}
+
+// ipNetStrings returns the CIDR string forms of ipNets.
+func ipNetStrings(ipNets []net.IPNet) []string {
+	result := make([]string, len(ipNets))
+	for i := range ipNets {
+		result[i] = ipNets[i].String()
+	}
+	return result
+}
+
+// JSONStrategy wraps a Strategy so that it can be marshalled to and unmarshalled from
+// JSON, such as to persist and reload it. The JSON form is that of the StrategyConfig
+// returned by ConfigFromStrategy. Unmarshalling uses StrategyFromConfig, so the result is
+// validated and ready to use; options can't be given, so strategies that need them should
+// be created with StrategyFromConfig instead.
+type JSONStrategy struct {
+	Strategy Strategy
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s JSONStrategy) MarshalJSON() ([]byte, error) {
+	cfg, err := ConfigFromStrategy(s.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cfg)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *JSONStrategy) UnmarshalJSON(data []byte) error {
+	var cfg StrategyConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+
+	strat, err := StrategyFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.Strategy = strat
+	return nil
+}
+
+// configRanges resolves the range names, ranges, and addresses in names into IPNets.
+func configRanges(names []string) ([]net.IPNet, error) {
+	var result []net.IPNet
+	for _, name := range names {
+		var known []string
+		switch strings.ToLower(name) {
+		case "cloudflare":
+			known = ranges.Cloudflare
+		case "aws", "cloudfront":
+			known = ranges.CloudFront
+		case "azure-front-door":
+			known = ranges.AzureFrontDoor
+		case "private":
+			result = append(result, privateAndLocalRanges...)
+			continue
+		default:
+			known = []string{name}
+		}
+
+		ipNets, err := AddressesAndRangesToIPNets(known...)
+		if err != nil {
+			return nil, fmt.Errorf("range %q is not a known range set, range, or address: %w", name, err)
+		}
+		result = append(result, ipNets...)
+	}
+
+	return result, nil
+}
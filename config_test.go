@@ -0,0 +1,216 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestStrategyFromConfig(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For":  []string{"1.1.1.1, 2.2.2.2, 192.168.1.1, 173.245.48.1"},
+		"Forwarded":        []string{"For=3.3.3.3, For=10.0.0.1"},
+		"Cf-Connecting-Ip": []string{"4.4.4.4"},
+		"Proxy-Protocol":   []string{"PROXY TCP4 5.5.5.5 192.168.1.2 56324 443"},
+	}
+	remoteAddr := "6.6.6.6:4711"
+
+	tests := []struct {
+		name    string
+		cfg     StrategyConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "remote-addr",
+			cfg:  StrategyConfig{Type: "remote-addr"},
+			want: "6.6.6.6",
+		},
+		{
+			name: "single-ip-header",
+			cfg:  StrategyConfig{Type: "single-ip-header", Header: "CF-Connecting-IP"},
+			want: "4.4.4.4",
+		},
+		{
+			name: "leftmost-non-private",
+			cfg:  StrategyConfig{Type: "leftmost-non-private", Header: "X-Forwarded-For"},
+			want: "1.1.1.1",
+		},
+		{
+			name: "leftmost-non-private-within",
+			cfg:  StrategyConfig{Type: "leftmost-non-private-within", Header: "Forwarded", MaxDepth: 1},
+			want: "3.3.3.3",
+		},
+		{
+			name: "leftmost-non-private-trusted",
+			cfg:  StrategyConfig{Type: "leftmost-non-private-trusted", Header: "Forwarded", Ranges: []string{"private"}},
+			want: "3.3.3.3",
+		},
+		{
+			name: "rightmost-non-private",
+			cfg:  StrategyConfig{Type: "rightmost-non-private", Header: "Forwarded"},
+			want: "3.3.3.3",
+		},
+		{
+			name: "rightmost-trusted-count",
+			cfg:  StrategyConfig{Type: "rightmost-trusted-count", Header: "X-Forwarded-For", TrustedCount: 2},
+			want: "192.168.1.1",
+		},
+		{
+			name: "rightmost-trusted-range",
+			cfg:  StrategyConfig{Type: "Rightmost-Trusted-Range", Header: "X-Forwarded-For", Ranges: []string{"Cloudflare", "private"}},
+			want: "2.2.2.2",
+		},
+		{
+			name: "contiguous-trusted-range",
+			cfg:  StrategyConfig{Type: "contiguous-trusted-range", Header: "X-Forwarded-For", Ranges: []string{"cloudflare", "192.168.0.0/16", "6.6.6.6"}},
+			want: "2.2.2.2",
+		},
+		{
+			name: "proxy-protocol-header",
+			cfg:  StrategyConfig{Type: "proxy-protocol-header", Header: "Proxy-Protocol"},
+			want: "5.5.5.5",
+		},
+		{
+			name: "chain",
+			cfg: StrategyConfig{Type: "chain", Strategies: []StrategyConfig{
+				{Type: "single-ip-header", Header: "X-Real-IP"},
+				{Type: "remote-addr"},
+			}},
+			want: "6.6.6.6",
+		},
+		{
+			name:    "Error: unknown type",
+			cfg:     StrategyConfig{Type: "nope", Header: "X-Forwarded-For"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad range",
+			cfg:     StrategyConfig{Type: "rightmost-trusted-range", Header: "X-Forwarded-For", Ranges: []string{"nope"}},
+			wantErr: true,
+		},
+		{
+			name:    "Error: constructor failure",
+			cfg:     StrategyConfig{Type: "rightmost-trusted-count", Header: "X-Forwarded-For"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: empty chain",
+			cfg:     StrategyConfig{Type: "chain"},
+			wantErr: true,
+		},
+		{
+			name: "Error: bad chain element",
+			cfg: StrategyConfig{Type: "chain", Strategies: []StrategyConfig{
+				{Type: "remote-addr"},
+				{Type: "single-ip-header", Header: "X-Forwarded-For"},
+			}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := StrategyFromConfig(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StrategyFromConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got := strat.ClientIP(headers, remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONStrategy(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For":  []string{"1.1.1.1, 2.2.2.2, 192.168.1.1, 173.245.48.1"},
+		"Forwarded":        []string{"For=3.3.3.3, For=10.0.0.1"},
+		"Cf-Connecting-Ip": []string{"4.4.4.4"},
+		"Proxy-Protocol":   []string{"PROXY TCP4 5.5.5.5 192.168.1.2 56324 443"},
+	}
+	remoteAddr := "6.6.6.6:4711"
+
+	cfgs := []StrategyConfig{
+		{Type: "remote-addr"},
+		{Type: "single-ip-header", Header: "CF-Connecting-IP"},
+		{Type: "leftmost-non-private", Header: "X-Forwarded-For"},
+		{Type: "leftmost-non-private-within", Header: "Forwarded", MaxDepth: 1},
+		{Type: "leftmost-non-private-trusted", Header: "Forwarded", Ranges: []string{"private"}},
+		{Type: "rightmost-non-private", Header: "Forwarded"},
+		{Type: "rightmost-trusted-count", Header: "X-Forwarded-For", TrustedCount: 2},
+		{Type: "rightmost-trusted-range", Header: "X-Forwarded-For", Ranges: []string{"cloudflare", "192.168.0.0/16", "2.2.2.2"}},
+		{Type: "contiguous-trusted-range", Header: "X-Forwarded-For", Ranges: []string{"private", "6.6.6.6"}},
+		{Type: "proxy-protocol-header", Header: "Proxy-Protocol"},
+		{Type: "chain", Strategies: []StrategyConfig{
+			{Type: "single-ip-header", Header: "X-Real-IP"},
+			{Type: "rightmost-trusted-range", Header: "Forwarded", Ranges: []string{"10.0.0.0/8"}},
+			{Type: "remote-addr"},
+		}},
+	}
+	for _, cfg := range cfgs {
+		t.Run(cfg.Type, func(t *testing.T) {
+			strat, err := StrategyFromConfig(cfg)
+			if err != nil {
+				t.Fatalf("StrategyFromConfig error = %v", err)
+			}
+
+			b, err := json.Marshal(JSONStrategy{Strategy: strat})
+			if err != nil {
+				t.Fatalf("json.Marshal error = %v", err)
+			}
+
+			var got JSONStrategy
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("json.Unmarshal error = %v", err)
+			}
+
+			if describeStrategy(got.Strategy) != describeStrategy(strat) {
+				t.Fatalf("round trip gave %s, want %s", describeStrategy(got.Strategy), describeStrategy(strat))
+			}
+
+			if gotIP, wantIP := got.Strategy.ClientIP(headers, remoteAddr), strat.ClientIP(headers, remoteAddr); gotIP != wantIP {
+				t.Fatalf("round trip ClientIP = %q, want %q", gotIP, wantIP)
+			}
+
+			// A second round trip must be stable
+			b2, err := json.Marshal(got)
+			if err != nil {
+				t.Fatalf("second json.Marshal error = %v", err)
+			}
+			var cfg1, cfg2 StrategyConfig
+			_ = json.Unmarshal(b, &cfg1)
+			_ = json.Unmarshal(b2, &cfg2)
+			if !reflect.DeepEqual(cfg1, cfg2) {
+				t.Fatalf("second round trip gave %s, want %s", b2, b)
+			}
+		})
+	}
+
+	t.Run("Error: unrepresentable strategy", func(t *testing.T) {
+		if _, err := json.Marshal(JSONStrategy{Strategy: NewChainStrategyFailClosed(RemoteAddrStrategy{})}); err == nil {
+			t.Fatalf("json.Marshal succeeded, want error")
+		}
+		if _, err := json.Marshal(JSONStrategy{Strategy: unstringableStrategy{}}); err == nil {
+			t.Fatalf("json.Marshal succeeded, want error")
+		}
+	})
+
+	t.Run("Error: invalid config", func(t *testing.T) {
+		var s JSONStrategy
+		if err := json.Unmarshal([]byte(`{"type":"single-ip-header","header":"X-Forwarded-For"}`), &s); err == nil {
+			t.Fatalf("json.Unmarshal succeeded, want error")
+		}
+		if err := json.Unmarshal([]byte(`{"type":"rightmost-trusted-range","header":"X-Forwarded-For","ranges":["nope"]}`), &s); err == nil {
+			t.Fatalf("json.Unmarshal succeeded, want error")
+		}
+	})
+}
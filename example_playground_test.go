@@ -52,25 +52,25 @@ func Example_playground() {
 	fmt.Println(strat.ClientIP(req.Header, req.RemoteAddr)) // 192.168.1.2
 
 	// Output:
-	// realclientip.RemoteAddrStrategy: {}
+	// realclientip.RemoteAddrStrategy: RemoteAddrStrategy{}
 	// 192.168.1.2
 	//
-	// realclientip.SingleIPHeaderStrategy: {headerName:X-Real-Ip}
+	// realclientip.SingleIPHeaderStrategy: SingleIPHeaderStrategy{header=X-Real-Ip}
 	// 4.4.4.4
 	//
-	// realclientip.LeftmostNonPrivateStrategy: {headerName:Forwarded}
+	// realclientip.LeftmostNonPrivateStrategy: LeftmostNonPrivateStrategy{header=Forwarded}
 	// 188.0.2.128
 	//
-	// realclientip.RightmostNonPrivateStrategy: {headerName:X-Forwarded-For}
+	// realclientip.RightmostNonPrivateStrategy: RightmostNonPrivateStrategy{header=X-Forwarded-For}
 	// 3.3.3.3
 	//
-	// realclientip.RightmostTrustedCountStrategy: {headerName:Forwarded trustedCount:2}
+	// realclientip.RightmostTrustedCountStrategy: RightmostTrustedCountStrategy{header=Forwarded, count=2}
 	// 2001:db8:cafe::17
 	//
-	// realclientip.RightmostTrustedRangeStrategy: {headerName:X-Forwarded-For trustedRanges:[192.168.0.0/16 3.3.3.3/32]
+	// realclientip.RightmostTrustedRangeStrategy: RightmostTrustedRangeStrategy{header=X-Forwarded-For, ranges=2}
 	// 2001:db8:cafe::99%eth0
 	// 2001:db8:cafe::99
 	//
-	// realclientip.ChainStrategy: {strategies:[realclientip.SingleIPHeaderStrategy{headerName:Cf-Connecting-Ip} realclientip.RemoteAddrStrategy{}]}
+	// realclientip.ChainStrategy: ChainStrategy{[SingleIPHeaderStrategy{header=Cf-Connecting-Ip}, RemoteAddrStrategy{}]}
 	// 192.168.1.2
 }
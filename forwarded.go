@@ -0,0 +1,71 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net"
+	"net/http"
+)
+
+// ForwardedElement is a single list element of the Forwarded header, like
+// `for=192.0.2.60;proto=http;by=203.0.113.43`.
+type ForwardedElement struct {
+	// Raw is the element, trimmed of surrounding whitespace.
+	Raw string
+}
+
+// For parses and returns the "for" IP address of the element. Nil is returned if the
+// "for" parameter is absent or not a valid IP. The element is parsed on each call.
+func (e ForwardedElement) For() *net.IPAddr {
+	return parseForwardedListItem(e.Raw, &options{})
+}
+
+// Param returns the value of the parameter called name (case-insensitive), like "for",
+// "by", "host", or "proto", with any enclosing quotes removed. Empty string is returned
+// if the parameter is absent or malformed.
+func (e ForwardedElement) Param(name string) string {
+	return forwardedParam(e.Raw, name)
+}
+
+// ForwardedHost returns the value of the "host" parameter from the rightmost element of
+// the Forwarded header that has one, with any enclosing quotes removed. This is the Host
+// request header as received by the proxy that added the element, like "example.com" or
+// "[::1]:8443"; brackets around IPv6 addresses are kept, as they are part of the Host
+// syntax. ok is false if no element has a "host" parameter.
+// The rightmost value is the one added by the proxy nearest to this server, which is
+// usually the only one that can be trusted.
+func ForwardedHost(headers http.Header) (host string, ok bool) {
+	scanner := NewForwardedScanner(headers)
+	for elem, more := scanner.Next(); more; elem, more = scanner.Next() {
+		if h := elem.Param("host"); h != "" {
+			host, ok = h, true
+		}
+	}
+	return host, ok
+}
+
+// ForwardedScanner reads the elements of the Forwarded header one at a time, from the
+// concatenation of all instances of the header. Unlike collecting the elements into a
+// slice, scanning uses a fixed amount of memory no matter how long the header is, which
+// makes it suitable for pathologically long (possibly malicious) headers. Empty elements
+// are skipped.
+// A ForwardedScanner must not be used concurrently.
+type ForwardedScanner struct {
+	list listScanner
+}
+
+// NewForwardedScanner creates a ForwardedScanner that reads the Forwarded header in
+// headers. headers is expected to be like http.Request.Header.
+func NewForwardedScanner(headers http.Header) *ForwardedScanner {
+	return &ForwardedScanner{list: listScanner{values: headers[forwardedHdr]}}
+}
+
+// Next returns the next element of the header. ok is false when there are no more
+// elements.
+func (s *ForwardedScanner) Next() (elem ForwardedElement, ok bool) {
+	raw, ok := s.list.next()
+	if !ok {
+		return ForwardedElement{}, false
+	}
+	return ForwardedElement{Raw: raw}, true
+}
@@ -0,0 +1,122 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForwardedScanner(t *testing.T) {
+	headers := http.Header{"Forwarded": []string{
+		`For="[2607:f8b0:4004:83f::200e]:4711";proto=https, , for=nope`,
+		`by=1.1.1.1,For=3.3.3.3 `,
+	}}
+
+	wantRaw := []string{`For="[2607:f8b0:4004:83f::200e]:4711";proto=https`, `for=nope`, `by=1.1.1.1`, `For=3.3.3.3`}
+	wantFor := []string{"2607:f8b0:4004:83f::200e", "", "", "3.3.3.3"}
+
+	scanner := NewForwardedScanner(headers)
+	for i := range wantRaw {
+		elem, ok := scanner.Next()
+		if !ok {
+			t.Fatalf("Next() ended early at %d", i)
+		}
+
+		if elem.Raw != wantRaw[i] {
+			t.Fatalf("element %d Raw = %q, want %q", i, elem.Raw, wantRaw[i])
+		}
+
+		var gotFor string
+		if ip := elem.For(); ip != nil {
+			gotFor = ip.String()
+		}
+		if gotFor != wantFor[i] {
+			t.Fatalf("element %d For() = %q, want %q", i, gotFor, wantFor[i])
+		}
+	}
+
+	if elem, ok := scanner.Next(); ok {
+		t.Fatalf("Next() returned extra element %q", elem.Raw)
+	}
+
+	// An absent header has no elements
+	if _, ok := NewForwardedScanner(http.Header{}).Next(); ok {
+		t.Fatalf("Next() returned element for absent header")
+	}
+}
+
+func TestForwardedScanner_largeHeader(t *testing.T) {
+	// A synthetic ~3.5 MB header, split across several header instances
+	const elemsPerValue = 50000
+	value := strings.Repeat(`for="[2001:db8::1]:4711";proto=https, `, elemsPerValue)
+	headers := http.Header{"Forwarded": []string{value, value}}
+
+	var count int
+	allocs := testing.AllocsPerRun(3, func() {
+		count = 0
+		scanner := NewForwardedScanner(headers)
+		for _, ok := scanner.Next(); ok; _, ok = scanner.Next() {
+			count++
+		}
+	})
+
+	if count != 2*elemsPerValue {
+		t.Fatalf("scanned %d elements, want %d", count, 2*elemsPerValue)
+	}
+
+	// Scanning must not allocate per element
+	if allocs > 1 {
+		t.Fatalf("scanning allocated %v times, want at most 1", allocs)
+	}
+}
+
+func TestForwardedHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  http.Header
+		wantHost string
+		wantOK   bool
+	}{
+		{
+			name:     "Plain host",
+			headers:  http.Header{"Forwarded": []string{`for=1.1.1.1;host=example.com;proto=https`}},
+			wantHost: "example.com",
+			wantOK:   true,
+		},
+		{
+			name:     "Quoted IPv6 host with port",
+			headers:  http.Header{"Forwarded": []string{`For=1.1.1.1;Host="[::1]:8443"`}},
+			wantHost: "[::1]:8443",
+			wantOK:   true,
+		},
+		{
+			name: "Rightmost wins",
+			headers: http.Header{"Forwarded": []string{
+				`host=spoofed.example, for=2.2.2.2;HOST=example.com`,
+				`for=3.3.3.3`,
+			}},
+			wantHost: "example.com",
+			wantOK:   true,
+		},
+		{
+			name:    "No host",
+			headers: http.Header{"Forwarded": []string{`for=1.1.1.1;proto=https`}},
+			wantOK:  false,
+		},
+		{
+			name:    "No header",
+			headers: http.Header{},
+			wantOK:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotHost, gotOK := ForwardedHost(tt.headers)
+			if gotHost != tt.wantHost || gotOK != tt.wantOK {
+				t.Fatalf("ForwardedHost() = %q, %v, want %q, %v", gotHost, gotOK, tt.wantHost, tt.wantOK)
+			}
+		})
+	}
+}
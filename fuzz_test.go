@@ -0,0 +1,79 @@
+// SPDX: 0BSD
+
+//go:build go1.18
+// +build go1.18
+
+package realclientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// forwardedFuzzSeeds are Forwarded header values that exercise the parser's edge cases,
+// including those in Test_forwardedHeaderRFCDeviations.
+var forwardedFuzzSeeds = []string{
+	`For="1.1.1.1, For=2.2.2.2, For=3.3.3.3", For="4.4.4.4"`,
+	`For="1.1.1.1, For=2.2.2.2`,
+	`For=1.1.1.1;@!=😀, For=2.2.2.2`,
+	`For=1.1.1.1;For=2.2.2.2, For=3.3.3.3`,
+	`For="3.3.3.\3"`,
+	`For =1.1.1.1, For= 3.3.3.3`,
+	`For="[2001:db8:cafe::17%zone]:4711"`,
+	`for=192.0.2.60;proto=http; by=203.0.113.43`,
+	`For="[1.1.1.1]:4711"`,
+	`For=[2001:db8::1]`,
+	`For="[[2001:db8::1]]"`,
+	`For=""""`,
+	`For="_hidden", For=unknown`,
+	"For=1.1.1.1\x00, For=\t2.2.2.2\r\n",
+	`For="[::ffff:1.2.3.4%"]:99"`,
+	strings.Repeat(`for="[2001:db8::1]:4711";proto=https, `, 1000),
+}
+
+// checkFuzzIPAddr fails the test if ipAddr is neither nil nor a valid IP.
+func checkFuzzIPAddr(t *testing.T, input string, ipAddr *net.IPAddr) {
+	t.Helper()
+
+	if ipAddr == nil {
+		return
+	}
+
+	if len(ipAddr.IP) != net.IPv4len && len(ipAddr.IP) != net.IPv6len {
+		t.Fatalf("input %q gave IP of invalid length %d", input, len(ipAddr.IP))
+	}
+
+	if ipAddr.IP.IsUnspecified() {
+		t.Fatalf("input %q gave unspecified IP %v", input, ipAddr)
+	}
+}
+
+func FuzzParseForwardedListItem(f *testing.F) {
+	for _, seed := range forwardedFuzzSeeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, fwd string) {
+		checkFuzzIPAddr(t, fwd, parseForwardedListItem(fwd, &options{}))
+		checkFuzzIPAddr(t, fwd, parseForwardedListItem(fwd, &options{rejectBracketedIPv4: true, rejectMappedIPv6: true}))
+	})
+}
+
+func FuzzGetIPAddrList(f *testing.F) {
+	for _, seed := range forwardedFuzzSeeds {
+		f.Add(seed)
+	}
+	f.Add(`1.1.1.1, 2001:db8:cafe::99%eth0, 3.3.3.3, 192.168.1.1`)
+	f.Add(`[2001:db8::1]:4711,, ,::ffff:1.1.1.1:80`)
+
+	f.Fuzz(func(t *testing.T, value string) {
+		for _, headerName := range []string{forwardedHdr, xForwardedForHdr} {
+			headers := http.Header{headerName: []string{value, value}}
+			for _, ipAddr := range getIPAddrList(headers, headerName, &options{}) {
+				checkFuzzIPAddr(t, value, ipAddr)
+			}
+		}
+	})
+}
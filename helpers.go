@@ -0,0 +1,273 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// ClientIPContext is like strat.ClientIP, except that it first checks ctx and returns an
+// empty string if it has already been cancelled or has passed its deadline. Deriving the
+// client IP is synchronous and fast, so ctx is not otherwise used; this exists to provide
+// a uniform, context-aware call for middleware and framework integration. It works with
+// any Strategy, including custom ones.
+func ClientIPContext(ctx context.Context, strat Strategy, headers http.Header, remoteAddr string) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	return strat.ClientIP(headers, remoteAddr)
+}
+
+// ClientIPNetAddr is like strat.ClientIP, except that it returns the client IP as a
+// net.Addr (a *net.IPAddr), for use with APIs in the net package. ok is false if no valid
+// IP can be derived. It works with any Strategy, including custom ones.
+func ClientIPNetAddr(strat Strategy, headers http.Header, remoteAddr string) (addr net.Addr, ok bool) {
+	ipAddr, err := ParseIPAddr(strat.ClientIP(headers, remoteAddr))
+	if err != nil {
+		return nil, false
+	}
+	return &ipAddr, true
+}
+
+// ClientIPFromMap is like strat.ClientIP, but takes headers as a map whose keys may not
+// be canonicalized, such as is provided by some frameworks; textproto.MIMEHeader can also
+// be passed. http.Header lookups only find canonical keys, so without this a key like
+// "x-forwarded-for" would silently be ignored. The keys are canonicalized (without
+// modifying headers) before the strategy is used. If more than one key canonicalizes to
+// the same name, their values are combined in the sort order of the keys.
+func ClientIPFromMap(strat Strategy, headers map[string][]string, remoteAddr string) string {
+	return strat.ClientIP(canonicalizeHeaders(headers), remoteAddr)
+}
+
+// canonicalizeHeaders returns headers as an http.Header with canonical keys. headers is
+// returned as-is (without copying) if all of its keys are already canonical.
+func canonicalizeHeaders(headers map[string][]string) http.Header {
+	needsCopy := false
+	for k := range headers {
+		if http.CanonicalHeaderKey(k) != k {
+			needsCopy = true
+			break
+		}
+	}
+	if !needsCopy {
+		return headers
+	}
+
+	// Sort the keys so that the order of combined values doesn't depend on map iteration
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make(http.Header, len(headers))
+	for _, k := range keys {
+		canonicalKey := http.CanonicalHeaderKey(k)
+		result[canonicalKey] = append(result[canonicalKey], headers[k]...)
+	}
+	return result
+}
+
+// ClientIPHash derives the client IP using strat, and returns a salted hash of it instead
+// of the IP itself, for privacy-preserving logging. The hash is the hex-encoded
+// HMAC-SHA256 of the IP (in the form returned by strat.ClientIP), keyed with salt, so it
+// is the same for the same IP and salt, allowing log entries to be joined, but differs
+// across salts. salt should be secret and long enough that the hashes can't be reversed
+// by hashing every possible IP. ok is false if no valid IP can be derived.
+func ClientIPHash(strat Strategy, headers http.Header, remoteAddr string, salt []byte) (hash string, ok bool) {
+	ip := strat.ClientIP(headers, remoteAddr)
+	if ip == "" {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil)), true
+}
+
+// ClientSubnet derives the client IP using strat, and returns it masked to a prefix of
+// v6Bits for IPv6 or v4Bits for IPv4 (including IPv4-mapped IPv6), in CIDR form like
+// "2001:db8:cafe:17::/64" or "192.0.2.0/24". This is useful as a rate-limiting key: a
+// single IPv6 client usually controls at least a /64, so keying on the full address is
+// easily evaded. Any zone is discarded. ok is false if no valid IP can be derived, or if
+// the prefix length for its family is out of range.
+func ClientSubnet(strat Strategy, headers http.Header, remoteAddr string, v6Bits, v4Bits int) (subnet string, ok bool) {
+	ipAddr, err := ParseIPAddr(strat.ClientIP(headers, remoteAddr))
+	if err != nil {
+		return "", false
+	}
+
+	ip, bits, maxBits := ipAddr.IP, v6Bits, 8*net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, maxBits = ip4, v4Bits, 8*net.IPv4len
+	}
+	if bits < 0 || bits > maxBits {
+		return "", false
+	}
+
+	mask := net.CIDRMask(bits, maxBits)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String(), true
+}
+
+// ClientIPWithRawToken is like strat.ClientIP, except that it also returns the original
+// text that the client IP was parsed from: the X-Forwarded-For list item, the whole
+// Forwarded list item (like `For="[2001:db8::1]:4711";proto=https`), the single-IP
+// header value, or RemoteAddr. This is useful for diagnosing differences between what a
+// proxy sent and the normalized IP, such as "::ffff:1.2.3.4" being returned as "1.2.3.4".
+// rawToken is trimmed of surrounding whitespace but otherwise unmodified.
+// The token is found by looking for the IP in the headers used by strat, from right to
+// left, and then in RemoteAddr. So if the same IP appears more than once in different
+// forms, the token may not be the one that the strategy chose. Custom strategies are
+// supported, but only RemoteAddr is checked for their token.
+// ip and rawToken are empty if no valid IP can be derived. rawToken is also empty if the
+// token can't be found.
+func ClientIPWithRawToken(strat Strategy, headers http.Header, remoteAddr string) (ip, rawToken string) {
+	ip = strat.ClientIP(headers, remoteAddr)
+	if ip == "" {
+		return "", ""
+	}
+
+	rawToken, _, _ = clientIPToken(strat, ip, headers, remoteAddr)
+	return ip, rawToken
+}
+
+// clientIPToken returns the rightmost list item in the headers used by strat, or else
+// remoteAddr, that has the IP ip. headerName is the name of the header the item is from,
+// or empty string if it is remoteAddr. found is false if there is no such item.
+func clientIPToken(strat Strategy, ip string, headers http.Header, remoteAddr string) (token, headerName string, found bool) {
+	hasIP := func(s string) bool {
+		ipAddr, _, _, err := ParseIPAddrWithPort(s)
+		return err == nil && FormatIPAddr(ipAddr) == ip
+	}
+
+	for _, headerName := range strategyHeaderNames(strat) {
+		scanner := listScanner{values: headers[headerName]}
+		if headerName != forwardedHdr {
+			// Split the list as the strategy did
+			scanner.sep = strategyListSeparator(strat, headerName)
+		}
+		for item, more := scanner.next(); more; item, more = scanner.next() {
+			ipStr := item
+			if headerName == forwardedHdr {
+				ipStr = forwardedParam(item, "for")
+			}
+
+			// Keep going, as we want the rightmost
+			if hasIP(ipStr) {
+				token, found = item, true
+			}
+		}
+
+		if found {
+			return token, headerName, true
+		}
+	}
+
+	if hasIP(remoteAddr) {
+		return remoteAddr, "", true
+	}
+	return "", "", false
+}
+
+// strategyListSeparator returns the separator that strat uses to split the headerName
+// list header (see WithListSeparator), or zero if it uses the default of comma. A strategy
+// that wraps others uses the separator of the first of them that uses the header.
+func strategyListSeparator(strat Strategy, headerName string) rune {
+	var subStrats []Strategy
+	switch s := strat.(type) {
+	case LeftmostNonPrivateStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case LeftmostNonPrivateWithinStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case LeftmostNonPrivateTrustedStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case RightmostNonPrivateStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case RightmostTrustedCountStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case RightmostTrustedRangeStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case ContiguousTrustedRangeStrategy:
+		return listSeparatorFor(s.headerName, headerName, &s.opts)
+	case RightmostNonPrivateWithRemoteAddrStrategy:
+		subStrats = []Strategy{s.rightmost}
+	case RightmostTrustedCountByHeaderStrategy:
+		for _, subStrat := range s.strategies {
+			// They all use the same header and options
+			subStrats = []Strategy{subStrat}
+			break
+		}
+	case ChainStrategy:
+		subStrats = s.strategies
+	case CrossCheckStrategy:
+		subStrats = []Strategy{s.primary, s.verify}
+	case ExactProxyStrategy:
+		subStrats = []Strategy{s.inner}
+	case MemoizedStrategy:
+		subStrats = []Strategy{s.inner}
+	}
+
+	for _, subStrat := range subStrats {
+		if sep := strategyListSeparator(subStrat, headerName); sep != 0 {
+			return sep
+		}
+	}
+	return 0
+}
+
+// listSeparatorFor returns the list separator in opts if stratHeaderName is headerName,
+// or else zero.
+func listSeparatorFor(stratHeaderName, headerName string, opts *options) rune {
+	if stratHeaderName != headerName {
+		return 0
+	}
+	return opts.listSeparator
+}
+
+// Input is the request data needed to derive a client IP, for use with ClientIPBatch.
+type Input struct {
+	// Headers is expected to be like http.Request.Header.
+	Headers http.Header
+	// RemoteAddr is expected to be like http.Request.RemoteAddr.
+	RemoteAddr string
+}
+
+// ClientIPBatch derives the client IP of each of inputs using strat, as strat.ClientIP
+// would, for offline processing of many requests (like from logs). The result at each
+// index is for the input at the same index. Setup that ClientIP does on each call, such as
+// loading the trusted ranges and allocating working memory, is done once for the batch
+// where possible. It works with any Strategy, including custom ones.
+// Inputs are independent, so a large batch can be processed in parallel by calling
+// ClientIPBatch concurrently with separate subslices of inputs.
+func ClientIPBatch(strat Strategy, inputs []Input) []string {
+	results := make([]string, len(inputs))
+
+	switch s := strat.(type) {
+	case RightmostTrustedRangeStrategy:
+		trustedRanges := s.trustedRanges.load()
+		var ipAddrs []*net.IPAddr
+		for i, in := range inputs {
+			if ip, ok := loopbackRemoteAddrResult(in.RemoteAddr, &s.opts); ok {
+				results[i] = ip
+				continue
+			}
+
+			ipAddrs = appendIPAddrList(ipAddrs[:0], in.Headers, s.headerName, &s.opts)
+			if clientIndex := s.clientIndex(ipAddrs, trustedRanges); clientIndex >= 0 {
+				results[i] = ipAddrString(*ipAddrs[clientIndex], &s.opts)
+			}
+		}
+	default:
+		for i, in := range inputs {
+			results[i] = strat.ClientIP(in.Headers, in.RemoteAddr)
+		}
+	}
+
+	return results
+}
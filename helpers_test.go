@@ -0,0 +1,416 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func BenchmarkClientIPBatch(b *testing.B) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2607:f8b0::/32")
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges))
+	inputs := benchmarkBatchInputs(1000)
+
+	b.Run("Batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = ClientIPBatch(strat, inputs)
+		}
+	})
+
+	b.Run("PerCall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			results := make([]string, len(inputs))
+			for j, in := range inputs {
+				results[j] = strat.ClientIP(in.Headers, in.RemoteAddr)
+			}
+		}
+	})
+}
+
+func TestClientIPBatch(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2607:f8b0::/32")
+	inputs := append(benchmarkBatchInputs(300),
+		Input{Headers: http.Header{}, RemoteAddr: "3.3.3.3:4747"},
+		Input{Headers: http.Header{"X-Forwarded-For": []string{"nope, 10.0.0.1"}}, RemoteAddr: "@"},
+		Input{Headers: http.Header{"X-Forwarded-For": []string{"10.0.0.1"}, "X-Real-Ip": []string{"4.4.4.4"}}},
+	)
+
+	strats := []Strategy{
+		Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)),
+		Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithRequireTrustedHop())),
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), RemoteAddrStrategy{}),
+	}
+
+	for _, strat := range strats {
+		got := ClientIPBatch(strat, inputs)
+		if len(got) != len(inputs) {
+			t.Fatalf("%v: got %d results, want %d", strat, len(got), len(inputs))
+		}
+
+		for i, in := range inputs {
+			if want := strat.ClientIP(in.Headers, in.RemoteAddr); got[i] != want {
+				t.Fatalf("%v: result %d = %q, want %q", strat, i, got[i], want)
+			}
+		}
+	}
+
+	if got := ClientIPBatch(RemoteAddrStrategy{}, nil); len(got) != 0 {
+		t.Fatalf("got %d results for no inputs, want 0", len(got))
+	}
+}
+
+func TestClientIPContext(t *testing.T) {
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}}
+	strats := []Strategy{
+		RemoteAddrStrategy{},
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), RemoteAddrStrategy{}),
+	}
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, strat := range strats {
+		want := strat.ClientIP(headers, "3.3.3.3:4747")
+		if want == "" {
+			t.Fatalf("%v: ClientIP is empty; bad test input", strat)
+		}
+
+		if got := ClientIPContext(context.Background(), strat, headers, "3.3.3.3:4747"); got != want {
+			t.Fatalf("%v: ClientIPContext = %q, want %q", strat, got, want)
+		}
+
+		if got := ClientIPContext(cancelledCtx, strat, headers, "3.3.3.3:4747"); got != "" {
+			t.Fatalf("%v: ClientIPContext with cancelled context = %q, want empty", strat, got)
+		}
+	}
+}
+
+func TestClientIPFromMap(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:    "Lowercase key",
+			headers: map[string][]string{"x-forwarded-for": {"1.1.1.1, 10.0.0.1"}},
+			want:    "1.1.1.1",
+		},
+		{
+			name:    "Uppercase key",
+			headers: map[string][]string{"X-FORWARDED-FOR": {"2.2.2.2"}},
+			want:    "2.2.2.2",
+		},
+		{
+			name:    "Canonical key",
+			headers: map[string][]string{"X-Forwarded-For": {"3.3.3.3"}},
+			want:    "3.3.3.3",
+		},
+		{
+			name: "Keys are combined in sort order",
+			headers: map[string][]string{
+				"x-forwarded-for": {"5.5.5.5"},
+				"X-Forwarded-For": {"4.4.4.4"},
+			},
+			want: "5.5.5.5",
+		},
+		{
+			name:    "MIMEHeader",
+			headers: textproto.MIMEHeader{"x-Forwarded-for": {"6.6.6.6"}},
+			want:    "6.6.6.6",
+		},
+		{
+			name:    "No header",
+			headers: map[string][]string{"x-real-ip": {"7.7.7.7"}},
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClientIPFromMap(strat, tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIPFromMap = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The map isn't modified
+	headers := map[string][]string{"x-forwarded-for": {"1.1.1.1"}}
+	ClientIPFromMap(strat, headers, "")
+	if want := (map[string][]string{"x-forwarded-for": {"1.1.1.1"}}); !reflect.DeepEqual(headers, want) {
+		t.Fatalf("headers = %v, want %v", headers, want)
+	}
+}
+
+func TestClientIPHash(t *testing.T) {
+	strat := NewChainStrategy(
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		RemoteAddrStrategy{},
+	)
+	saltA, saltB := []byte("salt A"), []byte("salt B")
+
+	hash := func(xff, remoteAddr string, salt []byte) string {
+		t.Helper()
+		h, ok := ClientIPHash(strat, http.Header{"X-Forwarded-For": []string{xff}}, remoteAddr, salt)
+		if !ok {
+			t.Fatalf("ClientIPHash(%q, %q) not ok", xff, remoteAddr)
+		}
+		return h
+	}
+
+	h1 := hash("1.1.1.1", "10.0.0.1:4711", saltA)
+	if len(h1) != 64 {
+		t.Fatalf("hash = %q, want 64 hex characters", h1)
+	}
+
+	// Deterministic for the same IP, even if it was derived differently
+	if h2 := hash("1.1.1.1", "10.0.0.1:4711", saltA); h2 != h1 {
+		t.Fatalf("hashes of same input differ: %q vs %q", h1, h2)
+	}
+	if h2 := hash("10.0.0.2", "1.1.1.1:4711", saltA); h2 != h1 {
+		t.Fatalf("hashes of same IP differ: %q vs %q", h1, h2)
+	}
+	if h2 := hash("::ffff:1.1.1.1", "10.0.0.1:4711", saltA); h2 != h1 {
+		t.Fatalf("hashes of IPv4 and IPv4-mapped forms differ: %q vs %q", h1, h2)
+	}
+
+	// Different for different IPs and salts
+	if h2 := hash("2.2.2.2", "10.0.0.1:4711", saltA); h2 == h1 {
+		t.Fatalf("hashes of different IPs are equal: %q", h1)
+	}
+	if h2 := hash("1.1.1.1", "10.0.0.1:4711", saltB); h2 == h1 {
+		t.Fatalf("hashes with different salts are equal: %q", h1)
+	}
+
+	if h, ok := ClientIPHash(strat, http.Header{}, "@", saltA); ok || h != "" {
+		t.Fatalf("ClientIPHash() = (%q, %v), want (\"\", false)", h, ok)
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	tests := []struct {
+		name       string
+		xff        string
+		v6Bits     int
+		v4Bits     int
+		wantSubnet string
+		wantOK     bool
+	}{
+		{
+			name:       "IPv6 to /64",
+			xff:        "2607:f8b0:4004:83f::200e",
+			v6Bits:     64,
+			v4Bits:     32,
+			wantSubnet: "2607:f8b0:4004:83f::/64",
+			wantOK:     true,
+		},
+		{
+			name:       "IPv6 with zone",
+			xff:        "2607:f8b0:4004:83f::200e%eth0",
+			v6Bits:     48,
+			v4Bits:     32,
+			wantSubnet: "2607:f8b0:4004::/48",
+			wantOK:     true,
+		},
+		{
+			name:       "IPv4 to /24",
+			xff:        "1.2.3.4",
+			v6Bits:     64,
+			v4Bits:     24,
+			wantSubnet: "1.2.3.0/24",
+			wantOK:     true,
+		},
+		{
+			name:       "IPv4 to /32",
+			xff:        "1.2.3.4",
+			v6Bits:     64,
+			v4Bits:     32,
+			wantSubnet: "1.2.3.4/32",
+			wantOK:     true,
+		},
+		{
+			name:       "IPv4-mapped uses IPv4 bits",
+			xff:        "::ffff:1.2.3.4",
+			v6Bits:     64,
+			v4Bits:     16,
+			wantSubnet: "1.2.0.0/16",
+			wantOK:     true,
+		},
+		{
+			name:   "Fail: IPv4 bits out of range",
+			xff:    "1.2.3.4",
+			v6Bits: 64,
+			v4Bits: 33,
+		},
+		{
+			name:   "Fail: negative IPv6 bits",
+			xff:    "2607:f8b0:4004:83f::200e",
+			v6Bits: -1,
+			v4Bits: 24,
+		},
+		{
+			name:   "Fail: no client IP",
+			xff:    "10.0.0.1",
+			v6Bits: 64,
+			v4Bits: 24,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+			subnet, ok := ClientSubnet(strat, headers, "", tt.v6Bits, tt.v4Bits)
+			if subnet != tt.wantSubnet || ok != tt.wantOK {
+				t.Fatalf("ClientSubnet() = (%q, %v), want (%q, %v)", subnet, ok, tt.wantSubnet, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestClientIPWithRawToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		strat        Strategy
+		headers      http.Header
+		remoteAddr   string
+		wantIP       string
+		wantRawToken string
+	}{
+		{
+			name:         "NAT64 in XFF",
+			strat:        Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers:      http.Header{"X-Forwarded-For": []string{"1.1.1.1, 64:ff9b::2.2.2.2 , 10.0.0.1"}},
+			wantIP:       "64:ff9b::202:202",
+			wantRawToken: "64:ff9b::2.2.2.2",
+		},
+		{
+			name:         "Mapped in Forwarded",
+			strat:        Must(NewRightmostNonPrivateStrategy("Forwarded")),
+			headers:      http.Header{"Forwarded": []string{`For=1.1.1.1, For="[::ffff:3.3.3.3]:4711";Proto=https, For=10.0.0.1`}},
+			wantIP:       "3.3.3.3",
+			wantRawToken: `For="[::ffff:3.3.3.3]:4711";Proto=https`,
+		},
+		{
+			name:         "Rightmost of duplicates",
+			strat:        Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			headers:      http.Header{"X-Forwarded-For": []string{"1.1.1.1, ::ffff:1.1.1.1"}},
+			wantIP:       "1.1.1.1",
+			wantRawToken: "::ffff:1.1.1.1",
+		},
+		{
+			name:         "Single-IP header",
+			strat:        Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			headers:      http.Header{"X-Real-Ip": []string{"4.4.4.4:4711"}},
+			wantIP:       "4.4.4.4",
+			wantRawToken: "4.4.4.4:4711",
+		},
+		{
+			name: "RemoteAddr in chain",
+			strat: NewChainStrategy(
+				Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+				RemoteAddrStrategy{},
+			),
+			headers:      http.Header{"X-Forwarded-For": []string{"10.0.0.1"}},
+			remoteAddr:   "[::ffff:5.5.5.5]:4711",
+			wantIP:       "5.5.5.5",
+			wantRawToken: "[::ffff:5.5.5.5]:4711",
+		},
+		{
+			name:         "Custom list separator",
+			strat:        Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator(';'))),
+			headers:      http.Header{"X-Forwarded-For": []string{"1.1.1.1; [::ffff:2.2.2.2]:4711; 10.0.0.1"}},
+			wantIP:       "2.2.2.2",
+			wantRawToken: "[::ffff:2.2.2.2]:4711",
+		},
+		{
+			name: "Custom list separator in chain",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				Memoize(Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, WithListSeparator('|')))),
+			),
+			headers:      http.Header{"X-Forwarded-For": []string{"1.1.1.1|2.2.2.2:4711|10.0.0.1"}},
+			wantIP:       "2.2.2.2",
+			wantRawToken: "2.2.2.2:4711",
+		},
+		{
+			name:         "No client IP",
+			strat:        Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers:      http.Header{"X-Forwarded-For": []string{"10.0.0.1"}},
+			wantIP:       "",
+			wantRawToken: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, rawToken := ClientIPWithRawToken(tt.strat, tt.headers, tt.remoteAddr)
+			if ip != tt.wantIP || rawToken != tt.wantRawToken {
+				t.Fatalf("ClientIPWithRawToken() = (%q, %q), want (%q, %q)", ip, rawToken, tt.wantIP, tt.wantRawToken)
+			}
+		})
+	}
+}
+
+func TestClientIPNetAddr(t *testing.T) {
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		wantOK  bool
+		want    string
+	}{
+		{
+			name:    "IPv4",
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, 10.0.0.1`}},
+			wantOK:  true,
+			want:    "1.1.1.1",
+		},
+		{
+			name:    "Zoned IPv6",
+			headers: http.Header{"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::200e%eth0]:4711`}},
+			wantOK:  true,
+			want:    "2607:f8b0:4004:83f::200e%eth0",
+		},
+		{
+			name:    "Fail: no IP",
+			headers: http.Header{"X-Forwarded-For": []string{`10.0.0.1`}},
+			wantOK:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, ok := ClientIPNetAddr(strat, tt.headers, "")
+			if ok != tt.wantOK {
+				t.Fatalf("ClientIPNetAddr ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			if !ok {
+				if addr != nil {
+					t.Fatalf("ClientIPNetAddr addr = %v, want nil", addr)
+				}
+				return
+			}
+
+			if _, isIPAddr := addr.(*net.IPAddr); !isIPAddr {
+				t.Fatalf("ClientIPNetAddr addr is %T, want *net.IPAddr", addr)
+			}
+			if addr.Network() != "ip" {
+				t.Fatalf("Network() = %q, want %q", addr.Network(), "ip")
+			}
+			if addr.String() != tt.want {
+				t.Fatalf("String() = %q, want %q", addr.String(), tt.want)
+			}
+		})
+	}
+}
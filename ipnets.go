@@ -0,0 +1,244 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// AddressesAndRangesFromEnv reads a list of IPv4 and IPv6 addresses and CIDR ranges from
+// the environment variable varName and converts them to net.IPNet instances, like
+// AddressesAndRangesToIPNets. The elements may be separated by commas, whitespace, or
+// both, like "10.0.0.0/8, 192.168.0.0/16". If the variable is unset or empty, the result
+// is empty. If an element is invalid, the error identifies it.
+func AddressesAndRangesFromEnv(varName string) ([]net.IPNet, error) {
+	tokens := strings.FieldsFunc(os.Getenv(varName), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+
+	var result []net.IPNet
+	for i, token := range tokens {
+		ipNets, err := AddressesAndRangesToIPNets(token)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s element %d (%q) is invalid: %w", varName, i, token, err)
+		}
+		result = append(result, ipNets...)
+	}
+
+	return result, nil
+}
+
+// SubtractIPNets returns the ranges in base, minus any addresses covered by the ranges in
+// remove. Ranges in base are split into smaller CIDRs as needed. This can be used to
+// carve exceptions out of a set of trusted ranges, like distrusting part of a provider's
+// range.
+// The result is ordered by the base range it came from, then by address. IPv4 ranges only
+// remove from IPv4 ranges, and IPv6 from IPv6.
+func SubtractIPNets(base, remove []net.IPNet) []net.IPNet {
+	normalizedRemove := make([]net.IPNet, len(remove))
+	for i, r := range remove {
+		normalizedRemove[i] = normalizeIPNet(r)
+	}
+
+	var result []net.IPNet
+	for _, b := range base {
+		result = append(result, subtractFromIPNet(normalizeIPNet(b), normalizedRemove)...)
+	}
+	return result
+}
+
+// subtractFromIPNet returns n minus the ranges in remove. n and remove must be normalized.
+func subtractFromIPNet(n net.IPNet, remove []net.IPNet) []net.IPNet {
+	nOnes, _ := n.Mask.Size()
+	for _, r := range remove {
+		if len(r.IP) != len(n.IP) {
+			// Different families never overlap
+			continue
+		}
+
+		rOnes, _ := r.Mask.Size()
+		if rOnes <= nOnes {
+			if r.Contains(n.IP) {
+				// r covers all of n
+				return nil
+			}
+			// r and n are disjoint
+			continue
+		}
+
+		if !n.Contains(r.IP) {
+			// r and n are disjoint
+			continue
+		}
+
+		// r is strictly inside n, so split n in half and remove from each half
+		lo, hi := splitIPNet(n)
+		return append(subtractFromIPNet(lo, remove), subtractFromIPNet(hi, remove)...)
+	}
+
+	return []net.IPNet{n}
+}
+
+// splitIPNet splits n, which must be normalized and not a single address, into its lower
+// and upper halves.
+func splitIPNet(n net.IPNet) (lo, hi net.IPNet) {
+	ones, bits := n.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+
+	loIP := append(net.IP(nil), n.IP...)
+	hiIP := append(net.IP(nil), n.IP...)
+	hiIP[ones/8] |= 0x80 >> uint(ones%8)
+
+	return net.IPNet{IP: loIP, Mask: mask}, net.IPNet{IP: hiIP, Mask: mask}
+}
+
+// SortedIPNets returns a sorted copy of ipNets. IPv4 ranges come before IPv6 ranges, then
+// ranges are ordered by network start address, then by prefix length (shortest, and so
+// largest, first). This gives a stable order for comparing sets of ranges. The ranges are
+// masked, so a range like 10.1.2.3/8 becomes 10.0.0.0/8; duplicates are not removed.
+func SortedIPNets(ipNets []net.IPNet) []net.IPNet {
+	result := make([]net.IPNet, len(ipNets))
+	for i, n := range ipNets {
+		result[i] = normalizeIPNet(n)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if len(a.IP) != len(b.IP) {
+			// IPv4 (4 bytes) before IPv6 (16 bytes)
+			return len(a.IP) < len(b.IP)
+		}
+
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+
+		aOnes, _ := a.Mask.Size()
+		bOnes, _ := b.Mask.Size()
+		return aOnes < bOnes
+	})
+
+	return result
+}
+
+// ipv4MappedPrefix is the ::ffff:0:0/96 range of IPv4-mapped IPv6 addresses.
+var ipv4MappedPrefix = mustParseCIDR("::ffff:0:0/96")
+
+// ExpandIPv4MappedIPNets returns a copy of ipNets with the plain IPv4 equivalent of each
+// IPv4-mapped IPv6 range (like ::ffff:4.4.4.0/120, whose equivalent is 4.4.4.0/24) added
+// immediately after it, unless the equivalent is already present. This makes it explicit
+// that both forms of the range are trusted, and makes the ranges safe to use with code
+// that compares IP families strictly (like netip).
+// Note that containment checks in this package already treat a mapped range as matching
+// the dotted-quad form of an address, and vice versa, so this is not needed for use with
+// the strategies.
+// Mapped ranges with a prefix shorter than /96 don't have an IPv4 equivalent and are left
+// as-is.
+func ExpandIPv4MappedIPNets(ipNets []net.IPNet) []net.IPNet {
+	// We can't use IPNet.String as the key, as it formats mapped ranges as IPv4
+	ipNetKey := func(n net.IPNet) string {
+		n = normalizeIPNet(n)
+		return string(n.IP) + "/" + string(n.Mask)
+	}
+
+	present := make(map[string]bool, len(ipNets))
+	for _, n := range ipNets {
+		present[ipNetKey(n)] = true
+	}
+
+	result := make([]net.IPNet, 0, len(ipNets))
+	for _, n := range copyIPNets(ipNets) {
+		result = append(result, n)
+
+		ones, bits := n.Mask.Size()
+		if bits != 8*net.IPv6len || ones < 96 || !ipv4MappedPrefix.Contains(n.IP) || n.IP.To4() == nil {
+			continue
+		}
+
+		ipv4Net := net.IPNet{
+			IP:   n.IP.Mask(n.Mask).To4(),
+			Mask: net.CIDRMask(ones-96, 8*net.IPv4len),
+		}
+		if key := ipNetKey(ipv4Net); !present[key] {
+			present[key] = true
+			result = append(result, ipv4Net)
+		}
+	}
+
+	return result
+}
+
+// dashedRangeToIPNets converts r, an inclusive range like "1.1.1.1-1.1.1.255", to the
+// minimal set of CIDR ranges that cover it, in address order.
+func dashedRangeToIPNets(r string) ([]net.IPNet, error) {
+	dash := strings.IndexByte(r, '-')
+	startStr, endStr := strings.TrimSpace(r[:dash]), strings.TrimSpace(r[dash+1:])
+
+	start, end := net.ParseIP(startStr), net.ParseIP(endStr)
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("%w: not a valid IP address range: %q", ErrInvalidRange, r)
+	}
+
+	// Use the 4-byte form for IPv4, so that the resulting masks are the right size
+	start4, end4 := start.To4(), end.To4()
+	if (start4 == nil) != (end4 == nil) {
+		return nil, fmt.Errorf("%w: range start and end are different IP families: %q", ErrInvalidRange, r)
+	}
+	if start4 != nil {
+		start, end = start4, end4
+	}
+
+	if bytes.Compare(start, end) > 0 {
+		return nil, fmt.Errorf("%w: range start is after end: %q", ErrInvalidRange, r)
+	}
+
+	bits := len(start) * 8
+	cur := new(big.Int).SetBytes(start)
+	last := new(big.Int).SetBytes(end)
+	one := big.NewInt(1)
+
+	var result []net.IPNet
+	for cur.Cmp(last) <= 0 {
+		// Find the largest block that starts at cur (so is aligned to it) and doesn't
+		// extend past last
+		hostBits := int(cur.TrailingZeroBits())
+		if cur.Sign() == 0 || hostBits > bits {
+			hostBits = bits
+		}
+		for {
+			blockEnd := new(big.Int).Lsh(one, uint(hostBits))
+			blockEnd.Add(blockEnd, cur).Sub(blockEnd, one)
+			if blockEnd.Cmp(last) <= 0 {
+				break
+			}
+			hostBits--
+		}
+
+		// big.Int.Bytes omits leading zeros, so right-align it
+		ip := make(net.IP, len(start))
+		curBytes := cur.Bytes()
+		copy(ip[len(ip)-len(curBytes):], curBytes)
+		result = append(result, net.IPNet{IP: ip, Mask: net.CIDRMask(bits-hostBits, bits)})
+
+		cur.Add(cur, new(big.Int).Lsh(one, uint(hostBits)))
+	}
+
+	return result, nil
+}
+
+// normalizeIPNet returns a copy of n with the IP masked, and in 4-byte form if n is an
+// IPv4 range.
+func normalizeIPNet(n net.IPNet) net.IPNet {
+	ip := n.IP.Mask(n.Mask)
+	if _, bits := n.Mask.Size(); bits == 8*net.IPv4len {
+		ip = ip.To4()
+	}
+	return net.IPNet{IP: ip, Mask: append(net.IPMask(nil), n.Mask...)}
+}
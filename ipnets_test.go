@@ -0,0 +1,326 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubtractIPNets(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     []string
+		remove   []string
+		want     []string
+		contains []string
+		excludes []string
+	}{
+		{
+			name:   "Slash 24 from slash 16",
+			base:   []string{"10.0.0.0/16"},
+			remove: []string{"10.0.5.0/24"},
+			want: []string{
+				"10.0.0.0/22", "10.0.4.0/24", "10.0.6.0/23", "10.0.8.0/21", "10.0.16.0/20",
+				"10.0.32.0/19", "10.0.64.0/18", "10.0.128.0/17",
+			},
+			contains: []string{"10.0.0.0", "10.0.4.255", "10.0.6.0", "10.0.255.255"},
+			excludes: []string{"10.0.5.0", "10.0.5.128", "10.0.5.255", "10.1.0.0"},
+		},
+		{
+			name:     "Single address",
+			base:     []string{"2606:4700::/126"},
+			remove:   []string{"2606:4700::2"},
+			want:     []string{"2606:4700::/127", "2606:4700::3/128"},
+			contains: []string{"2606:4700::", "2606:4700::1", "2606:4700::3"},
+			excludes: []string{"2606:4700::2"},
+		},
+		{
+			name:   "Remove covers base",
+			base:   []string{"10.0.5.0/24", "1.1.1.0/24"},
+			remove: []string{"10.0.0.0/8"},
+			want:   []string{"1.1.1.0/24"},
+		},
+		{
+			name:   "Disjoint and mixed families",
+			base:   []string{"10.0.0.0/8", "2001:db8::/32"},
+			remove: []string{"11.0.0.0/8", "::/0"},
+			want:   []string{"10.0.0.0/8"},
+		},
+		{
+			name:   "Nothing to remove",
+			base:   []string{"10.0.0.0/8"},
+			remove: nil,
+			want:   []string{"10.0.0.0/8"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := AddressesAndRangesToIPNets(tt.base...)
+			if err != nil {
+				t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+			}
+			remove, err := AddressesAndRangesToIPNets(tt.remove...)
+			if err != nil {
+				t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+			}
+
+			got := SubtractIPNets(base, remove)
+
+			var gotStrs []string
+			for _, n := range got {
+				gotStrs = append(gotStrs, n.String())
+			}
+			if !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Fatalf("SubtractIPNets() = %v, want %v", gotStrs, tt.want)
+			}
+
+			for _, ip := range tt.contains {
+				if !isIPContainedInRanges(net.ParseIP(ip), got) {
+					t.Fatalf("result does not contain %s", ip)
+				}
+			}
+			for _, ip := range tt.excludes {
+				if isIPContainedInRanges(net.ParseIP(ip), got) {
+					t.Fatalf("result contains %s", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestSubtractIPNets_strategy(t *testing.T) {
+	base, _ := AddressesAndRangesToIPNets("10.0.0.0/16")
+	remove, _ := AddressesAndRangesToIPNets("10.0.5.0/24")
+
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", SubtractIPNets(base, remove)))
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 10.0.5.1, 10.0.4.1`}}
+	if got := strat.ClientIP(headers, ""); got != "10.0.5.1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "10.0.5.1")
+	}
+}
+
+func TestAddressesAndRangesFromEnv(t *testing.T) {
+	const varName = "REALCLIENTIP_TEST_TRUSTED_PROXY_CIDRS"
+
+	tests := []struct {
+		name    string
+		value   string
+		unset   bool
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "Commas",
+			value: "10.0.0.0/8,192.168.0.0/16",
+			want:  []string{"10.0.0.0/8", "192.168.0.0/16"},
+		},
+		{
+			name:  "Commas and whitespace",
+			value: " 10.0.0.0/8, 2001:db8::/32\n1.1.1.1 ,,",
+			want:  []string{"10.0.0.0/8", "2001:db8::/32", "1.1.1.1/32"},
+		},
+		{
+			name:  "Empty",
+			value: "",
+			want:  nil,
+		},
+		{
+			name:  "Unset",
+			unset: true,
+			want:  nil,
+		},
+		{
+			name:    "Error: malformed",
+			value:   "10.0.0.0/8, 192.168.0.0/33",
+			wantErr: `element 1 ("192.168.0.0/33")`,
+		},
+		{
+			name:    "Error: zone",
+			value:   "fe80::1%eth0",
+			wantErr: `element 0 ("fe80::1%eth0")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.unset {
+				os.Unsetenv(varName)
+			} else {
+				os.Setenv(varName, tt.value)
+				defer os.Unsetenv(varName)
+			}
+
+			got, err := AddressesAndRangesFromEnv(varName)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("AddressesAndRangesFromEnv() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddressesAndRangesFromEnv() error = %v", err)
+			}
+
+			var gotStrs []string
+			for _, n := range got {
+				gotStrs = append(gotStrs, n.String())
+			}
+			if !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Fatalf("AddressesAndRangesFromEnv() = %v, want %v", gotStrs, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortedIPNets(t *testing.T) {
+	input, err := AddressesAndRangesToIPNets(
+		"2001:db8::/32", "10.1.0.0/16", "::ffff:10.0.0.1", "2001:db8::/48", "10.0.0.0/8",
+		"1.1.1.1", "fe80::1", "10.0.0.0/16", "::/0",
+	)
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	// The input order is preserved by AddressesAndRangesToIPNets
+	if got := input[0].String(); got != "2001:db8::/32" {
+		t.Fatalf("AddressesAndRangesToIPNets()[0] = %q, want %q", got, "2001:db8::/32")
+	}
+
+	got := SortedIPNets(input)
+
+	var gotStrs []string
+	for _, n := range got {
+		gotStrs = append(gotStrs, n.String())
+	}
+
+	want := []string{
+		"1.1.1.1/32", "10.0.0.0/8", "10.0.0.0/16", "10.0.0.1/32", "10.1.0.0/16",
+		"::/0", "2001:db8::/32", "2001:db8::/48", "fe80::1/128",
+	}
+	if !reflect.DeepEqual(gotStrs, want) {
+		t.Fatalf("SortedIPNets() = %v, want %v", gotStrs, want)
+	}
+
+	// The input is not modified
+	if got := input[0].String(); got != "2001:db8::/32" {
+		t.Fatalf("input[0] = %q after sorting, want %q", got, "2001:db8::/32")
+	}
+}
+
+func TestAddressesAndRangesToIPNets_dashedRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "Aligned IPv4",
+			ranges: []string{"1.1.1.0-1.1.1.255"},
+			want:   []string{"1.1.1.0/24"},
+		},
+		{
+			name:   "Unaligned IPv4",
+			ranges: []string{"1.1.1.1-1.1.1.255"},
+			want: []string{
+				"1.1.1.1/32", "1.1.1.2/31", "1.1.1.4/30", "1.1.1.8/29", "1.1.1.16/28",
+				"1.1.1.32/27", "1.1.1.64/26", "1.1.1.128/25",
+			},
+		},
+		{
+			name:   "Across octets, with spaces",
+			ranges: []string{"10.0.0.254 - 10.0.1.1"},
+			want:   []string{"10.0.0.254/31", "10.0.1.0/31"},
+		},
+		{
+			name:   "Single address",
+			ranges: []string{"1.1.1.1-1.1.1.1"},
+			want:   []string{"1.1.1.1/32"},
+		},
+		{
+			name:   "Entire IPv4 space",
+			ranges: []string{"0.0.0.0-255.255.255.255"},
+			want:   []string{"0.0.0.0/0"},
+		},
+		{
+			name:   "IPv6",
+			ranges: []string{"2001:db8::-2001:db8::2"},
+			want:   []string{"2001:db8::/127", "2001:db8::2/128"},
+		},
+		{
+			name:   "Mixed with other forms",
+			ranges: []string{"3.3.3.3", "2001:db8::/32", "2.2.2.0-2.2.3.255"},
+			want:   []string{"3.3.3.3/32", "2001:db8::/32", "2.2.2.0/23"},
+		},
+		{
+			name:    "Error: reversed",
+			ranges:  []string{"1.1.1.255-1.1.1.1"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: mismatched families",
+			ranges:  []string{"1.1.1.1-2001:db8::1"},
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad address",
+			ranges:  []string{"1.1.1.1-nope"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddressesAndRangesToIPNets(tt.ranges...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddressesAndRangesToIPNets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var gotStrs []string
+			for _, n := range got {
+				gotStrs = append(gotStrs, n.String())
+			}
+			if !reflect.DeepEqual(gotStrs, tt.want) {
+				t.Fatalf("AddressesAndRangesToIPNets() = %v, want %v", gotStrs, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandIPv4MappedIPNets(t *testing.T) {
+	input, err := AddressesAndRangesToIPNets("::ffff:4.4.4.4/124", "::ffff:5.5.5.0/120", "5.5.5.0/24", "::ffff:0:0/95", "2001:db8::/32", "6.6.6.6")
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	got := ExpandIPv4MappedIPNets(input)
+
+	// IPNet.String formats mapped ranges as IPv4, so we need to show the lengths
+	var gotStrs []string
+	for _, n := range got {
+		gotStrs = append(gotStrs, fmt.Sprintf("%s(%d)", n.String(), len(n.IP)))
+	}
+	want := []string{
+		"4.4.4.0/28(16)", "4.4.4.0/28(4)", "5.5.5.0/24(16)", "5.5.5.0/24(4)", "::fffe:0:0/95(16)",
+		"2001:db8::/32(16)", "6.6.6.6/32(4)",
+	}
+	if !reflect.DeepEqual(gotStrs, want) {
+		t.Fatalf("ExpandIPv4MappedIPNets() = %v, want %v", gotStrs, want)
+	}
+
+	// Both forms of candidate match both forms of range, with or without expansion
+	mapped, _ := AddressesAndRangesToIPNets("::ffff:4.4.4.4/124")
+	plain, _ := AddressesAndRangesToIPNets("4.4.4.0/28")
+	for _, ranges := range [][]net.IPNet{mapped, ExpandIPv4MappedIPNets(mapped), plain} {
+		strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", ranges))
+		for _, xff := range []string{"1.1.1.1, 4.4.4.1", "1.1.1.1, ::ffff:4.4.4.1"} {
+			if got := strat.ClientIP(http.Header{"X-Forwarded-For": []string{xff}}, ""); got != "1.1.1.1" {
+				t.Fatalf("ClientIP with ranges %v and XFF %q = %q, want %q", ranges, xff, got, "1.1.1.1")
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// memoShards is the number of independently locked parts of a MemoizedStrategy's
+	// cache, so that concurrent requests rarely contend for a lock.
+	memoShards = 16
+
+	// memoShardSize is the number of results held by each shard. The cache only needs to
+	// cover the requests that are in flight at once, as it's meant to save repeated calls
+	// for the same request.
+	memoShardSize = 32
+)
+
+// MemoizedStrategy wraps another strategy and caches its results, so that repeated calls
+// for the same request -- such as by several middlewares -- derive the client IP only
+// once. It has two caches:
+//
+// ClientIP caches by the values of RemoteAddr and of the headers that the inner strategy
+// uses. Finding a result takes a single pass over those values, without allocating, and
+// the cache is sharded so that concurrent requests rarely contend. It has a fixed size,
+// and a result is only returned if its input matches exactly, so an evicted or colliding
+// entry just causes the result to be derived again. For the strategies in this package
+// (including in a ChainStrategy), only the headers they use are considered; for other
+// strategies, all headers are.
+//
+// ClientIPFromRequest additionally caches by request, if the request's context was set up
+// with MemoizeMiddleware. A lookup is then O(1), and the result is kept for the life of
+// the request: later changes to the request's headers or RemoteAddr (such as by
+// SanitizeHeaders) are not seen by later calls for it.
+//
+// Cache hits don't call the inner strategy, so if it was created with WithSelectionStats,
+// they aren't counted.
+// Results derived before a call of RightmostTrustedRangeStrategy.SetRanges on the inner
+// strategy may continue to be returned until they are evicted, so don't memoize a
+// strategy whose ranges are replaced.
+// It is safe for concurrent use.
+type MemoizedStrategy struct {
+	inner Strategy
+	cache *memoCache
+}
+
+// Memoize creates a MemoizedStrategy that caches the results of inner.
+func Memoize(inner Strategy) MemoizedStrategy {
+	headerNames, known := memoHeaderNames(inner)
+	return MemoizedStrategy{
+		inner: inner,
+		cache: &memoCache{headerNames: headerNames, allHeaders: !known},
+	}
+}
+
+// ClientIP derives the client IP using the inner strategy, or returns the cached result
+// for identical input.
+func (strat MemoizedStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	hash := strat.cache.hash(headers, remoteAddr)
+
+	if ip, ok := strat.cache.get(hash, headers, remoteAddr); ok {
+		return ip
+	}
+
+	ip := strat.inner.ClientIP(headers, remoteAddr)
+	strat.cache.put(hash, headers, remoteAddr, ip)
+	return ip
+}
+
+// ClientIPFromRequest derives the client IP of r like ClientIP, but if r's context was set
+// up with MemoizeMiddleware, the result is also cached for the request. Requests derived
+// from r (such as with r.WithContext) share its cache.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat MemoizedStrategy) ClientIPFromRequest(r *http.Request) string {
+	reqCache, _ := r.Context().Value(memoContextKey{}).(*memoRequestCache)
+	if reqCache == nil {
+		return strat.ClientIP(r.Header, r.RemoteAddr)
+	}
+
+	// The lock is held while deriving, so that concurrent calls for the same request
+	// don't derive it more than once
+	reqCache.mu.Lock()
+	defer reqCache.mu.Unlock()
+
+	if ip, ok := reqCache.results[strat.cache]; ok {
+		return ip
+	}
+
+	ip := strat.ClientIP(r.Header, r.RemoteAddr)
+	if reqCache.results == nil {
+		reqCache.results = make(map[*memoCache]string, 1)
+	}
+	reqCache.results[strat.cache] = ip
+	return ip
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat MemoizedStrategy) String() string {
+	return fmt.Sprintf("MemoizedStrategy{inner=%s}", describeStrategy(strat.inner))
+}
+
+// MemoizeMiddleware sets up the context of each request with a cache for the results of
+// MemoizedStrategy.ClientIPFromRequest. A single MemoizeMiddleware serves any number of
+// MemoizedStrategy instances.
+func MemoizeMiddleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), memoContextKey{}, &memoRequestCache{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// memoContextKey is the context key for a request's *memoRequestCache.
+type memoContextKey struct{}
+
+// memoRequestCache holds the client IPs derived for a single request, by strategy.
+type memoRequestCache struct {
+	mu      sync.Mutex
+	results map[*memoCache]string
+}
+
+// memoHeaderNames returns the names of the headers that strat uses. known is false if
+// strat isn't one of the strategies in this package, in which case any header may be used.
+func memoHeaderNames(strat Strategy) (headerNames []string, known bool) {
+	switch s := strat.(type) {
+	case RemoteAddrStrategy:
+		return nil, true
+	case MemoizedStrategy:
+		return s.cache.headerNames, !s.cache.allHeaders
+	case ExactProxyStrategy:
+		return memoHeaderNames(s.inner)
+	case RightmostTrustedCountByHeaderStrategy:
+		headerNames = append(headerNames, s.selectorHeader)
+		for _, subStrat := range s.strategies {
+			// They all use the same header
+			return append(headerNames, subStrat.headerName), true
+		}
+		return headerNames, true
+	case ChainStrategy:
+		return memoCombinedHeaderNames(s.strategies)
+	case CrossCheckStrategy:
+		return memoCombinedHeaderNames([]Strategy{s.primary, s.verify})
+	}
+
+	if headerName := strategyHeaderName(strat); headerName != "" {
+		return []string{headerName}, true
+	}
+	return nil, false
+}
+
+// memoCombinedHeaderNames returns the names of the headers used by any of strats. known is
+// false if any of them is unknown.
+func memoCombinedHeaderNames(strats []Strategy) (headerNames []string, known bool) {
+	for _, subStrat := range strats {
+		subHeaderNames, subKnown := memoHeaderNames(subStrat)
+		if !subKnown {
+			return nil, false
+		}
+		for _, headerName := range subHeaderNames {
+			if !containsString(headerNames, headerName) {
+				headerNames = append(headerNames, headerName)
+			}
+		}
+	}
+	return headerNames, true
+}
+
+// memoCache is a fixed-size, sharded, direct-mapped cache of client IPs keyed by
+// RemoteAddr and header values.
+type memoCache struct {
+	headerNames []string
+	allHeaders  bool
+	shards      [memoShards]memoShard
+}
+
+// memoShard is an independently locked part of a memoCache.
+type memoShard struct {
+	mu      sync.Mutex
+	entries [memoShardSize]memoEntry
+}
+
+// memoEntry is a single cached result, with the input it was derived from.
+type memoEntry struct {
+	valid      bool
+	hash       uint64
+	remoteAddr string
+	headers    http.Header
+	ip         string
+}
+
+// FNV-1a parameters, inlined so that hashing doesn't allocate.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnvString adds s to the FNV-1a hash h, followed by a NUL terminator. NUL can't appear in
+// a valid header, so the terminator keeps adjacent strings from running together.
+func fnvString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h * fnvPrime64
+}
+
+// fnvHeader returns the hash of a header's name and values.
+func fnvHeader(headerName string, values []string) uint64 {
+	h := fnvString(fnvOffset64, headerName)
+	for _, v := range values {
+		h = fnvString(h, v)
+	}
+	return h
+}
+
+// hash returns the hash of remoteAddr and the relevant headers.
+func (c *memoCache) hash(headers http.Header, remoteAddr string) uint64 {
+	h := fnvString(fnvOffset64, remoteAddr)
+	if c.allHeaders {
+		// Map iteration order is random, so the headers' hashes are combined in a way
+		// that doesn't depend on order
+		var sum uint64
+		for headerName, values := range headers {
+			sum += fnvHeader(headerName, values)
+		}
+		return h ^ sum
+	}
+
+	for _, headerName := range c.headerNames {
+		h ^= fnvHeader(headerName, headers[headerName])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// slot returns the entry for hash, and the shard that guards it.
+func (c *memoCache) slot(hash uint64) (*memoShard, *memoEntry) {
+	shard := &c.shards[hash%memoShards]
+	return shard, &shard.entries[(hash/memoShards)%memoShardSize]
+}
+
+// get returns the cached client IP for headers and remoteAddr, which hash to hash. ok is
+// false if it isn't cached.
+func (c *memoCache) get(hash uint64, headers http.Header, remoteAddr string) (ip string, ok bool) {
+	shard, e := c.slot(hash)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if !e.valid || e.hash != hash || e.remoteAddr != remoteAddr || !c.headersEqual(e.headers, headers) {
+		return "", false
+	}
+	return e.ip, true
+}
+
+// put caches ip for headers and remoteAddr, which hash to hash, evicting any entry in the
+// same slot.
+func (c *memoCache) put(hash uint64, headers http.Header, remoteAddr, ip string) {
+	// The headers may be modified after this call, so the relevant ones are copied
+	var headerNames []string
+	if c.allHeaders {
+		headerNames = make([]string, 0, len(headers))
+		for headerName := range headers {
+			headerNames = append(headerNames, headerName)
+		}
+	} else {
+		headerNames = c.headerNames
+	}
+	headersCopy := make(http.Header, len(headerNames))
+	for _, headerName := range headerNames {
+		if values, ok := headers[headerName]; ok {
+			headersCopy[headerName] = append([]string(nil), values...)
+		}
+	}
+
+	shard, e := c.slot(hash)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	*e = memoEntry{valid: true, hash: hash, remoteAddr: remoteAddr, headers: headersCopy, ip: ip}
+}
+
+// headersEqual reports whether the relevant headers of cached and headers have the same
+// values.
+func (c *memoCache) headersEqual(cached, headers http.Header) bool {
+	if c.allHeaders {
+		if len(cached) != len(headers) {
+			return false
+		}
+		for headerName, values := range headers {
+			cachedValues, ok := cached[headerName]
+			if !ok || !stringsEqual(cachedValues, values) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, headerName := range c.headerNames {
+		if !stringsEqual(cached[headerName], headers[headerName]) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringsEqual reports whether a and b hold the same strings in the same order.
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
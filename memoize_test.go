@@ -0,0 +1,348 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStrategy counts the calls of an inner strategy.
+type countingStrategy struct {
+	inner Strategy
+	calls *int64
+}
+
+func (s countingStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	atomic.AddInt64(s.calls, 1)
+	return s.inner.ClientIP(headers, remoteAddr)
+}
+
+// serveMemoized serves r through MemoizeMiddleware, calling handler with the request.
+func serveMemoized(r *http.Request, handler func(r *http.Request)) {
+	h := MemoizeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(r)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMemoize(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = MemoizedStrategy{}
+
+	var calls int64
+	inner := countingStrategy{inner: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), calls: &calls}
+	strat := Memoize(inner)
+
+	headers := http.Header{
+		"X-Forwarded-For": []string{"1.1.1.1, 10.0.0.1"},
+		"Accept":          []string{"*/*"},
+	}
+
+	for i := 0; i < 5; i++ {
+		if got := strat.ClientIP(headers, "10.0.0.2:4711"); got != "1.1.1.1" {
+			t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("inner called %d times, want 1", calls)
+	}
+
+	// A custom strategy might use any header
+	headers.Set("Accept", "text/html")
+	if got := strat.ClientIP(headers, "10.0.0.2:4711"); got != "1.1.1.1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+	}
+	if calls != 2 {
+		t.Fatalf("inner called %d times, want 2", calls)
+	}
+
+	// Changed input is not served from the cache, including when the cached headers are
+	// modified in place
+	headers["X-Forwarded-For"][0] = "2.2.2.2"
+	if got := strat.ClientIP(headers, "10.0.0.2:4711"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+	if got := strat.ClientIP(headers, "10.0.0.3:4711"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+	headers.Add("Cache-Control", "no-cache")
+	if got := strat.ClientIP(headers, "10.0.0.3:4711"); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+	if calls != 5 {
+		t.Fatalf("inner called %d times, want 5", calls)
+	}
+}
+
+func TestMemoize_throughInterface(t *testing.T) {
+	var calls int64
+	inner := countingStrategy{inner: Must(NewSingleIPHeaderStrategy("X-Real-IP")), calls: &calls}
+
+	// Memoization also happens when the strategy is used through the Strategy interface,
+	// such as in a chain
+	var strat Strategy = NewChainStrategy(Memoize(inner), RemoteAddrStrategy{})
+	headers := http.Header{"X-Real-Ip": []string{"1.1.1.1"}}
+	for i := 0; i < 5; i++ {
+		if got := strat.ClientIP(headers, "10.0.0.1:4711"); got != "1.1.1.1" {
+			t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+		}
+		if got := ClientIPContext(context.Background(), strat, headers, "10.0.0.1:4711"); got != "1.1.1.1" {
+			t.Fatalf("ClientIPContext = %q, want %q", got, "1.1.1.1")
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("inner called %d times, want 1", calls)
+	}
+}
+
+func TestMemoize_relevantHeaders(t *testing.T) {
+	strat := Memoize(NewChainStrategy(
+		Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		RemoteAddrStrategy{},
+	))
+
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "RemoteAddr",
+			remoteAddr: "3.3.3.3:4711",
+			want:       "3.3.3.3",
+		},
+		{
+			name:       "Irrelevant header doesn't matter",
+			headers:    http.Header{"Accept": []string{"*/*"}},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "3.3.3.3",
+		},
+		{
+			name:       "Different RemoteAddr",
+			remoteAddr: "4.4.4.4:4711",
+			want:       "4.4.4.4",
+		},
+		{
+			name:       "XFF",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1"}},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "X-Real-IP",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1"}, "X-Real-Ip": []string{"2.2.2.2"}},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "2.2.2.2",
+		},
+		{
+			name:       "Values aren't confused across headers",
+			headers:    http.Header{"X-Real-Ip": []string{}, "X-Forwarded-For": []string{"1.1.1.1"}},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Split across lines",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1", "5.5.5.5"}},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "5.5.5.5",
+		},
+		{
+			name:       "Joined into one line",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, 5.5.5.5"}},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "5.5.5.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Twice, to get a cached result
+			for i := 0; i < 2; i++ {
+				if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+					t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoize_request(t *testing.T) {
+	var calls int64
+	inner := countingStrategy{inner: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), calls: &calls}
+	strat := Memoize(inner)
+
+	newRequest := func(xff, remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Forwarded-For", xff)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	// Repeated calls for a request derive the client IP once, including for requests
+	// derived from it, and the result is kept for the request even if its headers change
+	serveMemoized(newRequest("1.1.1.1, 10.0.0.1", "10.0.0.2:4711"), func(r *http.Request) {
+		for i := 0; i < 5; i++ {
+			if got := strat.ClientIPFromRequest(r); got != "1.1.1.1" {
+				t.Fatalf("ClientIPFromRequest = %q, want %q", got, "1.1.1.1")
+			}
+		}
+
+		type ctxKey struct{}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, true))
+		r.Header.Set("X-Forwarded-For", "2.2.2.2")
+		if got := strat.ClientIPFromRequest(r); got != "1.1.1.1" {
+			t.Fatalf("ClientIPFromRequest = %q, want %q", got, "1.1.1.1")
+		}
+	})
+	if calls != 1 {
+		t.Fatalf("inner called %d times, want 1", calls)
+	}
+
+	// Another request gets its own result
+	serveMemoized(newRequest("3.3.3.3", "10.0.0.2:4711"), func(r *http.Request) {
+		for i := 0; i < 2; i++ {
+			if got := strat.ClientIPFromRequest(r); got != "3.3.3.3" {
+				t.Fatalf("ClientIPFromRequest = %q, want %q", got, "3.3.3.3")
+			}
+		}
+	})
+	if calls != 2 {
+		t.Fatalf("inner called %d times, want 2", calls)
+	}
+
+	// Without the middleware, the request's headers are used as the key
+	r := newRequest("4.4.4.4", "10.0.0.2:4711")
+	for i := 0; i < 2; i++ {
+		if got := strat.ClientIPFromRequest(r); got != "4.4.4.4" {
+			t.Fatalf("ClientIPFromRequest = %q, want %q", got, "4.4.4.4")
+		}
+	}
+	r.Header.Set("X-Forwarded-For", "5.5.5.5")
+	if got := strat.ClientIPFromRequest(r); got != "5.5.5.5" {
+		t.Fatalf("ClientIPFromRequest = %q, want %q", got, "5.5.5.5")
+	}
+	if calls != 4 {
+		t.Fatalf("inner called %d times, want 4", calls)
+	}
+}
+
+func TestMemoize_severalStrategies(t *testing.T) {
+	xffStrat := Memoize(Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")))
+	realIPStrat := Memoize(Must(NewSingleIPHeaderStrategy("X-Real-IP")))
+	remoteAddrStrat := Memoize(RemoteAddrStrategy{})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "1.1.1.1")
+	r.Header.Set("X-Real-IP", "2.2.2.2")
+	r.RemoteAddr = "3.3.3.3:4711"
+
+	// Strategies sharing a request's cache don't see each other's results
+	serveMemoized(r, func(r *http.Request) {
+		for i := 0; i < 2; i++ {
+			if got := xffStrat.ClientIPFromRequest(r); got != "1.1.1.1" {
+				t.Fatalf("X-Forwarded-For ClientIPFromRequest = %q, want %q", got, "1.1.1.1")
+			}
+			if got := realIPStrat.ClientIPFromRequest(r); got != "2.2.2.2" {
+				t.Fatalf("X-Real-IP ClientIPFromRequest = %q, want %q", got, "2.2.2.2")
+			}
+			if got := remoteAddrStrat.ClientIPFromRequest(r); got != "3.3.3.3" {
+				t.Fatalf("RemoteAddr ClientIPFromRequest = %q, want %q", got, "3.3.3.3")
+			}
+		}
+	})
+
+	xffStratCopy := xffStrat
+	if xffStrat == realIPStrat || xffStrat != xffStratCopy {
+		t.Fatalf("MemoizedStrategy should only equal copies of itself")
+	}
+}
+
+func TestMemoize_selectionStats(t *testing.T) {
+	var stats SelectionStats
+	strat := Memoize(Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithSelectionStats(&stats))))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "1.1.1.1")
+
+	// Cache hits don't call the inner strategy, so they aren't counted
+	serveMemoized(r, func(r *http.Request) {
+		for i := 0; i < 3; i++ {
+			strat.ClientIPFromRequest(r)
+		}
+	})
+	for i := 0; i < 3; i++ {
+		strat.ClientIP(r.Header, r.RemoteAddr)
+	}
+	if got := stats.IPv4Selected(); got != 1 {
+		t.Fatalf("IPv4Selected() = %d, want 1", got)
+	}
+}
+
+// This test is most meaningful when run with the race detector (go test -race).
+func TestMemoize_concurrent(t *testing.T) {
+	var calls int64
+	strat := Memoize(countingStrategy{inner: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")), calls: &calls})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				xff := "1.1.1.1"
+				if (i+j)%2 == 1 {
+					xff = "2.2.2.2"
+				}
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("X-Forwarded-For", xff)
+
+				serveMemoized(r, func(r *http.Request) {
+					// Concurrent calls for the same request, as from parallel subhandlers
+					var reqWG sync.WaitGroup
+					for k := 0; k < 4; k++ {
+						reqWG.Add(1)
+						go func() {
+							defer reqWG.Done()
+							if got := strat.ClientIPFromRequest(r); got != xff {
+								t.Errorf("ClientIPFromRequest = %q, want %q", got, xff)
+							}
+						}()
+					}
+					reqWG.Wait()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Each request was derived once at most; the value cache may have served some
+	if calls > 800 {
+		t.Fatalf("inner called %d times, want at most 800", calls)
+	}
+
+	// Concurrent calls of ClientIP share the value cache
+	var wg2 sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg2.Add(1)
+		go func(i int) {
+			defer wg2.Done()
+			for j := 0; j < 1000; j++ {
+				xff := "1.1.1.1"
+				if (i+j)%2 == 1 {
+					xff = "2.2.2.2"
+				}
+				if got := strat.ClientIP(http.Header{"X-Forwarded-For": []string{xff}}, ""); got != xff {
+					t.Errorf("ClientIP = %q, want %q", got, xff)
+					return
+				}
+			}
+		}(i)
+	}
+	wg2.Wait()
+}
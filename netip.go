@@ -0,0 +1,83 @@
+// SPDX: 0BSD
+
+//go:build go1.18
+// +build go1.18
+
+package realclientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// ClientIPAddrPort is like strat.ClientIP, except that it returns the client IP paired
+// with its port, as a netip.AddrPort. The port is taken from the header entry or
+// RemoteAddr that the IP was derived from; it is 0 if there is no valid port. ok is false
+// if no valid IP can be derived.
+// The entry is found by looking for the IP in the headers used by strat, from right to
+// left, and then in RemoteAddr. The headers are split into entries as strat splits them,
+// including with a separator set by WithListSeparator. So if the same IP appears more than once with different
+// ports, the port may not be from the entry that the strategy chose. Custom strategies
+// are supported, but only RemoteAddr is checked for their port.
+func ClientIPAddrPort(strat Strategy, headers http.Header, remoteAddr string) (addrPort netip.AddrPort, ok bool) {
+	ip := strat.ClientIP(headers, remoteAddr)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+
+	return netip.AddrPortFrom(addr, clientPort(strat, ip, headers, remoteAddr)), true
+}
+
+// clientPort returns the port of the rightmost entry in the headers used by strat, or
+// else of remoteAddr, that has the IP ip. 0 is returned if there is no such entry or it
+// has no valid port.
+func clientPort(strat Strategy, ip string, headers http.Header, remoteAddr string) uint16 {
+	token, headerName, found := clientIPToken(strat, ip, headers, remoteAddr)
+	if !found {
+		return 0
+	}
+
+	if headerName == forwardedHdr {
+		token = forwardedParam(token, "for")
+	}
+
+	_, port, portValid, err := ParseIPAddrWithPort(token)
+	if err != nil || !portValid {
+		return 0
+	}
+	return uint16(port)
+}
+
+// ParseAddrKeepMapped parses ipStr like ParseIPAddr does, including discarding any port
+// and brackets, but returns a netip.Addr that keeps an IPv4-mapped IPv6 address in its
+// IPv6 form; for example, "::ffff:172.21.0.6" is not converted to "172.21.0.6". This
+// can't be done with net.IPAddr, as net.IP stores IPv4 addresses in the IPv4-mapped form
+// and so can't tell them apart. Use netip.Addr.Unmap to convert to the IPv4 form.
+// A zone is kept for IPv6 addresses, but discarded for IPv4 addresses, as netip.Addr
+// can't represent it.
+func ParseAddrKeepMapped(ipStr string) (netip.Addr, error) {
+	ipAddr, host, err := parseIPAddr(ipStr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("netip.ParseAddr failed: %w", err)
+	}
+
+	return addr.WithZone(ipAddr.Zone), nil
+}
+
+// AddrInRanges is like IPInRanges, but takes a netip.Addr. Any zone is ignored.
+// IPv4-mapped IPv6 addresses are treated as IPv4, as they are by IPInRanges (but not by
+// netip.Prefix.Contains).
+func AddrInRanges(addr netip.Addr, ranges []net.IPNet) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	return isIPContainedInRanges(net.IP(addr.AsSlice()), ranges)
+}
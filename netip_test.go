@@ -0,0 +1,224 @@
+// SPDX: 0BSD
+
+//go:build go1.18
+// +build go1.18
+
+package realclientip
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestAddrInRanges(t *testing.T) {
+	ranges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32", "::ffff:192.168.0.0/112")
+
+	tests := []struct {
+		name string
+		addr netip.Addr
+		want bool
+	}{
+		{
+			name: "IPv4",
+			addr: netip.MustParseAddr("10.1.2.3"),
+			want: true,
+		},
+		{
+			name: "IPv4-mapped in IPv4 range",
+			addr: netip.MustParseAddr("::ffff:10.1.2.3"),
+			want: true,
+		},
+		{
+			name: "IPv4 in mapped range",
+			addr: netip.MustParseAddr("192.168.1.1"),
+			want: true,
+		},
+		{
+			name: "Zoned IPv6",
+			addr: netip.MustParseAddr("2001:db8::1%eth0"),
+			want: true,
+		},
+		{
+			name: "Not contained",
+			addr: netip.MustParseAddr("2607:f8b0:4004:83f::200e"),
+			want: false,
+		},
+		{
+			name: "Invalid",
+			addr: netip.Addr{},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AddrInRanges(tt.addr, ranges); got != tt.want {
+				t.Fatalf("AddrInRanges(%v) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAddrKeepMapped(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipStr    string
+		want     string
+		wantIPv4 string // the result of ParseIPAddr
+		wantErr  bool
+	}{
+		{
+			name:     "IPv4-mapped",
+			ipStr:    "::ffff:172.21.0.6",
+			want:     "::ffff:172.21.0.6",
+			wantIPv4: "172.21.0.6",
+		},
+		{
+			name:     "IPv4-mapped with brackets and port",
+			ipStr:    "[::ffff:172.21.0.6]:4747",
+			want:     "::ffff:172.21.0.6",
+			wantIPv4: "172.21.0.6",
+		},
+		{
+			name:     "IPv4-mapped in IPv6 form",
+			ipStr:    "0:0:0:0:0:ffff:ac15:0006",
+			want:     "::ffff:172.21.0.6",
+			wantIPv4: "172.21.0.6",
+		},
+		{
+			name:     "IPv4",
+			ipStr:    "172.21.0.6",
+			want:     "172.21.0.6",
+			wantIPv4: "172.21.0.6",
+		},
+		{
+			name:     "Zoned IPv6",
+			ipStr:    "[fe80::abcd%eth0]:4747",
+			want:     "fe80::abcd%eth0",
+			wantIPv4: "fe80::abcd%eth0",
+		},
+		{
+			name:    "Error: invalid",
+			ipStr:   "::ffff:nope",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAddrKeepMapped(tt.ipStr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAddrKeepMapped() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got.String() != tt.want {
+				t.Fatalf("ParseAddrKeepMapped() = %q, want %q", got.String(), tt.want)
+			}
+
+			// ParseIPAddr still normalizes to the IPv4 form
+			ipAddr, err := ParseIPAddr(tt.ipStr)
+			if err != nil || ipAddr.String() != tt.wantIPv4 {
+				t.Fatalf("ParseIPAddr() = %q, %v, want %q", ipAddr.String(), err, tt.wantIPv4)
+			}
+		})
+	}
+}
+
+func TestClientIPAddrPort(t *testing.T) {
+	tests := []struct {
+		name       string
+		strat      Strategy
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantOK     bool
+	}{
+		{
+			name:    "XFF entry with port",
+			strat:   Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1:1111, 2.2.2.2:4711, 10.0.0.1:80`}},
+			want:    "2.2.2.2:4711",
+			wantOK:  true,
+		},
+		{
+			name:    "XFF entry without port",
+			strat:   Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1:1111, 2.2.2.2, 10.0.0.1:80`}},
+			want:    "2.2.2.2:0",
+			wantOK:  true,
+		},
+		{
+			name:    "Forwarded IPv6 with port",
+			strat:   Must(NewLeftmostNonPrivateStrategy("Forwarded")),
+			headers: http.Header{"Forwarded": []string{`For="[2607:f8b0:4004:83f::200e]:4711";proto=https, For=2.2.2.2:80`}},
+			want:    "[2607:f8b0:4004:83f::200e]:4711",
+			wantOK:  true,
+		},
+		{
+			name:    "XFF entry with custom list separator",
+			strat:   Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator(';'))),
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1:1111; 2.2.2.2:4711; 10.0.0.1:80`}},
+			want:    "2.2.2.2:4711",
+			wantOK:  true,
+		},
+		{
+			name: "XFF entry with custom list separator in chain",
+			strat: NewChainStrategy(
+				Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", mustParseCIDRs(t, "10.0.0.0/8"), WithListSeparator('|'))),
+				RemoteAddrStrategy{},
+			),
+			headers:    http.Header{"X-Forwarded-For": []string{`1.1.1.1:1111|[2607:f8b0:4004:83f::200e]:4711|10.0.0.1:80`}},
+			remoteAddr: "10.0.0.2:4711",
+			want:       "[2607:f8b0:4004:83f::200e]:4711",
+			wantOK:     true,
+		},
+		{
+			name:    "IPv4-mapped entry",
+			strat:   Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{"X-Forwarded-For": []string{`[::ffff:2.2.2.2]:4711`}},
+			want:    "2.2.2.2:4711",
+			wantOK:  true,
+		},
+		{
+			name:       "RemoteAddr",
+			strat:      RemoteAddrStrategy{},
+			remoteAddr: "[2001:db8::1%eth0]:4711",
+			want:       "[2001:db8::1%eth0]:4711",
+			wantOK:     true,
+		},
+		{
+			name: "Chain falls back to RemoteAddr",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				RemoteAddrStrategy{},
+			),
+			headers:    http.Header{},
+			remoteAddr: "3.3.3.3:4711",
+			want:       "3.3.3.3:4711",
+			wantOK:     true,
+		},
+		{
+			name:       "Fail: no IP",
+			strat:      Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers:    http.Header{"X-Forwarded-For": []string{`10.0.0.1:80`}},
+			remoteAddr: "3.3.3.3:4711",
+			wantOK:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ClientIPAddrPort(tt.strat, tt.headers, tt.remoteAddr)
+			if ok != tt.wantOK {
+				t.Fatalf("ClientIPAddrPort() ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			if ok && got.String() != tt.want {
+				t.Fatalf("ClientIPAddrPort() = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net"
+)
+
+// Option configures optional behaviour of a strategy. Options are passed to the strategy
+// constructors, like:
+//
+//	NewRightmostNonPrivateStrategy("Forwarded", WithRejectBracketedIPv4())
+//
+// Each option documents the strategies it applies to. Strategies ignore options that
+// don't apply to them.
+// Options don't stop a strategy from being comparable with ==, but a strategy created
+// with an option that takes a func or slice (like WithNormalizeZone) is only equal to
+// copies of itself.
+type Option func(*options)
+
+// options holds the optional configuration of a strategy. The zero value is the default
+// behaviour.
+// Many strategies hold options by value, and must remain comparable (with ==), so options
+// must only have comparable fields. Funcs and slices go in refOptions instead.
+type options struct {
+	rejectBracketedIPv4       bool
+	decodeTunneledIPv6        bool
+	maxTrustedRanges          int
+	stripZone                 bool
+	commaJoinedRemoteAddr     bool
+	requirePublic             bool
+	rejectMappedIPv6          bool
+	requireTrustedHop         bool
+	requireGlobalUnicast      bool
+	requirePublicClient       bool
+	lastHeaderLineOnly        bool
+	allowUnspecified          bool
+	stats                     *SelectionStats
+	allowBroadRanges          bool
+	ignoreHeadersFromLoopback bool
+	listSeparator             rune
+	dedupeConsecutive         bool
+	maxHeaderValueLen         int
+	ref                       *refOptions
+}
+
+// refOptions holds the options that aren't comparable. It is only allocated if one of them
+// is set, so that strategies without them compare equal when their other options are
+// equal. Strategies with them compare equal only to copies of themselves.
+type refOptions struct {
+	normalizeZone func(string) string
+	allowedRanges []net.IPNet
+	routableCheck func(net.IP) bool
+}
+
+// setRef returns the refOptions of o, allocating it if necessary. It must only be used
+// while the options are being built.
+func (o *options) setRef() *refOptions {
+	if o.ref == nil {
+		o.ref = &refOptions{}
+	}
+	return o.ref
+}
+
+// normalizeZone returns the WithNormalizeZone function, or nil if not set.
+func (o *options) normalizeZone() func(string) string {
+	if o.ref == nil {
+		return nil
+	}
+	return o.ref.normalizeZone
+}
+
+// allowedRanges returns the WithAllowedRanges ranges, or nil if not set.
+func (o *options) allowedRanges() []net.IPNet {
+	if o.ref == nil {
+		return nil
+	}
+	return o.ref.allowedRanges
+}
+
+// routableCheck returns the WithRoutableCheck function, or nil if not set.
+func (o *options) routableCheck() func(net.IP) bool {
+	if o.ref == nil {
+		return nil
+	}
+	return o.ref.routableCheck
+}
+
+// newOptions applies opts to a default options value.
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithRejectBracketedIPv4 makes Forwarded header parsing reject IPv4 addresses that are
+// enclosed in square brackets, like For="[1.1.1.1]". RFC 7239 only allows brackets around
+// IPv6 addresses, and no legitimate proxy should add them around IPv4, but by default
+// they are tolerated and trimmed.
+// It applies to the strategies that parse the Forwarded header.
+func WithRejectBracketedIPv4() Option {
+	return func(o *options) {
+		o.rejectBracketedIPv4 = true
+	}
+}
+
+// WithDecodeTunneledIPv6 makes the private-address check classify 6to4 (2002::/16) and
+// Teredo (2001::/32) IPv6 addresses by the IPv4 address tunneled inside them. By default,
+// all such addresses are considered private, as both mechanisms are deprecated. With this
+// option, for example, 2002:c0a8:101:: (wrapping 192.168.1.1) is private but
+// 2002:101:101:: (wrapping 1.1.1.1) is not.
+// It applies to the non-private strategies.
+func WithDecodeTunneledIPv6() Option {
+	return func(o *options) {
+		o.decodeTunneledIPv6 = true
+	}
+}
+
+// WithMaxTrustedRanges makes strategy construction fail if more than n trusted ranges
+// are given. Every range may be checked on every request, so this guards against
+// accidentally passing in an enormous (for example, unmerged) list. n of zero or less
+// means no limit, which is the default.
+// It applies to the strategies that take trusted ranges.
+func WithMaxTrustedRanges(n int) Option {
+	return func(o *options) {
+		o.maxTrustedRanges = n
+	}
+}
+
+// WithNormalizeZone makes the strategies pass the zone identifier of the returned IP (if
+// it has one) through fn. This can be used to fold the case of zones (like "%ETH0" vs
+// "%eth0") or to map numeric zone indexes to interface names, so that they're consistent
+// in downstream storage. The default is to return the zone unchanged. fn must be safe for
+// concurrent use.
+// It applies to all strategies that can return an IP with a zone.
+func WithNormalizeZone(fn func(zone string) string) Option {
+	return func(o *options) {
+		o.setRef().normalizeZone = fn
+	}
+}
+
+// WithStripZone makes the strategies remove the zone identifier from the returned IP, so
+// that "fe80::1%eth0" or "fe80::1%3" (as RemoteAddr may be on platforms that use numeric
+// zone indexes, like Windows) is returned as "fe80::1". This is for downstream systems
+// that reject zones. It takes precedence over WithNormalizeZone.
+// It applies to all strategies that can return an IP with a zone.
+func WithStripZone() Option {
+	return func(o *options) {
+		o.stripZone = true
+	}
+}
+
+// WithCommaJoinedRemoteAddr makes the strategies tolerate a RemoteAddr that is a
+// comma-separated list of addresses, as set by some multiplexing servers and proxies,
+// by using the last element. By default such a RemoteAddr is invalid.
+// It applies to the strategies that use RemoteAddr.
+func WithCommaJoinedRemoteAddr() Option {
+	return func(o *options) {
+		o.commaJoinedRemoteAddr = true
+	}
+}
+
+// WithRequirePublic makes the strategy return empty string if the IP it derives is
+// private or local. This defends against a misconfigured proxy forwarding internal IPs
+// in a header that should only ever contain a public client IP. If it is combined with
+// WithAllowedRanges, an IP is accepted if it is public or within the allowed ranges.
+// It applies to SingleIPHeaderStrategy.
+func WithRequirePublic() Option {
+	return func(o *options) {
+		o.requirePublic = true
+	}
+}
+
+// WithAllowedRanges makes the strategy return empty string if the IP it derives is not
+// within one of ranges. If it is combined with WithRequirePublic, an IP is accepted if it
+// is public or within the allowed ranges.
+// It applies to SingleIPHeaderStrategy.
+func WithAllowedRanges(ranges []net.IPNet) Option {
+	return func(o *options) {
+		ref := o.setRef()
+		ref.allowedRanges = append(ref.allowedRanges, ranges...)
+	}
+}
+
+// WithRejectMappedIPv6 makes the strategies treat IPv4-mapped IPv6 addresses in headers,
+// like "::ffff:188.0.2.128", as invalid. Proxies don't normally add IPs in that form, so
+// some security policies consider them to be probable spoofing attempts. By default they
+// are accepted and treated as the IPv4 address they contain.
+// It applies to the strategies that use headers.
+func WithRejectMappedIPv6() Option {
+	return func(o *options) {
+		o.rejectMappedIPv6 = true
+	}
+}
+
+// WithRequireTrustedHop makes the strategy fail unless at least one entry at the right
+// of the header is within the trusted ranges. By default, if the rightmost entry is not
+// trusted, it is returned as the client IP, even though no proxy hop was verified; that
+// can indicate that the header was injected by the client and passed through unchanged.
+// It applies to RightmostTrustedRangeStrategy.
+func WithRequireTrustedHop() Option {
+	return func(o *options) {
+		o.requireTrustedHop = true
+	}
+}
+
+// WithRequireGlobalUnicast makes the strategies only return global unicast addresses, as
+// determined by net.IP.IsGlobalUnicast, excluding the documentation and benchmarking
+// ranges (like 203.0.113.0/24 and 2001:db8::/32). Multicast, loopback, link-local, and
+// unspecified addresses are rejected. Private addresses are not rejected by this option.
+// The non-private strategies skip over unacceptable addresses; the other strategies
+// return empty string if the address they derive is unacceptable. Trusted proxy entries
+// are not affected.
+// It applies to all strategies.
+func WithRequireGlobalUnicast() Option {
+	return func(o *options) {
+		o.requireGlobalUnicast = true
+	}
+}
+
+// WithRequirePublicClient makes the strategies return empty string if the client IP they
+// derive is private or local. For example, RightmostTrustedRangeStrategy will otherwise
+// return a private IP if it is the rightmost untrusted entry, as can happen with internal
+// testing or a proxy missing from the trusted ranges. Trusted proxy entries are not
+// affected.
+// For SingleIPHeaderStrategy, prefer WithRequirePublic, which can be combined with
+// WithAllowedRanges.
+// It applies to all strategies.
+func WithRequirePublicClient() Option {
+	return func(o *options) {
+		o.requirePublicClient = true
+	}
+}
+
+// WithLastHeaderLineOnly makes the strategies use only the last instance (line) of the
+// X-Forwarded-For or Forwarded header, rather than the concatenation of all instances.
+// This is useful if only the last instance is added by your own reverse proxy, and others
+// may have been added by the client or other parties.
+// It applies to the strategies that use the X-Forwarded-For, Forwarded, or
+// X-Original-Forwarded-For header.
+func WithLastHeaderLineOnly() Option {
+	return func(o *options) {
+		o.lastHeaderLineOnly = true
+	}
+}
+
+// WithAllowUnspecified makes the strategies accept the unspecified addresses "0.0.0.0"
+// and "::", which are otherwise treated as invalid. This is for tooling that uses them as
+// sentinel values. Note that they are private, so the non-private strategies will still
+// skip over them.
+// It applies to all strategies.
+func WithAllowUnspecified() Option {
+	return func(o *options) {
+		o.allowUnspecified = true
+	}
+}
+
+// WithSelectionStats makes the strategy count the IP family of each client IP it derives
+// in stats. Counting is opt-in, as it has a small cost. Results returned from the cache of
+// a MemoizedStrategy are not derived again, so they are not counted.
+// It applies to all strategies that take options.
+func WithSelectionStats(stats *SelectionStats) Option {
+	return func(o *options) {
+		o.stats = stats
+	}
+}
+
+// WithAllowBroadRanges allows trusted ranges that include a large part of the public
+// internet, like 0.0.0.0/0 or ::/0. By default, a range that is shorter than a /8 for
+// IPv4 or a /16 for IPv6 is rejected unless it is wholly private (like fc00::/7), as
+// trusting so much of the internet is almost certainly a mistake: for example,
+// RightmostTrustedRangeStrategy would then never find an untrusted IP.
+// It applies to the strategies that take trusted ranges.
+func WithAllowBroadRanges() Option {
+	return func(o *options) {
+		o.allowBroadRanges = true
+	}
+}
+
+// WithIgnoreHeadersFromLoopback makes the strategies ignore the headers when RemoteAddr
+// is a loopback address (like 127.0.0.1 or ::1), and derive the client IP from RemoteAddr
+// instead. During local development, requests from loopback usually come directly from a
+// browser or tool on the same machine, and any headers they have are likely to be
+// spoofed or left over from testing. Options that restrict the result, like
+// WithRequirePublicClient, still apply, so the result may be empty string.
+// It applies to the strategies that use headers.
+func WithIgnoreHeadersFromLoopback() Option {
+	return func(o *options) {
+		o.ignoreHeadersFromLoopback = true
+	}
+}
+
+// WithListSeparator makes X-Forwarded-For-style headers be split into list items on sep,
+// rather than on comma. This is for legacy appliances that use a non-standard delimiter,
+// like "1.1.1.1; 2.2.2.2". sep must be a punctuation or symbol character that can't
+// appear in an IP address, port, or zone, like ';' or '|' (so not any of ":.[]%-_" or
+// '"'); the strategy constructors return an error if it isn't. The Forwarded header is always split
+// on comma, as required by its syntax.
+// It applies to the strategies that use the X-Forwarded-For header (or another list
+// header that is parsed like it).
+func WithListSeparator(sep rune) Option {
+	return func(o *options) {
+		o.listSeparator = sep
+	}
+}
+
+// WithDedupeConsecutive makes runs of identical adjacent IPs in the X-Forwarded-For or
+// Forwarded header be treated as a single entry, before any counting or selection. Some
+// misconfigured proxies duplicate the IP they add, which throws off the indexing of
+// RightmostTrustedCountStrategy; with this option, "1.1.1.1, 1.1.1.1, 2.2.2.2" is treated
+// as "1.1.1.1, 2.2.2.2". Invalid entries are never collapsed.
+// It applies to the strategies that use the X-Forwarded-For, Forwarded, or
+// X-Original-Forwarded-For header.
+func WithDedupeConsecutive() Option {
+	return func(o *options) {
+		o.dedupeConsecutive = true
+	}
+}
+
+// WithMaxHeaderValueLen makes the strategies ignore any single header value (line) that is
+// longer than n bytes, treating it as absent, before any parsing is done. This caps the
+// work done for abusive requests. n of zero or less means no limit, which is the default.
+// Note that with the list headers, other lines of the same header are still used, unless
+// WithLastHeaderLineOnly is also used.
+// It applies to the strategies that use the X-Forwarded-For, Forwarded, or
+// X-Original-Forwarded-For header, and to SingleIPHeaderStrategy and
+// ProxyProtocolHeaderStrategy.
+func WithMaxHeaderValueLen(n int) Option {
+	return func(o *options) {
+		o.maxHeaderValueLen = n
+	}
+}
+
+// WithRoutableCheck makes the leftmost strategies also require the chosen IP to pass fn,
+// such as a check against a bogon or RPKI-derived list of unallocated or unrouted
+// addresses. IPs that fail are skipped over, as private IPs are, and the scan continues
+// to the right. fn must be safe for concurrent use, and should be fast, as it may be
+// called for many entries on every request. The default is no check.
+// It applies to LeftmostNonPrivateStrategy, LeftmostNonPrivateWithinStrategy,
+// LeftmostNonPrivateTrustedStrategy, and ForwardedLeftmostTrustedStrategy.
+func WithRoutableCheck(fn func(ip net.IP) bool) Option {
+	return func(o *options) {
+		o.setRef().routableCheck = fn
+	}
+}
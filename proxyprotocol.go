@@ -0,0 +1,133 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ParseProxyProtocolV1 parses a human-readable (version 1) PROXY protocol header line,
+// like "PROXY TCP4 1.2.3.4 5.6.7.8 56324 443", and returns the source address.
+// A trailing CRLF is allowed. An error is returned if the line is malformed, if the
+// address doesn't match the protocol family, or if the protocol is UNKNOWN (in which case
+// the line carries no address information).
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+func ParseProxyProtocolV1(line string) (net.IPAddr, error) {
+	line = strings.TrimSuffix(line, "\r\n")
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return net.IPAddr{}, fmt.Errorf("not a PROXY protocol v1 line: %q", line)
+	}
+
+	family := fields[1]
+	switch family {
+	case "TCP4", "TCP6":
+	case "UNKNOWN":
+		return net.IPAddr{}, fmt.Errorf("PROXY protocol family is UNKNOWN; no source address available")
+	default:
+		return net.IPAddr{}, fmt.Errorf("unsupported PROXY protocol family: %q", family)
+	}
+
+	if len(fields) != 6 {
+		return net.IPAddr{}, fmt.Errorf("PROXY protocol line must have 6 fields, got %d: %q", len(fields), line)
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil {
+		return net.IPAddr{}, fmt.Errorf("PROXY protocol source address is invalid: %q", fields[2])
+	}
+
+	// The address must be of the declared family. An IPv4-mapped IPv6 address is IPv6 in
+	// form, so we check the text rather than using net.IP.To4.
+	isIPv6 := strings.Contains(fields[2], ":")
+	if isIPv6 != (family == "TCP6") {
+		return net.IPAddr{}, fmt.Errorf("PROXY protocol source address %q does not match family %s", fields[2], family)
+	}
+
+	if net.ParseIP(fields[3]) == nil {
+		return net.IPAddr{}, fmt.Errorf("PROXY protocol destination address is invalid: %q", fields[3])
+	}
+
+	for _, port := range fields[4:] {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return net.IPAddr{}, fmt.Errorf("PROXY protocol port is invalid: %q", port)
+		}
+	}
+
+	return net.IPAddr{IP: srcIP}, nil
+}
+
+// ProxyProtocolHeaderStrategy derives the client IP from a single header containing a
+// PROXY protocol v1 line, as set by a server that terminates HAProxy's PROXY protocol and
+// passes the parsed line on in a request header.
+// Like SingleIPHeaderStrategy, this strategy should only be used when the header is added
+// by a trusted reverse proxy, and you must ensure that it is not spoofable.
+type ProxyProtocolHeaderStrategy struct {
+	headerName string
+	opts       options
+}
+
+// NewProxyProtocolHeaderStrategy creates a ProxyProtocolHeaderStrategy that uses the
+// headerName request header to get the PROXY protocol line.
+func NewProxyProtocolHeaderStrategy(headerName string, opts ...Option) (ProxyProtocolHeaderStrategy, error) {
+	if headerName == "" {
+		return ProxyProtocolHeaderStrategy{}, fmt.Errorf("ProxyProtocolHeaderStrategy header must not be empty")
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll canonicalize here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if isStandardListHeader(headerName) {
+		return ProxyProtocolHeaderStrategy{}, fmt.Errorf("ProxyProtocolHeaderStrategy header must not be %s or %s", xForwardedForHdr, forwardedHdr)
+	}
+
+	return ProxyProtocolHeaderStrategy{headerName: headerName, opts: newOptions(opts)}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// If no valid IP can be derived, empty string will be returned.
+func (strat ProxyProtocolHeaderStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	// As with SingleIPHeaderStrategy, we use the last instance of the header
+	line := lastHeader(headers, strat.headerName)
+	if line == "" {
+		// There is no header
+		return ""
+	}
+
+	if strat.opts.maxHeaderValueLen > 0 && len(line) > strat.opts.maxHeaderValueLen {
+		// Treat an overlong header as absent
+		return ""
+	}
+
+	if _, err := ParseProxyProtocolV1(line); err != nil {
+		// The header value is invalid or carries no address
+		return ""
+	}
+
+	// The line is valid, so it has a source address field. It's parsed again like any
+	// other header IP, so that the options are honoured.
+	ipAddr := headerIPAddr(strings.Fields(line)[2], &strat.opts)
+	if ipAddr == nil {
+		// The address is not usable, such as being unspecified
+		return ""
+	}
+
+	return ipAddrString(*ipAddr, &strat.opts)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat ProxyProtocolHeaderStrategy) String() string {
+	return fmt.Sprintf("ProxyProtocolHeaderStrategy{header=%s}", strat.headerName)
+}
@@ -0,0 +1,207 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseProxyProtocolV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    net.IPAddr
+		wantErr bool
+	}{
+		{
+			name: "TCP4",
+			line: "PROXY TCP4 1.2.3.4 5.6.7.8 56324 443",
+			want: net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+		},
+		{
+			name: "TCP4 with CRLF",
+			line: "PROXY TCP4 1.2.3.4 5.6.7.8 56324 443\r\n",
+			want: net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+		},
+		{
+			name: "TCP6",
+			line: "PROXY TCP6 2607:f8b0:4004:83f::200e 2001:db8::1 56324 443",
+			want: net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			name: "TCP6 with IPv4-mapped address",
+			line: "PROXY TCP6 ::ffff:1.2.3.4 ::ffff:5.6.7.8 56324 443",
+			want: net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+		},
+		{
+			name:    "Error: UNKNOWN",
+			line:    "PROXY UNKNOWN",
+			wantErr: true,
+		},
+		{
+			name:    "Error: UNKNOWN with addresses",
+			line:    "PROXY UNKNOWN 1.2.3.4 5.6.7.8 56324 443",
+			wantErr: true,
+		},
+		{
+			name:    "Error: family mismatch",
+			line:    "PROXY TCP4 2607:f8b0:4004:83f::200e 2001:db8::1 56324 443",
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad source",
+			line:    "PROXY TCP4 1.2.3 5.6.7.8 56324 443",
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad destination",
+			line:    "PROXY TCP4 1.2.3.4 nope 56324 443",
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad port",
+			line:    "PROXY TCP4 1.2.3.4 5.6.7.8 99999 443",
+			wantErr: true,
+		},
+		{
+			name:    "Error: missing fields",
+			line:    "PROXY TCP4 1.2.3.4 5.6.7.8",
+			wantErr: true,
+		},
+		{
+			name:    "Error: not PROXY",
+			line:    "1.2.3.4",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseProxyProtocolV1(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseProxyProtocolV1() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !ipAddrsEqual(got, tt.want) {
+				t.Fatalf("ParseProxyProtocolV1() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = ProxyProtocolHeaderStrategy{}
+
+	tests := []struct {
+		name       string
+		headerName string
+		opts       []Option
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "TCP4",
+			headerName: "proxy",
+			headers:    http.Header{"Proxy": []string{"PROXY TCP4 1.2.3.4 5.6.7.8 56324 443"}},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "TCP6",
+			headerName: "Proxy",
+			headers:    http.Header{"Proxy": []string{"PROXY TCP6 2607:f8b0:4004:83f::200e 2001:db8::1 56324 443"}},
+			want:       "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:       "Fail: UNKNOWN",
+			headerName: "Proxy",
+			headers:    http.Header{"Proxy": []string{"PROXY UNKNOWN"}},
+			want:       "",
+		},
+		{
+			name:       "Fail: unspecified source",
+			headerName: "Proxy",
+			headers:    http.Header{"Proxy": []string{"PROXY TCP4 0.0.0.0 5.6.7.8 56324 443"}},
+			want:       "",
+		},
+		{
+			name:       "Fail: header missing",
+			headerName: "Proxy",
+			headers:    http.Header{"X-Real-Ip": []string{"1.1.1.1"}},
+			want:       "",
+		},
+		{
+			name:       "IPv4-mapped source",
+			headerName: "Proxy",
+			headers:    http.Header{"Proxy": []string{"PROXY TCP6 ::ffff:1.2.3.4 2001:db8::1 56324 443"}},
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "Fail: IPv4-mapped source with WithRejectMappedIPv6",
+			headerName: "Proxy",
+			opts:       []Option{WithRejectMappedIPv6()},
+			headers:    http.Header{"Proxy": []string{"PROXY TCP6 ::ffff:1.2.3.4 2001:db8::1 56324 443"}},
+			want:       "",
+		},
+		{
+			name:       "Fail: private source with WithRequirePublicClient",
+			headerName: "Proxy",
+			opts:       []Option{WithRequirePublicClient()},
+			headers:    http.Header{"Proxy": []string{"PROXY TCP4 10.0.0.1 5.6.7.8 56324 443"}},
+			want:       "",
+		},
+		{
+			name:       "Fail: overlong line with WithMaxHeaderValueLen",
+			headerName: "Proxy",
+			opts:       []Option{WithMaxHeaderValueLen(20)},
+			headers:    http.Header{"Proxy": []string{"PROXY TCP4 1.2.3.4 5.6.7.8 56324 443"}},
+			want:       "",
+		},
+		{
+			name:       "Loopback RemoteAddr with WithIgnoreHeadersFromLoopback",
+			headerName: "Proxy",
+			opts:       []Option{WithIgnoreHeadersFromLoopback()},
+			headers:    http.Header{"Proxy": []string{"PROXY TCP4 1.2.3.4 5.6.7.8 56324 443"}},
+			remoteAddr: "127.0.0.1:4711",
+			want:       "127.0.0.1",
+		},
+		{
+			name:       "Non-loopback RemoteAddr with WithIgnoreHeadersFromLoopback",
+			headerName: "Proxy",
+			opts:       []Option{WithIgnoreHeadersFromLoopback()},
+			headers:    http.Header{"Proxy": []string{"PROXY TCP4 1.2.3.4 5.6.7.8 56324 443"}},
+			remoteAddr: "10.0.0.1:4711",
+			want:       "1.2.3.4",
+		},
+		{
+			name:       "Error: empty header name",
+			headerName: "",
+			wantErr:    true,
+		},
+		{
+			name:       "Error: list header",
+			headerName: "X-Forwarded-For",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewProxyProtocolHeaderStrategy(tt.headerName, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProxyProtocolHeaderStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
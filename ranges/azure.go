@@ -0,0 +1,17 @@
+package ranges
+
+// Azure Front Door's backend IP ranges. These are the addresses that Front Door uses to
+// connect to origin servers.
+// It is taken from the "AzureFrontDoor.Backend" service tag: https://learn.microsoft.com/en-us/azure/frontdoor/origin-security#public-ip-address-based-origins
+// The service tag is also published in the weekly "Azure IP Ranges and Service Tags"
+// download, and can be retrieved at runtime with the Service Tag Discovery API:
+// https://learn.microsoft.com/en-us/azure/virtual-network/service-tags-overview#use-the-service-tag-discovery-api
+// Note that these ranges are shared by all Front Door customers, so you must also check
+// the X-Azure-FDID header to ensure that requests are coming from your own Front Door
+// instance.
+// The broader Azure datacenter ranges are not provided here, as they number in the
+// thousands and change weekly; use the service tags download for those.
+var AzureFrontDoor = []string{
+	"147.243.0.0/16",
+	"2a01:111:2050::/44",
+}
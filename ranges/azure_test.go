@@ -0,0 +1,51 @@
+package ranges_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/realclientip/realclientip-go"
+	"github.com/realclientip/realclientip-go/ranges"
+)
+
+func TestAzureFrontDoor(t *testing.T) {
+	trustedRanges, err := realclientip.AddressesAndRangesToIPNets(ranges.AzureFrontDoor...)
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	strat, err := realclientip.NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategy error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		xff  string
+		want string
+	}{
+		{
+			name: "IPv4 backend",
+			xff:  "1.1.1.1, 147.243.12.34",
+			want: "1.1.1.1",
+		},
+		{
+			name: "IPv6 backend",
+			xff:  "1.1.1.1, 2a01:111:2050:1::1",
+			want: "1.1.1.1",
+		},
+		{
+			name: "Not a backend",
+			xff:  "1.1.1.1, 147.244.12.34",
+			want: "147.244.12.34",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+			if got := strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,13 +1,30 @@
 // SPDX: 0BSD
 
 // Package realclientip provides strategies for obtaining the "real" client IP from HTTP requests.
+//
+// The strategies are not modified after construction (apart from by SetRanges, which is
+// itself safe for concurrent use), so a single strategy instance can be shared and used
+// concurrently by any number of goroutines. The constructors copy any
+// slices they are given, so later changes by the caller don't affect the strategy.
+//
+// WebSocket handshakes are ordinary HTTP requests, so the strategies work the same way
+// for them: the X-Forwarded-For, Forwarded, and other headers of the Upgrade request are
+// used, and RemoteAddr is the address of the connection that is being upgraded (which is
+// the nearest reverse proxy, if there is one). Derive the client IP from the handshake
+// request before upgrading; the upgraded connection carries no headers.
 package realclientip
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Strategy is satisfied by all of the specific strategies in this package. It can be used
@@ -23,10 +40,72 @@ type Strategy interface {
 
 const (
 	// Pre-canonicalized constants to avoid typos later on
-	xForwardedForHdr = "X-Forwarded-For"
-	forwardedHdr     = "Forwarded"
+	xForwardedForHdr         = "X-Forwarded-For"
+	forwardedHdr             = "Forwarded"
+	xOriginalForwardedForHdr = "X-Original-Forwarded-For"
 )
 
+// Canonicalized names of common single-IP headers, for use with NewSingleIPHeaderStrategy.
+// See the SingleIPHeaderStrategy documentation for important caveats about their use.
+const (
+	HeaderXRealIP          = "X-Real-Ip"
+	HeaderCFConnectingIP   = "Cf-Connecting-Ip"
+	HeaderCFConnectingIPv6 = "Cf-Connecting-Ipv6"
+	HeaderTrueClientIP     = "True-Client-Ip"
+	HeaderFastlyClientIP   = "Fastly-Client-Ip"
+	HeaderXAzureClientIP   = "X-Azure-Clientip"
+	HeaderXAzureSocketIP   = "X-Azure-Socketip"
+)
+
+var (
+	// ErrChainTooShort is returned (wrapped) when a list header has fewer entries than
+	// there are trusted proxies, so the client entry is missing.
+	ErrChainTooShort = errors.New("header has fewer entries than trusted proxies")
+
+	// ErrBadValueAtIndex is returned (wrapped) when the list header entry at the position
+	// where the client IP is expected is not a valid IP.
+	ErrBadValueAtIndex = errors.New("header entry at client index is not a valid IP")
+
+	// ErrInvalidRange is returned (wrapped) by AddressesAndRangesToIPNets when an input
+	// string is not a valid address or range. The wrapping error describes the problem
+	// and includes the offending input.
+	ErrInvalidRange = errors.New("invalid address or range")
+
+	// ErrControlCharacter is returned (wrapped) by CheckControlCharacters when a header
+	// value contains a control character.
+	ErrControlCharacter = errors.New("header value contains control character")
+)
+
+// IsListHeaderName returns true if name is a header that the list-based strategies (like
+// RightmostNonPrivateStrategy) accept: "X-Forwarded-For", "Forwarded", or
+// "X-Original-Forwarded-For", in any case.
+// It can be used to validate configuration before calling the strategy constructors.
+func IsListHeaderName(name string) bool {
+	return isListHeader(CanonicalHeaderName(name))
+}
+
+// CanonicalHeaderName returns the canonical form of the header name, which is the form
+// that the strategies use and report. It is the same as http.CanonicalHeaderKey.
+func CanonicalHeaderName(name string) string {
+	return http.CanonicalHeaderKey(name)
+}
+
+// isListHeader returns true if headerName, which must already be canonicalized, is
+// acceptable for the list-based strategies. X-Original-Forwarded-For is emitted by some
+// ingress controllers (like ingress-nginx) to preserve the XFF they received, and is
+// parsed like X-Forwarded-For.
+func isListHeader(headerName string) bool {
+	return isStandardListHeader(headerName) || headerName == xOriginalForwardedForHdr
+}
+
+// isStandardListHeader returns true if headerName, which must already be canonicalized, is
+// X-Forwarded-For or Forwarded. These can't be used by the single-IP strategies.
+// X-Original-Forwarded-For isn't included, as it was accepted by them before it was
+// accepted as a list header, and some proxies set it to a single IP.
+func isStandardListHeader(headerName string) bool {
+	return headerName == xForwardedForHdr || headerName == forwardedHdr
+}
+
 // Must panics if err is not nil. This can be used to make sure the strategy-making
 // functions do not return an error. It can also facilitate calling NewChainStrategy().
 // It can be called like Must(NewSingleIPHeaderStrategy("X-Real-IP")).
@@ -37,20 +116,97 @@ func Must(strat Strategy, err error) Strategy {
 	return strat
 }
 
+// CheckControlCharacters returns an error wrapping ErrControlCharacter if any value of
+// the headers called headerNames contains a control character, like CR, LF, or NUL
+// (horizontal tab is allowed, as it is valid whitespace). headers is expected to be like
+// http.Request.Header. Such a value can't contain a valid IP, so the strategies already
+// ignore it, but it may indicate an attempt at header injection or request smuggling
+// that is worth logging. The error names the header and includes the value.
+func CheckControlCharacters(headers http.Header, headerNames ...string) error {
+	for _, headerName := range headerNames {
+		headerName = http.CanonicalHeaderKey(headerName)
+		for _, value := range headers[headerName] {
+			for i := 0; i < len(value); i++ {
+				if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+					return fmt.Errorf("%w in %s: %q", ErrControlCharacter, headerName, value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // ChainStrategy attempts to use the given strategies in order. If the first one returns
 // an empty string, the second one is tried, and so on, until a good IP is found or the
 // strategies are exhausted.
 // A common use for this is if a server is both directly connected to the internet and
 // expecting a header to check. It might be called like:
-//   NewChainStrategy(Must(LeftmostNonPrivateStrategy("X-Forwarded-For")), RemoteAddrStrategy)
+//
+//	NewChainStrategy(Must(LeftmostNonPrivateStrategy("X-Forwarded-For")), RemoteAddrStrategy)
 type ChainStrategy struct {
 	strategies []Strategy
+	failClosed bool
 }
 
 // NewChainStrategy creates a ChainStrategy that attempts to use the given strategies to
 // derive the client IP, stopping when the first one succeeds.
 func NewChainStrategy(strategies ...Strategy) ChainStrategy {
-	return ChainStrategy{strategies: strategies}
+	// Copy the slice, in case the caller passed one in with `...` and later modifies it
+	return ChainStrategy{strategies: append([]Strategy(nil), strategies...)}
+}
+
+// NewChainStrategyFailClosed creates a ChainStrategy that fails closed: rather than
+// falling through to the next strategy whenever one returns empty string, the chain
+// only falls through if the headers that the strategy uses are all absent from the
+// request. If a header is present but no valid IP can be derived from it, the whole chain
+// returns empty string. This avoids silently dropping to a weaker strategy when a
+// trusted header is malformed or spoofed.
+// Note that an empty result does not always stop the chain: if it did, only the first
+// strategy would ever be used, as a missing header (such as for a direct connection)
+// would also stop it.
+// The headers of a strategy that wraps others, like ExactProxyStrategy, MemoizedStrategy,
+// or a nested ChainStrategy, are those of the strategies it wraps (for
+// RightmostTrustedCountByHeaderStrategy, the list header, not the selector header).
+// Strategies that don't use a header (like RemoteAddrStrategy) and custom strategies
+// always stop the chain.
+func NewChainStrategyFailClosed(strategies ...Strategy) ChainStrategy {
+	strat := NewChainStrategy(strategies...)
+	strat.failClosed = true
+	return strat
+}
+
+// DefaultStrategy returns a strategy for getting started quickly, when the network
+// configuration isn't yet known. It is a ChainStrategy that tries, in order:
+// RightmostNonPrivateStrategy with the Forwarded header, then RightmostNonPrivateStrategy
+// with X-Forwarded-For, then SingleIPHeaderStrategy with X-Real-IP, then
+// RemoteAddrStrategy.
+// The rightmost-non-private strategies come first because they can't be spoofed as long
+// as all reverse proxies have private addresses, which is the common case; Forwarded is
+// preferred to X-Forwarded-For as it is the standard. X-Real-IP is next, as it is
+// commonly set by nginx. RemoteAddr is last, so that a direct connection still gets an IP.
+// Checking multiple headers like this can leave you open to spoofing if a header that
+// your proxies don't set is added by the client, so you SHOULD replace this with a
+// strategy chosen for your network configuration. See AnalyzeChain.
+func DefaultStrategy() Strategy {
+	return NewChainStrategy(
+		Must(NewRightmostNonPrivateStrategy(forwardedHdr)),
+		Must(NewRightmostNonPrivateStrategy(xForwardedForHdr)),
+		Must(NewSingleIPHeaderStrategy(HeaderXRealIP)),
+		RemoteAddrStrategy{},
+	)
+}
+
+// NewNginxRealIPStrategy creates a strategy for use behind nginx with the realip module
+// (ngx_http_realip_module), which is typically configured to compute the client IP and
+// pass it on in the X-Real-IP header. This prefers the X-Real-IP header, and falls back
+// to RemoteAddr if it is absent or invalid, as when the request didn't come through nginx.
+// As with SingleIPHeaderStrategy, nginx must be configured to always set or overwrite
+// X-Real-IP, or else it can be spoofed by the client. opts are passed to both strategies.
+func NewNginxRealIPStrategy(opts ...Option) ChainStrategy {
+	return NewChainStrategy(
+		Must(NewSingleIPHeaderStrategy(HeaderXRealIP, opts...)),
+		NewRemoteAddrStrategy(opts...),
+	)
 }
 
 // ClientIP derives the client IP using this strategy.
@@ -61,30 +217,272 @@ func NewChainStrategy(strategies ...Strategy) ChainStrategy {
 func (strat ChainStrategy) ClientIP(headers http.Header, remoteAddr string) string {
 	for _, subStrat := range strat.strategies {
 		result := subStrat.ClientIP(headers, remoteAddr)
-		if result != "" {
+		if result != "" || strat.stopsAt(subStrat, headers) {
 			return result
 		}
 	}
 	return ""
 }
 
+// stopsAt reports whether a failure of subStrat should stop the chain, rather than
+// falling through to the next strategy.
+func (strat ChainStrategy) stopsAt(subStrat Strategy, headers http.Header) bool {
+	if !strat.failClosed {
+		return false
+	}
+
+	headerNames := strategyHeaderNames(subStrat)
+	if len(headerNames) == 0 {
+		return true
+	}
+
+	for _, headerName := range headerNames {
+		if len(headers[headerName]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIPWithFallbackInfo is like ClientIP, but also reports whether the result came
+// from a RemoteAddrStrategy link (including in a nested ChainStrategy). When the chain
+// ends with RemoteAddrStrategy as the last, least-trusted option, usedFallback being true
+// is a signal that the reverse proxies aren't setting the expected headers.
+func (strat ChainStrategy) ClientIPWithFallbackInfo(headers http.Header, remoteAddr string) (ip string, usedFallback bool) {
+	for _, subStrat := range strat.strategies {
+		switch s := subStrat.(type) {
+		case ChainStrategy:
+			ip, usedFallback = s.ClientIPWithFallbackInfo(headers, remoteAddr)
+		case RemoteAddrStrategy:
+			ip, usedFallback = s.ClientIP(headers, remoteAddr), true
+		default:
+			ip, usedFallback = s.ClientIP(headers, remoteAddr), false
+		}
+
+		if ip != "" {
+			return ip, usedFallback
+		}
+
+		if strat.stopsAt(subStrat, headers) {
+			break
+		}
+	}
+	return "", false
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging. Each of the chained strategies is described in turn.
 func (strat ChainStrategy) String() string {
 	var b strings.Builder
-	b.WriteString("{strategies:[")
+	b.WriteString("ChainStrategy{[")
 	for i, s := range strat.strategies {
 		if i > 0 {
-			b.WriteString(" ")
+			b.WriteString(", ")
 		}
-		b.WriteString(fmt.Sprintf("%T%+v", s, s))
+		b.WriteString(describeStrategy(s))
+	}
+	b.WriteString("]")
+	if strat.failClosed {
+		b.WriteString(", failClosed")
 	}
-	b.WriteString("]}")
+	b.WriteString("}")
 	return b.String()
 }
 
+// describeStrategy returns the String() of strat if it has one, or else its type and
+// fields. The latter is needed for custom strategies.
+func describeStrategy(strat Strategy) string {
+	if s, ok := strat.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T%+v", strat, strat)
+}
+
+// CrossCheckStrategy derives the client IP with a primary strategy, and can also check it
+// against the result of a second, verifying strategy, as a tamper check. For example, the
+// primary might use the X-Real-IP header and the verifier the leftmost X-Forwarded-For
+// entry, if the reverse proxy is expected to set both to the same value.
+type CrossCheckStrategy struct {
+	primary Strategy
+	verify  Strategy
+}
+
+// NewCrossCheckStrategy creates a CrossCheckStrategy that returns the IP derived by
+// primary, and checks it against the one derived by verify.
+func NewCrossCheckStrategy(primary, verify Strategy) CrossCheckStrategy {
+	return CrossCheckStrategy{primary: primary, verify: verify}
+}
+
+// ClientIP derives the client IP using the primary strategy. The verifying strategy is
+// not used; use ClientIPConsistent for that.
+func (strat CrossCheckStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	return strat.primary.ClientIP(headers, remoteAddr)
+}
+
+// ClientIPConsistent derives the client IP using the primary strategy, and reports
+// whether the verifying strategy derived the same IP. consistent is false if either
+// strategy fails to derive an IP. ip is returned even if it is not consistent; how to
+// handle a mismatch (like logging it, or rejecting the request) is up to the caller.
+func (strat CrossCheckStrategy) ClientIPConsistent(headers http.Header, remoteAddr string) (ip string, consistent bool) {
+	ip = strat.primary.ClientIP(headers, remoteAddr)
+	if ip == "" {
+		return "", false
+	}
+
+	return ip, ip == strat.verify.ClientIP(headers, remoteAddr)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat CrossCheckStrategy) String() string {
+	return fmt.Sprintf("CrossCheckStrategy{primary=%s, verify=%s}", describeStrategy(strat.primary), describeStrategy(strat.verify))
+}
+
+// ExactProxyStrategy uses an inner strategy to derive the client IP from headers, but only
+// if the request came directly from one of a set of known reverse proxy IPs; otherwise
+// the RemoteAddr IP is returned. This is useful when there are exactly one or a few
+// reverse proxies with fixed IPs, and is tighter than gating by range.
+type ExactProxyStrategy struct {
+	inner    Strategy
+	proxyIPs []net.IP
+}
+
+// NewExactProxyStrategy creates an ExactProxyStrategy that uses inner if the RemoteAddr IP
+// is equal to one of proxyIPs. proxyIPs must not be empty or contain invalid IPs.
+func NewExactProxyStrategy(inner Strategy, proxyIPs []net.IP) (ExactProxyStrategy, error) {
+	if inner == nil {
+		return ExactProxyStrategy{}, fmt.Errorf("ExactProxyStrategy inner strategy must not be nil")
+	}
+
+	if len(proxyIPs) == 0 {
+		return ExactProxyStrategy{}, fmt.Errorf("ExactProxyStrategy proxy IPs must not be empty")
+	}
+
+	// Copy the IPs so that later modification by the caller can't race with ClientIP
+	ips := make([]net.IP, len(proxyIPs))
+	for i, ip := range proxyIPs {
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			return ExactProxyStrategy{}, fmt.Errorf("ExactProxyStrategy proxy IP at index %d is invalid: %v", i, ip)
+		}
+		ips[i] = append(net.IP(nil), ip...)
+	}
+
+	return ExactProxyStrategy{inner: inner, proxyIPs: ips}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat ExactProxyStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	remoteIPAddr := goodIPAddr(remoteAddr)
+	if remoteIPAddr == nil {
+		// We can't tell whether the connection is from a proxy
+		return ""
+	}
+
+	for _, proxyIP := range strat.proxyIPs {
+		if proxyIP.Equal(remoteIPAddr.IP) {
+			return strat.inner.ClientIP(headers, remoteAddr)
+		}
+	}
+
+	// The connection isn't from one of our proxies, so it's from the client
+	return remoteIPAddr.String()
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat ExactProxyStrategy) String() string {
+	return fmt.Sprintf("ExactProxyStrategy{inner=%s, proxies=%v}", describeStrategy(strat.inner), strat.proxyIPs)
+}
+
+// GatedStrategy uses an inner strategy to derive the client IP from headers, but only if
+// a predicate on the request says that the connection is from a trusted reverse proxy;
+// otherwise the RemoteAddr IP is returned. This generalizes ExactProxyStrategy to
+// arbitrary connection-level trust, such as verifying the client certificate of a
+// mutual-TLS edge:
+//
+//	gate := func(r *http.Request) bool {
+//		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+//	}
+//
+// The predicate needs the request, so GatedStrategy doesn't implement Strategy, which
+// only gets the headers and RemoteAddr; ClientIPFromRequest must be used instead. This
+// makes it a compile error to use it where a Strategy is expected, such as in a
+// ChainStrategy or with Memoize, which would otherwise have to either skip the gate or
+// never trust the headers.
+type GatedStrategy struct {
+	inner Strategy
+	gate  func(r *http.Request) bool
+}
+
+// NewGatedStrategy creates a GatedStrategy that uses inner if gate returns true for the
+// request. gate must be safe for concurrent use.
+func NewGatedStrategy(inner Strategy, gate func(r *http.Request) bool) (GatedStrategy, error) {
+	if inner == nil {
+		return GatedStrategy{}, fmt.Errorf("GatedStrategy inner strategy must not be nil")
+	}
+
+	if gate == nil {
+		return GatedStrategy{}, fmt.Errorf("GatedStrategy gate must not be nil")
+	}
+
+	return GatedStrategy{inner: inner, gate: gate}, nil
+}
+
+// ClientIPFromRequest derives the client IP of r using this strategy.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat GatedStrategy) ClientIPFromRequest(r *http.Request) string {
+	if strat.gate(r) {
+		return strat.inner.ClientIP(r.Header, r.RemoteAddr)
+	}
+
+	// The connection isn't trusted, so it's from the client
+	remoteIPAddr := goodIPAddr(r.RemoteAddr)
+	if remoteIPAddr == nil {
+		return ""
+	}
+	return remoteIPAddr.String()
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat GatedStrategy) String() string {
+	return fmt.Sprintf("GatedStrategy{inner=%s}", describeStrategy(strat.inner))
+}
+
 // RemoteAddrStrategy returns the client socket IP, stripped of port.
 // This strategy should be used if the server accept direct connections, rather than
 // through a reverse proxy.
-type RemoteAddrStrategy struct{}
+// The zero value is ready to use; NewRemoteAddrStrategy is only needed to set options.
+type RemoteAddrStrategy struct {
+	defaultIP string
+	opts      options
+}
+
+// NewRemoteAddrStrategy creates a RemoteAddrStrategy with the given options.
+func NewRemoteAddrStrategy(opts ...Option) RemoteAddrStrategy {
+	return RemoteAddrStrategy{opts: newOptions(opts)}
+}
+
+// NewRemoteAddrStrategyWithDefault creates a RemoteAddrStrategy that returns defaultIP,
+// rather than empty string, when no valid IP can be derived from RemoteAddr -- such as
+// when the server is listening on a Unix domain socket. defaultIP must be a valid IP
+// address; an unspecified address like "0.0.0.0" or "::" is allowed, as it makes a good
+// placeholder.
+// Note that a strategy with a default never fails, so it should only be used as the last
+// strategy in a ChainStrategy.
+func NewRemoteAddrStrategyWithDefault(defaultIP string, opts ...Option) (RemoteAddrStrategy, error) {
+	ipAddr, err := ParseIPAddr(defaultIP)
+	if err != nil {
+		return RemoteAddrStrategy{}, fmt.Errorf("RemoteAddrStrategy default %q is not a valid IP: %w", defaultIP, err)
+	}
+
+	return RemoteAddrStrategy{defaultIP: ipAddr.String(), opts: newOptions(opts)}, nil
+}
 
 // ClientIP derives the client IP using this strategy.
 // remoteAddr is expected to be like http.Request.RemoteAddr.
@@ -92,13 +490,31 @@ type RemoteAddrStrategy struct{}
 // If no valid IP can be derived, empty string will be returned. This should only happen
 // if remoteAddr has been modified to something illegal, or if the server is accepting
 // connections on a Unix domain socket (in which case RemoteAddr is "@").
+// If the strategy was created with NewRemoteAddrStrategyWithDefault, the default is
+// returned instead of empty string.
 func (strat RemoteAddrStrategy) ClientIP(_ http.Header, remoteAddr string) string {
-	ipAddr := goodIPAddr(remoteAddr)
-	if ipAddr == nil {
-		return ""
+	if result, ok := fastRemoteAddrIPv4(remoteAddr, &strat.opts); ok {
+		return result
 	}
 
-	return ipAddr.String()
+	var result string
+	if ipAddr := remoteAddrIPAddr(remoteAddr, &strat.opts); ipAddr != nil {
+		result = ipAddrString(*ipAddr, &strat.opts)
+	}
+
+	if result == "" {
+		return strat.defaultIP
+	}
+
+	return result
+}
+
+// String returns a human-readable description of the strategy, suitable for logging.
+func (strat RemoteAddrStrategy) String() string {
+	if strat.defaultIP != "" {
+		return fmt.Sprintf("RemoteAddrStrategy{default=%s}", strat.defaultIP)
+	}
+	return "RemoteAddrStrategy{}"
 }
 
 // SingleIPHeaderStrategy derives an IP address from a single-IP header.
@@ -110,11 +526,12 @@ func (strat RemoteAddrStrategy) ClientIP(_ http.Header, remoteAddr string) strin
 // See the single-IP wiki page for more info: https://github.com/realclientip/realclientip-go/wiki/Single-IP-Headers
 type SingleIPHeaderStrategy struct {
 	headerName string
+	opts       options
 }
 
 // NewSingleIPHeaderStrategy creates a SingleIPHeaderStrategy that uses the headerName
 // request header to get the client IP.
-func NewSingleIPHeaderStrategy(headerName string) (SingleIPHeaderStrategy, error) {
+func NewSingleIPHeaderStrategy(headerName string, opts ...Option) (SingleIPHeaderStrategy, error) {
 	if headerName == "" {
 		return SingleIPHeaderStrategy{}, fmt.Errorf("SingleIPHeaderStrategy header must not be empty")
 	}
@@ -123,18 +540,22 @@ func NewSingleIPHeaderStrategy(headerName string) (SingleIPHeaderStrategy, error
 	// by canonicalized header name. We'll canonicalize here so we only have to do it once.
 	headerName = http.CanonicalHeaderKey(headerName)
 
-	if headerName == xForwardedForHdr || headerName == forwardedHdr {
+	if isStandardListHeader(headerName) {
 		return SingleIPHeaderStrategy{}, fmt.Errorf("SingleIPHeaderStrategy header must not be %s or %s", xForwardedForHdr, forwardedHdr)
 	}
 
-	return SingleIPHeaderStrategy{headerName: headerName}, nil
+	return SingleIPHeaderStrategy{headerName: headerName, opts: newOptions(opts)}, nil
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
 // The returned IP may contain a zone identifier.
 // If no valid IP can be derived, empty string will be returned.
-func (strat SingleIPHeaderStrategy) ClientIP(headers http.Header, _ string) string {
+func (strat SingleIPHeaderStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
 	// RFC 2616 does not allow multiple instances of single-IP headers (or any non-list header).
 	// It is debatable whether it is better to treat multiple such headers as an error
 	// (more correct) or simply pick one of them (more flexible). As we've already
@@ -147,13 +568,44 @@ func (strat SingleIPHeaderStrategy) ClientIP(headers http.Header, _ string) stri
 		return ""
 	}
 
-	ipAddr := goodIPAddr(ipStr)
+	if strat.opts.maxHeaderValueLen > 0 && len(ipStr) > strat.opts.maxHeaderValueLen {
+		// Treat an overlong header as absent
+		return ""
+	}
+
+	ipAddr := headerIPAddr(ipStr, &strat.opts)
 	if ipAddr == nil {
 		// The header value is invalid
 		return ""
 	}
 
-	return ipAddr.String()
+	if !strat.isAllowedIP(ipAddr.IP) {
+		// The IP is not plausible for this header, per the WithRequirePublic and
+		// WithAllowedRanges options
+		return ""
+	}
+
+	return ipAddrString(*ipAddr, &strat.opts)
+}
+
+// isAllowedIP reports whether ip is acceptable under the WithRequirePublic and
+// WithAllowedRanges options. If neither was given, all IPs are allowed.
+func (strat SingleIPHeaderStrategy) isAllowedIP(ip net.IP) bool {
+	if !strat.opts.requirePublic && strat.opts.allowedRanges() == nil {
+		return true
+	}
+
+	if strat.opts.requirePublic && !isPrivateOrLocal(ip, &strat.opts) {
+		return true
+	}
+
+	return isIPContainedInRanges(ip, strat.opts.allowedRanges())
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat SingleIPHeaderStrategy) String() string {
+	return fmt.Sprintf("SingleIPHeaderStrategy{header=%s}", strat.headerName)
 }
 
 // LeftmostNonPrivateStrategy derives the client IP from the leftmost valid and
@@ -163,11 +615,12 @@ func (strat SingleIPHeaderStrategy) ClientIP(headers http.Header, _ string) stri
 // SPOOFED.
 type LeftmostNonPrivateStrategy struct {
 	headerName string
+	opts       options
 }
 
 // NewLeftmostNonPrivateStrategy creates a LeftmostNonPrivateStrategy. headerName must be
-// "X-Forwarded-For" or "Forwarded".
-func NewLeftmostNonPrivateStrategy(headerName string) (LeftmostNonPrivateStrategy, error) {
+// "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For".
+func NewLeftmostNonPrivateStrategy(headerName string, opts ...Option) (LeftmostNonPrivateStrategy, error) {
 	if headerName == "" {
 		return LeftmostNonPrivateStrategy{}, fmt.Errorf("LeftmostNonPrivateStrategy header must not be empty")
 	}
@@ -176,28 +629,356 @@ func NewLeftmostNonPrivateStrategy(headerName string) (LeftmostNonPrivateStrateg
 	// by canonicalized header name. We'll do that here so we only have to do it once.
 	headerName = http.CanonicalHeaderKey(headerName)
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return LeftmostNonPrivateStrategy{}, fmt.Errorf("LeftmostNonPrivateStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+	if !isListHeader(headerName) {
+		return LeftmostNonPrivateStrategy{}, fmt.Errorf("LeftmostNonPrivateStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
 	}
 
-	return LeftmostNonPrivateStrategy{headerName: headerName}, nil
+	o := newOptions(opts)
+	if err := validateListOptions("LeftmostNonPrivateStrategy", &o); err != nil {
+		return LeftmostNonPrivateStrategy{}, err
+	}
+
+	return LeftmostNonPrivateStrategy{headerName: headerName, opts: o}, nil
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
 // The returned IP may contain a zone identifier.
 // If no valid IP can be derived, empty string will be returned.
-func (strat LeftmostNonPrivateStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
-	for _, ip := range ipAddrs {
-		if ip != nil && !isPrivateOrLocal(ip.IP) {
+func (strat LeftmostNonPrivateStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	var result string
+	forEachIPAddr(headers, strat.headerName, &strat.opts, func(_ int, ip *net.IPAddr) bool {
+		if ip != nil && isLeftmostCandidate(ip.IP, &strat.opts) {
 			// This is the leftmost valid, non-private IP
-			return ip.String()
+			result = ipAddrString(*ip, &strat.opts)
+			return false
 		}
+		return true
+	})
+
+	// If we failed to find any valid, non-private IP, result is empty
+	return result
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat LeftmostNonPrivateStrategy) String() string {
+	return fmt.Sprintf("LeftmostNonPrivateStrategy{header=%s}", strat.headerName)
+}
+
+// LeftmostNonPrivateWithinStrategy is like LeftmostNonPrivateStrategy, except that it
+// only considers the first (leftmost) maxDepth entries of the X-Forwarded-For or
+// Forwarded header. This strategy should be used when the client is known to be at most
+// maxDepth hops from the left of the list, unless those hops are private.
+// Like LeftmostNonPrivateStrategy, this MUST NOT BE USED FOR SECURITY PURPOSES. This IP
+// can be TRIVIALLY SPOOFED.
+type LeftmostNonPrivateWithinStrategy struct {
+	headerName string
+	maxDepth   int
+	opts       options
+}
+
+// NewLeftmostNonPrivateWithinStrategy creates a LeftmostNonPrivateWithinStrategy.
+// headerName must be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For".
+// maxDepth is the number of entries, counting from the left, that will be searched for a
+// non-private IP.
+func NewLeftmostNonPrivateWithinStrategy(headerName string, maxDepth int, opts ...Option) (LeftmostNonPrivateWithinStrategy, error) {
+	if headerName == "" {
+		return LeftmostNonPrivateWithinStrategy{}, fmt.Errorf("LeftmostNonPrivateWithinStrategy header must not be empty")
 	}
 
-	// We failed to find any valid, non-private IP
-	return ""
+	if maxDepth <= 0 {
+		return LeftmostNonPrivateWithinStrategy{}, fmt.Errorf("LeftmostNonPrivateWithinStrategy maxDepth must be greater than zero")
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if !isListHeader(headerName) {
+		return LeftmostNonPrivateWithinStrategy{}, fmt.Errorf("LeftmostNonPrivateWithinStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	o := newOptions(opts)
+	if err := validateListOptions("LeftmostNonPrivateWithinStrategy", &o); err != nil {
+		return LeftmostNonPrivateWithinStrategy{}, err
+	}
+
+	return LeftmostNonPrivateWithinStrategy{headerName: headerName, maxDepth: maxDepth, opts: o}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived within maxDepth entries, empty string will be returned.
+func (strat LeftmostNonPrivateWithinStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	var result string
+	forEachIPAddr(headers, strat.headerName, &strat.opts, func(idx int, ip *net.IPAddr) bool {
+		if idx >= strat.maxDepth {
+			// We've gone past the window we're allowed to search
+			return false
+		}
+
+		if ip != nil && isLeftmostCandidate(ip.IP, &strat.opts) {
+			// This is the leftmost valid, non-private IP within the window
+			result = ipAddrString(*ip, &strat.opts)
+			return false
+		}
+		return true
+	})
+
+	// If we failed to find any valid, non-private IP, result is empty
+	return result
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat LeftmostNonPrivateWithinStrategy) String() string {
+	return fmt.Sprintf("LeftmostNonPrivateWithinStrategy{header=%s, maxDepth=%d}", strat.headerName, strat.maxDepth)
+}
+
+// LeftmostNonPrivateTrustedStrategy derives the client IP from the leftmost valid and
+// non-private IP address in the X-Forwarded-For or Forwarded header, but only if every
+// entry to the right of it (toward the connection) is a valid IP within a set of trusted
+// ranges. If any of those entries is untrusted, the chain can't be vouched for and no IP
+// is returned. This catches requests where the intermediate hops are not your proxies,
+// but it does not make the leftmost IP trustworthy: a client can still prepend any IP it
+// likes. Like LeftmostNonPrivateStrategy, this MUST NOT BE USED FOR SECURITY PURPOSES.
+type LeftmostNonPrivateTrustedStrategy struct {
+	headerName    string
+	trustedRanges []net.IPNet
+	opts          options
+}
+
+// NewLeftmostNonPrivateTrustedStrategy creates a LeftmostNonPrivateTrustedStrategy.
+// headerName must be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For".
+// trustedRanges must contain all trusted reverse proxies on the path to this server.
+func NewLeftmostNonPrivateTrustedStrategy(headerName string, trustedRanges []net.IPNet, opts ...Option) (LeftmostNonPrivateTrustedStrategy, error) {
+	if headerName == "" {
+		return LeftmostNonPrivateTrustedStrategy{}, fmt.Errorf("LeftmostNonPrivateTrustedStrategy header must not be empty")
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if !isListHeader(headerName) {
+		return LeftmostNonPrivateTrustedStrategy{}, fmt.Errorf("LeftmostNonPrivateTrustedStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	o := newOptions(opts)
+	if err := validateListOptions("LeftmostNonPrivateTrustedStrategy", &o); err != nil {
+		return LeftmostNonPrivateTrustedStrategy{}, err
+	}
+
+	if err := validateTrustedRanges("LeftmostNonPrivateTrustedStrategy", trustedRanges, &o); err != nil {
+		return LeftmostNonPrivateTrustedStrategy{}, err
+	}
+
+	// Copy the ranges so that later modification by the caller can't race with ClientIP
+	trustedRanges = copyIPNets(trustedRanges)
+
+	return LeftmostNonPrivateTrustedStrategy{headerName: headerName, trustedRanges: trustedRanges, opts: o}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat LeftmostNonPrivateTrustedStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
+
+	clientIndex := -1
+	for i, ip := range ipAddrs {
+		if ip != nil && isLeftmostCandidate(ip.IP, &strat.opts) {
+			clientIndex = i
+			break
+		}
+	}
+
+	if clientIndex < 0 {
+		// There is no valid, non-private IP
+		return ""
+	}
+
+	// Every hop between the client and us must be one of our proxies
+	for _, ip := range ipAddrs[clientIndex+1:] {
+		if ip == nil || !isIPContainedInRanges(ip.IP, strat.trustedRanges) {
+			return ""
+		}
+	}
+
+	return ipAddrString(*ipAddrs[clientIndex], &strat.opts)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat LeftmostNonPrivateTrustedStrategy) String() string {
+	return fmt.Sprintf("LeftmostNonPrivateTrustedStrategy{header=%s, ranges=%d}", strat.headerName, len(strat.trustedRanges))
+}
+
+// ForwardedLeftmostTrustedStrategy is like LeftmostNonPrivateTrustedStrategy, but is
+// specific to the Forwarded header and also checks the "by" parameters. It derives the
+// client IP from the leftmost valid and non-private "for" IP, but only if the "for" IP of
+// every element to the right of it is within the trusted ranges, and the "by" IP of that
+// element and every element to the right of it is within the trusted ranges. A "by"
+// parameter that is absent or not an IP (such as an obfuscated identifier like "_edge")
+// is not checked. This suits edge proxies that record themselves in "by".
+// Like LeftmostNonPrivateStrategy, this MUST NOT BE USED FOR SECURITY PURPOSES.
+type ForwardedLeftmostTrustedStrategy struct {
+	trustedRanges []net.IPNet
+	opts          options
+}
+
+// NewForwardedLeftmostTrustedStrategy creates a ForwardedLeftmostTrustedStrategy.
+// trustedRanges must contain all trusted reverse proxies on the path to this server.
+func NewForwardedLeftmostTrustedStrategy(trustedRanges []net.IPNet, opts ...Option) (ForwardedLeftmostTrustedStrategy, error) {
+	o := newOptions(opts)
+
+	if err := validateTrustedRanges("ForwardedLeftmostTrustedStrategy", trustedRanges, &o); err != nil {
+		return ForwardedLeftmostTrustedStrategy{}, err
+	}
+
+	// Copy the ranges so that later modification by the caller can't race with ClientIP
+	trustedRanges = copyIPNets(trustedRanges)
+
+	return ForwardedLeftmostTrustedStrategy{trustedRanges: trustedRanges, opts: o}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat ForwardedLeftmostTrustedStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	var elems []string
+	list := listScanner{values: listHeaderValues(headers, forwardedHdr, &strat.opts)}
+	for elem, ok := list.next(); ok; elem, ok = list.next() {
+		elems = append(elems, elem)
+	}
+
+	clientIndex := -1
+	var clientIP *net.IPAddr
+	for i, elem := range elems {
+		if ip := parseForwardedListItem(elem, &strat.opts); ip != nil && isLeftmostCandidate(ip.IP, &strat.opts) {
+			clientIndex, clientIP = i, ip
+			break
+		}
+	}
+
+	if clientIndex < 0 {
+		// There is no valid, non-private IP
+		return ""
+	}
+
+	for i, elem := range elems[clientIndex:] {
+		if i > 0 {
+			// Every hop between the client and us must be one of our proxies
+			ip := parseForwardedListItem(elem, &strat.opts)
+			if ip == nil || !isIPContainedInRanges(ip.IP, strat.trustedRanges) {
+				return ""
+			}
+		}
+
+		// And so must every proxy that identified itself with an IP
+		if by := goodIPAddr(forwardedParam(elem, "by")); by != nil && !isIPContainedInRanges(by.IP, strat.trustedRanges) {
+			return ""
+		}
+	}
+
+	return ipAddrString(*clientIP, &strat.opts)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat ForwardedLeftmostTrustedStrategy) String() string {
+	return fmt.Sprintf("ForwardedLeftmostTrustedStrategy{ranges=%d}", len(strat.trustedRanges))
+}
+
+// ForwardedByMarkerStrategy derives the client IP from the "for" parameter of the
+// rightmost Forwarded header element whose "by" parameter is one of a set of markers. The
+// markers identify your own reverse proxies, like "edge1" or "_edge" (RFC 7239 calls
+// these obfuscated identifiers), and must not be revealed to clients. Elements added by
+// anything else, which lack a marker, are ignored. If the marked element has no valid
+// "for" IP, or no element is marked, no IP is returned.
+// This is robust against header injection, as long as the markers are secret and your
+// proxies overwrite or remove any Forwarded header that claims to be from them.
+type ForwardedByMarkerStrategy struct {
+	markers []string
+	opts    options
+}
+
+// NewForwardedByMarkerStrategy creates a ForwardedByMarkerStrategy. markers are compared
+// to the "by" values exactly, after removing any enclosing quotes.
+func NewForwardedByMarkerStrategy(markers []string, opts ...Option) (ForwardedByMarkerStrategy, error) {
+	if len(markers) == 0 {
+		return ForwardedByMarkerStrategy{}, fmt.Errorf("ForwardedByMarkerStrategy markers must not be empty")
+	}
+
+	for i, m := range markers {
+		if m == "" {
+			return ForwardedByMarkerStrategy{}, fmt.Errorf("ForwardedByMarkerStrategy marker at index %d is empty", i)
+		}
+	}
+
+	// Copy the markers so that later modification by the caller can't race with ClientIP
+	markers = append([]string(nil), markers...)
+
+	return ForwardedByMarkerStrategy{markers: markers, opts: newOptions(opts)}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat ForwardedByMarkerStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	var marked string
+	list := listScanner{values: listHeaderValues(headers, forwardedHdr, &strat.opts)}
+	for elem, ok := list.next(); ok; elem, ok = list.next() {
+		if containsString(strat.markers, forwardedParam(elem, "by")) {
+			// Keep going, as we want the rightmost
+			marked = elem
+		}
+	}
+
+	if marked == "" {
+		// None of our proxies added an element
+		return ""
+	}
+
+	ipAddr := parseForwardedListItem(marked, &strat.opts)
+	if ipAddr == nil {
+		return ""
+	}
+
+	return ipAddrString(*ipAddr, &strat.opts)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging. The markers are not included, as they should be kept secret.
+func (strat ForwardedByMarkerStrategy) String() string {
+	return fmt.Sprintf("ForwardedByMarkerStrategy{markers=%d}", len(strat.markers))
 }
 
 // RightmostNonPrivateStrategy derives the client IP from the rightmost valid,
@@ -206,11 +987,12 @@ func (strat LeftmostNonPrivateStrategy) ClientIP(headers http.Header, _ string)
 // server have private-space IP addresses.
 type RightmostNonPrivateStrategy struct {
 	headerName string
+	opts       options
 }
 
 // NewRightmostNonPrivateStrategy creates a RightmostNonPrivateStrategy. headerName must
-// be "X-Forwarded-For" or "Forwarded".
-func NewRightmostNonPrivateStrategy(headerName string) (RightmostNonPrivateStrategy, error) {
+// be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For".
+func NewRightmostNonPrivateStrategy(headerName string, opts ...Option) (RightmostNonPrivateStrategy, error) {
 	if headerName == "" {
 		return RightmostNonPrivateStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must not be empty")
 	}
@@ -219,24 +1001,35 @@ func NewRightmostNonPrivateStrategy(headerName string) (RightmostNonPrivateStrat
 	// by canonicalized header name. We'll do that here so we only have to do it once.
 	headerName = http.CanonicalHeaderKey(headerName)
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return RightmostNonPrivateStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+	if !isListHeader(headerName) {
+		return RightmostNonPrivateStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	o := newOptions(opts)
+	if err := validateListOptions("RightmostNonPrivateStrategy", &o); err != nil {
+		return RightmostNonPrivateStrategy{}, err
 	}
 
-	return RightmostNonPrivateStrategy{headerName: headerName}, nil
+	return RightmostNonPrivateStrategy{headerName: headerName, opts: o}, nil
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
 // The returned IP may contain a zone identifier.
 // If no valid IP can be derived, empty string will be returned.
-func (strat RightmostNonPrivateStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
+func (strat RightmostNonPrivateStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
 	// Look backwards through the list of IP addresses
 	for i := len(ipAddrs) - 1; i >= 0; i-- {
-		if ipAddrs[i] != nil && !isPrivateOrLocal(ipAddrs[i].IP) {
+		if ipAddrs[i] != nil && !isPrivateOrLocal(ipAddrs[i].IP, &strat.opts) {
 			// This is the rightmost non-private IP
-			return ipAddrs[i].String()
+			return ipAddrString(*ipAddrs[i], &strat.opts)
 		}
 	}
 
@@ -244,6 +1037,55 @@ func (strat RightmostNonPrivateStrategy) ClientIP(headers http.Header, _ string)
 	return ""
 }
 
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat RightmostNonPrivateStrategy) String() string {
+	return fmt.Sprintf("RightmostNonPrivateStrategy{header=%s}", strat.headerName)
+}
+
+// RightmostNonPrivateWithRemoteAddrStrategy is like RightmostNonPrivateStrategy, except
+// that RemoteAddr is treated as the rightmost element of the X-Forwarded-For or Forwarded
+// header. So if RemoteAddr is a valid, non-private IP, it is the client IP, and the
+// header is only used if the connection is from a private address (like a reverse
+// proxy). This suits servers that may be reached either directly or through reverse
+// proxies that all have private-space IP addresses.
+type RightmostNonPrivateWithRemoteAddrStrategy struct {
+	rightmost RightmostNonPrivateStrategy
+}
+
+// NewRightmostNonPrivateWithRemoteAddrStrategy creates a
+// RightmostNonPrivateWithRemoteAddrStrategy. headerName must be "X-Forwarded-For",
+// "Forwarded", or "X-Original-Forwarded-For".
+func NewRightmostNonPrivateWithRemoteAddrStrategy(headerName string, opts ...Option) (RightmostNonPrivateWithRemoteAddrStrategy, error) {
+	rightmost, err := NewRightmostNonPrivateStrategy(headerName, opts...)
+	if err != nil {
+		return RightmostNonPrivateWithRemoteAddrStrategy{}, fmt.Errorf("RightmostNonPrivateWithRemoteAddrStrategy: %w", err)
+	}
+
+	return RightmostNonPrivateWithRemoteAddrStrategy{rightmost: rightmost}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat RightmostNonPrivateWithRemoteAddrStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	opts := &strat.rightmost.opts
+	if ipAddr := remoteAddrIPAddr(remoteAddr, opts); ipAddr != nil && !isPrivateOrLocal(ipAddr.IP, opts) {
+		// The connection is from the client
+		return ipAddrString(*ipAddr, opts)
+	}
+
+	return strat.rightmost.ClientIP(headers, remoteAddr)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat RightmostNonPrivateWithRemoteAddrStrategy) String() string {
+	return fmt.Sprintf("RightmostNonPrivateWithRemoteAddrStrategy{header=%s}", strat.rightmost.headerName)
+}
+
 // RightmostTrustedCountStrategy derives the client IP from the valid IP address added by
 // the first trusted reverse proxy to the X-Forwarded-For or Forwarded header. This
 // Strategy should be used when there is a fixed number of trusted reverse proxies that
@@ -251,14 +1093,15 @@ func (strat RightmostNonPrivateStrategy) ClientIP(headers http.Header, _ string)
 type RightmostTrustedCountStrategy struct {
 	headerName   string
 	trustedCount int
+	opts         options
 }
 
 // NewRightmostTrustedCountStrategy creates a RightmostTrustedCountStrategy. headerName
-// must be "X-Forwarded-For" or "Forwarded". trustedCount is the  number of trusted
-// reverse proxies. The IP returned will be the (trustedCount-1)th from the right. For
-// example, if there's only one trusted proxy, this strategy will return the last
-// (rightmost) IP address.
-func NewRightmostTrustedCountStrategy(headerName string, trustedCount int) (RightmostTrustedCountStrategy, error) {
+// must be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For". trustedCount
+// is the  number of trusted reverse proxies. The IP returned will be the
+// (trustedCount-1)th from the right. For example, if there's only one trusted proxy, this
+// strategy will return the last (rightmost) IP address.
+func NewRightmostTrustedCountStrategy(headerName string, trustedCount int, opts ...Option) (RightmostTrustedCountStrategy, error) {
 	if headerName == "" {
 		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostTrustedCountStrategy header must not be empty")
 	}
@@ -271,19 +1114,45 @@ func NewRightmostTrustedCountStrategy(headerName string, trustedCount int) (Righ
 	// by canonicalized header name. We'll do that here so we only have to do it once.
 	headerName = http.CanonicalHeaderKey(headerName)
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+	if !isListHeader(headerName) {
+		return RightmostTrustedCountStrategy{}, fmt.Errorf("RightmostNonPrivateStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	o := newOptions(opts)
+	if err := validateListOptions("RightmostTrustedCountStrategy", &o); err != nil {
+		return RightmostTrustedCountStrategy{}, err
 	}
 
-	return RightmostTrustedCountStrategy{headerName: headerName, trustedCount: trustedCount}, nil
+	return RightmostTrustedCountStrategy{headerName: headerName, trustedCount: trustedCount, opts: o}, nil
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
 // The returned IP may contain a zone identifier.
 // If no valid IP can be derived, empty string will be returned.
-func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
+func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	ip, _ := strat.ClientIPErr(headers, remoteAddr)
+	return ip
+}
+
+// ClientIPErr is like ClientIP, except that it returns an error explaining why no IP
+// could be derived. The error wraps ErrChainTooShort if the header has fewer entries than
+// the trusted count (suggesting a missing hop), or ErrBadValueAtIndex if the entry at
+// the expected position is not a valid IP (suggesting a misbehaving or spoofed hop). Use
+// errors.Is to distinguish them.
+// If the headers are ignored because of WithIgnoreHeadersFromLoopback, the RemoteAddr IP
+// is returned, as by ClientIP.
+func (strat RightmostTrustedCountStrategy) ClientIPErr(headers http.Header, remoteAddr string) (string, error) {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		if ip == "" {
+			return "", fmt.Errorf("RemoteAddr %q is not an acceptable client address", remoteAddr)
+		}
+		return ip, nil
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
 
 	// We want the (N-1)th from the rightmost. For example, if there's only one
 	// trusted proxy, we want the last.
@@ -292,7 +1161,7 @@ func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, _ strin
 
 	if targetIndex < 0 {
 		// This is a misconfiguration error. There were fewer IPs than we expected.
-		return ""
+		return "", fmt.Errorf("%w: %s has %d entries, trusted count is %d", ErrChainTooShort, strat.headerName, len(ipAddrs), strat.trustedCount)
 	}
 
 	resultIP := ipAddrs[targetIndex]
@@ -300,15 +1169,100 @@ func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, _ strin
 	if resultIP == nil {
 		// This is a misconfiguration error. Our first trusted proxy didn't add a
 		// valid IP address to the header.
+		return "", fmt.Errorf("%w: %s entry at index %d", ErrBadValueAtIndex, strat.headerName, targetIndex)
+	}
+
+	if !isAcceptableResult(resultIP.IP, &strat.opts) {
+		return "", fmt.Errorf("%w: %s entry at index %d is not an acceptable client address", ErrBadValueAtIndex, strat.headerName, targetIndex)
+	}
+
+	return ipAddrString(*resultIP, &strat.opts), nil
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat RightmostTrustedCountStrategy) String() string {
+	return fmt.Sprintf("RightmostTrustedCountStrategy{header=%s, count=%d}", strat.headerName, strat.trustedCount)
+}
+
+// RightmostTrustedCountByHeaderStrategy is like RightmostTrustedCountStrategy, except
+// that the trusted count is chosen per request, by the value of a selector header. This
+// is useful when migrating between proxy topologies with different numbers of hops,
+// with requests routed through one or the other.
+// The selector header MUST be set (or overwritten) by a trusted reverse proxy, or else the
+// client can choose the count and so spoof its IP. If the selector header is absent or
+// has a value that isn't configured, no IP is returned.
+type RightmostTrustedCountByHeaderStrategy struct {
+	selectorHeader string
+	strategies     map[string]RightmostTrustedCountStrategy
+}
+
+// NewRightmostTrustedCountByHeaderStrategy creates a RightmostTrustedCountByHeaderStrategy.
+// headerName must be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For".
+// counts maps values of the selectorHeader request header to the trusted count to use for
+// them; each count must be greater than zero.
+func NewRightmostTrustedCountByHeaderStrategy(headerName, selectorHeader string, counts map[string]int, opts ...Option) (RightmostTrustedCountByHeaderStrategy, error) {
+	if selectorHeader == "" {
+		return RightmostTrustedCountByHeaderStrategy{}, fmt.Errorf("RightmostTrustedCountByHeaderStrategy selector header must not be empty")
+	}
+
+	if len(counts) == 0 {
+		return RightmostTrustedCountByHeaderStrategy{}, fmt.Errorf("RightmostTrustedCountByHeaderStrategy counts must not be empty")
+	}
+
+	// Build the strategies now, which also validates headerName and the counts
+	strategies := make(map[string]RightmostTrustedCountStrategy, len(counts))
+	for selector, count := range counts {
+		strat, err := NewRightmostTrustedCountStrategy(headerName, count, opts...)
+		if err != nil {
+			return RightmostTrustedCountByHeaderStrategy{}, fmt.Errorf("RightmostTrustedCountByHeaderStrategy count for %q: %w", selector, err)
+		}
+		strategies[selector] = strat
+	}
+
+	return RightmostTrustedCountByHeaderStrategy{
+		selectorHeader: http.CanonicalHeaderKey(selectorHeader),
+		strategies:     strategies,
+	}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat RightmostTrustedCountByHeaderStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	countStrat, ok := strat.strategies[lastHeader(headers, strat.selectorHeader)]
+	if !ok {
+		// Fail closed, rather than guessing at the topology
 		return ""
 	}
 
-	return resultIP.String()
+	return countStrat.ClientIP(headers, remoteAddr)
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat RightmostTrustedCountByHeaderStrategy) String() string {
+	var headerName string
+	counts := make(map[string]int, len(strat.strategies))
+	for selector, countStrat := range strat.strategies {
+		headerName = countStrat.headerName
+		counts[selector] = countStrat.trustedCount
+	}
+
+	// fmt prints maps with sorted keys, so this is deterministic
+	return fmt.Sprintf("RightmostTrustedCountByHeaderStrategy{header=%s, selector=%s, counts=%v}", headerName, strat.selectorHeader, counts)
 }
 
 // AddressesAndRangesToIPNets converts a slice of strings with IPv4 and IPv6 addresses and
 // CIDR ranges (prefixes) to net.IPNet instances.
-// If net.ParseCIDR or net.ParseIP fail, an error will be returned.
+// Ranges may also be given as inclusive start and end addresses separated by a dash, like
+// "1.1.1.1-1.1.1.255", as some providers publish them. These are converted to the minimal
+// set of CIDR ranges that cover them.
+// The result is in the same order as the input, with one element per input string (or,
+// for a dashed range, one or more). Use SortedIPNets if a canonical order is needed.
+// If an input string is empty or can't be parsed, an error wrapping ErrInvalidRange and
+// naming the offending input will be returned.
 // Zones in addresses or ranges are not allowed and will result in an error. This is because:
 // a) net.ParseCIDR will fail to parse a range with a zone, and
 // b) netip.ParsePrefix will succeed but silently throw away the zone; then
@@ -316,22 +1270,36 @@ func (strat RightmostTrustedCountStrategy) ClientIP(headers http.Header, _ strin
 func AddressesAndRangesToIPNets(ranges ...string) ([]net.IPNet, error) {
 	var result []net.IPNet
 	for _, r := range ranges {
+		if r == "" {
+			return nil, fmt.Errorf("%w: empty string", ErrInvalidRange)
+		}
+
 		if strings.Contains(r, "%") {
-			return nil, fmt.Errorf("zones are not allowed: %q", r)
+			if strings.Contains(r, "/") {
+				return nil, fmt.Errorf("%w: zones are not allowed in CIDR ranges: %q", ErrInvalidRange, r)
+			}
+			return nil, fmt.Errorf("%w: zones are not allowed in addresses: %q", ErrInvalidRange, r)
 		}
 
-		if strings.Contains(r, "/") {
+		if strings.Contains(r, "-") {
+			// This is a start-end range
+			ipNets, err := dashedRangeToIPNets(r)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, ipNets...)
+		} else if strings.Contains(r, "/") {
 			// This is a CIDR/prefix
 			_, ipNet, err := net.ParseCIDR(r)
 			if err != nil {
-				return nil, fmt.Errorf("net.ParseCIDR failed for %q: %w", r, err)
+				return nil, fmt.Errorf("%w: not a valid CIDR range: %q", ErrInvalidRange, r)
 			}
 			result = append(result, *ipNet)
 		} else {
 			// This is a single IP; convert it to a range including only itself
 			ip := net.ParseIP(r)
 			if ip == nil {
-				return nil, fmt.Errorf("net.ParseIP failed for %q", r)
+				return nil, fmt.Errorf("%w: not a valid IP address: %q", ErrInvalidRange, r)
 			}
 
 			// To use the right size IP and  mask, we need to know if the address is IPv4 or v6.
@@ -363,16 +1331,18 @@ func AddressesAndRangesToIPNets(ranges ...string) ([]net.IPNet, error) {
 // CF distribution that points at your origin server. The attacker uses Lambda@Edge to
 // spoof the Host and X-Forwarded-For headers. Now your "trusted" reverse proxy is no
 // longer trustworthy.
+// The trusted ranges can be replaced while the strategy is in use with SetRanges.
 type RightmostTrustedRangeStrategy struct {
 	headerName    string
-	trustedRanges []net.IPNet
+	trustedRanges *trustedRangesHolder
+	opts          options
 }
 
 // NewRightmostTrustedRangeStrategy creates a RightmostTrustedRangeStrategy. headerName
-// must be "X-Forwarded-For" or "Forwarded". trustedRanges must contain all trusted
-// reverse proxies on the path to this server. trustedRanges can be private/internal or
+// must be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For". trustedRanges
+// must contain all trusted reverse proxies on the path to this server. trustedRanges can be private/internal or
 // external (for example, if a third-party reverse proxy is used).
-func NewRightmostTrustedRangeStrategy(headerName string, trustedRanges []net.IPNet) (RightmostTrustedRangeStrategy, error) {
+func NewRightmostTrustedRangeStrategy(headerName string, trustedRanges []net.IPNet, opts ...Option) (RightmostTrustedRangeStrategy, error) {
 	if headerName == "" {
 		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy header must not be empty")
 	}
@@ -381,22 +1351,163 @@ func NewRightmostTrustedRangeStrategy(headerName string, trustedRanges []net.IPN
 	// by canonicalized header name. We'll do that here so we only have to do it once.
 	headerName = http.CanonicalHeaderKey(headerName)
 
-	if headerName != xForwardedForHdr && headerName != forwardedHdr {
-		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy header must be %s or %s", xForwardedForHdr, forwardedHdr)
+	if !isListHeader(headerName) {
+		return RightmostTrustedRangeStrategy{}, fmt.Errorf("RightmostTrustedRangeStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	o := newOptions(opts)
+	if err := validateListOptions("RightmostTrustedRangeStrategy", &o); err != nil {
+		return RightmostTrustedRangeStrategy{}, err
+	}
+
+	if err := validateTrustedRanges("RightmostTrustedRangeStrategy", trustedRanges, &o); err != nil {
+		return RightmostTrustedRangeStrategy{}, err
+	}
+
+	// Copy the ranges so that later modification by the caller can't race with ClientIP
+	trustedRanges = copyIPNets(trustedRanges)
+
+	return RightmostTrustedRangeStrategy{headerName: headerName, trustedRanges: newTrustedRangesHolder(trustedRanges), opts: o}, nil
+}
+
+// SetRanges replaces the trusted ranges of the strategy, for example when a provider's
+// published ranges change. It is safe to call concurrently with ClientIP and the other
+// methods; each call of those uses either the old or the new ranges, never a mix.
+// The strategy is a value type, but the ranges are shared by all copies of it, so the
+// change is seen everywhere the strategy has been passed (including in a ChainStrategy).
+// trustedRanges is validated as in NewRightmostTrustedRangeStrategy, and copied. If it
+// is invalid, an error is returned and the ranges are not changed.
+func (strat RightmostTrustedRangeStrategy) SetRanges(trustedRanges []net.IPNet) error {
+	if strat.trustedRanges == nil {
+		return fmt.Errorf("RightmostTrustedRangeStrategy must be created with NewRightmostTrustedRangeStrategy")
 	}
 
-	return RightmostTrustedRangeStrategy{headerName: headerName, trustedRanges: trustedRanges}, nil
+	if err := validateTrustedRanges("RightmostTrustedRangeStrategy", trustedRanges, &strat.opts); err != nil {
+		return err
+	}
+
+	strat.trustedRanges.store(copyIPNets(trustedRanges))
+	return nil
 }
 
 // ClientIP derives the client IP using this strategy.
 // headers is expected to be like http.Request.Header.
 // The returned IP may contain a zone identifier.
 // If no valid IP can be derived, empty string will be returned.
-func (strat RightmostTrustedRangeStrategy) ClientIP(headers http.Header, _ string) string {
-	ipAddrs := getIPAddrList(headers, strat.headerName)
+func (strat RightmostTrustedRangeStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
+	clientIndex := strat.clientIndex(ipAddrs, strat.trustedRanges.load())
+	if clientIndex < 0 {
+		return ""
+	}
+
+	return ipAddrString(*ipAddrs[clientIndex], &strat.opts)
+}
+
+// ClientAndProxy derives the client IP using this strategy, and also returns the IP of
+// the nearest trusted proxy -- that is, the entry immediately to the right of the client
+// in the header. This can be useful for correlating requests with load balancer logs.
+// headers is expected to be like http.Request.Header.
+// proxy is nil if the client was the rightmost entry in the header, or if the headers
+// were ignored because of WithIgnoreHeadersFromLoopback.
+// ok is false if no valid client IP can be derived, in which case client and proxy are
+// empty.
+func (strat RightmostTrustedRangeStrategy) ClientAndProxy(headers http.Header, remoteAddr string) (client net.IPAddr, proxy *net.IPAddr, ok bool) {
+	if remoteIPAddr := loopbackRemoteIPAddr(remoteAddr, &strat.opts); remoteIPAddr != nil {
+		// The headers are ignored, so RemoteAddr is the client and there is no proxy
+		if !isAcceptableResult(remoteIPAddr.IP, &strat.opts) {
+			return net.IPAddr{}, nil, false
+		}
+		return normalizedIPAddr(*remoteIPAddr, &strat.opts), nil, true
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
+	clientIndex := strat.clientIndex(ipAddrs, strat.trustedRanges.load())
+	if clientIndex < 0 || !isAcceptableResult(ipAddrs[clientIndex].IP, &strat.opts) {
+		return net.IPAddr{}, nil, false
+	}
+
+	if clientIndex < len(ipAddrs)-1 {
+		// Everything to the right of the client is valid and trusted
+		p := normalizedIPAddr(*ipAddrs[clientIndex+1], &strat.opts)
+		proxy = &p
+	}
+
+	return normalizedIPAddr(*ipAddrs[clientIndex], &strat.opts), proxy, true
+}
+
+// ClientIPWithMatchedRange is like ClientIP, but also returns the trusted range that
+// contained the nearest trusted proxy -- that is, the entry immediately to the right of
+// the client in the header. This can be useful for observing which of the trusted ranges
+// are in use.
+// matched is nil if the client was the rightmost entry in the header, if the headers were
+// ignored because of WithIgnoreHeadersFromLoopback, or if no valid client IP can be
+// derived. matched is a copy and may be modified by the caller.
+func (strat RightmostTrustedRangeStrategy) ClientIPWithMatchedRange(headers http.Header, remoteAddr string) (ip string, matched *net.IPNet) {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		// The headers are ignored, so no range was matched
+		return ip, nil
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
+	trustedRanges := strat.trustedRanges.load()
+	clientIndex := strat.clientIndex(ipAddrs, trustedRanges)
+	if clientIndex < 0 || !isAcceptableResult(ipAddrs[clientIndex].IP, &strat.opts) {
+		return "", nil
+	}
+
+	if clientIndex < len(ipAddrs)-1 {
+		// Everything to the right of the client is valid and trusted
+		matched = containingRange(ipAddrs[clientIndex+1].IP, trustedRanges)
+	}
+
+	return ipAddrString(*ipAddrs[clientIndex], &strat.opts), matched
+}
+
+// TrustedHopCount returns the number of trusted proxy entries that this strategy skips
+// over, from the right of the header, when deriving the client IP for the request -- that
+// is, the number of contiguous entries at the right of the header that are in the
+// trusted ranges. When a client IP is derived, a RightmostTrustedCountStrategy with a
+// trustedCount of TrustedHopCount+1 would derive the same IP, so this can be used to
+// check a count-based configuration against a range-based one before migrating.
+// headers is expected to be like http.Request.Header.
+func (strat RightmostTrustedRangeStrategy) TrustedHopCount(headers http.Header, remoteAddr string) int {
+	if _, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		// The headers aren't used
+		return 0
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
+	trustedRanges := strat.trustedRanges.load()
+
+	count := 0
+	for i := len(ipAddrs) - 1; i >= 0; i-- {
+		if ipAddrs[i] == nil || !isIPContainedInRanges(ipAddrs[i].IP, trustedRanges) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// clientIndex returns the index in ipAddrs of the rightmost IP not in trustedRanges, or
+// -1 if there is no valid such IP.
+func (strat RightmostTrustedRangeStrategy) clientIndex(ipAddrs []*net.IPAddr, trustedRanges []net.IPNet) int {
 	// Look backwards through the list of IP addresses
 	for i := len(ipAddrs) - 1; i >= 0; i-- {
-		if ipAddrs[i] != nil && isIPContainedInRanges(ipAddrs[i].IP, strat.trustedRanges) {
+		if ipAddrs[i] != nil && isIPContainedInRanges(ipAddrs[i].IP, trustedRanges) {
 			// This IP is trusted
 			continue
 		}
@@ -404,27 +1515,224 @@ func (strat RightmostTrustedRangeStrategy) ClientIP(headers http.Header, _ strin
 		// At this point we have found the first-from-the-rightmost untrusted IP
 
 		if ipAddrs[i] == nil {
+			return -1
+		}
+
+		if strat.opts.requireTrustedHop && i == len(ipAddrs)-1 {
+			// No proxy hop was verified, so the header may have come directly from the client
+			return -1
+		}
+
+		return i
+	}
+
+	// Either there are no addresses or they are all in our trusted ranges
+	return -1
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat RightmostTrustedRangeStrategy) String() string {
+	return fmt.Sprintf("RightmostTrustedRangeStrategy{header=%s, ranges=%d}", strat.headerName, len(strat.trustedRanges.load()))
+}
+
+// trustedRangesHolder holds a set of trusted ranges that can be replaced while in use.
+// A nil holder has no ranges.
+type trustedRangesHolder struct {
+	ranges atomic.Value // []net.IPNet
+}
+
+// newTrustedRangesHolder creates a trustedRangesHolder holding trustedRanges, which must
+// not be modified afterwards.
+func newTrustedRangesHolder(trustedRanges []net.IPNet) *trustedRangesHolder {
+	h := &trustedRangesHolder{}
+	h.store(trustedRanges)
+	return h
+}
+
+// load returns the current ranges. They must not be modified.
+func (h *trustedRangesHolder) load() []net.IPNet {
+	if h == nil {
+		return nil
+	}
+	trustedRanges, _ := h.ranges.Load().([]net.IPNet)
+	return trustedRanges
+}
+
+// store replaces the ranges with trustedRanges, which must not be modified afterwards.
+func (h *trustedRangesHolder) store(trustedRanges []net.IPNet) {
+	h.ranges.Store(trustedRanges)
+}
+
+// ContiguousTrustedRangeStrategy derives the client IP by walking outward from the
+// connection: it starts with RemoteAddr, then continues from the rightmost entry of the
+// X-Forwarded-For or Forwarded header to the left, for as long as the addresses are
+// within a set of trusted IP ranges. The first address that is not trusted is the client.
+// This differs from RightmostTrustedRangeStrategy in that RemoteAddr is the first hop:
+// if the connection doesn't come from a trusted proxy, the header is ignored entirely and
+// RemoteAddr is the client. This makes it suitable for servers that accept connections
+// both directly and through reverse proxies.
+// If an invalid entry is found within the trusted region, the chain is broken and no IP
+// is returned. The same caveats about third-party proxies as for
+// RightmostTrustedRangeStrategy apply.
+type ContiguousTrustedRangeStrategy struct {
+	headerName    string
+	trustedRanges []net.IPNet
+	opts          options
+}
+
+// NewContiguousTrustedRangeStrategy creates a ContiguousTrustedRangeStrategy. headerName
+// must be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For". trustedRanges
+// must contain all trusted reverse proxies on the path to this server.
+func NewContiguousTrustedRangeStrategy(headerName string, trustedRanges []net.IPNet, opts ...Option) (ContiguousTrustedRangeStrategy, error) {
+	if headerName == "" {
+		return ContiguousTrustedRangeStrategy{}, fmt.Errorf("ContiguousTrustedRangeStrategy header must not be empty")
+	}
+
+	// We will be using the headerName for lookups in the http.Header map, which is keyed
+	// by canonicalized header name. We'll do that here so we only have to do it once.
+	headerName = http.CanonicalHeaderKey(headerName)
+
+	if !isListHeader(headerName) {
+		return ContiguousTrustedRangeStrategy{}, fmt.Errorf("ContiguousTrustedRangeStrategy header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	o := newOptions(opts)
+	if err := validateListOptions("ContiguousTrustedRangeStrategy", &o); err != nil {
+		return ContiguousTrustedRangeStrategy{}, err
+	}
+
+	if err := validateTrustedRanges("ContiguousTrustedRangeStrategy", trustedRanges, &o); err != nil {
+		return ContiguousTrustedRangeStrategy{}, err
+	}
+
+	// Copy the ranges so that later modification by the caller can't race with ClientIP
+	trustedRanges = copyIPNets(trustedRanges)
+
+	return ContiguousTrustedRangeStrategy{headerName: headerName, trustedRanges: trustedRanges, opts: o}, nil
+}
+
+// ClientIP derives the client IP using this strategy.
+// headers is expected to be like http.Request.Header.
+// remoteAddr is expected to be like http.Request.RemoteAddr.
+// The returned IP may contain a zone identifier.
+// If no valid IP can be derived, empty string will be returned.
+func (strat ContiguousTrustedRangeStrategy) ClientIP(headers http.Header, remoteAddr string) string {
+	if ip, ok := loopbackRemoteAddrResult(remoteAddr, &strat.opts); ok {
+		return ip
+	}
+
+	remoteIPAddr := remoteAddrIPAddr(remoteAddr, &strat.opts)
+	if remoteIPAddr == nil {
+		// We can't tell whether the connection is from a trusted proxy
+		return ""
+	}
+
+	if !isIPContainedInRanges(remoteIPAddr.IP, strat.trustedRanges) {
+		// The connection isn't from a trusted proxy, so it's from the client
+		return ipAddrString(*remoteIPAddr, &strat.opts)
+	}
+
+	pooledIPAddrs := getPooledIPAddrList(headers, strat.headerName, &strat.opts)
+	defer putIPAddrList(pooledIPAddrs)
+	ipAddrs := *pooledIPAddrs
+
+	// Look backwards through the list of IP addresses
+	for i := len(ipAddrs) - 1; i >= 0; i-- {
+		if ipAddrs[i] == nil {
+			// The trusted region is broken by an invalid entry
 			return ""
 		}
 
-		return ipAddrs[i].String()
+		if !isIPContainedInRanges(ipAddrs[i].IP, strat.trustedRanges) {
+			// This is the first untrusted IP, outward from the connection
+			return ipAddrString(*ipAddrs[i], &strat.opts)
+		}
+	}
+
+	// Either there are no addresses or they are all in our trusted ranges
+	return ""
+}
+
+// String returns a human-readable description of the strategy and its parameters,
+// suitable for logging.
+func (strat ContiguousTrustedRangeStrategy) String() string {
+	return fmt.Sprintf("ContiguousTrustedRangeStrategy{header=%s, ranges=%d}", strat.headerName, len(strat.trustedRanges))
+}
+
+// validateTrustedRanges checks trustedRanges for a strategy named stratName, returning
+// an error suitable for returning from the strategy's constructor.
+func validateTrustedRanges(stratName string, trustedRanges []net.IPNet, opts *options) error {
+	// Checking a long list of ranges takes time on every request, so allow the user to
+	// guard against an accidentally huge (for example, unmerged) list
+	if opts.maxTrustedRanges > 0 && len(trustedRanges) > opts.maxTrustedRanges {
+		return fmt.Errorf("%s has %d trusted ranges, exceeding the maximum of %d", stratName, len(trustedRanges), opts.maxTrustedRanges)
+	}
+
+	// A malformed range (like a zero-value net.IPNet) will never contain anything, which
+	// is surely a mistake, so we check for them here rather than silently ignoring them.
+	for i, r := range trustedRanges {
+		if !isValidIPNet(r) {
+			return fmt.Errorf("%s trusted range at index %d is invalid: %q", stratName, i, r.String())
+		}
+
+		// A range like 0.0.0.0/0 trusts the whole internet, which makes the strategies
+		// useless. That is almost certainly a mistake, so it must be explicitly allowed.
+		if !opts.allowBroadRanges && isBroadPublicIPNet(r) {
+			return fmt.Errorf("%s trusted range at index %d includes a large part of the public internet: %q (use WithAllowBroadRanges if this is intended)", stratName, i, r.String())
+		}
+	}
+
+	return nil
+}
+
+// validateListOptions checks the options that affect the parsing of list headers.
+func validateListOptions(stratName string, opts *options) error {
+	if sep := opts.listSeparator; sep != 0 && !isValidListSeparator(sep) {
+		return fmt.Errorf("%s list separator %q is invalid; it must be punctuation or a symbol that can't appear in an IP address, port, or zone", stratName, sep)
+	}
+	return nil
+}
+
+// isValidListSeparator reports whether sep can be used to split a list header without
+// confusing the parsing of the IPs in it.
+func isValidListSeparator(sep rune) bool {
+	// Zones (like "eth0" or "en-1") can contain letters, digits, and other characters
+	// besides those of the address, so only punctuation and symbols are allowed, less what
+	// can appear in an address, port, zone, or quoted value. utf8.RuneError is a symbol,
+	// but IndexRune matches it to any invalid byte.
+	if sep == utf8.RuneError || !(unicode.IsPunct(sep) || unicode.IsSymbol(sep)) {
+		return false
+	}
+	return !strings.ContainsRune(`:.[]%-_"`, sep)
+}
+
+// isBroadPublicIPNet reports whether ipNet is shorter than a /8 (for IPv4 or IPv4-mapped
+// ranges) or a /16 (for IPv6), and is not wholly within the private and local ranges
+// (like fc00::/7 is).
+func isBroadPublicIPNet(ipNet net.IPNet) bool {
+	ones, isIPv4 := ipNetPrefixLen(ipNet)
+	if (isIPv4 && ones >= 8) || (!isIPv4 && ones >= 16) {
+		return false
 	}
 
-	// Either there are no addresses or they are all in our trusted ranges
-	return ""
+	for _, r := range privateAndLocalRanges {
+		rOnes, rIsIPv4 := ipNetPrefixLen(r)
+		if rIsIPv4 == isIPv4 && rOnes <= ones && r.Contains(ipNet.IP) {
+			return false
+		}
+	}
+	return true
 }
 
-func (strat RightmostTrustedRangeStrategy) String() string {
-	var b strings.Builder
-	b.WriteString(fmt.Sprintf("{headerName:%v trustedRanges:[", strat.headerName))
-	for i, r := range strat.trustedRanges {
-		if i > 0 {
-			b.WriteString(" ")
-		}
-		b.WriteString(r.String())
+// ipNetPrefixLen returns the prefix length of ipNet, and whether it is an IPv4 range. The
+// prefix length of an IPv4-mapped IPv6 range is given as though it were IPv4.
+func ipNetPrefixLen(ipNet net.IPNet) (ones int, isIPv4 bool) {
+	ones, bits := ipNet.Mask.Size()
+	if ipNet.IP.To4() != nil && ones >= bits-32 {
+		return ones - (bits - 32), true
 	}
-	b.WriteString("]")
-	return b.String()
+	return ones, false
 }
 
 // lastHeader returns the last header with the given name. It returns empty string if the
@@ -445,80 +1753,340 @@ func lastHeader(headers http.Header, headerName string) string {
 	return matches[len(matches)-1]
 }
 
+// ParseIPList parses all of the X-Forwarded-For or Forwarded header values in headers into
+// a single list of IPs, in order, exactly as the strategies do (see
+// Test_forwardedHeaderRFCDeviations for how this differs from the RFCs). Items that are
+// not valid IPs (or, for the Forwarded header, that have no valid "for=" IP) result in
+// nil elements, so that the indexes match the positions in the header; empty list items
+// are dropped. The header contents are not trustworthy.
+// An error is returned if headerName is not a list header (see IsListHeaderName).
+func ParseIPList(headers http.Header, headerName string) ([]*net.IPAddr, error) {
+	headerName = http.CanonicalHeaderKey(headerName)
+	if !isListHeader(headerName) {
+		return nil, fmt.Errorf("ParseIPList header must be %s, %s, or %s", xForwardedForHdr, forwardedHdr, xOriginalForwardedForHdr)
+	}
+
+	return getIPAddrList(headers, headerName, &options{}), nil
+}
+
 // getIPAddrList creates a single list of all of the X-Forwarded-For or Forwarded header
-// values, in order. Any invalid IPs will result in nil elements. headerName must already
-// be canonicalized.
-func getIPAddrList(headers http.Header, headerName string) []*net.IPAddr {
-	var result []*net.IPAddr
+// values, in order. Any invalid IPs will result in nil elements; empty list items are
+// dropped. headerName must already be canonicalized.
+func getIPAddrList(headers http.Header, headerName string, opts *options) []*net.IPAddr {
+	return appendIPAddrList(nil, headers, headerName, opts)
+}
+
+// appendIPAddrList is like getIPAddrList, but appends to dst.
+func appendIPAddrList(dst []*net.IPAddr, headers http.Header, headerName string, opts *options) []*net.IPAddr {
+	forEachIPAddr(headers, headerName, opts, func(_ int, ipAddr *net.IPAddr) bool {
+		// ipAddr is nil if not valid
+		dst = append(dst, ipAddr)
+		return true
+	})
+
+	// Possible performance improvements:
+	// Here we are parsing _all_ of the IPs in the XFF headers, but we don't need all of
+	// them. The leftmost strategies use forEachIPAddr directly and stop when they've come
+	// to the one they want, but the rightmost strategies would need to parse from the
+	// right, which would make them somewhat more complex.
+
+	return dst
+}
+
+// maxPooledIPAddrListCap is the largest capacity of slice that putIPAddrList will return
+// to the pool. We don't want a single pathologically long header to keep a huge slice
+// alive indefinitely.
+const maxPooledIPAddrListCap = 64
+
+// ipAddrListPool holds the slices used by getPooledIPAddrList, to reduce GC pressure
+// under load. It holds pointers to slices, as putting a plain slice in a sync.Pool
+// requires an allocation.
+var ipAddrListPool = sync.Pool{
+	New: func() interface{} {
+		return new([]*net.IPAddr)
+	},
+}
+
+// getPooledIPAddrList is like getIPAddrList, except that the returned slice is taken from
+// a pool. The caller must give it back with putIPAddrList when done with it, and must not
+// retain the slice (or let it escape) after that. The IPAddrs pointed to by the slice are
+// not pooled, so they may be retained.
+func getPooledIPAddrList(headers http.Header, headerName string, opts *options) *[]*net.IPAddr {
+	list := ipAddrListPool.Get().(*[]*net.IPAddr)
+	*list = appendIPAddrList((*list)[:0], headers, headerName, opts)
+	return list
+}
+
+// putIPAddrList returns a slice obtained from getPooledIPAddrList to the pool.
+func putIPAddrList(list *[]*net.IPAddr) {
+	if cap(*list) > maxPooledIPAddrListCap {
+		return
+	}
+
+	// Clear the elements so that the pool doesn't keep the parsed addresses alive
+	for i := range *list {
+		(*list)[i] = nil
+	}
+	*list = (*list)[:0]
 
+	ipAddrListPool.Put(list)
+}
+
+// ForEachForwardedFor calls fn with each of the X-Forwarded-For or Forwarded header list
+// items, in order, without collecting them into a slice. idx is the zero-based position of
+// the item in the combined list of all header instances. addr is nil if the item is not a
+// valid IP (or, for the Forwarded header, if it has no valid "for=" IP). Empty list items
+// are skipped and not given an index. Iteration stops when the list is exhausted or when
+// fn returns false.
+// headerName should be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For";
+// any other header is parsed like X-Forwarded-For.
+func ForEachForwardedFor(headers http.Header, headerName string, fn func(idx int, addr *net.IPAddr) bool) {
+	forEachIPAddr(headers, http.CanonicalHeaderKey(headerName), &options{}, fn)
+}
+
+// HopCount returns the number of valid IPs in the X-Forwarded-For or Forwarded header
+// list, across all instances of the header. Empty list items and items that aren't valid
+// IPs (or, for the Forwarded header, have no valid "for=" IP) are not counted, so
+// "1.1.1.1, garbage, 2.2.2.2" has a count of 2. This can be used as a measure of proxy
+// depth, but note that the header contents are not trustworthy.
+// headerName should be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For";
+// any other header is parsed like X-Forwarded-For.
+func HopCount(headers http.Header, headerName string) int {
+	count := 0
+	ForEachForwardedFor(headers, headerName, func(_ int, addr *net.IPAddr) bool {
+		if addr != nil {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// ValidateTrustChain walks the X-Forwarded-For or Forwarded header list from the right,
+// checking that each entry is in ranges, until it comes to the first entry that isn't --
+// the client. trustedCount is the number of contiguous trusted entries at the right of
+// the list. ok is true if the whole right side of the list up to the client is valid and
+// trusted, and the client IP is valid; clientIP is then the client IP, as
+// RightmostTrustedRangeStrategy would derive it. If an invalid entry is found before the
+// client, or if every entry is trusted, ok is false and clientIP is empty, but
+// trustedCount is still the number of trusted entries that were verified.
+// RemoteAddr is not considered; check it separately if required.
+// headerName should be "X-Forwarded-For", "Forwarded", or "X-Original-Forwarded-For";
+// any other header is parsed like X-Forwarded-For.
+func ValidateTrustChain(headers http.Header, headerName string, ranges []net.IPNet) (clientIP string, trustedCount int, ok bool) {
+	ipAddrs := getIPAddrList(headers, http.CanonicalHeaderKey(headerName), &options{})
+
+	for i := len(ipAddrs) - 1; i >= 0; i-- {
+		if ipAddrs[i] == nil {
+			// An invalid entry breaks the chain
+			return "", trustedCount, false
+		}
+
+		if !isIPContainedInRanges(ipAddrs[i].IP, ranges) {
+			// The first-from-the-rightmost untrusted IP is the client
+			return ipAddrString(*ipAddrs[i], &options{}), trustedCount, true
+		}
+
+		trustedCount++
+	}
+
+	// Everything was trusted, so there's no client IP
+	return "", trustedCount, false
+}
+
+// forEachIPAddr is the implementation of ForEachForwardedFor. headerName must already be
+// canonicalized. It returns false if iteration was stopped by fn.
+func forEachIPAddr(headers http.Header, headerName string, opts *options, fn func(idx int, addr *net.IPAddr) bool) bool {
 	// There may be multiple XFF headers present. We need to iterate through them all,
 	// in order, and collect all of the IPs.
-	// Note that we're not joining all of the headers into a single string and then
-	// splitting. Doing it that way would use more memory.
-	// Note that Go's Header map uses canonicalized keys.
-	for _, h := range headers[headerName] {
-		// We now have a string with comma-separated list items
-		for _, rawListItem := range strings.Split(h, ",") {
-			// The IPs are often comma-space separated, so we'll need to trim the string
-			rawListItem = strings.TrimSpace(rawListItem)
-
-			var ipAddr *net.IPAddr
-			// If this is the XFF header, rawListItem is just an IP;
-			// if it's the Forwarded header, then there's more parsing to do.
-			if headerName == forwardedHdr {
-				ipAddr = parseForwardedListItem(rawListItem)
-			} else { // == XFF
-				ipAddr = goodIPAddr(rawListItem)
+	scanner := listScanner{values: listHeaderValues(headers, headerName, opts)}
+	if headerName != forwardedHdr {
+		// The Forwarded header's syntax requires comma separators
+		scanner.sep = opts.listSeparator
+	}
+	var prevIPAddr *net.IPAddr
+	for idx := 0; ; {
+		rawListItem, ok := scanner.next()
+		if !ok {
+			return true
+		}
+
+		var ipAddr *net.IPAddr
+		// If this is the XFF header, rawListItem is just an IP;
+		// if it's the Forwarded header, then there's more parsing to do.
+		if headerName == forwardedHdr {
+			ipAddr = parseForwardedListItem(rawListItem, opts)
+		} else { // == XFF
+			ipAddr = headerIPAddr(rawListItem, opts)
+		}
+
+		if opts.dedupeConsecutive {
+			if ipAddr != nil && prevIPAddr != nil && ipAddr.IP.Equal(prevIPAddr.IP) && ipAddr.Zone == prevIPAddr.Zone {
+				// A repeat of the previous item isn't given an index
+				continue
 			}
+			prevIPAddr = ipAddr
+		}
 
-			// ipAddr is nil if not valid
-			result = append(result, ipAddr)
+		if !fn(idx, ipAddr) {
+			return false
 		}
+		idx++
 	}
+}
 
-	// Possible performance improvements:
-	// Here we are parsing _all_ of the IPs in the XFF headers, but we don't need all of
-	// them. Instead, we could start from the left or the right (depending on strategy),
-	// parse as we go, and stop when we've come to the one we want. But that would make
-	// the various strategies somewhat more complex.
+// listHeaderValues returns the values of the list header headerName that should be
+// parsed, honouring the relevant options.
+func listHeaderValues(headers http.Header, headerName string, opts *options) []string {
+	// Note that Go's Header map uses canonicalized keys
+	values := headers[headerName]
+	if opts.lastHeaderLineOnly && len(values) > 1 {
+		values = values[len(values)-1:]
+	}
+	if opts.maxHeaderValueLen > 0 {
+		values = withoutLongValues(values, opts.maxHeaderValueLen)
+	}
+	return values
+}
 
-	return result
+// withoutLongValues returns values without those that are longer than maxLen bytes.
+// values is returned as-is (without allocating) if none are too long.
+func withoutLongValues(values []string, maxLen int) []string {
+	for i, v := range values {
+		if len(v) <= maxLen {
+			continue
+		}
+
+		// Don't modify the original slice, which belongs to the headers
+		result := append(make([]string, 0, len(values)-1), values[:i]...)
+		for _, v := range values[i+1:] {
+			if len(v) <= maxLen {
+				result = append(result, v)
+			}
+		}
+		return result
+	}
+	return values
+}
+
+// listScanner walks through the items of a comma-separated list header, across all
+// instances of the header, without collecting them. The zero value has no items.
+// Note that we're not joining all of the headers into a single string and then
+// splitting. Doing it that way would use more memory. For the same reason, we walk
+// through each header value rather than using strings.Split.
+type listScanner struct {
+	// values are the header values that haven't been started yet
+	values []string
+	// cur is the unscanned remainder of the current header value
+	cur string
+	// inValue is true if cur has not been exhausted
+	inValue bool
+	// sep is the list item separator; zero means comma
+	sep rune
+}
+
+// next returns the next non-empty list item, trimmed of whitespace. ok is false when the
+// list is exhausted.
+func (s *listScanner) next() (item string, ok bool) {
+	for {
+		if !s.inValue {
+			if len(s.values) == 0 {
+				return "", false
+			}
+			s.cur, s.values, s.inValue = s.values[0], s.values[1:], true
+		}
+
+		item = s.cur
+		sep := s.sep
+		if sep == 0 {
+			sep = ','
+		}
+		if sepIndex := strings.IndexRune(s.cur, sep); sepIndex >= 0 {
+			// Skip the bytes that actually matched, which may not be the encoding of sep
+			// (IndexRune matches any invalid byte to utf8.RuneError)
+			_, sepLen := utf8.DecodeRuneInString(s.cur[sepIndex:])
+			item, s.cur = s.cur[:sepIndex], s.cur[sepIndex+sepLen:]
+		} else {
+			s.inValue = false
+		}
+
+		// The IPs are often comma-space separated, so we'll need to trim the string
+		item = trimOWS(item)
+
+		// RFC 7230 section 7 requires list recipients to ignore empty elements, as in
+		// "1.1.1.1, , 2.2.2.2" or a trailing comma. We drop them here, before they're
+		// given an index, so that the rightmost-count math matches human intuition.
+		if item != "" {
+			return item, true
+		}
+	}
 }
 
 // parseForwardedListItem parses a Forwarded header list item, and returns the "for" IP
 // address. Nil is returned if the "for" IP is absent or invalid.
-func parseForwardedListItem(fwd string) *net.IPAddr {
+func parseForwardedListItem(fwd string, opts *options) *net.IPAddr {
 	// The header list item can look like these kinds of thing:
 	//	For="[2001:db8:cafe::17%zone]:4711"
 	//	For="[2001:db8:cafe::17%zone]"
 	//	for=192.0.2.60;proto=http; by=203.0.113.43
 	//	for=192.0.2.43
 
+	// Find the "for=" part, since that has the IP we want (maybe)
+	forPart := forwardedParam(fwd, "for")
+
+	if forPart == "" {
+		// We failed to find a "for=" part
+		return nil
+	}
+
+	if opts.rejectBracketedIPv4 && isBracketedIPv4(forPart) {
+		// The RFC only allows brackets around IPv6 addresses
+		return nil
+	}
+
+	ipAddr := headerIPAddr(forPart, opts)
+	if ipAddr == nil {
+		// The IP extracted from the "for=" part isn't valid
+		return nil
+	}
+
+	return ipAddr
+}
+
+// forwardedParam returns the value of the parameter called name (like "for" or "host")
+// in the Forwarded header list item fwd, with any quotes removed. Empty string is returned
+// if the parameter is absent.
+func forwardedParam(fwd, name string) string {
 	// First split up "for=", "by=", "host=", etc.
 	fwdParts := strings.Split(fwd, ";")
 
-	// Find the "for=" part, since that has the IP we want (maybe)
-	var forPart string
+	var value string
 	for _, fp := range fwdParts {
 		// Whitespace is allowed around the semicolons
-		fp = strings.TrimSpace(fp)
-
-		fpSplit := strings.Split(fp, "=")
-		if len(fpSplit) != 2 {
-			// There are too many or too few equal signs in this part
+		fp = trimOWS(fp)
+
+		// Only the first equal sign separates the name from the value. Any others are part
+		// of the value, which makes it invalid for "for" (like "for==1.1.1.1" or
+		// "for=1.1.1.1=extra"); we don't go on to look for another parameter with the
+		// same name.
+		eq := strings.IndexByte(fp, '=')
+		if eq < 0 {
+			// There is no equal sign in this part
 			continue
 		}
 
-		if strings.EqualFold(fpSplit[0], "for") {
-			// We found the "for=" part
-			forPart = fpSplit[1]
+		// Parameter names are case-insensitive (RFC 7239 section 4), so "FOR", "By", etc.,
+		// are all valid.
+		if strings.EqualFold(fp[:eq], name) {
+			// We found the part we're looking for
+			value = fp[eq+1:]
 			break
 		}
 	}
 
-	// There shouldn't (per RFC 7239) be spaces around the semicolon or equal sign. It might
-	// be more correct to consider spaces an error, but we'll tolerate and trim them.
-	forPart = strings.TrimSpace(forPart)
+	// Per RFC 7239, there must not be whitespace around the equal sign. We don't trim it
+	// here, so a parameter with whitespace before the equal sign won't be found, and a
+	// value with whitespace after the equal sign will fail to parse.
 
 	// Get rid of any quotes, such as surrounding IPv6 addresses.
 	// Note that doing this without checking if the quotes are present means that we are
@@ -526,26 +2094,87 @@ func parseForwardedListItem(fwd string) *net.IPAddr {
 	// requires quotes. https://www.rfc-editor.org/rfc/rfc7239#section-4
 	// This behaviour is debatable.
 	// It also means that we will accept IPv4 addresses with quotes, which is correct.
-	forPart = trimMatchedEnds(forPart, `"`)
+	return trimMatchedEnds(value, `"`)
+}
 
-	if forPart == "" {
-		// We failed to find a "for=" part
-		return nil
+// trimOWS trims the optional whitespace (spaces and horizontal tabs) that RFC 7230
+// section 3.2.3 allows around list and parameter separators.
+func trimOWS(s string) string {
+	return strings.Trim(s, " \t")
+}
+
+// isBracketedIPv4 returns true if s starts with a square-bracketed host (optionally
+// followed by a port) that isn't an IPv6 address, like "[1.1.1.1]" or "[1.1.1.1]:4711".
+func isBracketedIPv4(s string) bool {
+	if len(s) == 0 || s[0] != '[' {
+		return false
 	}
 
-	ipAddr := goodIPAddr(forPart)
-	if ipAddr == nil {
-		// The IP extracted from the "for=" part isn't valid
-		return nil
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return false
 	}
 
-	return ipAddr
+	// Every IPv6 address contains a colon, and no IPv4 address does
+	return !strings.Contains(s[1:end], ":")
 }
 
 // ParseIPAddr parses the given string into a net.IPAddr, which is a useful type for
 // dealing with IPs have zones. The Go stdlib net package is lacking such a function.
 // This will also discard any port number from the input.
 func ParseIPAddr(ipStr string) (net.IPAddr, error) {
+	ipAddr, _, err := parseIPAddr(ipStr)
+	return ipAddr, err
+}
+
+// FormatIPAddr returns the string form of ipAddr exactly as the strategies' ClientIP
+// methods produce it (with default options): IPv4 and IPv4-mapped IPv6 addresses are in
+// dotted-decimal form, other IPv6 addresses are in RFC 5952 form, and any zone follows a
+// "%". Empty string is returned if ipAddr has no valid IP.
+func FormatIPAddr(ipAddr net.IPAddr) string {
+	if len(ipAddr.IP) != net.IPv4len && len(ipAddr.IP) != net.IPv6len {
+		return ""
+	}
+	return ipAddrString(ipAddr, &options{})
+}
+
+// ParseIPAddrDetailed is like ParseIPAddr, but also reports whether the input was an
+// IPv4-mapped IPv6 address, like "::ffff:1.2.3.4". The returned IP is the same as
+// ParseIPAddr would return, so the mapped flag is the only way to tell the forms apart.
+func ParseIPAddrDetailed(ipStr string) (ipAddr net.IPAddr, ipv4Mapped bool, err error) {
+	ipAddr, host, err := parseIPAddr(ipStr)
+	if err != nil {
+		return net.IPAddr{}, false, err
+	}
+
+	// Every IPv6 address contains a colon, and no IPv4 address does
+	ipv4Mapped = ipAddr.IP.To4() != nil && strings.Contains(host, ":")
+
+	return ipAddr, ipv4Mapped, nil
+}
+
+// ParseIPAddrWithPort is like ParseIPAddr, but also returns the port number from the
+// input, rather than discarding it. portValid is false if there is no port, or if the port
+// is malformed (like "[fe80::abcd%eth0]:xyz" or "1.1.1.1:99999"), in which case port is
+// zero. A malformed port is not an error, just as with ParseIPAddr.
+func ParseIPAddrWithPort(ipStr string) (ipAddr net.IPAddr, port int, portValid bool, err error) {
+	ipAddr, err = ParseIPAddr(ipStr)
+	if err != nil {
+		return net.IPAddr{}, 0, false, err
+	}
+
+	if _, portStr, err := net.SplitHostPort(ipStr); err == nil {
+		if p, err := strconv.ParseUint(portStr, 10, 16); err == nil {
+			return ipAddr, int(p), true, nil
+		}
+	}
+
+	return ipAddr, 0, false, nil
+}
+
+// parseIPAddr is the implementation of ParseIPAddr. It also returns the host part of
+// ipStr that was parsed as the IP, with any port, brackets, and zone removed.
+func parseIPAddr(ipStr string) (net.IPAddr, string, error) {
 	host, _, err := net.SplitHostPort(ipStr)
 	if err == nil {
 		ipStr = host
@@ -560,16 +2189,23 @@ func ParseIPAddr(ipStr string) (net.IPAddr, error) {
 
 	ipStr, zone := SplitHostZone(ipStr)
 
+	if strings.Contains(zone, ":") {
+		// Zones can't contain colons, so this is probably an unbracketed IPv6 address with
+		// a port, like "fe80::1%eth0:4711". We can't reliably separate the port from the
+		// address, so it's invalid.
+		return net.IPAddr{}, "", fmt.Errorf("zone contains a colon")
+	}
+
 	res := net.IPAddr{
 		IP:   net.ParseIP(ipStr),
 		Zone: zone,
 	}
 
 	if res.IP == nil {
-		return net.IPAddr{}, fmt.Errorf("net.ParseIP failed")
+		return net.IPAddr{}, "", fmt.Errorf("net.ParseIP failed")
 	}
 
-	return res, nil
+	return res, ipStr, nil
 }
 
 // MustParseIPAddr panics if ParseIPAddr fails.
@@ -581,6 +2217,176 @@ func MustParseIPAddr(ipStr string) net.IPAddr {
 	return ipAddr
 }
 
+// remoteAddrIPAddr parses remoteAddr, which is expected to be like
+// http.Request.RemoteAddr, like goodIPAddr does, honouring the relevant options.
+func remoteAddrIPAddr(remoteAddr string, opts *options) *net.IPAddr {
+	if opts.commaJoinedRemoteAddr {
+		// Use the last element, which should be the nearest hop
+		if i := strings.LastIndexByte(remoteAddr, ','); i >= 0 {
+			remoteAddr = trimOWS(remoteAddr[i+1:])
+		}
+	}
+
+	return optionsIPAddr(remoteAddr, opts)
+}
+
+// loopbackRemoteAddrResult returns the result for remoteAddr, and true, if opts says to
+// ignore headers and remoteAddr is a loopback address. Otherwise ok is false, and the
+// headers should be used.
+func loopbackRemoteAddrResult(remoteAddr string, opts *options) (ip string, ok bool) {
+	remoteIPAddr := loopbackRemoteIPAddr(remoteAddr, opts)
+	if remoteIPAddr == nil {
+		return "", false
+	}
+
+	return ipAddrString(*remoteIPAddr, opts), true
+}
+
+// loopbackRemoteIPAddr is like loopbackRemoteAddrResult, but returns the parsed RemoteAddr
+// IP, or nil if the headers should be used. The IP has not been checked with
+// isAcceptableResult or normalized.
+func loopbackRemoteIPAddr(remoteAddr string, opts *options) *net.IPAddr {
+	if !opts.ignoreHeadersFromLoopback {
+		return nil
+	}
+
+	remoteIPAddr := remoteAddrIPAddr(remoteAddr, opts)
+	if remoteIPAddr == nil || !remoteIPAddr.IP.IsLoopback() {
+		return nil
+	}
+
+	return remoteIPAddr
+}
+
+// fastRemoteAddrIPv4 is an allocation-free path for the common case of remoteAddr being
+// a plain IPv4 address with a port, like "1.2.3.4:4711". If remoteAddr is like that and
+// no options affect the result, the IPv4 address is returned (as a substring of
+// remoteAddr) with ok true. Otherwise ok is false, and the caller must use the general
+// path; that includes non-canonical and unspecified addresses, so that the result is
+// always exactly what the general path would produce.
+func fastRemoteAddrIPv4(remoteAddr string, opts *options) (ip string, ok bool) {
+	if opts.commaJoinedRemoteAddr || opts.requireGlobalUnicast || opts.requirePublicClient || opts.stats != nil {
+		return "", false
+	}
+
+	host := remoteAddr
+	if i := strings.LastIndexByte(remoteAddr, ':'); i >= 0 {
+		host = remoteAddr[:i]
+	}
+
+	// Check for four dot-separated decimal octets, without leading zeros
+	var octets, octetLen, octetVal int
+	allZero := true
+	for i := 0; i <= len(host); i++ {
+		if i == len(host) || host[i] == '.' {
+			if octetLen == 0 || octetVal > 255 {
+				return "", false
+			}
+			if octetVal != 0 {
+				allZero = false
+			}
+			octets++
+			octetLen, octetVal = 0, 0
+			continue
+		}
+
+		c := host[i]
+		if c < '0' || c > '9' || (octetLen > 0 && octetVal == 0) || octetLen == 3 {
+			return "", false
+		}
+		octetVal = octetVal*10 + int(c-'0')
+		octetLen++
+	}
+
+	if octets != 4 || allZero {
+		return "", false
+	}
+
+	return host, true
+}
+
+// normalizedIPAddr returns ipAddr with any normalization in opts applied.
+func normalizedIPAddr(ipAddr net.IPAddr, opts *options) net.IPAddr {
+	if ipAddr.Zone == "" {
+		return ipAddr
+	}
+
+	if opts.stripZone {
+		ipAddr.Zone = ""
+	} else if normalizeZone := opts.normalizeZone(); normalizeZone != nil {
+		ipAddr.Zone = normalizeZone(ipAddr.Zone)
+	}
+	return ipAddr
+}
+
+// ipAddrString returns the string form of ipAddr that the strategies return, with any
+// normalization in opts applied. It returns empty string if ipAddr is not acceptable as a
+// result under opts.
+func ipAddrString(ipAddr net.IPAddr, opts *options) string {
+	if !isAcceptableResult(ipAddr.IP, opts) {
+		return ""
+	}
+
+	if opts.stats != nil {
+		opts.stats.record(ipAddr.IP)
+	}
+
+	ipAddr = normalizedIPAddr(ipAddr, opts)
+	return ipAddr.String()
+}
+
+// isAcceptableResult reports whether ip may be returned as the client IP under opts.
+// This applies to the final result, rather than to every entry in a header, so that the
+// options don't affect the recognition of trusted proxies.
+func isAcceptableResult(ip net.IP, opts *options) bool {
+	if opts.requireGlobalUnicast && !isGlobalUnicast(ip) {
+		return false
+	}
+
+	if opts.requirePublicClient && isPrivateOrLocal(ip, opts) {
+		return false
+	}
+
+	return true
+}
+
+// headerIPAddr parses an IP from a request header like goodIPAddr does, honouring the
+// relevant options.
+func headerIPAddr(ipStr string, opts *options) *net.IPAddr {
+	if opts.rejectMappedIPv6 {
+		if _, ipv4Mapped, err := ParseIPAddrDetailed(ipStr); err != nil || ipv4Mapped {
+			return nil
+		}
+	}
+
+	return optionsIPAddr(ipStr, opts)
+}
+
+// optionsIPAddr is like goodIPAddr, except that it accepts unspecified addresses if opts
+// allows them, and if opts has stats enabled, plain IPv4 addresses are returned in their
+// 4-byte form so that they can be distinguished from IPv4-mapped IPv6 addresses.
+func optionsIPAddr(ipStr string, opts *options) *net.IPAddr {
+	if !opts.allowUnspecified && opts.stats == nil {
+		return goodIPAddr(ipStr)
+	}
+
+	ipAddr, host, err := parseIPAddr(ipStr)
+	if err != nil {
+		return nil
+	}
+
+	if !opts.allowUnspecified && ipAddr.IP.IsUnspecified() {
+		return nil
+	}
+
+	// Every IPv6 address contains a colon, and no IPv4 address does
+	if ip4 := ipAddr.IP.To4(); opts.stats != nil && ip4 != nil && !strings.Contains(host, ":") {
+		ipAddr.IP = ip4
+	}
+
+	return &ipAddr
+}
+
 // goodIPAddr wraps ParseIPAddr and adds a check for unspecified (like "::") and zero-value
 // addresses (like "0.0.0.0"). These are nominally valid IPs (net.ParseIP will accept them),
 // but they are undesirable for the purposes of this library.
@@ -591,6 +2397,8 @@ func goodIPAddr(ipStr string) *net.IPAddr {
 		return nil
 	}
 
+	// The zone has already been split off, so this also catches unspecified addresses
+	// with a zone appended, like "::%eth0"
 	if ipAddr.IP.IsUnspecified() {
 		return nil
 	}
@@ -623,6 +2431,8 @@ func mustParseCIDR(s string) net.IPNet {
 }
 
 // privateAndLocalRanges net.IPNets that are loopback, private, link local, default unicast.
+// Carrier-grade NAT space (100.64.0.0/10) is included, as addresses in it are never
+// routable on the internet.
 // Based on https://github.com/wader/filtertransport/blob/bdd9e61eee7804e94ceb927c896b59920345c6e4/filter.go#L36-L64
 // which is based on https://github.com/letsencrypt/boulder/blob/master/bdns/dns.go
 var privateAndLocalRanges = []net.IPNet{
@@ -641,7 +2451,7 @@ var privateAndLocalRanges = []net.IPNet{
 	mustParseCIDR("224.0.0.0/4"),        // RFC 3171
 	mustParseCIDR("240.0.0.0/4"),        // RFC 1112
 	mustParseCIDR("255.255.255.255/32"), // RFC 919 Section 7
-	mustParseCIDR("100.64.0.0/10"),      // RFC 6598
+	mustParseCIDR("100.64.0.0/10"),      // RFC 6598: carrier-grade NAT
 	mustParseCIDR("::/128"),             // RFC 4291: Unspecified Address
 	mustParseCIDR("::1/128"),            // RFC 4291: Loopback Address
 	mustParseCIDR("100::/64"),           // RFC 6666: Discard Address Block
@@ -655,6 +2465,37 @@ var privateAndLocalRanges = []net.IPNet{
 	mustParseCIDR("2002::/16"),          // RFC 7526: 6to4 anycast prefix deprecated
 }
 
+// isValidIPNet returns true if ipNet has an IPv4 or IPv6 address and a canonical mask of
+// the matching size, as produced by net.ParseCIDR.
+func isValidIPNet(ipNet net.IPNet) bool {
+	_, bits := ipNet.Mask.Size()
+	switch {
+	case bits == 8*net.IPv4len:
+		return ipNet.IP.To4() != nil
+	case bits == 8*net.IPv6len:
+		return len(ipNet.IP) == net.IPv6len
+	}
+
+	// The mask is missing, non-canonical, or of an unknown size
+	return false
+}
+
+// copyIPNets returns a deep copy of ipNets, including the underlying IP and mask bytes.
+func copyIPNets(ipNets []net.IPNet) []net.IPNet {
+	if ipNets == nil {
+		return nil
+	}
+
+	result := make([]net.IPNet, len(ipNets))
+	for i, n := range ipNets {
+		result[i] = net.IPNet{
+			IP:   append(net.IP(nil), n.IP...),
+			Mask: append(net.IPMask(nil), n.Mask...),
+		}
+	}
+	return result
+}
+
 // isIPContainedInRanges returns true if the given IP is contained in at least one of the given ranges
 func isIPContainedInRanges(ip net.IP, ranges []net.IPNet) bool {
 	for _, r := range ranges {
@@ -665,12 +2506,116 @@ func isIPContainedInRanges(ip net.IP, ranges []net.IPNet) bool {
 	return false
 }
 
+// IPInRanges reports whether ip is contained in any of ranges, using the same logic as
+// RightmostTrustedRangeStrategy. IPv4-mapped IPv6 addresses (like "::ffff:1.2.3.4") are
+// treated as IPv4, so they are contained in IPv4 ranges, and vice versa.
+func IPInRanges(ip net.IP, ranges []net.IPNet) bool {
+	return isIPContainedInRanges(ip, ranges)
+}
+
+// containingRange returns a copy of the first of ranges that contains ip, or nil if none
+// do.
+func containingRange(ip net.IP, ranges []net.IPNet) *net.IPNet {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return &copyIPNets([]net.IPNet{r})[0]
+		}
+	}
+	return nil
+}
+
+// isLeftmostCandidate returns true if ip may be chosen by the leftmost-non-private scans:
+// it must not be private or local, and must pass any WithRoutableCheck function.
+func isLeftmostCandidate(ip net.IP, opts *options) bool {
+	if isPrivateOrLocal(ip, opts) {
+		return false
+	}
+	routableCheck := opts.routableCheck()
+	return routableCheck == nil || routableCheck(ip)
+}
+
 // isPrivateOrLocal return true if the given IP address is private, local, or otherwise
 // not suitable for an external client IP.
-func isPrivateOrLocal(ip net.IP) bool {
+// IPv4-mapped IPv6 addresses (like ::ffff:10.0.0.1) are classified by the IPv4 address
+// they contain, as net.IPNet.Contains unmaps them.
+func isPrivateOrLocal(ip net.IP, opts *options) bool {
+	if opts.requireGlobalUnicast && !isGlobalUnicast(ip) {
+		// Treating the IP as private means that the non-private strategies skip it
+		return true
+	}
+
+	if opts.decodeTunneledIPv6 {
+		if embedded := tunneledIPv4(ip); embedded != nil {
+			return isIPContainedInRanges(embedded, privateAndLocalRanges)
+		}
+	}
+
 	return isIPContainedInRanges(ip, privateAndLocalRanges)
 }
 
+// nonGlobalUnicastRanges are the ranges that net.IP.IsGlobalUnicast accepts but which
+// are reserved for documentation or benchmarking, and so are never legitimately routed.
+var nonGlobalUnicastRanges = []net.IPNet{
+	mustParseCIDR("192.0.2.0/24"),    // RFC 5737: TEST-NET-1
+	mustParseCIDR("198.51.100.0/24"), // RFC 5737: TEST-NET-2
+	mustParseCIDR("203.0.113.0/24"),  // RFC 5737: TEST-NET-3
+	mustParseCIDR("198.18.0.0/15"),   // RFC 2544: Benchmarking
+	mustParseCIDR("2001:db8::/32"),   // RFC 3849: Documentation
+	mustParseCIDR("2001:2::/48"),     // RFC 5180: Benchmarking
+}
+
+// isGlobalUnicast reports whether ip is a global unicast address, per
+// net.IP.IsGlobalUnicast, and not in a documentation or benchmarking range. Note that
+// private addresses are considered global unicast.
+func isGlobalUnicast(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !isIPContainedInRanges(ip, nonGlobalUnicastRanges)
+}
+
+// tunneledIPv4 returns the IPv4 address embedded in a 6to4 (RFC 3056) or Teredo
+// (RFC 4380) IPv6 address, or nil if ip is neither.
+func tunneledIPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return nil
+	}
+
+	switch {
+	case ip[0] == 0x20 && ip[1] == 0x02:
+		// 6to4 is 2002:VVWW:XXYY::/48, wrapping VV.WW.XX.YY
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5])
+	case ip[0] == 0x20 && ip[1] == 0x01 && ip[2] == 0 && ip[3] == 0:
+		// Teredo is 2001:0000::/32, with the client's IPv4 address obfuscated (by
+		// flipping all of the bits) in the last 32 bits
+		return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15])
+	}
+
+	return nil
+}
+
+// TrimMatchedEnds trims the enclosing quotes or brackets from s, using the same logic
+// that is used for Forwarded header values. If ends is a single character (like `"`),
+// then s is trimmed if it begins and ends with that character. If ends is two characters
+// (like "[]"), s is trimmed if it begins with the first and ends with the second.
+// If s has neither end, it is returned unchanged. An error is returned if ends is not
+// one or two characters long, or if s has only one of the ends (like `"1.1.1.1`), as
+// that indicates a malformed value.
+// Nested ends must be trimmed from the outside in, like a quoted, bracketed IPv6
+// address: TrimMatchedEnds(s, `"`), then TrimMatchedEnds(s, "[]").
+func TrimMatchedEnds(s string, ends string) (string, error) {
+	if len(ends) != 1 && len(ends) != 2 {
+		return "", fmt.Errorf("TrimMatchedEnds ends must be length 1 or 2; got %q", ends)
+	}
+
+	first, last := ends[0], ends[len(ends)-1]
+	hasFirst := len(s) > 0 && s[0] == first
+	hasLast := len(s) > 0 && s[len(s)-1] == last
+
+	if hasFirst != hasLast || (hasFirst && len(s) < 2) {
+		return "", fmt.Errorf("TrimMatchedEnds found unmatched %q in %q", ends, s)
+	}
+
+	return trimMatchedEnds(s, ends), nil
+}
+
 // trimMatchedEnds trims s if and only if the first and last bytes in s are in chars.
 // If chars is a single character (like `"`), then the first and last bytes must match
 // that single character. If chars is two characters (like `[]`), the first byte in s
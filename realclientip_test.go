@@ -3,11 +3,16 @@
 package realclientip
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/realclientip/realclientip-go/ranges"
 )
@@ -60,6 +65,166 @@ func ipAddrsEqual(a, b net.IPAddr) bool {
 	return a.IP.Equal(b.IP) && a.Zone == b.Zone
 }
 
+func TestExactProxyStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = ExactProxyStrategy{}
+
+	inner := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+	proxyIPs := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 10.0.0.2"}}
+
+	tests := []struct {
+		name       string
+		inner      Strategy
+		proxyIPs   []net.IP
+		remoteAddr string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "Matching IPv4 proxy",
+			inner:      inner,
+			proxyIPs:   proxyIPs,
+			remoteAddr: "10.0.0.1:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Matching IPv6 proxy",
+			inner:      inner,
+			proxyIPs:   proxyIPs,
+			remoteAddr: "[2001:db8::1]:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Matching IPv4-mapped proxy",
+			inner:      inner,
+			proxyIPs:   []net.IP{net.IPv4(10, 0, 0, 1).To4()},
+			remoteAddr: "[::ffff:10.0.0.1]:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Non-matching proxy in same range",
+			inner:      inner,
+			proxyIPs:   proxyIPs,
+			remoteAddr: "10.0.0.3:4711",
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "Non-matching public RemoteAddr",
+			inner:      inner,
+			proxyIPs:   proxyIPs,
+			remoteAddr: "[2607:f8b0:4004:83f::200e]:4711",
+			want:       "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:       "Fail: bad RemoteAddr",
+			inner:      inner,
+			proxyIPs:   proxyIPs,
+			remoteAddr: "@",
+			want:       "",
+		},
+		{
+			name:     "Error: nil inner",
+			proxyIPs: proxyIPs,
+			wantErr:  true,
+		},
+		{
+			name:    "Error: no proxy IPs",
+			inner:   inner,
+			wantErr: true,
+		},
+		{
+			name:     "Error: invalid proxy IP",
+			inner:    inner,
+			proxyIPs: []net.IP{net.ParseIP("nope")},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewExactProxyStrategy(tt.inner, tt.proxyIPs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewExactProxyStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got := strat.ClientIP(headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatedStrategy(t *testing.T) {
+	// The strategy interface must not be implemented, as it can't evaluate the gate
+	if _, ok := interface{}(GatedStrategy{}).(Strategy); ok {
+		t.Fatalf("GatedStrategy must not implement Strategy")
+	}
+
+	inner := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+	verifiedTLS := func(r *http.Request) bool {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+
+	strat, err := NewGatedStrategy(inner, verifiedTLS)
+	if err != nil {
+		t.Fatalf("NewGatedStrategy error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		tls        *tls.ConnectionState
+		remoteAddr string
+		want       string
+	}{
+		{
+			name:       "Verified client certificate",
+			tls:        &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}},
+			remoteAddr: "10.0.0.1:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Unverified TLS",
+			tls:        &tls.ConnectionState{},
+			remoteAddr: "10.0.0.1:4711",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "No TLS",
+			remoteAddr: "[2001:db8::1]:4711",
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "Fail: untrusted with bad RemoteAddr",
+			remoteAddr: "@",
+			want:       "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "https://example.com", nil)
+			r.Header.Set("X-Forwarded-For", "1.1.1.1, 10.0.0.2")
+			r.RemoteAddr = tt.remoteAddr
+			r.TLS = tt.tls
+
+			if got := strat.ClientIPFromRequest(r); got != tt.want {
+				t.Fatalf("ClientIPFromRequest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewGatedStrategy(nil, verifiedTLS); err == nil {
+		t.Fatalf("NewGatedStrategy with nil inner should have returned an error")
+	}
+	if _, err := NewGatedStrategy(inner, nil); err == nil {
+		t.Fatalf("NewGatedStrategy with nil gate should have returned an error")
+	}
+}
+
 func TestRemoteAddrStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
 	var _ Strategy = RemoteAddrStrategy{}
@@ -218,6 +383,118 @@ func TestRemoteAddrStrategy(t *testing.T) {
 	}
 }
 
+func Test_fastRemoteAddrIPv4(t *testing.T) {
+	// The fast path must either decline or agree exactly with the general path
+	remoteAddrs := []string{
+		"1.2.3.4:4711", "1.2.3.4", "1.2.3.4:", "255.255.255.255:80", "0.0.0.1:80",
+		"0.0.0.0:80", "01.2.3.4:80", "1.2.3.04:80", "256.2.3.4:80", "1.2.3:80", "1.2.3.4.5:80",
+		"1..3.4:80", ".1.2.3:80", "1.2.3.4.:80", "1.2.3.4:80:90", "1.2.3.1000:80", "[1.2.3.4]:80",
+		"1.2.3.4%eth0:80", "::1", "[::ffff:1.2.3.4]:80", "@", "", " 1.2.3.4:80", "1.2.3.4 :80",
+	}
+
+	var slowStrat RemoteAddrStrategy
+	for _, remoteAddr := range remoteAddrs {
+		got, ok := fastRemoteAddrIPv4(remoteAddr, &options{})
+		if !ok {
+			continue
+		}
+
+		var want string
+		if ipAddr := remoteAddrIPAddr(remoteAddr, &slowStrat.opts); ipAddr != nil {
+			want = ipAddrString(*ipAddr, &slowStrat.opts)
+		}
+		if got != want {
+			t.Fatalf("fastRemoteAddrIPv4(%q) = %q, but general path gives %q", remoteAddr, got, want)
+		}
+	}
+
+	// Options that affect the result disable the fast path
+	if _, ok := fastRemoteAddrIPv4("1.2.3.4:80", &options{requirePublicClient: true}); ok {
+		t.Fatalf("fastRemoteAddrIPv4 used with requirePublicClient")
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		_ = RemoteAddrStrategy{}.ClientIP(nil, "1.2.3.4:4711")
+	})
+	if allocs != 0 {
+		t.Fatalf("RemoteAddrStrategy.ClientIP allocated %v times for IPv4, want 0", allocs)
+	}
+}
+
+func BenchmarkRemoteAddrStrategy(b *testing.B) {
+	strat := RemoteAddrStrategy{}
+	for _, remoteAddr := range []string{"1.2.3.4:4711", "[2607:f8b0:4004:83f::200e]:4711"} {
+		b.Run(remoteAddr, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = strat.ClientIP(nil, remoteAddr)
+			}
+		})
+	}
+}
+
+func TestNewRemoteAddrStrategyWithDefault(t *testing.T) {
+	tests := []struct {
+		name       string
+		defaultIP  string
+		remoteAddr string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "Empty RemoteAddr",
+			defaultIP:  "0.0.0.0",
+			remoteAddr: "",
+			want:       "0.0.0.0",
+		},
+		{
+			name:       "Unix socket RemoteAddr",
+			defaultIP:  "::",
+			remoteAddr: "@",
+			want:       "::",
+		},
+		{
+			name:       "Valid RemoteAddr",
+			defaultIP:  "0.0.0.0",
+			remoteAddr: "1.1.1.1:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Default is normalized",
+			defaultIP:  "[::ffff:127.0.0.1]:80",
+			remoteAddr: "@",
+			want:       "127.0.0.1",
+		},
+		{
+			name:      "Error: invalid default",
+			defaultIP: "unknown",
+			wantErr:   true,
+		},
+		{
+			name:      "Error: empty default",
+			defaultIP: "",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewRemoteAddrStrategyWithDefault(tt.defaultIP)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRemoteAddrStrategyWithDefault() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got := strat.ClientIP(nil, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSingleIPHeaderStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
 	var _ Strategy = SingleIPHeaderStrategy{}
@@ -677,12 +954,13 @@ func TestLeftmostNonPrivateStrategy(t *testing.T) {
 	}
 }
 
-func TestRightmostNonPrivateStrategy(t *testing.T) {
+func TestLeftmostNonPrivateWithinStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
-	var _ Strategy = RightmostNonPrivateStrategy{}
+	var _ Strategy = LeftmostNonPrivateWithinStrategy{}
 
 	type args struct {
 		headerName string
+		maxDepth   int
 		headers    http.Header
 		remoteAddr string
 	}
@@ -693,222 +971,198 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "IPv4 with port",
+			name: "Non-private IP within depth",
 			args: args{
 				headerName: "X-Forwarded-For",
+				maxDepth:   2,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
+					"X-Forwarded-For": []string{`192.168.1.1, 2.2.2.2, 10.0.0.1, 4.4.4.4`},
 				},
 			},
-			want: "4.4.4.4",
+			want: "2.2.2.2",
 		},
 		{
-			name: "IPv4 with no port",
+			name: "Fail: non-private IP beyond depth",
 			args: args{
-				headerName: "Forwarded",
+				headerName: "X-Forwarded-For",
+				maxDepth:   2,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`For=5.5.5.5`, `For=6.6.6.6`},
+					"X-Forwarded-For": []string{`192.168.1.1, 10.0.0.1, 172.16.1.1, 4.4.4.4`},
 				},
 			},
-			want: "6.6.6.6",
+			want: "",
 		},
 		{
-			name: "IPv6 with port",
+			name: "Depth spans multiple headers",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "Forwarded",
+				maxDepth:   3,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::18]:3838`},
+					"Forwarded": []string{`For=192.168.1.1, For=nope`, `For="[2607:f8b0:4004:83f::200e]:4747", For=4.4.4.4`},
 				},
 			},
-			want: "2607:f8b0:4004:83f::18",
+			want: "2607:f8b0:4004:83f::200e",
 		},
 		{
-			name: "IPv6 with no port",
+			name: "Fail: header missing",
 			args: args{
-				headerName: "Forwarded",
+				headerName: "X-Forwarded-For",
+				maxDepth:   2,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `Host=blah;For="2607:f8b0:4004:83f::18";Proto=https`},
+					"X-Real-Ip": []string{`1.1.1.1`},
 				},
 			},
-			want: "2607:f8b0:4004:83f::18",
+			want: "",
 		},
 		{
-			name: "IPv6 with port and zone",
+			name: "Error: empty header name",
 			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For="[fe80::1111%zone]:9943";Proto=https`},
-				},
+				headerName: "",
+				maxDepth:   2,
 			},
-			want: "2607:f8b0:4004:83f::18%eth0",
+			wantErr: true,
 		},
 		{
-			name: "IPv6 with port and zone, no quotes",
+			name: "Error: invalid header",
 			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For=[fe80::1111%zone]:9943;Proto=https`},
-				},
+				headerName: "X-Real-IP",
+				maxDepth:   2,
 			},
-			want: "2607:f8b0:4004:83f::18%eth0",
+			wantErr: true,
 		},
 		{
-			name: "IPv4-mapped IPv6",
+			name: "Error: zero maxDepth",
 			args: args{
-				headerName: "x-forwarded-for",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, ::ffff:188.0.2.128`},
-					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
-				},
+				headerName: "X-Forwarded-For",
+				maxDepth:   0,
 			},
-			want: "188.0.2.128",
+			wantErr: true,
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewLeftmostNonPrivateWithinStrategy(tt.args.headerName, tt.args.maxDepth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLeftmostNonPrivateWithinStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeftmostNonPrivateTrustedStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = LeftmostNonPrivateTrustedStrategy{}
+
+	trustedRanges, _ := AddressesAndRangesToIPNets("3.3.3.0/24", "10.0.0.0/8", "2001:db8::/32")
+
+	type args struct {
+		headerName    string
+		trustedRanges []net.IPNet
+		headers       http.Header
+		remoteAddr    string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
 		{
-			name: "IPv4-mapped IPv6 with port",
+			name: "Trusted middle hops",
 			args: args{
-				headerName: "x-forwarded-for",
+				headerName:    "X-Forwarded-For",
+				trustedRanges: trustedRanges,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4,[::ffff:188.0.2.128]:48483`},
-					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`192.168.1.1, 1.1.1.1, 3.3.3.3, 10.0.0.1`},
 				},
 			},
-			want: "188.0.2.128",
+			want: "1.1.1.1",
 		},
 		{
-			name: "IPv4-mapped IPv6 in IPv6 (hex) form",
+			name: "Trusted middle hops across multiple headers",
 			args: args{
-				headerName: "forwarded",
+				headerName:    "Forwarded",
+				trustedRanges: trustedRanges,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="::ffff:bc15:0006"`},
+					"Forwarded": []string{`For="[2607:f8b0:4004:83f::200e]:4747", For="[2001:db8::1]"`, `For=3.3.3.3`},
 				},
 			},
-			want: "188.21.0.6",
+			want: "2607:f8b0:4004:83f::200e",
 		},
 		{
-			name: "NAT64 IPv4-mapped IPv6",
+			name: "Fail: untrusted middle hop",
 			args: args{
-				headerName: "x-forwarded-for",
+				headerName:    "X-Forwarded-For",
+				trustedRanges: trustedRanges,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, 64:ff9b::188.0.2.128`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2, 3.3.3.3`},
 				},
 			},
-			want: "64:ff9b::bc00:280",
+			want: "",
 		},
 		{
-			name: "XFF: rightmost not desirable",
+			name: "Fail: invalid middle hop",
 			args: args{
-				headerName: "x-forwarded-for",
+				headerName:    "X-Forwarded-For",
+				trustedRanges: trustedRanges,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+					"X-Forwarded-For": []string{`1.1.1.1, nope, 3.3.3.3`},
 				},
 			},
-			want: "5.5.5.5",
+			want: "",
 		},
 		{
-			name: "Forwarded: rightmost not desirable",
+			name: "Fail: no non-private IP",
 			args: args{
-				headerName: "Forwarded",
+				headerName:    "X-Forwarded-For",
+				trustedRanges: trustedRanges,
 				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
-					"Forwarded":       []string{`host=what;for=:48485;proto=https,For=2.2.2.2`, `For="", For="::ffff:192.168.1.1"`},
+					"X-Forwarded-For": []string{`192.168.1.1, 10.0.0.1`},
 				},
 			},
-			want: "2.2.2.2",
+			want: "",
 		},
 		{
-			name: "Fail: XFF: none acceptable",
+			name: "Error: empty header name",
 			args: args{
-				headerName: "X-Forwarded-For",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, !?!, ::, 0.0.0.0`},
-					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="fe80::abcd%zone"`},
-				},
-			},
-			want: "",
-		},
-		{
-			name: "Fail: Forwarded: none acceptable",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, 2.2.2.2`},
-					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone", For="::", For=0.0.0.0`},
-				},
-			},
-			want: "",
-		},
-		{
-			name: "Fail: XFF: no header",
-			args: args{
-				headerName: "Forwarded",
-				headers: http.Header{
-					"X-Real-Ip": []string{`1.1.1.1`},
-					"Forwarded": []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone"`},
-				},
-				remoteAddr: "9.9.9.9",
-			},
-			want: "",
-		},
-		{
-			name: "Fail: Forwarded: no header",
-			args: args{
-				headerName: "forwarded",
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`64:ff9b::188.0.2.128, 3.3.3.3`, `4.4.4.4`},
-				},
+				headerName:    "",
+				trustedRanges: trustedRanges,
 			},
-			want: "",
+			wantErr: true,
 		},
 		{
-			name: "Error: empty header name",
+			name: "Error: invalid header",
 			args: args{
-				headerName: "",
-				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
+				headerName:    "X-Real-IP",
+				trustedRanges: trustedRanges,
 			},
 			wantErr: true,
 		},
 		{
-			name: "Error: invalid header",
+			name: "Error: invalid range",
 			args: args{
-				headerName: "X-Real-IP",
-				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
+				headerName:    "X-Forwarded-For",
+				trustedRanges: []net.IPNet{{}},
 			},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat, err := NewRightmostNonPrivateStrategy(tt.args.headerName)
+			strat, err := NewLeftmostNonPrivateTrustedStrategy(tt.args.headerName, tt.args.trustedRanges)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewRightmostNonPrivateStrategy error = %v, wantErr %v", err, tt.wantErr)
+				t.Fatalf("NewLeftmostNonPrivateTrustedStrategy error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 
@@ -925,157 +1179,86 @@ func TestRightmostNonPrivateStrategy(t *testing.T) {
 	}
 }
 
-func TestRightmostTrustedCountStrategy(t *testing.T) {
+func TestForwardedLeftmostTrustedStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
-	var _ Strategy = RightmostTrustedCountStrategy{}
+	var _ Strategy = ForwardedLeftmostTrustedStrategy{}
+
+	trustedRanges, _ := AddressesAndRangesToIPNets("3.3.3.0/24", "10.0.0.0/8", "2001:db8::/32")
 
-	type args struct {
-		headerName   string
-		trustedCount int
-		headers      http.Header
-		remoteAddr   string
-	}
 	tests := []struct {
-		name    string
-		args    args
-		want    string
-		wantErr bool
+		name          string
+		trustedRanges []net.IPNet
+		headers       http.Header
+		want          string
+		wantErr       bool
 	}{
-		// TODO: Is it okay not to test every IP type, since the logic is sufficiently similar to RightmostNonPrivateStrategy?
-
 		{
-			name: "Count one",
-			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 1,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name:          "Trusted for and by hops",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=192.168.1.1, for=1.1.1.1;by=3.3.3.1;proto=https, For="[2001:db8::1]";By=10.0.0.1, for=3.3.3.3;by="[2001:db8::2]:443";host=example.com`},
 			},
-			want: "6.6.6.6",
+			want: "1.1.1.1",
 		},
 		{
-			name: "Count five",
-			args: args{
-				headerName:   "X-Forwarded-For",
-				trustedCount: 5,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name:          "Obfuscated by is not checked",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=_edge`, `for=3.3.3.3;by=unknown`},
 			},
-			want: "8.8.8.8",
+			want: "1.1.1.1",
 		},
 		{
-			name: "Fail: header too short/count too large",
-			args: args{
-				headerName:   "X-Forwarded-For",
-				trustedCount: 50,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name:          "Fail: untrusted for hop",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=3.3.3.1, for=2.2.2.2;by=3.3.3.2, for=3.3.3.3`},
 			},
 			want: "",
 		},
 		{
-			name: "Fail: bad value at count index",
-			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 2,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=nope`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name:          "Fail: untrusted by on client element",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=2.2.2.2, for=3.3.3.3;by=10.0.0.1`},
 			},
 			want: "",
 		},
 		{
-			name: "Fail: zero value at count index",
-			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 2,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=0.0.0.0`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name:          "Fail: untrusted by on later hop",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=3.3.3.1, for=3.3.3.3;by=2.2.2.2`},
 			},
 			want: "",
 		},
 		{
-			name: "Fail: header missing",
-			args: args{
-				headerName:   "Forwarded",
-				trustedCount: 1,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
-				},
+			name:          "Fail: hop without for",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1, by=3.3.3.1, for=3.3.3.3`},
 			},
 			want: "",
 		},
 		{
-			name: "Error: empty header name",
-			args: args{
-				headerName:   "",
-				trustedCount: 1,
-				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
-			},
-			wantErr: true,
-		},
-		{
-			name: "Error: invalid header",
-			args: args{
-				headerName:   "X-Real-IP",
-				trustedCount: 1,
-				headers: http.Header{
-					"X-Real-Ip":       []string{"::1"},
-					"True-Client-Ip":  []string{"2.2.2.2"},
-					"X-Forwarded-For": []string{"3.3.3.3"}},
-			},
-			wantErr: true,
-		},
-		{
-			name: "Error: zero trustedCount",
-			args: args{
-				headerName:   "x-forwarded-for",
-				trustedCount: 0,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`, `fe80::382b:141b:fa4a:2a16%28`},
-					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
-				},
+			name:          "Fail: no non-private IP",
+			trustedRanges: trustedRanges,
+			headers: http.Header{
+				"Forwarded": []string{`for=192.168.1.1;by=10.0.0.1, for=10.0.0.2`},
 			},
-			wantErr: true,
+			want: "",
 		},
 		{
-			name: "Error: negative trustedCount",
-			args: args{
-				headerName:   "X-Forwarded-For",
-				trustedCount: -999,
-				headers: http.Header{
-					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
-				},
-			},
-			wantErr: true,
+			name:          "Error: invalid range",
+			trustedRanges: []net.IPNet{{}},
+			wantErr:       true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat, err := NewRightmostTrustedCountStrategy(tt.args.headerName, tt.args.trustedCount)
+			strat, err := NewForwardedLeftmostTrustedStrategy(tt.trustedRanges)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewRightmostTrustedCountStrategy error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("NewForwardedLeftmostTrustedStrategy error = %v, wantErr %v", err, tt.wantErr)
 			}
 
 			if err != nil {
@@ -1083,95 +1266,87 @@ func TestRightmostTrustedCountStrategy(t *testing.T) {
 				return
 			}
 
-			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
-			if !reflect.DeepEqual(got, tt.want) {
+			if got := strat.ClientIP(tt.headers, ""); got != tt.want {
 				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestAddressesAndRangesToIPNets(t *testing.T) {
+func TestForwardedByMarkerStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = ForwardedByMarkerStrategy{}
+
 	tests := []struct {
 		name    string
-		ranges  []string
-		want    []string
+		markers []string
+		headers http.Header
+		want    string
 		wantErr bool
 	}{
 		{
-			name:   "Empty input",
-			ranges: []string{},
-			want:   nil,
-		},
-		{
-			name:   "Single IPv4 address",
-			ranges: []string{"1.1.1.1"},
-			want:   []string{"1.1.1.1/32"},
-		},
-		{
-			name:   "Single IPv6 address",
-			ranges: []string{"2607:f8b0:4004:83f::200e"},
-			want:   []string{"2607:f8b0:4004:83f::200e/128"},
-		},
-		{
-			name:   "Single IPv4 range",
-			ranges: []string{"1.1.1.1/16"},
-			want:   []string{"1.1.0.0/16"},
+			name:    "Marked element",
+			markers: []string{"edge1"},
+			headers: http.Header{
+				"Forwarded": []string{`for=2.2.2.2;by=edge1, for=1.1.1.1;by=edge1;proto=https, for=3.3.3.3;by=10.0.0.1`},
+			},
+			want: "1.1.1.1",
 		},
 		{
-			name:   "Single IPv6 range",
-			ranges: []string{"2607:f8b0:4004:83f::200e/48"},
-			want:   []string{"2607:f8b0:4004::/48"},
+			name:    "Injected element without marker",
+			markers: []string{"edge1"},
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=edge1`, `for=6.6.6.6`, `for=7.7.7.7;by=edge2`},
+			},
+			want: "1.1.1.1",
 		},
 		{
-			name: "Mixed input",
-			ranges: []string{
-				"1.1.1.1", "2607:f8b0:4004:83f::200e",
-				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
-				"1.1.1.1/16", "2607:f8b0:4004:83f::200e/56",
-				"::ffff:188.0.2.128/112", "::ffff:bc15:0006/104",
-				"64:ff9b::188.0.2.128/112",
-			},
-			want: []string{
-				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
-				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
-				"1.1.0.0/16", "2607:f8b0:4004:800::/56",
-				"188.0.0.0/16", "188.0.0.0/8",
-				"64:ff9b::bc00:0/112",
+			name:    "Quoted marker and IPv6",
+			markers: []string{"_edge", "edge1"},
+			headers: http.Header{
+				"Forwarded": []string{`For="[2607:f8b0:4004:83f::200e]:4711";By="_edge"`},
 			},
+			want: "2607:f8b0:4004:83f::200e",
 		},
 		{
-			name:   "No input",
-			ranges: nil,
-			want:   nil,
+			name:    "Fail: marker is case-sensitive",
+			markers: []string{"edge1"},
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=EDGE1`},
+			},
+			want: "",
 		},
 		{
-			name:    "Error: garbage CIDR",
-			ranges:  []string{"2607:f8b0:4004:83f::200e/nope"},
-			wantErr: true,
+			name:    "Fail: no marked element",
+			markers: []string{"edge1"},
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=10.0.0.1, for=2.2.2.2`},
+			},
+			want: "",
 		},
 		{
-			name:    "Error: CIDR with zone",
-			ranges:  []string{"fe80::abcd%nope/64"},
-			wantErr: true,
+			name:    "Fail: marked element has invalid for",
+			markers: []string{"edge1"},
+			headers: http.Header{
+				"Forwarded": []string{`for=1.1.1.1;by=edge1, for=unknown;by=edge1`},
+			},
+			want: "",
 		},
 		{
-			name:    "Error: garbage IP",
-			ranges:  []string{"1.1.1.nope"},
+			name:    "Error: no markers",
 			wantErr: true,
 		},
 		{
-			name:    "Error: empty value",
-			ranges:  []string{""},
+			name:    "Error: empty marker",
+			markers: []string{"edge1", ""},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := AddressesAndRangesToIPNets(tt.ranges...)
+			strat, err := NewForwardedByMarkerStrategy(tt.markers)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("AddressesAndRangesToIPNets() error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("NewForwardedByMarkerStrategy error = %v, wantErr %v", err, tt.wantErr)
 			}
 
 			if err != nil {
@@ -1179,28 +1354,21 @@ func TestAddressesAndRangesToIPNets(t *testing.T) {
 				return
 			}
 
-			if len(got) != len(tt.want) {
-				t.Fatalf("len mismatch: %d != %d", len(got), len(tt.want))
-			}
-
-			for i := 0; i < len(got); i++ {
-				if got[i].String() != tt.want[i] {
-					t.Fatalf("got does not equal want; %d: %q != %q", i, got[i].String(), tt.want[i])
-				}
+			if got := strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestRightmostTrustedRangeStrategy(t *testing.T) {
+func TestRightmostNonPrivateStrategy(t *testing.T) {
 	// Ensure the strategy interface is implemented
-	var _ Strategy = RightmostTrustedRangeStrategy{}
+	var _ Strategy = RightmostNonPrivateStrategy{}
 
 	type args struct {
-		headerName    string
-		headers       http.Header
-		remoteAddr    string
-		trustedRanges []string
+		headerName string
+		headers    http.Header
+		remoteAddr string
 	}
 	tests := []struct {
 		name    string
@@ -1209,244 +1377,229 @@ func TestRightmostTrustedRangeStrategy(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "No ranges",
+			name: "IPv4 with port",
 			args: args{
 				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
 				},
-				trustedRanges: nil,
 			},
 			want: "4.4.4.4",
 		},
 		{
-			name: "One range",
+			name: "IPv4 with no port",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`For=5.5.5.5`, `For=6.6.6.6`},
 				},
-				trustedRanges: []string{`4.4.4.0/24`},
 			},
-			want: "3.3.3.3",
+			want: "6.6.6.6",
 		},
 		{
-			name: "One IP",
+			name: "IPv6 with port",
 			args: args{
 				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`[2607:f8b0:4004:83f::18]:3838`},
 				},
-				trustedRanges: []string{`4.4.4.4`},
 			},
-			want: "3.3.3.3",
+			want: "2607:f8b0:4004:83f::18",
 		},
 		{
-			name: "Many kinds of ranges",
+			name: "IPv6 with no port",
 			args: args{
 				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
 					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
-					"Forwarded": []string{
-						`For=99.99.99.99, For=4.4.4.8, For="[2607:f8b0:4004:83f::200e]:4747"`,
-						`For=2.2.2.2:8883, For=64:ff9b::188.0.2.200, For=3.3.5.5, For=2001:db7::abcd`,
-					},
-				},
-				trustedRanges: []string{
-					`2.2.2.2/32`, `2607:f8b0:4004:83f::200e/128`,
-					`3.3.0.0/16`, `2001:db7::/64`,
-					`::ffff:4.4.4.4/124`, `64:ff9b::188.0.2.128/112`,
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `Host=blah;For="2607:f8b0:4004:83f::18";Proto=https`},
 				},
 			},
-			want: "99.99.99.99",
+			want: "2607:f8b0:4004:83f::18",
 		},
 		{
-			name: "Cloudflare ranges",
+			name: "IPv6 with port and zone",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`, `2400:cb00::1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For="[fe80::1111%zone]:9943";Proto=https`},
 				},
-				trustedRanges: ranges.Cloudflare,
 			},
-			want: "4.4.4.4",
+			want: "2607:f8b0:4004:83f::18%eth0",
 		},
 		{
-			name: "Fail: no non-trusted IP",
+			name: "IPv6 with port and zone, no quotes",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="[2607:f8b0:4004:83f::18%eth0]:3393";Proto=https`, `Host=blah;For=[fe80::1111%zone]:9943;Proto=https`},
 				},
-				trustedRanges: []string{`2.2.2.0/24`},
 			},
-			want: "",
+			want: "2607:f8b0:4004:83f::18%eth0",
 		},
 		{
-			name: "Fail: rightmost non-trusted IP invalid",
+			name: "IPv4-mapped IPv6",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`nope, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, ::ffff:188.0.2.128`},
+					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: []string{`2.2.2.0/24`},
 			},
-			want: "",
+			want: "188.0.2.128",
 		},
 		{
-			name: "Fail: rightmost non-trusted IP unspecified",
+			name: "IPv4-mapped IPv6 with port",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`::, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4,[::ffff:188.0.2.128]:48483`},
+					"Forwarded":       []string{`Host=blah;For="7.7.7.7";Proto=https`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: []string{`2.2.2.0/24`},
 			},
-			want: "",
+			want: "188.0.2.128",
 		},
 		{
-			name: "Fail: no values in header",
+			name: "IPv4-mapped IPv6 in IPv6 (hex) form",
 			args: args{
-				headerName: "X-Forwarded-For",
+				headerName: "forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{}},
-				trustedRanges: []string{`2.2.2.0/24`},
+					"X-Forwarded-For": []string{`[::ffff:188.0.2.128]:48483, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded":       []string{`host=what;for=6.6.6.6;proto=https`, `For="::ffff:bc15:0006"`},
+				},
 			},
-			want: "",
+			want: "188.21.0.6",
 		},
 		{
-			name: "Error: empty header nanme",
+			name: "NAT64 IPv4-mapped IPv6",
 			args: args{
-				headerName: "",
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`3.3.3.3`, `4.4.4.4, 64:ff9b::188.0.2.128`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: nil,
 			},
-			wantErr: true,
+			want: "64:ff9b::bc00:280",
 		},
 		{
-			name: "Error: bad header nanme",
+			name: "XFF: rightmost not desirable",
 			args: args{
-				headerName: "Not-XFF-Or-Forwarded",
+				headerName: "x-forwarded-for",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
 				},
-				trustedRanges: nil,
 			},
-			wantErr: true,
+			want: "5.5.5.5",
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ranges, err := AddressesAndRangesToIPNets(tt.args.trustedRanges...)
-			if err != nil {
-				// We're not testing AddressesAndRangesToIPNets here
-				t.Fatalf("AddressesAndRangesToIPNets failed")
-			}
-
-			strat, err := NewRightmostTrustedRangeStrategy(tt.args.headerName, ranges)
-			if (err != nil) != tt.wantErr {
-				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-
-			if err != nil {
-				// We can't continue
-				return
-			}
-
-			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
-			}
-		})
-	}
-}
-
-func TestChainStrategy(t *testing.T) {
-	type args struct {
-		strategies []Strategy
-		headers    http.Header
-		remoteAddr string
-	}
-	tests := []struct {
-		name string
-		args args
-		want string
-	}{
 		{
-			name: "Single strategy",
+			name: "Forwarded: rightmost not desirable",
 			args: args{
-				strategies: []Strategy{RemoteAddrStrategy{}},
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`::1, nope`, `4.4.4.4, 5.5.5.5`},
+					"Forwarded":       []string{`host=what;for=:48485;proto=https,For=2.2.2.2`, `For="", For="::ffff:192.168.1.1"`},
 				},
-				remoteAddr: `5.5.5.5`,
 			},
-			want: "5.5.5.5",
+			want: "2.2.2.2",
 		},
 		{
-			name: "Multiple strategies",
+			name: "Fail: XFF: none acceptable",
 			args: args{
-				strategies: []Strategy{
-					Must(NewRightmostNonPrivateStrategy("Forwarded")),
-					Must(NewSingleIPHeaderStrategy("true-client-ip")),
-					Must(NewSingleIPHeaderStrategy("x-real-ip")),
-					RemoteAddrStrategy{},
-				},
+				headerName: "X-Forwarded-For",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, !?!, ::, 0.0.0.0`},
+					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="fe80::abcd%zone"`},
 				},
-				remoteAddr: `5.5.5.5`,
 			},
-			want: "1.1.1.1",
+			want: "",
 		},
 		{
-			name: "Fail: No strategies",
+			name: "Fail: Forwarded: none acceptable",
 			args: args{
-				strategies: nil,
+				headerName: "Forwarded",
 				headers: http.Header{
 					"X-Real-Ip":       []string{`1.1.1.1`},
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Forwarded-For": []string{`::1, nope`, `192.168.1.1, 2.2.2.2`},
+					"Forwarded":       []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone", For="::", For=0.0.0.0`},
 				},
-				remoteAddr: `5.5.5.5`,
 			},
 			want: "",
 		},
 		{
-			name: "Fail: Multiple strategies, all fail",
+			name: "Fail: XFF: no header",
 			args: args{
-				strategies: []Strategy{
-					Must(NewRightmostNonPrivateStrategy("Forwarded")),
-					Must(NewSingleIPHeaderStrategy("true-client-ip")),
-					Must(NewSingleIPHeaderStrategy("x-real-ip")),
-					RemoteAddrStrategy{},
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip": []string{`1.1.1.1`},
+					"Forwarded": []string{`For="", For="::ffff:192.168.1.1"`, `host=what;for=:48485;proto=https,For="::ffff:ac15:0006%zone"`},
 				},
+				remoteAddr: "9.9.9.9",
+			},
+			want: "",
+		},
+		{
+			name: "Fail: Forwarded: no header",
+			args: args{
+				headerName: "forwarded",
 				headers: http.Header{
-					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`64:ff9b::188.0.2.128, 3.3.3.3`, `4.4.4.4`},
 				},
-				remoteAddr: "",
 			},
 			want: "",
 		},
+		{
+			name: "Error: empty header name",
+			args: args{
+				headerName: "",
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: invalid header",
+			args: args{
+				headerName: "X-Real-IP",
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			strat := NewChainStrategy(tt.args.strategies...)
+			strat, err := NewRightmostNonPrivateStrategy(tt.args.headerName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostNonPrivateStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
 
 			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
 			if !reflect.DeepEqual(got, tt.want) {
@@ -1456,587 +1609,4741 @@ func TestChainStrategy(t *testing.T) {
 	}
 }
 
-func TestMust(t *testing.T) {
-	// We test the non-panic path elsewhere, but we need to specifically check the panic case
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("Must() did not panic")
-		}
-	}()
-
-	Must(RemoteAddrStrategy{}, fmt.Errorf("oh no"))
-}
+func TestRightmostNonPrivateWithRemoteAddrStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = RightmostNonPrivateWithRemoteAddrStrategy{}
 
-func TestMustParseIPAddr(t *testing.T) {
-	// We test the non-panic path elsewhere, but we need to specifically check the panic case
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("MustParseIPAddr() did not panic")
-		}
-	}()
+	tests := []struct {
+		name       string
+		headerName string
+		headers    http.Header
+		remoteAddr string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "RemoteAddr is the only public IP",
+			headerName: "X-Forwarded-For",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`10.0.0.1, 192.168.1.1`},
+			},
+			remoteAddr: "1.1.1.1:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Public RemoteAddr wins over header",
+			headerName: "Forwarded",
+			headers: http.Header{
+				"Forwarded": []string{`For=2.2.2.2`},
+			},
+			remoteAddr: "[2607:f8b0:4004:83f::200e]:4711",
+			want:       "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:       "Header entry is public",
+			headerName: "X-Forwarded-For",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2, 10.0.0.1`},
+			},
+			remoteAddr: "10.0.0.2:4711",
+			want:       "2.2.2.2",
+		},
+		{
+			name:       "Unix socket RemoteAddr",
+			headerName: "X-Forwarded-For",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`2.2.2.2`},
+			},
+			remoteAddr: "@",
+			want:       "2.2.2.2",
+		},
+		{
+			name:       "Fail: no public IP",
+			headerName: "X-Forwarded-For",
+			headers: http.Header{
+				"X-Forwarded-For": []string{`10.0.0.1`},
+			},
+			remoteAddr: "10.0.0.2:4711",
+			want:       "",
+		},
+		{
+			name:       "Error: invalid header",
+			headerName: "X-Real-IP",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat, err := NewRightmostNonPrivateWithRemoteAddrStrategy(tt.headerName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostNonPrivateWithRemoteAddrStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
 
-	MustParseIPAddr("nope")
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
 }
 
-func TestParseIPAddr(t *testing.T) {
+func TestRightmostTrustedCountStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = RightmostTrustedCountStrategy{}
+
+	type args struct {
+		headerName   string
+		trustedCount int
+		headers      http.Header
+		remoteAddr   string
+	}
 	tests := []struct {
 		name    string
-		ipStr   string
-		want    net.IPAddr
+		args    args
+		want    string
 		wantErr bool
 	}{
+		// TODO: Is it okay not to test every IP type, since the logic is sufficiently similar to RightmostNonPrivateStrategy?
+
 		{
-			name:  "Empty zone",
-			ipStr: "1.1.1.1%",
-			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+			name: "Count one",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "6.6.6.6",
 		},
 		{
-			name:  "No zone",
-			ipStr: "1.1.1.1",
-			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+			name: "Count five",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 5,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "8.8.8.8",
 		},
 		{
-			name:  "With zone",
-			ipStr: "fe80::abcd%zone",
-			want:  net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "zone"},
+			name: "Empty items are dropped before counting",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 2,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, , 2.2.2.2, `, ` ,3.3.3.3,`},
+				},
+			},
+			want: "2.2.2.2",
 		},
 		{
-			name:  "With zone and port",
-			ipStr: "[2607:f8b0:4004:83f::200e%zone]:4484",
-			want:  net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e"), Zone: "zone"},
+			name: "Empty Forwarded items are dropped before counting",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 2,
+				headers: http.Header{
+					"Forwarded": []string{`For=1.1.1.1,, For=2.2.2.2`, `,For=3.3.3.3`},
+				},
+			},
+			want: "2.2.2.2",
 		},
 		{
-			name:  "With port",
-			ipStr: "1.1.1.1:48944",
-			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+			name: "Whitespace-only header is empty",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1`, ` `},
+				},
+			},
+			want: "1.1.1.1",
 		},
 		{
-			name:  "Bad port (is discarded)",
-			ipStr: "[fe80::abcd%eth0]:xyz",
-			want:  net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+			name: "Fail: header too short/count too large",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: 50,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "",
 		},
 		{
-			name:  "Zero address",
-			ipStr: "0.0.0.0",
-			want:  net.IPAddr{IP: net.ParseIP("0.0.0.0"), Zone: ""},
+			name: "Fail: bad value at count index",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 2,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=nope`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "",
 		},
 		{
-			name:  "Unspecified address",
-			ipStr: "::",
-			want:  net.IPAddr{IP: net.ParseIP("::"), Zone: ""},
+			name: "Fail: zero value at count index",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 2,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `For=0.0.0.0`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			want: "",
 		},
 		{
-			name:    "Error: bad IP with zone",
-			ipStr:   "nope%zone",
+			name: "Fail: header missing",
+			args: args{
+				headerName:   "Forwarded",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, fe80::382b:141b:fa4a:2a16%28`, `7.7.7.7.7, 8.8.8.8, 9.9.9.9, 10.10.10.10,11.11.11.11, 12.12.12.12`},
+				},
+			},
+			want: "",
+		},
+		{
+			name: "Error: empty header name",
+			args: args{
+				headerName:   "",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
 			wantErr: true,
 		},
 		{
-			name:    "Error: bad IP",
-			ipStr:   "nope!!",
+			name: "Error: invalid header",
+			args: args{
+				headerName:   "X-Real-IP",
+				trustedCount: 1,
+				headers: http.Header{
+					"X-Real-Ip":       []string{"::1"},
+					"True-Client-Ip":  []string{"2.2.2.2"},
+					"X-Forwarded-For": []string{"3.3.3.3"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: zero trustedCount",
+			args: args{
+				headerName:   "x-forwarded-for",
+				trustedCount: 0,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`4.4.4.4, 5.5.5.5`, `::1, nope`, `fe80::382b:141b:fa4a:2a16%28`},
+					"Forwarded":       []string{`For="::ffff:bc15:0006"`, `host=what;for=6.6.6.6;proto=https`},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: negative trustedCount",
+			args: args{
+				headerName:   "X-Forwarded-For",
+				trustedCount: -999,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4:39333`},
+				},
+			},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := ParseIPAddr(tt.ipStr)
+			strat, err := NewRightmostTrustedCountStrategy(tt.args.headerName, tt.args.trustedCount)
 			if (err != nil) != tt.wantErr {
-				t.Fatalf("ParseIPAddr() error = %v, wantErr %v, got = %v", err, tt.wantErr, got)
+				t.Fatalf("NewRightmostTrustedCountStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
 				return
 			}
 
-			if !ipAddrsEqual(got, tt.want) {
-				t.Fatalf("ParseIPAddr() = %v, want %v", got, tt.want)
-			}
-		})
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressesAndRangesToIPNets(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "Empty input",
+			ranges: []string{},
+			want:   nil,
+		},
+		{
+			name:   "Single IPv4 address",
+			ranges: []string{"1.1.1.1"},
+			want:   []string{"1.1.1.1/32"},
+		},
+		{
+			name:   "Single IPv6 address",
+			ranges: []string{"2607:f8b0:4004:83f::200e"},
+			want:   []string{"2607:f8b0:4004:83f::200e/128"},
+		},
+		{
+			name:   "Single IPv4 range",
+			ranges: []string{"1.1.1.1/16"},
+			want:   []string{"1.1.0.0/16"},
+		},
+		{
+			name:   "Single IPv6 range",
+			ranges: []string{"2607:f8b0:4004:83f::200e/48"},
+			want:   []string{"2607:f8b0:4004::/48"},
+		},
+		{
+			name: "Mixed input",
+			ranges: []string{
+				"1.1.1.1", "2607:f8b0:4004:83f::200e",
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.1.1/16", "2607:f8b0:4004:83f::200e/56",
+				"::ffff:188.0.2.128/112", "::ffff:bc15:0006/104",
+				"64:ff9b::188.0.2.128/112",
+			},
+			want: []string{
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.1.1/32", "2607:f8b0:4004:83f::200e/128",
+				"1.1.0.0/16", "2607:f8b0:4004:800::/56",
+				"188.0.0.0/16", "188.0.0.0/8",
+				"64:ff9b::bc00:0/112",
+			},
+		},
+		{
+			name:   "No input",
+			ranges: nil,
+			want:   nil,
+		},
+		{
+			name:    "Error: garbage CIDR",
+			ranges:  []string{"2607:f8b0:4004:83f::200e/nope"},
+			wantErr: `invalid address or range: not a valid CIDR range: "2607:f8b0:4004:83f::200e/nope"`,
+		},
+		{
+			name:    "Error: CIDR with zone",
+			ranges:  []string{"fe80::abcd%nope/64"},
+			wantErr: `invalid address or range: zones are not allowed in CIDR ranges: "fe80::abcd%nope/64"`,
+		},
+		{
+			name:    "Error: garbage IP",
+			ranges:  []string{"1.1.1.nope"},
+			wantErr: `invalid address or range: not a valid IP address: "1.1.1.nope"`,
+		},
+		{
+			name:    "Error: address with zone",
+			ranges:  []string{"fe80::abcd%eth0"},
+			wantErr: `invalid address or range: zones are not allowed in addresses: "fe80::abcd%eth0"`,
+		},
+		{
+			name:    "Error: empty value",
+			ranges:  []string{""},
+			wantErr: `invalid address or range: empty string`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AddressesAndRangesToIPNets(tt.ranges...)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("AddressesAndRangesToIPNets() error = %v, wantErr %q", err, tt.wantErr)
+			}
+
+			if err != nil {
+				// The error must be actionable by callers
+				if !errors.Is(err, ErrInvalidRange) {
+					t.Fatalf("AddressesAndRangesToIPNets() error = %v, want ErrInvalidRange", err)
+				}
+				if err.Error() != tt.wantErr {
+					t.Fatalf("AddressesAndRangesToIPNets() error = %q, want %q", err.Error(), tt.wantErr)
+				}
+				return
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("len mismatch: %d != %d", len(got), len(tt.want))
+			}
+
+			for i := 0; i < len(got); i++ {
+				if got[i].String() != tt.want[i] {
+					t.Fatalf("got does not equal want; %d: %q != %q", i, got[i].String(), tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRightmostTrustedRangeStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = RightmostTrustedRangeStrategy{}
+
+	type args struct {
+		headerName    string
+		headers       http.Header
+		remoteAddr    string
+		trustedRanges []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "No ranges",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: nil,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "One range",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: []string{`4.4.4.0/24`},
+			},
+			want: "3.3.3.3",
+		},
+		{
+			name: "One IP",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: []string{`4.4.4.4`},
+			},
+			want: "3.3.3.3",
+		},
+		{
+			name: "Many kinds of ranges",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+					"Forwarded": []string{
+						`For=99.99.99.99, For=4.4.4.8, For="[2607:f8b0:4004:83f::200e]:4747"`,
+						`For=2.2.2.2:8883, For=64:ff9b::188.0.2.200, For=3.3.5.5, For=2001:db7::abcd`,
+					},
+				},
+				trustedRanges: []string{
+					`2.2.2.2/32`, `2607:f8b0:4004:83f::200e/128`,
+					`3.3.0.0/16`, `2001:db7::/64`,
+					`::ffff:4.4.4.4/124`, `64:ff9b::188.0.2.128/112`,
+				},
+			},
+			want: "99.99.99.99",
+		},
+		{
+			name: "Cloudflare ranges",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`, `2400:cb00::1`},
+				},
+				trustedRanges: ranges.Cloudflare,
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name: "Fail: no non-trusted IP",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+				},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: rightmost non-trusted IP invalid",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`nope, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+				},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: rightmost non-trusted IP unspecified",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`::, 2.2.2.2:3384, 2.2.2.3`, `2.2.2.4`},
+				},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: no values in header",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{}},
+				trustedRanges: []string{`2.2.2.0/24`},
+			},
+			want: "",
+		},
+		{
+			name: "Error: empty header nanme",
+			args: args{
+				headerName: "",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: nil,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: bad header nanme",
+			args: args{
+				headerName: "Not-XFF-Or-Forwarded",
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				trustedRanges: nil,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := AddressesAndRangesToIPNets(tt.args.trustedRanges...)
+			if err != nil {
+				// We're not testing AddressesAndRangesToIPNets here
+				t.Fatalf("AddressesAndRangesToIPNets failed")
+			}
+
+			strat, err := NewRightmostTrustedRangeStrategy(tt.args.headerName, ranges)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainStrategy(t *testing.T) {
+	type args struct {
+		strategies []Strategy
+		headers    http.Header
+		remoteAddr string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "Single strategy",
+			args: args{
+				strategies: []Strategy{RemoteAddrStrategy{}},
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: `5.5.5.5`,
+			},
+			want: "5.5.5.5",
+		},
+		{
+			name: "Multiple strategies",
+			args: args{
+				strategies: []Strategy{
+					Must(NewRightmostNonPrivateStrategy("Forwarded")),
+					Must(NewSingleIPHeaderStrategy("true-client-ip")),
+					Must(NewSingleIPHeaderStrategy("x-real-ip")),
+					RemoteAddrStrategy{},
+				},
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: `5.5.5.5`,
+			},
+			want: "1.1.1.1",
+		},
+		{
+			name: "Fail: No strategies",
+			args: args{
+				strategies: nil,
+				headers: http.Header{
+					"X-Real-Ip":       []string{`1.1.1.1`},
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: `5.5.5.5`,
+			},
+			want: "",
+		},
+		{
+			name: "Fail: Multiple strategies, all fail",
+			args: args{
+				strategies: []Strategy{
+					Must(NewRightmostNonPrivateStrategy("Forwarded")),
+					Must(NewSingleIPHeaderStrategy("true-client-ip")),
+					Must(NewSingleIPHeaderStrategy("x-real-ip")),
+					RemoteAddrStrategy{},
+				},
+				headers: http.Header{
+					"X-Forwarded-For": []string{`2.2.2.2:3384, 3.3.3.3`, `4.4.4.4`},
+				},
+				remoteAddr: "",
+			},
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := NewChainStrategy(tt.args.strategies...)
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewChainStrategyFailClosed(t *testing.T) {
+	strategies := []Strategy{
+		Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")),
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		RemoteAddrStrategy{},
+	}
+
+	tests := []struct {
+		name           string
+		headers        http.Header
+		remoteAddr     string
+		wantFailOpen   string
+		wantFailClosed string
+	}{
+		{
+			name:           "First succeeds",
+			headers:        http.Header{"Cf-Connecting-Ip": []string{"1.1.1.1"}, "X-Forwarded-For": []string{"2.2.2.2"}},
+			remoteAddr:     "5.5.5.5:4711",
+			wantFailOpen:   "1.1.1.1",
+			wantFailClosed: "1.1.1.1",
+		},
+		{
+			name:           "Header absent falls through",
+			headers:        http.Header{"X-Forwarded-For": []string{"2.2.2.2"}},
+			remoteAddr:     "5.5.5.5:4711",
+			wantFailOpen:   "2.2.2.2",
+			wantFailClosed: "2.2.2.2",
+		},
+		{
+			name:           "Header present but invalid",
+			headers:        http.Header{"Cf-Connecting-Ip": []string{"nope"}, "X-Forwarded-For": []string{"2.2.2.2"}},
+			remoteAddr:     "5.5.5.5:4711",
+			wantFailOpen:   "2.2.2.2",
+			wantFailClosed: "",
+		},
+		{
+			name:           "Header present but only private",
+			headers:        http.Header{"X-Forwarded-For": []string{"10.0.0.1, 192.168.1.1"}},
+			remoteAddr:     "5.5.5.5:4711",
+			wantFailOpen:   "5.5.5.5",
+			wantFailClosed: "",
+		},
+		{
+			name:           "No headers",
+			headers:        http.Header{},
+			remoteAddr:     "5.5.5.5:4711",
+			wantFailOpen:   "5.5.5.5",
+			wantFailClosed: "5.5.5.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failOpen := NewChainStrategy(strategies...)
+			if got := failOpen.ClientIP(tt.headers, tt.remoteAddr); got != tt.wantFailOpen {
+				t.Fatalf("fail-open ClientIP = %q, want %q", got, tt.wantFailOpen)
+			}
+
+			failClosed := NewChainStrategyFailClosed(strategies...)
+			if got := failClosed.ClientIP(tt.headers, tt.remoteAddr); got != tt.wantFailClosed {
+				t.Fatalf("fail-closed ClientIP = %q, want %q", got, tt.wantFailClosed)
+			}
+
+			if got, _ := failClosed.ClientIPWithFallbackInfo(tt.headers, tt.remoteAddr); got != tt.wantFailClosed {
+				t.Fatalf("fail-closed ClientIPWithFallbackInfo = %q, want %q", got, tt.wantFailClosed)
+			}
+		})
+	}
+
+	// Strategies that wrap others use the headers of the strategies they wrap
+	xffStrat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+	wrapperTests := []struct {
+		name  string
+		strat Strategy
+	}{
+		{
+			name:  "ChainStrategy",
+			strat: NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), xffStrat),
+		},
+		{
+			name:  "ExactProxyStrategy",
+			strat: Must(NewExactProxyStrategy(xffStrat, []net.IP{net.ParseIP("10.0.0.1")})),
+		},
+		{
+			name:  "CrossCheckStrategy",
+			strat: NewCrossCheckStrategy(xffStrat, Must(NewSingleIPHeaderStrategy("X-Real-IP"))),
+		},
+		{
+			name:  "MemoizedStrategy",
+			strat: Memoize(xffStrat),
+		},
+		{
+			name:  "RightmostTrustedCountByHeaderStrategy",
+			strat: Must(NewRightmostTrustedCountByHeaderStrategy("X-Forwarded-For", "X-Proxy-Tier", map[string]int{"edge": 1})),
+		},
+	}
+	for _, tt := range wrapperTests {
+		t.Run(tt.name, func(t *testing.T) {
+			failClosed := NewChainStrategyFailClosed(tt.strat, RemoteAddrStrategy{})
+
+			// The wrapped strategy's header is absent, so the chain falls through
+			if got := failClosed.ClientIP(http.Header{"Accept": []string{"*/*"}}, "5.5.5.5:4711"); got != "5.5.5.5" {
+				t.Fatalf("fail-closed ClientIP with header absent = %q, want %q", got, "5.5.5.5")
+			}
+
+			// The wrapped strategy's header is present but only private, so the chain stops
+			headers := http.Header{"X-Forwarded-For": []string{"10.0.0.1, 192.168.1.1"}}
+			if got := failClosed.ClientIP(headers, "10.0.0.1:4711"); got != "" {
+				t.Fatalf("fail-closed ClientIP with header present = %q, want empty", got)
+			}
+		})
+	}
+
+	// A strategy that doesn't use a header always stops the chain
+	failClosed := NewChainStrategyFailClosed(RemoteAddrStrategy{}, Must(NewSingleIPHeaderStrategy("X-Real-IP")))
+	if got := failClosed.ClientIP(http.Header{"X-Real-Ip": []string{"1.1.1.1"}}, "nope"); got != "" {
+		t.Fatalf("fail-closed ClientIP = %q, want empty", got)
+	}
+
+	if got, want := failClosed.String(), "ChainStrategy{[RemoteAddrStrategy{}, SingleIPHeaderStrategy{header=X-Real-Ip}], failClosed}"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestNewNginxRealIPStrategy(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		want       string
+	}{
+		{
+			name: "X-Real-IP set by nginx",
+			headers: http.Header{
+				"X-Real-Ip":       []string{"1.1.1.1"},
+				"X-Forwarded-For": []string{"2.2.2.2, 1.1.1.1"},
+			},
+			remoteAddr: "10.0.0.1:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "No X-Real-IP",
+			headers:    http.Header{"X-Forwarded-For": []string{"2.2.2.2"}},
+			remoteAddr: "10.0.0.1:4711",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Invalid X-Real-IP",
+			headers:    http.Header{"X-Real-Ip": []string{"nope"}},
+			remoteAddr: "[2607:f8b0:4004:83f::200e]:4711",
+			want:       "2607:f8b0:4004:83f::200e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := NewNginxRealIPStrategy()
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrossCheckStrategy(t *testing.T) {
+	strat := NewCrossCheckStrategy(
+		Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+		Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+	)
+
+	tests := []struct {
+		name           string
+		headers        http.Header
+		wantIP         string
+		wantConsistent bool
+	}{
+		{
+			name: "Matching",
+			headers: http.Header{
+				"X-Real-Ip":       []string{"1.1.1.1"},
+				"X-Forwarded-For": []string{"1.1.1.1, 10.0.0.1"},
+			},
+			wantIP:         "1.1.1.1",
+			wantConsistent: true,
+		},
+		{
+			name: "Matching IPv6 in different forms",
+			headers: http.Header{
+				"X-Real-Ip":       []string{"2607:f8b0:4004:83f:0:0:0:200e"},
+				"X-Forwarded-For": []string{"[2607:f8b0:4004:83f::200e]:4711"},
+			},
+			wantIP:         "2607:f8b0:4004:83f::200e",
+			wantConsistent: true,
+		},
+		{
+			name: "Mismatching",
+			headers: http.Header{
+				"X-Real-Ip":       []string{"1.1.1.1"},
+				"X-Forwarded-For": []string{"2.2.2.2, 1.1.1.1"},
+			},
+			wantIP:         "1.1.1.1",
+			wantConsistent: false,
+		},
+		{
+			name: "Verifier fails",
+			headers: http.Header{
+				"X-Real-Ip": []string{"1.1.1.1"},
+			},
+			wantIP:         "1.1.1.1",
+			wantConsistent: false,
+		},
+		{
+			name: "Primary fails",
+			headers: http.Header{
+				"X-Forwarded-For": []string{"1.1.1.1"},
+			},
+			wantIP:         "",
+			wantConsistent: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strat.ClientIP(tt.headers, ""); got != tt.wantIP {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.wantIP)
+			}
+
+			gotIP, gotConsistent := strat.ClientIPConsistent(tt.headers, "")
+			if gotIP != tt.wantIP || gotConsistent != tt.wantConsistent {
+				t.Fatalf("ClientIPConsistent = %q, %v, want %q, %v", gotIP, gotConsistent, tt.wantIP, tt.wantConsistent)
+			}
+		})
+	}
+
+	if got, want := strat.String(), "CrossCheckStrategy{primary=SingleIPHeaderStrategy{header=X-Real-Ip}, verify=LeftmostNonPrivateStrategy{header=X-Forwarded-For}}"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestDefaultStrategy(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    http.Header
+		remoteAddr string
+		want       string
+	}{
+		{
+			name: "Forwarded",
+			headers: http.Header{
+				"Forwarded":       []string{"For=1.1.1.1, For=10.0.0.1"},
+				"X-Forwarded-For": []string{"2.2.2.2"},
+				"X-Real-Ip":       []string{"3.3.3.3"},
+			},
+			remoteAddr: "10.0.0.2:4711",
+			want:       "1.1.1.1",
+		},
+		{
+			name: "X-Forwarded-For",
+			headers: http.Header{
+				"Forwarded":       []string{"For=10.0.0.1"},
+				"X-Forwarded-For": []string{"2.2.2.2, 192.168.1.1"},
+				"X-Real-Ip":       []string{"3.3.3.3"},
+			},
+			remoteAddr: "10.0.0.2:4711",
+			want:       "2.2.2.2",
+		},
+		{
+			name: "X-Real-IP",
+			headers: http.Header{
+				"X-Forwarded-For": []string{"192.168.1.1"},
+				"X-Real-Ip":       []string{"3.3.3.3"},
+			},
+			remoteAddr: "10.0.0.2:4711",
+			want:       "3.3.3.3",
+		},
+		{
+			name:       "RemoteAddr",
+			headers:    http.Header{},
+			remoteAddr: "[2607:f8b0:4004:83f::200e]:4711",
+			want:       "2607:f8b0:4004:83f::200e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DefaultStrategy().ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMust(t *testing.T) {
+	// We test the non-panic path elsewhere, but we need to specifically check the panic case
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Must() did not panic")
+		}
+	}()
+
+	Must(RemoteAddrStrategy{}, fmt.Errorf("oh no"))
+}
+
+func TestMustParseIPAddr(t *testing.T) {
+	// We test the non-panic path elsewhere, but we need to specifically check the panic case
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("MustParseIPAddr() did not panic")
+		}
+	}()
+
+	MustParseIPAddr("nope")
+}
+
+func TestParseIPAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		ipStr   string
+		want    net.IPAddr
+		wantErr bool
+	}{
+		{
+			name:  "Empty zone",
+			ipStr: "1.1.1.1%",
+			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+		},
+		{
+			name:  "No zone",
+			ipStr: "1.1.1.1",
+			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+		},
+		{
+			name:  "With zone",
+			ipStr: "fe80::abcd%zone",
+			want:  net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "zone"},
+		},
+		{
+			name:  "With zone and port",
+			ipStr: "[2607:f8b0:4004:83f::200e%zone]:4484",
+			want:  net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e"), Zone: "zone"},
+		},
+		{
+			name:  "With port",
+			ipStr: "1.1.1.1:48944",
+			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+		},
+		{
+			name:  "Bad port (is discarded)",
+			ipStr: "[fe80::abcd%eth0]:xyz",
+			want:  net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+		},
+		{
+			name:  "Zero address",
+			ipStr: "0.0.0.0",
+			want:  net.IPAddr{IP: net.ParseIP("0.0.0.0"), Zone: ""},
+		},
+		{
+			name:  "Unspecified address",
+			ipStr: "::",
+			want:  net.IPAddr{IP: net.ParseIP("::"), Zone: ""},
+		},
+		{
+			name:    "Error: bad IP with zone",
+			ipStr:   "nope%zone",
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad IP",
+			ipStr:   "nope!!",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIPAddr(tt.ipStr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIPAddr() error = %v, wantErr %v, got = %v", err, tt.wantErr, got)
+				return
+			}
+
+			if !ipAddrsEqual(got, tt.want) {
+				t.Fatalf("ParseIPAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatIPAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		ipAddr net.IPAddr
+		header string // the header value that a strategy would derive ipAddr from
+		want   string
+	}{
+		{
+			name:   "IPv4",
+			ipAddr: net.IPAddr{IP: net.IPv4(1, 2, 3, 4).To4()},
+			header: "1.2.3.4",
+			want:   "1.2.3.4",
+		},
+		{
+			name:   "IPv4-mapped",
+			ipAddr: net.IPAddr{IP: net.ParseIP("::ffff:1.2.3.4")},
+			header: "::ffff:1.2.3.4",
+			want:   "1.2.3.4",
+		},
+		{
+			name:   "Zoned IPv6",
+			ipAddr: net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+			header: "[fe80::abcd%eth0]:4711",
+			want:   "fe80::abcd%eth0",
+		},
+		{
+			name:   "NAT64",
+			ipAddr: net.IPAddr{IP: net.ParseIP("64:ff9b::1.2.3.4")},
+			header: "64:ff9b::1.2.3.4",
+			want:   "64:ff9b::102:304",
+		},
+		{
+			name:   "IPv6 is compressed",
+			ipAddr: net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:083f:0000:0000:0000:200e")},
+			header: "2607:F8B0:4004:083F:0000:0000:0000:200E",
+			want:   "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:   "No IP",
+			ipAddr: net.IPAddr{},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FormatIPAddr(tt.ipAddr)
+			if got != tt.want {
+				t.Fatalf("FormatIPAddr() = %q, want %q", got, tt.want)
+			}
+
+			if tt.header == "" {
+				return
+			}
+
+			// The result must be exactly what a strategy emits
+			strat := Must(NewSingleIPHeaderStrategy("X-Real-IP"))
+			if fromStrat := strat.ClientIP(http.Header{"X-Real-Ip": []string{tt.header}}, ""); got != fromStrat {
+				t.Fatalf("FormatIPAddr() = %q, but ClientIP = %q", got, fromStrat)
+			}
+		})
+	}
+}
+
+func TestParseIPAddrDetailed(t *testing.T) {
+	tests := []struct {
+		name           string
+		ipStr          string
+		want           net.IPAddr
+		wantIPv4Mapped bool
+		wantErr        bool
+	}{
+		{
+			name:  "IPv4",
+			ipStr: "1.2.3.4",
+			want:  net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+		},
+		{
+			name:  "IPv4 with port",
+			ipStr: "1.2.3.4:4711",
+			want:  net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+		},
+		{
+			name:           "IPv4-mapped",
+			ipStr:          "::ffff:1.2.3.4",
+			want:           net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+			wantIPv4Mapped: true,
+		},
+		{
+			name:           "IPv4-mapped hex, brackets, and port",
+			ipStr:          "[::ffff:102:304]:4711",
+			want:           net.IPAddr{IP: net.ParseIP("1.2.3.4")},
+			wantIPv4Mapped: true,
+		},
+		{
+			name:  "IPv6",
+			ipStr: "2607:f8b0:4004:83f::200e",
+			want:  net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			name:    "Error: bad IP",
+			ipStr:   "::ffff:nope",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotIPv4Mapped, err := ParseIPAddrDetailed(tt.ipStr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIPAddrDetailed() error = %v, wantErr %v, got = %v", err, tt.wantErr, got)
+			}
+
+			if !ipAddrsEqual(got, tt.want) {
+				t.Fatalf("ParseIPAddrDetailed() = %v, want %v", got, tt.want)
+			}
+
+			if gotIPv4Mapped != tt.wantIPv4Mapped {
+				t.Fatalf("ParseIPAddrDetailed() ipv4Mapped = %v, want %v", gotIPv4Mapped, tt.wantIPv4Mapped)
+			}
+		})
+	}
+}
+
+func TestParseIPAddrWithPort(t *testing.T) {
+	tests := []struct {
+		name          string
+		ipStr         string
+		want          net.IPAddr
+		wantPort      int
+		wantPortValid bool
+		wantErr       bool
+	}{
+		{
+			name:          "IPv4 with valid port",
+			ipStr:         "1.1.1.1:48944",
+			want:          net.IPAddr{IP: net.ParseIP("1.1.1.1")},
+			wantPort:      48944,
+			wantPortValid: true,
+		},
+		{
+			name:          "IPv6 with zone and valid port",
+			ipStr:         "[fe80::abcd%eth0]:4711",
+			want:          net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+			wantPort:      4711,
+			wantPortValid: true,
+		},
+		{
+			name:  "Missing port",
+			ipStr: "2607:f8b0:4004:83f::200e",
+			want:  net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			name:  "Missing port with brackets",
+			ipStr: "[2607:f8b0:4004:83f::200e]",
+			want:  net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			name:  "Malformed port",
+			ipStr: "[fe80::abcd%eth0]:xyz",
+			want:  net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+		},
+		{
+			name:  "Out of range port",
+			ipStr: "1.1.1.1:65536",
+			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1")},
+		},
+		{
+			name:  "Empty port",
+			ipStr: "1.1.1.1:",
+			want:  net.IPAddr{IP: net.ParseIP("1.1.1.1")},
+		},
+		{
+			name:    "Error: bad IP",
+			ipStr:   "nope:80",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotPort, gotPortValid, err := ParseIPAddrWithPort(tt.ipStr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIPAddrWithPort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !ipAddrsEqual(got, tt.want) {
+				t.Fatalf("ParseIPAddrWithPort() = %v, want %v", got, tt.want)
+			}
+
+			if gotPort != tt.wantPort || gotPortValid != tt.wantPortValid {
+				t.Fatalf("ParseIPAddrWithPort() port = %d, %v, want %d, %v", gotPort, gotPortValid, tt.wantPort, tt.wantPortValid)
+			}
+		})
+	}
+}
+
+func Test_goodIPAddr(t *testing.T) {
+	// This is mostly a copy of TestParseIPAddr, except that zero and unspecified addresses are disallowed
+	tests := []struct {
+		name  string
+		ipStr string
+		want  *net.IPAddr
+	}{
+		{
+			name:  "Empty zone",
+			ipStr: "1.1.1.1%",
+			want:  &net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+		},
+		{
+			name:  "No zone",
+			ipStr: "1.1.1.1",
+			want:  &net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+		},
+		{
+			name:  "With zone",
+			ipStr: "fe80::abcd%zone",
+			want:  &net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "zone"},
+		},
+		{
+			name:  "With zone and port",
+			ipStr: "[2607:f8b0:4004:83f::200e%zone]:4484",
+			want:  &net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e"), Zone: "zone"},
+		},
+		{
+			name:  "With port",
+			ipStr: "1.1.1.1:48944",
+			want:  &net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+		},
+		{
+			name:  "Bad port (is discarded)",
+			ipStr: "[fe80::abcd%eth0]:xyz",
+			want:  &net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+		},
+		{
+			name:  "Error: Zero address",
+			ipStr: "0.0.0.0",
+			want:  nil,
+		},
+		{
+			name:  "Error: Unspecified address",
+			ipStr: "::",
+			want:  nil,
+		},
+		{
+			name:  "Error: Zero address with zone",
+			ipStr: "0.0.0.0%zone",
+			want:  nil,
+		},
+		{
+			name:  "Error: Unspecified address with zone",
+			ipStr: "::%eth0",
+			want:  nil,
+		},
+		{
+			name:  "Error: Unspecified address with zone, brackets, and port",
+			ipStr: "[::%eth0]:4711",
+			want:  nil,
+		},
+		{
+			name:  "Error: bad IP with zone",
+			ipStr: "nope%zone",
+			want:  nil,
+		},
+		{
+			name:  "Error: bad IP",
+			ipStr: "nope!!",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := goodIPAddr(tt.ipStr)
+
+			if got == nil || tt.want == nil {
+				if got != tt.want {
+					t.Fatalf("ParseIPAddr() = %v, want %v", got, tt.want)
+				}
+				return
+			}
+
+			if !ipAddrsEqual(*got, *tt.want) {
+				t.Fatalf("ParseIPAddr() = %v, want %v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func Test_isPrivateOrLocal(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{
+			name: "IPv4 loopback",
+			ip:   `127.0.0.2`,
+			want: true,
+		},
+		{
+			name: "IPv6 loopback",
+			ip:   `::1`,
+			want: true,
+		},
+		{
+			name: "IPv4 10.*",
+			ip:   `10.0.0.1`,
+			want: true,
+		},
+		{
+			name: "IPv4 192.168.*",
+			ip:   `192.168.1.1`,
+			want: true,
+		},
+		{
+			name: "IPv6 unique local address",
+			ip:   `fd12:3456:789a:1::1`,
+			want: true,
+		},
+		{
+			name: "IPv4 link-local",
+			ip:   `169.254.1.1`,
+			want: true,
+		},
+		{
+			name: "IPv6 link-local",
+			ip:   `fe80::abcd`,
+			want: true,
+		},
+		{
+			name: "Non-local IPv4",
+			ip:   `1.1.1.1`,
+			want: false,
+		},
+		{
+			name: "Non-local IPv4-mapped IPv6",
+			ip:   `::ffff:188.0.2.128`,
+			want: false,
+		},
+		{
+			name: "IPv4-mapped IPv6 10.*",
+			ip:   `::ffff:10.0.0.1`,
+			want: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 192.168.*",
+			ip:   `::ffff:192.168.1.1`,
+			want: true,
+		},
+		{
+			name: "IPv4-mapped IPv6 loopback, hex form",
+			ip:   `::ffff:7f00:1`,
+			want: true,
+		},
+		{
+			name: "IPv6 unique local address, fc00::/8 half",
+			ip:   `fc00::1`,
+			want: true,
+		},
+		{
+			name: "IPv6 unique local address, top of range",
+			ip:   `fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff`,
+			want: true,
+		},
+		{
+			name: "IPv6 just above unique local range",
+			ip:   `fe00::1`,
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("net.ParseIP failed; bad test input")
+			}
+			if got := isPrivateOrLocal(ip, &options{}); got != tt.want {
+				t.Fatalf("isPrivateOrLocal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mustParseCIDR(t *testing.T) {
+	// We test the non-panic path elsewhere, but we need to specifically check the panic case
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("mustParseCIDR() did not panic")
+		}
+	}()
+
+	mustParseCIDR("nope")
+}
+
+func Test_trimMatchedEnds(t *testing.T) {
+	// We test the non-panic paths elsewhere, but we need to specifically check the panic case
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("trimMatchedEnds() did not panic")
+		}
+	}()
+
+	trimMatchedEnds("nope", "abcd")
+}
+
+func TestTrimMatchedEnds(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		ends    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Matched quotes",
+			s:    `"1.1.1.1"`,
+			ends: `"`,
+			want: "1.1.1.1",
+		},
+		{
+			name: "Matched brackets",
+			s:    "[2607:f8b0:4004:83f::200e]",
+			ends: "[]",
+			want: "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name: "No ends",
+			s:    "1.1.1.1",
+			ends: `"`,
+			want: "1.1.1.1",
+		},
+		{
+			name: "Empty",
+			s:    "",
+			ends: "[]",
+			want: "",
+		},
+		{
+			name: "Quotes around brackets, outer",
+			s:    `"[2607:f8b0:4004:83f::200e]:4711"`,
+			ends: `"`,
+			want: "[2607:f8b0:4004:83f::200e]:4711",
+		},
+		{
+			name: "Quotes around brackets, wrong order",
+			s:    `"[2607:f8b0:4004:83f::200e]"`,
+			ends: "[]",
+			want: `"[2607:f8b0:4004:83f::200e]"`,
+		},
+		{
+			name: "Brackets around quotes",
+			s:    `["2607:f8b0:4004:83f::200e"]`,
+			ends: "[]",
+			want: `"2607:f8b0:4004:83f::200e"`,
+		},
+		{
+			name:    "Error: unmatched leading quote",
+			s:       `"1.1.1.1`,
+			ends:    `"`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: unmatched trailing bracket",
+			s:       "2607:f8b0:4004:83f::200e]",
+			ends:    "[]",
+			wantErr: true,
+		},
+		{
+			name:    "Error: lone quote",
+			s:       `"`,
+			ends:    `"`,
+			wantErr: true,
+		},
+		{
+			name:    "Error: bad ends",
+			s:       "nope",
+			ends:    "abcd",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TrimMatchedEnds(tt.s, tt.ends)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TrimMatchedEnds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Fatalf("TrimMatchedEnds() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseForwardedListItem(t *testing.T) {
+	mustParseIPAddrPtr := func(ipStr string) *net.IPAddr {
+		res := MustParseIPAddr(ipStr)
+		return &res
+	}
+
+	tests := []struct {
+		name string
+		fwd  string
+		want *net.IPAddr
+	}{
+		{
+			// This is the correct form for IPv6 wit port
+			name: "IPv6 with port and quotes",
+			fwd:  `For="[2607:f8b0:4004:83f::200e]:4711"`,
+			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			// This is the correct form for IP with no port
+			name: "IPv6 with quotes, brackets and no port",
+			fwd:  `fOR="[2607:f8b0:4004:83f::200e]"`,
+			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			// RFC deviation: missing brackets
+			name: "IPv6 with quotes, no brackets, and no port",
+			fwd:  `for="2607:f8b0:4004:83f::200e"`,
+			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			// RFC deviation: missing quotes
+			name: "IPv6 with brackets, no quotes, and no port",
+			fwd:  `FOR=[2607:f8b0:4004:83f::200e]`,
+			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			// RFC deviation: missing quotes
+			name: "IPv6 with port and no quotes",
+			fwd:  `For=[2607:f8b0:4004:83f::200e]:4711`,
+			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			name: "IPv6 with port, quotes, and zone",
+			fwd:  `For="[fe80::abcd%zone]:4711"`,
+			want: mustParseIPAddrPtr("fe80::abcd%zone"),
+		},
+		{
+			// RFC deviation: missing brackets
+			name: "IPv6 with zone, no quotes, no port",
+			fwd:  `For="fe80::abcd%zone"`,
+			want: mustParseIPAddrPtr("fe80::abcd%zone"),
+		},
+		{
+			// RFC deviation: missing quotes
+			name: "IPv4 with port",
+			fwd:  `FoR=192.0.2.60:4711`,
+			want: mustParseIPAddrPtr("192.0.2.60"),
+		},
+		{
+			name: "IPv4 with no port",
+			fwd:  `for=192.0.2.60`,
+			want: mustParseIPAddrPtr("192.0.2.60"),
+		},
+		{
+			name: "IPv4 with quotes",
+			fwd:  `for="192.0.2.60"`,
+			want: mustParseIPAddrPtr("192.0.2.60"),
+		},
+		{
+			name: "IPv4 with port and quotes",
+			fwd:  `for="192.0.2.60:4823"`,
+			want: mustParseIPAddrPtr("192.0.2.60"),
+		},
+		{
+			name: "Error: invalid IPv4",
+			fwd:  `for=192.0.2.999`,
+			want: nil,
+		},
+		{
+			name: "Error: invalid IPv6",
+			fwd:  `for="2607:f8b0:4004:83f::999999"`,
+			want: nil,
+		},
+		{
+			name: "Error: non-IP identifier",
+			fwd:  `for="_test"`,
+			want: nil,
+		},
+		{
+			name: "Error: empty IP value",
+			fwd:  `for=`,
+			want: nil,
+		},
+		{
+			name: "Multiple IPv4 directives",
+			fwd:  `by=1.1.1.1; for=2.2.2.2;host=myhost; proto=https`,
+			want: mustParseIPAddrPtr("2.2.2.2"),
+		},
+		{
+			// RFC deviation: missing quotes around IPv6
+			name: "Multiple IPv6 directives",
+			fwd:  `by=1::1;host=myhost;for=2::2;proto=https`,
+			want: mustParseIPAddrPtr("2::2"),
+		},
+		{
+			// RFC deviation: missing quotes around IPv6
+			name: "Multiple mixed directives",
+			fwd:  `by=1::1;host=myhost;proto=https;for=2.2.2.2`,
+			want: mustParseIPAddrPtr("2.2.2.2"),
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			fwd:  `for="[::ffff:188.0.2.128]"`,
+			want: mustParseIPAddrPtr("188.0.2.128"),
+		},
+		{
+			name: "IPv4-mapped IPv6 with port and quotes",
+			fwd:  `for="[::ffff:188.0.2.128]:49428"`,
+			want: mustParseIPAddrPtr("188.0.2.128"),
+		},
+		{
+			name: "IPv4-mapped IPv6 in IPv6 form",
+			fwd:  `for="[0:0:0:0:0:ffff:bc15:0006]"`,
+			want: mustParseIPAddrPtr("188.21.0.6"),
+		},
+		{
+			name: "NAT64 IPv4-mapped IPv6",
+			fwd:  `for="[64:ff9b::188.0.2.128]"`,
+			want: mustParseIPAddrPtr("64:ff9b::188.0.2.128"),
+		},
+		{
+			name: "IPv4 loopback",
+			fwd:  `for=127.0.0.1`,
+			want: mustParseIPAddrPtr("127.0.0.1"),
+		},
+		{
+			name: "IPv6 loopback",
+			fwd:  `for="[::1]"`,
+			want: mustParseIPAddrPtr("::1"),
+		},
+		{
+			// RFC deviation: quotes must be matched
+			name: "Error: Unmatched quote",
+			fwd:  `for="1.1.1.1`,
+			want: nil,
+		},
+		{
+			// RFC deviation: brackets must be matched
+			name: "Error: IPv6 loopback",
+			fwd:  `for="::1]"`,
+			want: nil,
+		},
+		{
+			name: "Error: misplaced quote",
+			fwd:  `for="[0:0:0:0:0:ffff:bc15:0006"]`,
+			want: nil,
+		},
+		{
+			name: "Error: garbage",
+			fwd:  "ads\x00jkl&#*(383fdljk",
+			want: nil,
+		},
+		{
+			// Per RFC 7230 section 3.2.6, this should not be an error, but we don't have
+			// full syntax support yet.
+			name: "RFC deviation: quoted pair",
+			fwd:  `for=1.1.1.\1`,
+			want: nil,
+		},
+		{
+			name: "Uppercase FOR after uppercase BY",
+			fwd:  `BY=1.1.1.1;FOR=2.2.2.2`,
+			want: mustParseIPAddrPtr("2.2.2.2"),
+		},
+		{
+			name: "Uppercase FOR after uppercase HOST",
+			fwd:  `HOST=x;FOR="[::1]"`,
+			want: mustParseIPAddrPtr("::1"),
+		},
+		{
+			name: "Mixed-case parameters around For",
+			fwd:  `PrOtO=https;By="[2001:db8::1]:80";fOr="[2607:f8b0:4004:83f::200e]:4747";HoSt=example.com`,
+			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			name: "BY value that looks like a For",
+			fwd:  `BY=for;FOR=3.3.3.3`,
+			want: mustParseIPAddrPtr("3.3.3.3"),
+		},
+		{
+			name: "Semicolon in quoted HOST before FOR",
+			fwd:  `HOST="a;b";FOR=4.4.4.4`,
+			want: mustParseIPAddrPtr("4.4.4.4"),
+		},
+		{
+			name: "Uppercase BY but no FOR",
+			fwd:  `BY=1.1.1.1;PROTO=https`,
+			want: nil,
+		},
+		{
+			name: "Error: doubled equal sign",
+			fwd:  `for==1.1.1.1`,
+			want: nil,
+		},
+		{
+			name: "Error: extra equal sign in value",
+			fwd:  `for=1.1.1.1=extra`,
+			want: nil,
+		},
+		{
+			// The first For is used, even though it's malformed
+			name: "Error: malformed For before valid For",
+			fwd:  `for=1.1.1.1=extra;for=2.2.2.2`,
+			want: nil,
+		},
+		{
+			name: "Equal sign in other quoted parameter",
+			fwd:  `host="a=b";for=3.3.3.3`,
+			want: mustParseIPAddrPtr("3.3.3.3"),
+		},
+		{
+			// Per RFC 7239, whitespace is not allowed around the equal sign
+			name: "Error: Incorrect whitespace",
+			fwd:  `for= 1.1.1.1`,
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseForwardedListItem(tt.fwd, &options{})
+
+			if got == nil || tt.want == nil {
+				if got != tt.want {
+					t.Fatalf("parseForwardedListItem() = %v, want %v", got, tt.want)
+				}
+				return
+			}
+
+			if !ipAddrsEqual(*got, *tt.want) {
+				t.Fatalf("parseForwardedListItem() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Demonstrate parsing deviations from Forwarded header syntax RFCs, particularly
+// RFC 7239 (Forwarded header) and RFC 7230 (HTTP/1.1 syntax) section 3.2.6.
+func Test_forwardedHeaderRFCDeviations(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	type args struct {
+		headers    http.Header
+		headerName string
+	}
+	tests := []struct {
+		name string
+		args args
+		want []*net.IPAddr
+	}{
+		{
+			// The value in quotes should be a single value but we split by comma, so it's not.
+			// The first and third "For=" bits have one double-quote in them, so they are
+			// considered invalid by our parser. The second is still in the quoted-string,
+			// but doesn't have any quotes in it, so it parses okay.
+			name: "Comma in quotes",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For="1.1.1.1, For=2.2.2.2, For=3.3.3.3", For="4.4.4.4"`}},
+				headerName: "Forwarded",
+			},
+			// There are really only two values, so we actually want: {nil, "4.4.4.4"}
+			want: []*net.IPAddr{nil, mustParseIPAddrPtr("2.2.2.2"), nil, mustParseIPAddrPtr("4.4.4.4")},
+		},
+		{
+			// Per 7239, the opening unmatched quote makes the whole rest of the header invalid.
+			// But that would mean that an attacker can invalidate the whole header with a
+			// quote character early on, even the trusted IPs added by our reverse proxies.
+			// Our actual behaviour is probably the best approach.
+			name: "Unmatched quote",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For="1.1.1.1, For=2.2.2.2`}},
+				headerName: "Forwarded",
+			},
+			// There are really only two values, so the RFC would require: {nil} (or empty slice?)
+			want: []*net.IPAddr{nil, mustParseIPAddrPtr("2.2.2.2")},
+		},
+		{
+			// The invalid non-For parameter should invalidate the whole item, but we're
+			// not checking anything but the "For=" part.
+			name: "Invalid characters",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For=1.1.1.1;@!=😀, For=2.2.2.2`}},
+				headerName: "Forwarded",
+			},
+			// Only the last value is valid, so it should be: {nil, "2.2.2.2"}
+			want: []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2.2.2.2")},
+		},
+		{
+			// The duplicate "For=" parameter should invalidate the whole item but we don't check for it
+			name: "Duplicate token",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For=1.1.1.1;For=2.2.2.2, For=3.3.3.3`}},
+				headerName: "Forwarded",
+			},
+			// Only the last value is valid, so it should be: {nil, "3.3.3.3"}
+			want: []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("3.3.3.3")},
+		},
+		{
+			// An escaped character in quotes should be unescaped, but we're not doing it.
+			// (And if we do end up doing it, make sure that `\\` becomes `\` after escaping.
+			// And escaping is only allowed in quoted strings.)
+			// There is no good reason for any part of an IP address to be escaped anyway.
+			name: "Escaped character",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For="3.3.3.\3"`}},
+				headerName: "Forwarded",
+			},
+			// The value is valid, so it should be: {nil, "3.3.3.3"}
+			want: []*net.IPAddr{nil},
+		},
+		{
+			// Spaces are not allowed around the equal signs. This is no longer a deviation,
+			// but it's kept here to contrast with the other whitespace handling.
+			name: "Equal sign spaces",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For =1.1.1.1, For= 3.3.3.3`}},
+				headerName: "Forwarded",
+			},
+			// Neither value is valid
+			want: []*net.IPAddr{nil, nil},
+		},
+		{
+			// Disallowed characters are only allowed in quoted strings. This means
+			// that IPv6 addresses must be quoted.
+			name: "Disallowed characters in unquoted value (like colons and square brackets",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For=[2607:f8b0:4004:83f::200e]`}},
+				headerName: "Forwarded",
+			},
+			// Value is invalid without quotes, so should be {nil}
+			want: []*net.IPAddr{mustParseIPAddrPtr("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			// IPv6 addresses are required to be contained in square brackets. We don't
+			// require this simply to be more flexible in what is accepted.
+			name: "IPv6 brackets",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For="2607:f8b0:4004:83f::200e"`}},
+				headerName: "Forwarded",
+			},
+			// IPv6 is invalid without brackets, so should be {nil}
+			want: []*net.IPAddr{mustParseIPAddrPtr("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			// IPv4 addresses are _not_ supposed to be in square brackets, but we trim
+			// them unless WithRejectBracketedIPv4 is used.
+			name: "IPv4 brackets",
+			args: args{
+				headers:    http.Header{"Forwarded": []string{`For="[1.1.1.1]"`}},
+				headerName: "Forwarded",
+			},
+			// IPv4 is invalid with brackets, so should be {nil}
+			want: []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getIPAddrList(tt.args.headers, tt.args.headerName, &options{}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getIPAddrList() = %v, want %v", got, tt.want)
+			}
+
+			// The exported function must behave identically
+			got, err := ParseIPList(tt.args.headers, tt.args.headerName)
+			if err != nil {
+				t.Fatalf("ParseIPList() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseIPList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIPList(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For": []string{"1.1.1.1, nope,, [2607:f8b0:4004:83f::200e]:4711"},
+		"X-Real-Ip":       []string{"2.2.2.2"},
+	}
+
+	got, err := ParseIPList(headers, "x-forwarded-for")
+	if err != nil {
+		t.Fatalf("ParseIPList() error = %v", err)
+	}
+
+	want := []*net.IPAddr{{IP: net.ParseIP("1.1.1.1")}, nil, {IP: net.ParseIP("2607:f8b0:4004:83f::200e")}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseIPList() = %v, want %v", got, want)
+	}
+
+	if _, err := ParseIPList(headers, "X-Real-IP"); err == nil {
+		t.Fatalf("ParseIPList() with X-Real-IP did not return an error")
+	}
+}
+
+func TestForEachForwardedFor(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	type visit struct {
+		idx  int
+		addr *net.IPAddr
+	}
+
+	type args struct {
+		headers    http.Header
+		headerName string
+		stopAt     int // stop when this index is visited; -1 means never stop
+	}
+	tests := []struct {
+		name string
+		args args
+		want []visit
+	}{
+		{
+			name: "XFF in document order",
+			args: args{
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, nope`, `3.3.3.3:4747,4.4.4.4`},
+				},
+				headerName: "x-forwarded-for",
+				stopAt:     -1,
+			},
+			want: []visit{
+				{0, mustParseIPAddrPtr("1.1.1.1")},
+				{1, nil},
+				{2, mustParseIPAddrPtr("3.3.3.3")},
+				{3, mustParseIPAddrPtr("4.4.4.4")},
+			},
+		},
+		{
+			name: "Forwarded in document order",
+			args: args{
+				headers: http.Header{
+					"Forwarded": []string{`For="[2607:f8b0:4004:83f::200e]:4747", host=what`, `for=2.2.2.2;proto=https`},
+				},
+				headerName: "Forwarded",
+				stopAt:     -1,
+			},
+			want: []visit{
+				{0, mustParseIPAddrPtr("2607:f8b0:4004:83f::200e")},
+				{1, nil},
+				{2, mustParseIPAddrPtr("2.2.2.2")},
+			},
+		},
+		{
+			name: "Stop on false",
+			args: args{
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`, `3.3.3.3`},
+				},
+				headerName: "X-Forwarded-For",
+				stopAt:     1,
+			},
+			want: []visit{
+				{0, mustParseIPAddrPtr("1.1.1.1")},
+				{1, mustParseIPAddrPtr("2.2.2.2")},
+			},
+		},
+		{
+			name: "Header missing",
+			args: args{
+				headers:    http.Header{"X-Real-Ip": []string{`1.1.1.1`}},
+				headerName: "X-Forwarded-For",
+				stopAt:     -1,
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []visit
+			ForEachForwardedFor(tt.args.headers, tt.args.headerName, func(idx int, addr *net.IPAddr) bool {
+				got = append(got, visit{idx, addr})
+				return idx != tt.args.stopAt
+			})
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ForEachForwardedFor() visited %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRejectBracketedIPv4(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	tests := []struct {
+		name       string
+		fwd        string
+		wantLax    *net.IPAddr
+		wantStrict *net.IPAddr
+	}{
+		{
+			name:       "Bracketed IPv4",
+			fwd:        `For="[1.1.1.1]"`,
+			wantLax:    mustParseIPAddrPtr("1.1.1.1"),
+			wantStrict: nil,
+		},
+		{
+			name:       "Bracketed IPv4 with port",
+			fwd:        `For="[1.1.1.1]:4711"`,
+			wantLax:    mustParseIPAddrPtr("1.1.1.1"),
+			wantStrict: nil,
+		},
+		{
+			name:       "Unbracketed IPv4",
+			fwd:        `For=1.1.1.1`,
+			wantLax:    mustParseIPAddrPtr("1.1.1.1"),
+			wantStrict: mustParseIPAddrPtr("1.1.1.1"),
+		},
+		{
+			name:       "Bracketed IPv6",
+			fwd:        `For="[2607:f8b0:4004:83f::200e]:4711"`,
+			wantLax:    mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+			wantStrict: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+		},
+		{
+			name:       "Bracketed IPv4-mapped IPv6",
+			fwd:        `For="[::ffff:188.0.2.128]"`,
+			wantLax:    mustParseIPAddrPtr("188.0.2.128"),
+			wantStrict: mustParseIPAddrPtr("188.0.2.128"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lax := newOptions(nil)
+			if got := parseForwardedListItem(tt.fwd, &lax); !reflect.DeepEqual(got, tt.wantLax) {
+				t.Fatalf("lenient parseForwardedListItem() = %v, want %v", got, tt.wantLax)
+			}
+
+			strict := newOptions([]Option{WithRejectBracketedIPv4()})
+			if got := parseForwardedListItem(tt.fwd, &strict); !reflect.DeepEqual(got, tt.wantStrict) {
+				t.Fatalf("strict parseForwardedListItem() = %v, want %v", got, tt.wantStrict)
+			}
+		})
+	}
+
+	// The option must also reach the parser through a strategy
+	headers := http.Header{"Forwarded": []string{`For=2.2.2.2, For="[1.1.1.1]"`}}
+	strat := Must(NewRightmostNonPrivateStrategy("Forwarded", WithRejectBracketedIPv4()))
+	if got := strat.ClientIP(headers, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+}
+
+func TestHeaderConstants(t *testing.T) {
+	headerNames := []string{
+		HeaderXRealIP,
+		HeaderCFConnectingIP,
+		HeaderCFConnectingIPv6,
+		HeaderTrueClientIP,
+		HeaderFastlyClientIP,
+		HeaderXAzureClientIP,
+		HeaderXAzureSocketIP,
+	}
+	for _, h := range headerNames {
+		if canon := http.CanonicalHeaderKey(h); canon != h {
+			t.Fatalf("header constant %q is not canonical; want %q", h, canon)
+		}
+	}
+
+	strat, err := NewSingleIPHeaderStrategy(HeaderCFConnectingIP)
+	if err != nil {
+		t.Fatalf("NewSingleIPHeaderStrategy error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	req.Header.Set("X-Real-IP", "1.1.1.1")
+	req.Header.Set("CF-Connecting-IP", "2.2.2.2")
+	if got := strat.ClientIP(req.Header, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+}
+
+// This test is only meaningful when run with the race detector (go test -race).
+func TestStrategyConcurrentUse(t *testing.T) {
+	trustedRanges, err := AddressesAndRangesToIPNets(append([]string{"10.0.0.0/8"}, ranges.Cloudflare...)...)
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	rangeStrat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges))
+	strats := []Strategy{
+		rangeStrat,
+		// A second strategy sharing the same ranges
+		Must(NewRightmostTrustedRangeStrategy("Forwarded", trustedRanges)),
+		NewChainStrategy(rangeStrat, RemoteAddrStrategy{}),
+	}
+
+	headers := http.Header{
+		"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`, `173.245.48.1, 10.1.1.1`},
+		"Forwarded":       []string{`For=2.2.2.2, For="[2400:cb00::1]:4747"`},
+	}
+
+	const goroutines = 32
+	const iterations = 200
+	done := make(chan string, goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			strat := strats[g%len(strats)]
+			for i := 0; i < iterations; i++ {
+				if got := strat.ClientIP(headers, "10.0.0.1:4747"); got != "2.2.2.2" {
+					done <- got
+					return
+				}
+			}
+			done <- ""
+		}(g)
+	}
+
+	// Modifying the caller's slice must not affect (or race with) the strategies
+	trustedRanges[0] = mustParseCIDR("0.0.0.0/0")
+
+	for g := 0; g < goroutines; g++ {
+		if got := <-done; got != "" {
+			t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+		}
+	}
+}
+
+// unstringableStrategy is a custom strategy that doesn't implement fmt.Stringer
+type unstringableStrategy struct {
+	name string
+}
+
+func (strat unstringableStrategy) ClientIP(_ http.Header, _ string) string {
+	return ""
+}
+
+func TestStrategyString(t *testing.T) {
+	trustedRanges, err := AddressesAndRangesToIPNets(ranges.Cloudflare...)
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		strat fmt.Stringer
+		want  string
+	}{
+		{
+			name: "Representative chain",
+			strat: NewChainStrategy(
+				Must(NewRightmostTrustedRangeStrategy("x-forwarded-for", trustedRanges)),
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				RemoteAddrStrategy{},
+			),
+			want: "ChainStrategy{[RightmostTrustedRangeStrategy{header=X-Forwarded-For, ranges=22}, SingleIPHeaderStrategy{header=X-Real-Ip}, RemoteAddrStrategy{}]}",
+		},
+		{
+			name: "Nested chain",
+			strat: NewChainStrategy(
+				NewChainStrategy(Must(NewLeftmostNonPrivateStrategy("Forwarded"))),
+				Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)),
+			),
+			want: "ChainStrategy{[ChainStrategy{[LeftmostNonPrivateStrategy{header=Forwarded}]}, RightmostTrustedCountStrategy{header=X-Forwarded-For, count=2}]}",
+		},
+		{
+			name:  "Custom strategy without String",
+			strat: NewChainStrategy(unstringableStrategy{name: "mine"}),
+			want:  "ChainStrategy{[realclientip.unstringableStrategy{name:mine}]}",
+		},
+		{
+			name:  "Leftmost within",
+			strat: Must(NewLeftmostNonPrivateWithinStrategy("Forwarded", 3)).(fmt.Stringer),
+			want:  "LeftmostNonPrivateWithinStrategy{header=Forwarded, maxDepth=3}",
+		},
+		{
+			name:  "Rightmost non-private",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")).(fmt.Stringer),
+			want:  "RightmostNonPrivateStrategy{header=X-Forwarded-For}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strat.String(); got != tt.want {
+				t.Fatalf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_ClientAndProxy(t *testing.T) {
+	trustedRanges, err := AddressesAndRangesToIPNets("10.0.0.0/8", "4.4.4.0/24")
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy)
+
+	tests := []struct {
+		name       string
+		headers    http.Header
+		wantClient string
+		wantProxy  string
+		wantOK     bool
+	}{
+		{
+			name:       "Multi-hop chain",
+			headers:    http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2, 4.4.4.4`, `10.0.0.1`}},
+			wantClient: "2.2.2.2",
+			wantProxy:  "4.4.4.4",
+			wantOK:     true,
+		},
+		{
+			name:       "Single-entry chain",
+			headers:    http.Header{"X-Forwarded-For": []string{`2.2.2.2`}},
+			wantClient: "2.2.2.2",
+			wantProxy:  "",
+			wantOK:     true,
+		},
+		{
+			name:    "Fail: all trusted",
+			headers: http.Header{"X-Forwarded-For": []string{`4.4.4.4, 10.0.0.1`}},
+			wantOK:  false,
+		},
+		{
+			name:    "Fail: invalid client",
+			headers: http.Header{"X-Forwarded-For": []string{`nope, 10.0.0.1`}},
+			wantOK:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, proxy, ok := strat.ClientAndProxy(tt.headers, "")
+			if ok != tt.wantOK {
+				t.Fatalf("ClientAndProxy ok = %v, want %v", ok, tt.wantOK)
+			}
+
+			if !ok {
+				return
+			}
+
+			if client.String() != tt.wantClient {
+				t.Fatalf("ClientAndProxy client = %q, want %q", client.String(), tt.wantClient)
+			}
+
+			if tt.wantProxy == "" {
+				if proxy != nil {
+					t.Fatalf("ClientAndProxy proxy = %q, want nil", proxy.String())
+				}
+			} else if proxy == nil || proxy.String() != tt.wantProxy {
+				t.Fatalf("ClientAndProxy proxy = %v, want %q", proxy, tt.wantProxy)
+			}
+
+			// The client must be consistent with ClientIP
+			if got := strat.ClientIP(tt.headers, ""); got != tt.wantClient {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.wantClient)
+			}
+		})
+	}
+
+	// With WithIgnoreHeadersFromLoopback, a loopback RemoteAddr is the client, as with ClientIP
+	loopbackStrat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithIgnoreHeadersFromLoopback())).(RightmostTrustedRangeStrategy)
+	headers := http.Header{"X-Forwarded-For": []string{`2.2.2.2, 4.4.4.4`}}
+	client, proxy, ok := loopbackStrat.ClientAndProxy(headers, "127.0.0.1:4711")
+	if !ok || client.String() != "127.0.0.1" || proxy != nil {
+		t.Fatalf("ClientAndProxy with loopback = (%v, %v, %v), want (127.0.0.1, nil, true)", client.String(), proxy, ok)
+	}
+	if got := loopbackStrat.ClientIP(headers, "127.0.0.1:4711"); got != client.String() {
+		t.Fatalf("ClientIP = %q, want %q", got, client.String())
+	}
+
+	// Other RemoteAddrs still use the headers
+	client, proxy, ok = loopbackStrat.ClientAndProxy(headers, "10.0.0.1:4711")
+	if !ok || client.String() != "2.2.2.2" || proxy == nil || proxy.String() != "4.4.4.4" {
+		t.Fatalf("ClientAndProxy = (%v, %v, %v), want (2.2.2.2, 4.4.4.4, true)", client.String(), proxy, ok)
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_ClientIPWithMatchedRange(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("173.245.48.0/20", "2400:cb00::/32", "10.0.0.0/8")
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy)
+
+	tests := []struct {
+		name        string
+		headers     http.Header
+		wantIP      string
+		wantMatched string
+	}{
+		{
+			name:        "Cloudflare-style chain",
+			headers:     http.Header{"X-Forwarded-For": []string{`1.1.1.1, 173.245.49.7, 10.0.0.1`}},
+			wantIP:      "1.1.1.1",
+			wantMatched: "173.245.48.0/20",
+		},
+		{
+			name:        "IPv6 proxy",
+			headers:     http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2400:cb00::1`}},
+			wantIP:      "1.1.1.1",
+			wantMatched: "2400:cb00::/32",
+		},
+		{
+			name:    "Rightmost is untrusted",
+			headers: http.Header{"X-Forwarded-For": []string{`173.245.49.7, 1.1.1.1`}},
+			wantIP:  "1.1.1.1",
+		},
+		{
+			name:    "Fail: all trusted",
+			headers: http.Header{"X-Forwarded-For": []string{`173.245.49.7, 10.0.0.1`}},
+			wantIP:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, matched := strat.ClientIPWithMatchedRange(tt.headers, "")
+			if ip != tt.wantIP {
+				t.Fatalf("ClientIPWithMatchedRange ip = %q, want %q", ip, tt.wantIP)
+			}
+
+			if tt.wantMatched == "" {
+				if matched != nil {
+					t.Fatalf("ClientIPWithMatchedRange matched = %q, want nil", matched.String())
+				}
+			} else if matched == nil || matched.String() != tt.wantMatched {
+				t.Fatalf("ClientIPWithMatchedRange matched = %v, want %q", matched, tt.wantMatched)
+			}
+		})
+	}
+
+	// With WithIgnoreHeadersFromLoopback, a loopback RemoteAddr is the client, as with ClientIP
+	loopbackStrat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithIgnoreHeadersFromLoopback())).(RightmostTrustedRangeStrategy)
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 173.245.49.7`}}
+	ip, matched := loopbackStrat.ClientIPWithMatchedRange(headers, "[::1]:4711")
+	if want := loopbackStrat.ClientIP(headers, "[::1]:4711"); ip != want || ip != "::1" || matched != nil {
+		t.Fatalf("ClientIPWithMatchedRange with loopback = (%q, %v), want (%q, nil)", ip, matched, want)
+	}
+	if ip, matched := loopbackStrat.ClientIPWithMatchedRange(headers, "10.0.0.1:4711"); ip != "1.1.1.1" || matched == nil {
+		t.Fatalf("ClientIPWithMatchedRange = (%q, %v), want (%q, 173.245.48.0/20)", ip, matched, "1.1.1.1")
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_TrustedHopCount(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("173.245.48.0/20", "2400:cb00::/32", "10.0.0.0/8")
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)).(RightmostTrustedRangeStrategy)
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    int
+	}{
+		{
+			name:    "Two trusted hops",
+			headers: http.Header{"X-Forwarded-For": []string{`9.9.9.9, 1.1.1.1, 173.245.49.7, 10.0.0.1`}},
+			want:    2,
+		},
+		{
+			name:    "Three trusted hops across lines",
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2400:cb00::1`, `173.245.49.7, 10.0.0.1`}},
+			want:    3,
+		},
+		{
+			name:    "Rightmost is untrusted",
+			headers: http.Header{"X-Forwarded-For": []string{`173.245.49.7, 1.1.1.1`}},
+			want:    0,
+		},
+		{
+			name:    "Invalid entry",
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, nope, 10.0.0.1`}},
+			want:    1,
+		},
+		{
+			name:    "All trusted",
+			headers: http.Header{"X-Forwarded-For": []string{`173.245.49.7, 10.0.0.1`}},
+			want:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strat.TrustedHopCount(tt.headers, "")
+			if got != tt.want {
+				t.Fatalf("TrustedHopCount = %d, want %d", got, tt.want)
+			}
+
+			// A count-based strategy with one more than the hop count derives the same IP
+			rangeIP := strat.ClientIP(tt.headers, "")
+			if rangeIP == "" {
+				return
+			}
+			countStrat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", got+1))
+			if countIP := countStrat.ClientIP(tt.headers, ""); countIP != rangeIP {
+				t.Fatalf("count-based ClientIP = %q, want %q", countIP, rangeIP)
+			}
+		})
+	}
+}
+
+func TestWithDecodeTunneledIPv6(t *testing.T) {
+	tests := []struct {
+		name        string
+		ip          string
+		wantDefault bool
+		wantDecoded bool
+	}{
+		{
+			name:        "6to4 wrapping private IPv4",
+			ip:          `2002:c0a8:0101::`,
+			wantDefault: true,
+			wantDecoded: true,
+		},
+		{
+			name:        "6to4 wrapping public IPv4",
+			ip:          `2002:0101:0101::1`,
+			wantDefault: true,
+			wantDecoded: false,
+		},
+		{
+			name:        "Teredo wrapping documentation IPv4",
+			ip:          `2001:0:4136:e378:8000:63bf:3fff:fdd2`,
+			wantDefault: true,
+			wantDecoded: true,
+		},
+		{
+			name:        "Teredo wrapping public IPv4",
+			ip:          `2001:0:4136:e378:8000:63bf:fefe:fefe`,
+			wantDefault: true,
+			wantDecoded: false,
+		},
+		{
+			name:        "Non-tunneled IPv6",
+			ip:          `2607:f8b0:4004:83f::200e`,
+			wantDefault: false,
+			wantDecoded: false,
+		},
+		{
+			name:        "Non-tunneled private IPv4",
+			ip:          `10.0.0.1`,
+			wantDefault: true,
+			wantDecoded: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("net.ParseIP failed; bad test input")
+			}
+
+			if got := isPrivateOrLocal(ip, &options{}); got != tt.wantDefault {
+				t.Fatalf("default isPrivateOrLocal() = %v, want %v", got, tt.wantDefault)
+			}
+
+			decoded := newOptions([]Option{WithDecodeTunneledIPv6()})
+			if got := isPrivateOrLocal(ip, &decoded); got != tt.wantDecoded {
+				t.Fatalf("decoded isPrivateOrLocal() = %v, want %v", got, tt.wantDecoded)
+			}
+		})
+	}
+
+	// The option must also reach the check through a strategy
+	headers := http.Header{"X-Forwarded-For": []string{`2002:101:101::1, 2002:c0a8:101::1`}}
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithDecodeTunneledIPv6()))
+	if got := strat.ClientIP(headers, ""); got != "2002:101:101::1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2002:101:101::1")
+	}
+}
+
+func TestForwardedOptionalWhitespace(t *testing.T) {
+	mustParseIPAddrPtr := func(s string) *net.IPAddr {
+		res := MustParseIPAddr(s)
+		return &res
+	}
+
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    []*net.IPAddr
+	}{
+		{
+			name:    "Typical proxy output",
+			headers: http.Header{"Forwarded": []string{`For=1.1.1.1; proto=https, For=2.2.2.2`}},
+			want:    []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2.2.2.2")},
+		},
+		{
+			name:    "No whitespace",
+			headers: http.Header{"Forwarded": []string{`proto=https;For=1.1.1.1,For=2.2.2.2;by=3.3.3.3`}},
+			want:    []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2.2.2.2")},
+		},
+		{
+			name:    "Lots of whitespace",
+			headers: http.Header{"Forwarded": []string{"  proto=https  ;  For=1.1.1.1  ,  by=3.3.3.3 ;For=\"[2607:f8b0:4004:83f::200e]:4747\"  "}},
+			want:    []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2607:f8b0:4004:83f::200e")},
+		},
+		{
+			name:    "Tabs",
+			headers: http.Header{"Forwarded": []string{"For=1.1.1.1\t;\tproto=https\t,\tFor=2.2.2.2"}},
+			want:    []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2.2.2.2")},
+		},
+		{
+			name:    "Whitespace around equal sign is rejected",
+			headers: http.Header{"Forwarded": []string{`For =1.1.1.1, For= 2.2.2.2, For = 3.3.3.3, For=4.4.4.4`}},
+			want:    []*net.IPAddr{nil, nil, nil, mustParseIPAddrPtr("4.4.4.4")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getIPAddrList(tt.headers, "Forwarded", &options{}); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("getIPAddrList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRightmostTrustedRangeStrategy_validation(t *testing.T) {
+	cloudflare, err := AddressesAndRangesToIPNets(ranges.Cloudflare...)
+	if err != nil {
+		t.Fatalf("AddressesAndRangesToIPNets error: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		trustedRanges []net.IPNet
+		opts          []Option
+		wantErr       bool
+	}{
+		{
+			name:          "Valid ranges",
+			trustedRanges: cloudflare,
+		},
+		{
+			name:          "IPv4 in 16-byte form",
+			trustedRanges: []net.IPNet{{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}},
+		},
+		{
+			name:          "Error: zero-value range",
+			trustedRanges: []net.IPNet{mustParseCIDR("10.0.0.0/8"), {}},
+			wantErr:       true,
+		},
+		{
+			name:          "Error: missing mask",
+			trustedRanges: []net.IPNet{{IP: net.ParseIP("10.0.0.0").To4()}},
+			wantErr:       true,
+		},
+		{
+			name:          "Error: mismatched family",
+			trustedRanges: []net.IPNet{{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(8, 32)}},
+			wantErr:       true,
+		},
+		{
+			name:          "Error: non-canonical mask",
+			trustedRanges: []net.IPNet{{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.IPv4Mask(255, 0, 255, 0)}},
+			wantErr:       true,
+		},
+		{
+			name:          "Within maximum",
+			trustedRanges: cloudflare,
+			opts:          []Option{WithMaxTrustedRanges(len(cloudflare))},
+		},
+		{
+			name:          "Error: exceeds maximum",
+			trustedRanges: cloudflare,
+			opts:          []Option{WithMaxTrustedRanges(10)},
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", tt.trustedRanges, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithNormalizeZone(t *testing.T) {
+	lower := WithNormalizeZone(strings.ToLower)
+
+	headers := http.Header{
+		"X-Real-Ip":       []string{`fe80::abcd%ETH0`},
+		"X-Forwarded-For": []string{`fe80::1111%ETH0, 2607:f8b0:4004:83f::200e%ETH1`},
+		"Forwarded":       []string{`For="[2607:f8b0:4004:83f::200e%ETH1]:4747"`},
+	}
+	remoteAddr := "[fe80::2222%ETH0]:4747"
+
+	tests := []struct {
+		name  string
+		strat Strategy
+		want  string
+	}{
+		{
+			name:  "RemoteAddrStrategy",
+			strat: NewRemoteAddrStrategy(lower),
+			want:  "fe80::2222%eth0",
+		},
+		{
+			name:  "SingleIPHeaderStrategy",
+			strat: Must(NewSingleIPHeaderStrategy("X-Real-IP", lower)),
+			want:  "fe80::abcd%eth0",
+		},
+		{
+			name:  "LeftmostNonPrivateStrategy",
+			strat: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", lower)),
+			want:  "2607:f8b0:4004:83f::200e%eth1",
+		},
+		{
+			name:  "RightmostNonPrivateStrategy",
+			strat: Must(NewRightmostNonPrivateStrategy("Forwarded", lower)),
+			want:  "2607:f8b0:4004:83f::200e%eth1",
+		},
+		{
+			name:  "RightmostTrustedCountStrategy",
+			strat: Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, lower)),
+			want:  "fe80::1111%eth0",
+		},
+		{
+			name:  "RightmostTrustedRangeStrategy",
+			strat: Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", nil, lower)),
+			want:  "2607:f8b0:4004:83f::200e%eth1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strat.ClientIP(headers, remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Without the option, the zone is unchanged
+	if got := (RemoteAddrStrategy{}).ClientIP(headers, remoteAddr); got != "fe80::2222%ETH0" {
+		t.Fatalf("ClientIP = %q, want %q", got, "fe80::2222%ETH0")
+	}
+}
+
+func TestRemoteAddrZones(t *testing.T) {
+	// Go's net package formats RemoteAddr zones with the interface name on most platforms,
+	// but with the numeric interface index on some (like Windows), so both forms must be
+	// handled the same way, regardless of the platform the tests run on.
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+		wantStrip  string
+	}{
+		{
+			name:       "Named zone",
+			remoteAddr: "[fe80::1%eth0]:4711",
+			want:       "fe80::1%eth0",
+			wantStrip:  "fe80::1",
+		},
+		{
+			name:       "Numeric zone",
+			remoteAddr: "[fe80::1%3]:4711",
+			want:       "fe80::1%3",
+			wantStrip:  "fe80::1",
+		},
+		{
+			name:       "Windows-style interface name",
+			remoteAddr: "[fe80::1%Ethernet 2]:4711",
+			want:       "fe80::1%Ethernet 2",
+			wantStrip:  "fe80::1",
+		},
+		{
+			name:       "Numeric zone without port",
+			remoteAddr: "fe80::1%12",
+			want:       "fe80::1%12",
+			wantStrip:  "fe80::1",
+		},
+		{
+			name:       "No zone",
+			remoteAddr: "[fe80::1]:4711",
+			want:       "fe80::1",
+			wantStrip:  "fe80::1",
+		},
+		{
+			name:       "IPv4",
+			remoteAddr: "1.1.1.1:4711",
+			want:       "1.1.1.1",
+			wantStrip:  "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (RemoteAddrStrategy{}).ClientIP(nil, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+
+			if got := NewRemoteAddrStrategy(WithStripZone()).ClientIP(nil, tt.remoteAddr); got != tt.wantStrip {
+				t.Fatalf("ClientIP with WithStripZone = %q, want %q", got, tt.wantStrip)
+			}
+
+			// The zone is kept in the parsed address
+			ipAddr, err := ParseIPAddr(tt.want)
+			if err != nil {
+				t.Fatalf("ParseIPAddr error: %v", err)
+			}
+			if got := FormatIPAddr(ipAddr); got != tt.want {
+				t.Fatalf("FormatIPAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithStripZone(t *testing.T) {
+	headers := http.Header{
+		"X-Real-Ip":       []string{`fe80::abcd%3`},
+		"X-Forwarded-For": []string{`fe80::1111%eth0, 2607:f8b0:4004:83f::200e%eth1`},
+		"Forwarded":       []string{`For="[2607:f8b0:4004:83f::200e%7]:4747"`},
+	}
+
+	tests := []struct {
+		name  string
+		strat Strategy
+		want  string
+	}{
+		{
+			name:  "SingleIPHeaderStrategy",
+			strat: Must(NewSingleIPHeaderStrategy("X-Real-IP", WithStripZone())),
+			want:  "fe80::abcd",
+		},
+		{
+			name:  "RightmostNonPrivateStrategy",
+			strat: Must(NewRightmostNonPrivateStrategy("Forwarded", WithStripZone())),
+			want:  "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:  "RightmostTrustedCountStrategy",
+			strat: Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, WithStripZone())),
+			want:  "fe80::1111",
+		},
+		{
+			name:  "Takes precedence over WithNormalizeZone",
+			strat: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithNormalizeZone(strings.ToUpper), WithStripZone())),
+			want:  "2607:f8b0:4004:83f::200e",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// This test is most meaningful when run with the race detector (go test -race). Each
+// goroutine uses different headers, so a pooled slice being shared would show up as a
+// wrong result.
+func Test_getPooledIPAddrList_concurrent(t *testing.T) {
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2))
+
+	const goroutines = 32
+	const iterations = 200
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			want := fmt.Sprintf("1.1.1.%d", g)
+			// Vary the length of the list, so that slices of different sizes are pooled
+			xff := strings.Repeat("9.9.9.9, ", g) + want + ", 2.2.2.2"
+			headers := http.Header{"X-Forwarded-For": []string{xff}}
+			for i := 0; i < iterations; i++ {
+				if got := strat.ClientIP(headers, ""); got != want {
+					errs <- fmt.Errorf("ClientIP = %q, want %q", got, want)
+					return
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+
+	for g := 0; g < goroutines; g++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_putIPAddrList(t *testing.T) {
+	headers := http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2`}}
+	list := getPooledIPAddrList(headers, "X-Forwarded-For", &options{})
+	if len(*list) != 2 {
+		t.Fatalf("getPooledIPAddrList() len = %d, want 2", len(*list))
+	}
+
+	backing := (*list)[:cap(*list)]
+	putIPAddrList(list)
+	for i, ipAddr := range backing {
+		if ipAddr != nil {
+			t.Fatalf("putIPAddrList() did not clear element %d", i)
+		}
+	}
+}
+
+var benchmarkHeaders = http.Header{
+	"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2:4747, 2607:f8b0:4004:83f::200e`, `10.0.0.1, 192.168.1.1`},
+}
+
+func Benchmark_getIPAddrList(b *testing.B) {
+	b.ReportAllocs()
+	opts := &options{}
+	for i := 0; i < b.N; i++ {
+		_ = getIPAddrList(benchmarkHeaders, "X-Forwarded-For", opts)
+	}
+}
+
+func Benchmark_getPooledIPAddrList(b *testing.B) {
+	b.ReportAllocs()
+	opts := &options{}
+	for i := 0; i < b.N; i++ {
+		list := getPooledIPAddrList(benchmarkHeaders, "X-Forwarded-For", opts)
+		putIPAddrList(list)
+	}
+}
+
+// benchmarkBatchInputs returns n inputs with varied X-Forwarded-For headers.
+func benchmarkBatchInputs(n int) []Input {
+	inputs := make([]Input, n)
+	for i := range inputs {
+		inputs[i] = Input{
+			Headers: http.Header{
+				"X-Forwarded-For": []string{fmt.Sprintf("1.1.%d.%d, 2607:f8b0:4004:83f::%x, 10.0.0.%d", i/256%256, i%256, i, i%256)},
+			},
+			RemoteAddr: fmt.Sprintf("10.0.1.%d:4747", i%256),
+		}
+	}
+	return inputs
+}
+
+func TestRightmostTrustedCountStrategy_ClientIPErr(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "Success",
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2, 3.3.3.3`}},
+			want:    "2.2.2.2",
+		},
+		{
+			name:    "Chain too short",
+			headers: http.Header{"X-Forwarded-For": []string{`3.3.3.3`}},
+			wantErr: ErrChainTooShort,
+		},
+		{
+			name:    "Header missing",
+			headers: http.Header{},
+			wantErr: ErrChainTooShort,
+		},
+		{
+			name:    "Bad value at index",
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, nope, 3.3.3.3`}},
+			wantErr: ErrBadValueAtIndex,
+		},
+		{
+			name:    "Zero value at index",
+			headers: http.Header{"X-Forwarded-For": []string{`1.1.1.1, 0.0.0.0, 3.3.3.3`}},
+			wantErr: ErrBadValueAtIndex,
+		},
+	}
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)).(RightmostTrustedCountStrategy)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := strat.ClientIPErr(tt.headers, "")
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("ClientIPErr error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Fatalf("ClientIPErr = %q, want %q", got, tt.want)
+			}
+
+			// ClientIP must agree
+			if got := strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// With WithIgnoreHeadersFromLoopback, ClientIPErr and ClientIP agree on a loopback RemoteAddr
+	loopbackStrat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, WithIgnoreHeadersFromLoopback())).(RightmostTrustedCountStrategy)
+	headers := http.Header{"X-Forwarded-For": []string{`3.3.3.3`}}
+	for _, remoteAddr := range []string{"127.0.0.1:4711", "[::1]:4711"} {
+		got, err := loopbackStrat.ClientIPErr(headers, remoteAddr)
+		if err != nil {
+			t.Fatalf("ClientIPErr(%q) error: %v", remoteAddr, err)
+		}
+		if want := loopbackStrat.ClientIP(headers, remoteAddr); got != want || got == "" {
+			t.Fatalf("ClientIPErr(%q) = %q, want %q", remoteAddr, got, want)
+		}
+	}
+
+	// An unacceptable loopback RemoteAddr is an error
+	publicStrat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, WithIgnoreHeadersFromLoopback(), WithRequirePublicClient())).(RightmostTrustedCountStrategy)
+	if got, err := publicStrat.ClientIPErr(headers, "127.0.0.1:4711"); err == nil || got != "" {
+		t.Fatalf("ClientIPErr = (%q, %v), want an error", got, err)
+	}
+}
+
+func TestContiguousTrustedRangeStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = ContiguousTrustedRangeStrategy{}
+
+	type args struct {
+		headerName    string
+		headers       http.Header
+		remoteAddr    string
+		trustedRanges []string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "Contiguous trusted run",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, 2.2.2.2, 10.0.0.2`, `4.4.4.4`},
+				},
+				remoteAddr:    "10.0.0.1:4747",
+				trustedRanges: []string{`10.0.0.0/8`, `4.4.4.0/24`},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name: "Gap in trusted run",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, 4.4.4.5, 3.3.3.3, 10.0.0.2`},
+				},
+				remoteAddr:    "10.0.0.1:4747",
+				trustedRanges: []string{`10.0.0.0/8`, `4.4.4.0/24`},
+			},
+			// The trusted proxy at 4.4.4.5 is beyond the gap, so it doesn't count
+			want: "3.3.3.3",
+		},
+		{
+			name: "Untrusted RemoteAddr ignores headers",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, 10.0.0.2`},
+				},
+				remoteAddr:    "[2607:f8b0:4004:83f::200e]:4747",
+				trustedRanges: []string{`10.0.0.0/8`},
+			},
+			want: "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name: "Forwarded header",
+			args: args{
+				headerName: "Forwarded",
+				headers: http.Header{
+					"Forwarded": []string{`For=1.1.1.1, For="[2607:f8b0:4004:83f::200e]:4747";proto=https, For=10.0.0.2`},
+				},
+				remoteAddr:    "10.0.0.1",
+				trustedRanges: []string{`10.0.0.0/8`},
+			},
+			want: "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name: "Fail: invalid entry in trusted region",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1, nope, 10.0.0.2`},
+				},
+				remoteAddr:    "10.0.0.1:4747",
+				trustedRanges: []string{`10.0.0.0/8`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: all trusted",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`10.0.0.3, 10.0.0.2`},
+				},
+				remoteAddr:    "10.0.0.1:4747",
+				trustedRanges: []string{`10.0.0.0/8`},
+			},
+			want: "",
+		},
+		{
+			name: "Fail: bad RemoteAddr",
+			args: args{
+				headerName: "X-Forwarded-For",
+				headers: http.Header{
+					"X-Forwarded-For": []string{`1.1.1.1`},
+				},
+				remoteAddr:    "@",
+				trustedRanges: []string{`10.0.0.0/8`},
+			},
+			want: "",
+		},
+		{
+			name: "Error: empty header name",
+			args: args{
+				headerName: "",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Error: bad header name",
+			args: args{
+				headerName: "X-Real-IP",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := AddressesAndRangesToIPNets(tt.args.trustedRanges...)
+			if err != nil {
+				// We're not testing AddressesAndRangesToIPNets here
+				t.Fatalf("AddressesAndRangesToIPNets failed")
+			}
+
+			strat, err := NewContiguousTrustedRangeStrategy(tt.args.headerName, ranges)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewContiguousTrustedRangeStrategy error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				// We can't continue
+				return
+			}
+
+			got := strat.ClientIP(tt.args.headers, tt.args.remoteAddr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsListHeaderName(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerName string
+		want       bool
+		wantCanon  string
+	}{
+		{
+			name:       "X-Forwarded-For",
+			headerName: "X-Forwarded-For",
+			want:       true,
+			wantCanon:  "X-Forwarded-For",
+		},
+		{
+			name:       "Non-canonical X-Forwarded-For",
+			headerName: "x-forwarded-FOR",
+			want:       true,
+			wantCanon:  "X-Forwarded-For",
+		},
+		{
+			name:       "Forwarded",
+			headerName: "forwarded",
+			want:       true,
+			wantCanon:  "Forwarded",
+		},
+		{
+			name:       "X-Real-IP",
+			headerName: "X-Real-IP",
+			want:       false,
+			wantCanon:  "X-Real-Ip",
+		},
+		{
+			name:       "Empty",
+			headerName: "",
+			want:       false,
+			wantCanon:  "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsListHeaderName(tt.headerName); got != tt.want {
+				t.Fatalf("IsListHeaderName() = %v, want %v", got, tt.want)
+			}
+
+			if got := CanonicalHeaderName(tt.headerName); got != tt.wantCanon {
+				t.Fatalf("CanonicalHeaderName() = %q, want %q", got, tt.wantCanon)
+			}
+
+			// The pre-check must agree with the constructor
+			_, err := NewRightmostNonPrivateStrategy(tt.headerName)
+			if (err == nil) != tt.want {
+				t.Fatalf("NewRightmostNonPrivateStrategy error = %v, but IsListHeaderName = %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnbracketedEmbeddedIPv4InXFF(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{
+			name: "NAT64",
+			ip:   `64:ff9b::188.0.2.128`,
+			want: "64:ff9b::bc00:280",
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			ip:   `::ffff:188.0.2.128`,
+			want: "188.0.2.128",
+		},
+	}
+
+	leftmost := Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For"))
+	rightmost := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Private addresses surround the test address, so that it's selected by both
+			// scans, and it's in a middle position, so that both separators are exercised.
+			headers := http.Header{"X-Forwarded-For": []string{`10.0.0.1, ` + tt.ip + `,192.168.1.1`}}
+			if got := leftmost.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("leftmost ClientIP = %q, want %q", got, tt.want)
+			}
+			if got := rightmost.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("rightmost ClientIP = %q, want %q", got, tt.want)
+			}
+
+			// As the only entry
+			headers = http.Header{"X-Forwarded-For": []string{tt.ip}}
+			if got := leftmost.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("leftmost single ClientIP = %q, want %q", got, tt.want)
+			}
+			if got := rightmost.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("rightmost single ClientIP = %q, want %q", got, tt.want)
+			}
+
+			// In its own header instance, among others
+			headers = http.Header{"X-Forwarded-For": []string{`10.0.0.1`, tt.ip, `192.168.1.1`}}
+			if got := leftmost.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("leftmost multi-header ClientIP = %q, want %q", got, tt.want)
+			}
+			if got := rightmost.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("rightmost multi-header ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainStrategy_ClientIPWithFallbackInfo(t *testing.T) {
+	strat := NewChainStrategy(
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+		RemoteAddrStrategy{},
+	)
+
+	tests := []struct {
+		name             string
+		strat            ChainStrategy
+		headers          http.Header
+		remoteAddr       string
+		want             string
+		wantUsedFallback bool
+	}{
+		{
+			name:             "Headers absent",
+			strat:            strat,
+			headers:          http.Header{},
+			remoteAddr:       "5.5.5.5:4747",
+			want:             "5.5.5.5",
+			wantUsedFallback: true,
+		},
+		{
+			name:             "Header matches",
+			strat:            strat,
+			headers:          http.Header{"X-Real-Ip": []string{`1.1.1.1`}},
+			remoteAddr:       "5.5.5.5:4747",
+			want:             "1.1.1.1",
+			wantUsedFallback: false,
+		},
+		{
+			name:             "Nested chain falls back",
+			strat:            NewChainStrategy(Must(NewSingleIPHeaderStrategy("X-Real-IP")), NewChainStrategy(RemoteAddrStrategy{})),
+			headers:          http.Header{},
+			remoteAddr:       "5.5.5.5:4747",
+			want:             "5.5.5.5",
+			wantUsedFallback: true,
+		},
+		{
+			name:             "Fail: everything fails",
+			strat:            strat,
+			headers:          http.Header{},
+			remoteAddr:       "@",
+			want:             "",
+			wantUsedFallback: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, usedFallback := tt.strat.ClientIPWithFallbackInfo(tt.headers, tt.remoteAddr)
+			if got != tt.want || usedFallback != tt.wantUsedFallback {
+				t.Fatalf("ClientIPWithFallbackInfo = (%q, %v), want (%q, %v)", got, usedFallback, tt.want, tt.wantUsedFallback)
+			}
+		})
+	}
+}
+
+func TestWithCommaJoinedRemoteAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantStrict string
+		wantJoined string
+	}{
+		{
+			name:       "Comma-joined",
+			remoteAddr: "1.1.1.1:80, 2.2.2.2:81",
+			wantStrict: "",
+			wantJoined: "2.2.2.2",
+		},
+		{
+			name:       "Comma-joined IPv6",
+			remoteAddr: "1.1.1.1:80,[2607:f8b0:4004:83f::200e]:81",
+			wantStrict: "",
+			wantJoined: "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:       "Single address",
+			remoteAddr: "2.2.2.2:81",
+			wantStrict: "2.2.2.2",
+			wantJoined: "2.2.2.2",
+		},
+		{
+			name:       "Trailing comma",
+			remoteAddr: "1.1.1.1,",
+			wantStrict: "",
+			wantJoined: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (RemoteAddrStrategy{}).ClientIP(nil, tt.remoteAddr); got != tt.wantStrict {
+				t.Fatalf("strict ClientIP = %q, want %q", got, tt.wantStrict)
+			}
+
+			if got := NewRemoteAddrStrategy(WithCommaJoinedRemoteAddr()).ClientIP(nil, tt.remoteAddr); got != tt.wantJoined {
+				t.Fatalf("joined ClientIP = %q, want %q", got, tt.wantJoined)
+			}
+		})
+	}
+}
+
+func TestSingleIPHeaderStrategy_allowlist(t *testing.T) {
+	allowed, _ := AddressesAndRangesToIPNets("10.1.0.0/16")
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		header string
+		want   string
+	}{
+		{
+			name:   "No options, private",
+			header: "192.168.1.1",
+			want:   "192.168.1.1",
+		},
+		{
+			name:   "Require public, private",
+			opts:   []Option{WithRequirePublic()},
+			header: "192.168.1.1",
+			want:   "",
+		},
+		{
+			name:   "Require public, loopback",
+			opts:   []Option{WithRequirePublic()},
+			header: "::1",
+			want:   "",
+		},
+		{
+			name:   "Require public, public",
+			opts:   []Option{WithRequirePublic()},
+			header: "2607:f8b0:4004:83f::200e",
+			want:   "2607:f8b0:4004:83f::200e",
+		},
+		{
+			name:   "Allowed ranges, within",
+			opts:   []Option{WithAllowedRanges(allowed)},
+			header: "10.1.2.3",
+			want:   "10.1.2.3",
+		},
+		{
+			name:   "Allowed ranges, public outside",
+			opts:   []Option{WithAllowedRanges(allowed)},
+			header: "1.1.1.1",
+			want:   "",
+		},
+		{
+			name:   "Both, public",
+			opts:   []Option{WithRequirePublic(), WithAllowedRanges(allowed)},
+			header: "1.1.1.1",
+			want:   "1.1.1.1",
+		},
+		{
+			name:   "Both, allowed private",
+			opts:   []Option{WithRequirePublic(), WithAllowedRanges(allowed)},
+			header: "10.1.2.3",
+			want:   "10.1.2.3",
+		},
+		{
+			name:   "Both, other private",
+			opts:   []Option{WithRequirePublic(), WithAllowedRanges(allowed)},
+			header: "10.2.2.3",
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := Must(NewSingleIPHeaderStrategy("CF-Connecting-IP", tt.opts...))
+			headers := http.Header{"Cf-Connecting-Ip": []string{tt.header}}
+			if got := strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHopCount(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerName string
+		headers    http.Header
+		want       int
+	}{
+		{
+			name:       "No header",
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{},
+			want:       0,
+		},
+		{
+			name:       "XFF with garbage",
+			headerName: "X-Forwarded-For",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1, garbage, 2.2.2.2"}},
+			want:       2,
+		},
+		{
+			name:       "XFF multiple headers and empty items",
+			headerName: "x-forwarded-for",
+			headers:    http.Header{"X-Forwarded-For": []string{"1.1.1.1,, 2.2.2.2,", "3.3.3.3"}},
+			want:       3,
+		},
+		{
+			name:       "Forwarded",
+			headerName: "Forwarded",
+			headers:    http.Header{"Forwarded": []string{`For=1.1.1.1, proto=https, For="[2607:f8b0:4004:83f::200e]:4711"`}},
+			want:       2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HopCount(tt.headers, tt.headerName); got != tt.want {
+				t.Fatalf("HopCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTrustChain(t *testing.T) {
+	ranges, err := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		headerName       string
+		headers          http.Header
+		wantClientIP     string
+		wantTrustedCount int
+		wantOK           bool
+	}{
+		{
+			name:             "Fully trusted tail",
+			headerName:       "X-Forwarded-For",
+			headers:          http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 10.0.0.1", "2001:db8::1"}},
+			wantClientIP:     "2.2.2.2",
+			wantTrustedCount: 2,
+			wantOK:           true,
+		},
+		{
+			name:             "No trusted hops",
+			headerName:       "X-Forwarded-For",
+			headers:          http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}},
+			wantClientIP:     "2.2.2.2",
+			wantTrustedCount: 0,
+			wantOK:           true,
+		},
+		{
+			name:             "Broken tail",
+			headerName:       "X-Forwarded-For",
+			headers:          http.Header{"X-Forwarded-For": []string{"1.1.1.1, garbage, 10.0.0.2, 10.0.0.1"}},
+			wantClientIP:     "",
+			wantTrustedCount: 2,
+			wantOK:           false,
+		},
+		{
+			name:             "All trusted",
+			headerName:       "X-Forwarded-For",
+			headers:          http.Header{"X-Forwarded-For": []string{"10.0.0.2, 10.0.0.1"}},
+			wantClientIP:     "",
+			wantTrustedCount: 2,
+			wantOK:           false,
+		},
+		{
+			name:             "No header",
+			headerName:       "X-Forwarded-For",
+			headers:          http.Header{},
+			wantClientIP:     "",
+			wantTrustedCount: 0,
+			wantOK:           false,
+		},
+		{
+			name:             "Forwarded",
+			headerName:       "forwarded",
+			headers:          http.Header{"Forwarded": []string{`For=1.1.1.1, For="[2001:db8::2]:4711";proto=https`}},
+			wantClientIP:     "1.1.1.1",
+			wantTrustedCount: 1,
+			wantOK:           true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientIP, trustedCount, ok := ValidateTrustChain(tt.headers, tt.headerName, ranges)
+			if clientIP != tt.wantClientIP || trustedCount != tt.wantTrustedCount || ok != tt.wantOK {
+				t.Fatalf("ValidateTrustChain() = (%q, %d, %v), want (%q, %d, %v)",
+					clientIP, trustedCount, ok, tt.wantClientIP, tt.wantTrustedCount, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestWithRejectMappedIPv6(t *testing.T) {
+	tests := []struct {
+		name       string
+		newStrat   func(opts ...Option) (Strategy, error)
+		headers    http.Header
+		wantAccept string
+		wantReject string
+	}{
+		{
+			name: "Leftmost XFF",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostNonPrivateStrategy("X-Forwarded-For", opts...)
+			},
+			headers:    http.Header{"X-Forwarded-For": []string{"::ffff:188.0.2.128, 3.3.3.3"}},
+			wantAccept: "188.0.2.128",
+			wantReject: "3.3.3.3",
+		},
+		{
+			name: "Rightmost Forwarded",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostNonPrivateStrategy("Forwarded", opts...)
+			},
+			headers:    http.Header{"Forwarded": []string{`For=3.3.3.3, For="[::ffff:188.0.2.128]:4711"`}},
+			wantAccept: "188.0.2.128",
+			wantReject: "3.3.3.3",
+		},
+		{
+			name: "Single-IP header",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewSingleIPHeaderStrategy("X-Real-IP", opts...)
+			},
+			headers:    http.Header{"X-Real-Ip": []string{"::ffff:188.0.2.128"}},
+			wantAccept: "188.0.2.128",
+			wantReject: "",
+		},
+		{
+			name: "Single-IP header, plain IPv4",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewSingleIPHeaderStrategy("X-Real-IP", opts...)
+			},
+			headers:    http.Header{"X-Real-Ip": []string{"188.0.2.128"}},
+			wantAccept: "188.0.2.128",
+			wantReject: "188.0.2.128",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := Must(tt.newStrat())
+			if got := strat.ClientIP(tt.headers, ""); got != tt.wantAccept {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantAccept)
+			}
+
+			strat = Must(tt.newStrat(WithRejectMappedIPv6()))
+			if got := strat.ClientIP(tt.headers, ""); got != tt.wantReject {
+				t.Fatalf("rejecting ClientIP = %q, want %q", got, tt.wantReject)
+			}
+		})
+	}
+}
+
+func TestWithRequireTrustedHop(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
+	tests := []struct {
+		name        string
+		xff         string
+		wantDefault string
+		wantRequire string
+	}{
+		{
+			name:        "Trusted rightmost hop",
+			xff:         "1.1.1.1, 2.2.2.2, 10.0.0.1",
+			wantDefault: "2.2.2.2",
+			wantRequire: "2.2.2.2",
+		},
+		{
+			name:        "Untrusted rightmost entry",
+			xff:         "1.1.1.1, 2.2.2.2",
+			wantDefault: "2.2.2.2",
+			wantRequire: "",
+		},
+		{
+			name:        "Single untrusted entry",
+			xff:         "2.2.2.2",
+			wantDefault: "2.2.2.2",
+			wantRequire: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+
+			strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges))
+			if got := strat.ClientIP(headers, ""); got != tt.wantDefault {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantDefault)
+			}
+
+			strat = Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithRequireTrustedHop()))
+			if got := strat.ClientIP(headers, ""); got != tt.wantRequire {
+				t.Fatalf("requiring ClientIP = %q, want %q", got, tt.wantRequire)
+			}
+		})
+	}
+}
+
+func TestWithRequireGlobalUnicast(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("127.0.0.1")
+
+	tests := []struct {
+		name        string
+		newStrat    func(opts ...Option) (Strategy, error)
+		headers     http.Header
+		remoteAddr  string
+		wantDefault string
+		wantRequire string
+	}{
+		{
+			name: "Single-IP header with documentation IPv6",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewSingleIPHeaderStrategy("X-Real-IP", opts...)
+			},
+			headers:     http.Header{"X-Real-Ip": []string{"2001:db8::1"}},
+			wantDefault: "2001:db8::1",
+			wantRequire: "",
+		},
+		{
+			name: "Trusted count with documentation IPv4",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, opts...)
+			},
+			headers:     http.Header{"X-Forwarded-For": []string{"1.1.1.1, 203.0.113.5"}},
+			wantDefault: "203.0.113.5",
+			wantRequire: "",
+		},
+		{
+			name: "Trusted range with loopback proxy",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...)
+			},
+			headers:     http.Header{"X-Forwarded-For": []string{"1.1.1.1, 127.0.0.1"}},
+			wantDefault: "1.1.1.1",
+			wantRequire: "1.1.1.1",
+		},
+		{
+			name: "Trusted range with multicast client",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...)
+			},
+			headers:     http.Header{"X-Forwarded-For": []string{"1.1.1.1, 224.0.0.1, 127.0.0.1"}},
+			wantDefault: "224.0.0.1",
+			wantRequire: "",
+		},
+		{
+			name: "Leftmost skips benchmarking",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewLeftmostNonPrivateStrategy("X-Forwarded-For", opts...)
+			},
+			headers:     http.Header{"X-Forwarded-For": []string{"198.19.0.1, 2.2.2.2"}},
+			wantDefault: "198.19.0.1",
+			wantRequire: "2.2.2.2",
+		},
+		{
+			name: "Remote addr link-local",
+			newStrat: func(opts ...Option) (Strategy, error) {
+				return NewRemoteAddrStrategy(opts...), nil
+			},
+			remoteAddr:  "[fe80::1]:4711",
+			wantDefault: "fe80::1",
+			wantRequire: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := Must(tt.newStrat())
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.wantDefault {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantDefault)
+			}
+
+			strat = Must(tt.newStrat(WithRequireGlobalUnicast()))
+			if got := strat.ClientIP(tt.headers, tt.remoteAddr); got != tt.wantRequire {
+				t.Fatalf("requiring ClientIP = %q, want %q", got, tt.wantRequire)
+			}
+		})
+	}
+
+	strat := Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, WithRequireGlobalUnicast())).(RightmostTrustedCountStrategy)
+	if _, err := strat.ClientIPErr(http.Header{"X-Forwarded-For": []string{"203.0.113.5"}}, ""); !errors.Is(err, ErrBadValueAtIndex) {
+		t.Fatalf("ClientIPErr error = %v, want ErrBadValueAtIndex", err)
+	}
+}
+
+func TestWithRequirePublicClient(t *testing.T) {
+	trustedRanges, _ := AddressesAndRangesToIPNets("192.168.0.0/16")
+
+	tests := []struct {
+		name        string
+		xff         string
+		wantDefault string
+		wantRequire string
+	}{
+		{
+			name:        "Private client",
+			xff:         "1.1.1.1, 10.0.0.5, 192.168.1.1",
+			wantDefault: "10.0.0.5",
+			wantRequire: "",
+		},
+		{
+			name:        "Public client",
+			xff:         "10.0.0.5, 1.1.1.1, 192.168.1.1",
+			wantDefault: "1.1.1.1",
+			wantRequire: "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{tt.xff}}
+
+			strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges))
+			if got := strat.ClientIP(headers, ""); got != tt.wantDefault {
+				t.Fatalf("default ClientIP = %q, want %q", got, tt.wantDefault)
+			}
+
+			strat = Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithRequirePublicClient()))
+			if got := strat.ClientIP(headers, ""); got != tt.wantRequire {
+				t.Fatalf("requiring ClientIP = %q, want %q", got, tt.wantRequire)
+			}
+
+			_, _, ok := strat.(RightmostTrustedRangeStrategy).ClientAndProxy(headers, "")
+			if ok != (tt.wantRequire != "") {
+				t.Fatalf("requiring ClientAndProxy ok = %v", ok)
+			}
+		})
+	}
+}
+
+func TestRightmostTrustedCountByHeaderStrategy(t *testing.T) {
+	// Ensure the strategy interface is implemented
+	var _ Strategy = RightmostTrustedCountByHeaderStrategy{}
+
+	counts := map[string]int{"old": 1, "new": 2}
+	strat, err := NewRightmostTrustedCountByHeaderStrategy("X-Forwarded-For", "X-Topology", counts)
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedCountByHeaderStrategy error = %v", err)
+	}
+
+	// Later modification of the map must not affect the strategy
+	counts["old"] = 3
+
+	tests := []struct {
+		name     string
+		selector []string
+		want     string
+	}{
+		{
+			name:     "Count 1",
+			selector: []string{"old"},
+			want:     "3.3.3.3",
+		},
+		{
+			name:     "Count 2",
+			selector: []string{"new"},
+			want:     "2.2.2.2",
+		},
+		{
+			name:     "Fail: unknown selector",
+			selector: []string{"other"},
+			want:     "",
+		},
+		{
+			name:     "Fail: missing selector",
+			selector: nil,
+			want:     "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}}
+			if tt.selector != nil {
+				headers["X-Topology"] = tt.selector
+			}
+
+			if got := strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got, want := strat.String(), "RightmostTrustedCountByHeaderStrategy{header=X-Forwarded-For, selector=X-Topology, counts=map[new:2 old:1]}"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+
+	// Constructor errors
+	badArgs := []struct {
+		headerName     string
+		selectorHeader string
+		counts         map[string]int
+	}{
+		{"X-Forwarded-For", "", map[string]int{"a": 1}},
+		{"X-Forwarded-For", "X-Topology", nil},
+		{"X-Forwarded-For", "X-Topology", map[string]int{"a": 0}},
+		{"X-Real-IP", "X-Topology", map[string]int{"a": 1}},
+	}
+	for _, args := range badArgs {
+		if _, err := NewRightmostTrustedCountByHeaderStrategy(args.headerName, args.selectorHeader, args.counts); err == nil {
+			t.Fatalf("NewRightmostTrustedCountByHeaderStrategy(%q, %q, %v) did not return an error", args.headerName, args.selectorHeader, args.counts)
+		}
+	}
+}
+
+func TestRightmostTrustedRangeStrategy_SetRanges(t *testing.T) {
+	rangesA, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+	rangesB, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2.2.2.2")
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 10.0.0.1"}}
+
+	strat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", rangesA)).(RightmostTrustedRangeStrategy)
+	chain := NewChainStrategy(strat, RemoteAddrStrategy{})
+
+	if got := chain.ClientIP(headers, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+
+	// Copies of the strategy, like the one in the chain, see the new ranges
+	if err := strat.SetRanges(rangesB); err != nil {
+		t.Fatalf("SetRanges error = %v", err)
+	}
+	if got := chain.ClientIP(headers, ""); got != "1.1.1.1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+	}
+	if got := strat.String(); got != "RightmostTrustedRangeStrategy{header=X-Forwarded-For, ranges=2}" {
+		t.Fatalf("String() = %q", got)
+	}
+
+	// Invalid ranges are rejected and don't change the strategy
+	if err := strat.SetRanges([]net.IPNet{{}}); err == nil {
+		t.Fatalf("SetRanges with invalid range did not return an error")
+	}
+	if got := strat.ClientIP(headers, ""); got != "1.1.1.1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+	}
+
+	// The zero value can't be updated
+	if err := (RightmostTrustedRangeStrategy{}).SetRanges(rangesA); err == nil {
+		t.Fatalf("SetRanges on zero value did not return an error")
+	}
+
+	// Swap the ranges while ClientIP is in use. This is mostly useful with -race.
+	const goroutines = 8
+	stop := make(chan struct{})
+	done := make(chan string, goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					done <- ""
+					return
+				default:
+				}
+
+				if got := strat.ClientIP(headers, ""); got != "1.1.1.1" && got != "2.2.2.2" {
+					done <- got
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		ranges := rangesA
+		if i%2 == 0 {
+			ranges = rangesB
+		}
+		if err := strat.SetRanges(ranges); err != nil {
+			t.Fatalf("SetRanges error = %v", err)
+		}
+	}
+	close(stop)
+
+	for g := 0; g < goroutines; g++ {
+		if got := <-done; got != "" {
+			t.Fatalf("ClientIP during SetRanges = %q", got)
+		}
 	}
 }
 
-func Test_goodIPAddr(t *testing.T) {
-	// This is mostly a copy of TestParseIPAddr, except that zero and unspecified addresses are disallowed
+func TestCGNATIsPrivate(t *testing.T) {
+	// Carrier-grade NAT space is always treated as private, so there is no option for it
+	for _, ip := range []string{"100.64.0.0", "100.64.1.1", "100.127.255.255"} {
+		if !isPrivateOrLocal(net.ParseIP(ip), &options{}) {
+			t.Fatalf("isPrivateOrLocal(%s) = false, want true", ip)
+		}
+	}
+	for _, ip := range []string{"100.63.255.255", "100.128.0.0"} {
+		if isPrivateOrLocal(net.ParseIP(ip), &options{}) {
+			t.Fatalf("isPrivateOrLocal(%s) = true, want false", ip)
+		}
+	}
+
+	headers := http.Header{"X-Forwarded-For": []string{"1.1.1.1, 100.64.1.1"}}
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+	if got := strat.ClientIP(headers, ""); got != "1.1.1.1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+	}
+}
+
+func TestUnixSocketRemoteAddr(t *testing.T) {
+	// Connections on a Unix domain socket have a RemoteAddr of "@". Strategies that only
+	// use headers must be unaffected, and only the RemoteAddr fallback should fail.
+	const remoteAddr = "@"
+	headers := http.Header{
+		"X-Real-Ip":       []string{"1.1.1.1"},
+		"X-Forwarded-For": []string{"1.1.1.1, 10.0.0.1"},
+		"Forwarded":       []string{"For=1.1.1.1, For=10.0.0.1"},
+	}
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
+
 	tests := []struct {
 		name  string
-		ipStr string
-		want  *net.IPAddr
+		strat Strategy
+		want  string
 	}{
 		{
-			name:  "Empty zone",
-			ipStr: "1.1.1.1%",
-			want:  &net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+			name:  "RemoteAddrStrategy",
+			strat: RemoteAddrStrategy{},
+			want:  "",
 		},
 		{
-			name:  "No zone",
-			ipStr: "1.1.1.1",
-			want:  &net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+			name:  "SingleIPHeaderStrategy",
+			strat: Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			want:  "1.1.1.1",
 		},
 		{
-			name:  "With zone",
-			ipStr: "fe80::abcd%zone",
-			want:  &net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "zone"},
+			name:  "LeftmostNonPrivateStrategy",
+			strat: Must(NewLeftmostNonPrivateStrategy("Forwarded")),
+			want:  "1.1.1.1",
 		},
 		{
-			name:  "With zone and port",
-			ipStr: "[2607:f8b0:4004:83f::200e%zone]:4484",
-			want:  &net.IPAddr{IP: net.ParseIP("2607:f8b0:4004:83f::200e"), Zone: "zone"},
+			name:  "RightmostNonPrivateStrategy",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			want:  "1.1.1.1",
 		},
 		{
-			name:  "With port",
-			ipStr: "1.1.1.1:48944",
-			want:  &net.IPAddr{IP: net.ParseIP("1.1.1.1"), Zone: ""},
+			name:  "RightmostTrustedCountStrategy",
+			strat: Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2)),
+			want:  "1.1.1.1",
 		},
 		{
-			name:  "Bad port (is discarded)",
-			ipStr: "[fe80::abcd%eth0]:xyz",
-			want:  &net.IPAddr{IP: net.ParseIP("fe80::abcd"), Zone: "eth0"},
+			name:  "RightmostTrustedRangeStrategy",
+			strat: Must(NewRightmostTrustedRangeStrategy("Forwarded", trustedRanges)),
+			want:  "1.1.1.1",
 		},
 		{
-			name:  "Error: Zero address",
-			ipStr: "0.0.0.0",
-			want:  nil,
+			// This strategy needs RemoteAddr to know if the connection is from a trusted proxy
+			name:  "ContiguousTrustedRangeStrategy",
+			strat: Must(NewContiguousTrustedRangeStrategy("X-Forwarded-For", trustedRanges)),
+			want:  "",
 		},
 		{
-			name:  "Error: Unspecified address",
-			ipStr: "::",
-			want:  nil,
+			name: "ChainStrategy uses header",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				RemoteAddrStrategy{},
+			),
+			want: "1.1.1.1",
 		},
 		{
-			name:  "Error: bad IP with zone",
-			ipStr: "nope%zone",
-			want:  nil,
+			name: "ChainStrategy falls back to RemoteAddr",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")),
+				RemoteAddrStrategy{},
+			),
+			want: "",
 		},
 		{
-			name:  "Error: bad IP",
-			ipStr: "nope!!",
-			want:  nil,
+			name:  "DefaultStrategy",
+			strat: DefaultStrategy(),
+			want:  "1.1.1.1",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := goodIPAddr(tt.ipStr)
-
-			if got == nil || tt.want == nil {
-				if got != tt.want {
-					t.Fatalf("ParseIPAddr() = %v, want %v", got, tt.want)
-				}
-				return
-			}
-
-			if !ipAddrsEqual(*got, *tt.want) {
-				t.Fatalf("ParseIPAddr() = %v, want %v", *got, *tt.want)
+			if got := tt.strat.ClientIP(headers, remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_isPrivateOrLocal(t *testing.T) {
+func TestIPInRanges(t *testing.T) {
+	ranges, _ := AddressesAndRangesToIPNets("10.0.0.0/8", "2001:db8::/32", "::ffff:192.168.0.0/112")
+
 	tests := []struct {
 		name string
-		ip   string
+		ip   net.IP
 		want bool
 	}{
 		{
-			name: "IPv4 loopback",
-			ip:   `127.0.0.2`,
+			name: "IPv4",
+			ip:   net.ParseIP("10.1.2.3"),
 			want: true,
 		},
 		{
-			name: "IPv6 loopback",
-			ip:   `::1`,
+			name: "4-byte IPv4",
+			ip:   net.ParseIP("10.1.2.3").To4(),
 			want: true,
 		},
 		{
-			name: "IPv4 10.*",
-			ip:   `10.0.0.1`,
+			name: "IPv4-mapped in IPv4 range",
+			ip:   net.ParseIP("::ffff:10.1.2.3"),
 			want: true,
 		},
 		{
-			name: "IPv4 192.168.*",
-			ip:   `192.168.1.1`,
+			name: "IPv4 in mapped range",
+			ip:   net.ParseIP("192.168.1.1"),
 			want: true,
 		},
 		{
-			name: "IPv6 unique local address",
-			ip:   `fd12:3456:789a:1::1`,
+			name: "IPv6",
+			ip:   net.ParseIP("2001:db8::1"),
 			want: true,
 		},
 		{
-			name: "IPv4 link-local",
-			ip:   `169.254.1.1`,
-			want: true,
+			name: "IPv4 not contained",
+			ip:   net.ParseIP("11.1.2.3"),
+			want: false,
 		},
 		{
-			name: "IPv6 link-local",
-			ip:   `fe80::abcd`,
-			want: true,
+			name: "IPv6 not contained",
+			ip:   net.ParseIP("2607:f8b0:4004:83f::200e"),
+			want: false,
 		},
 		{
-			name: "Non-local IPv4",
-			ip:   `1.1.1.1`,
+			name: "NAT64 is not IPv4",
+			ip:   net.ParseIP("64:ff9b::10.1.2.3"),
 			want: false,
 		},
 		{
-			name: "Non-local IPv4-mapped IPv6",
-			ip:   `::ffff:188.0.2.128`,
+			name: "Nil IP",
+			ip:   nil,
 			want: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ip := net.ParseIP(tt.ip)
-			if ip == nil {
-				t.Fatalf("net.ParseIP failed; bad test input")
-			}
-			if got := isPrivateOrLocal(ip); got != tt.want {
-				t.Fatalf("isPrivateOrLocal() = %v, want %v", got, tt.want)
+			if got := IPInRanges(tt.ip, ranges); got != tt.want {
+				t.Fatalf("IPInRanges(%v) = %v, want %v", tt.ip, got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_mustParseCIDR(t *testing.T) {
-	// We test the non-panic path elsewhere, but we need to specifically check the panic case
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("mustParseCIDR() did not panic")
-		}
-	}()
+func TestWithLastHeaderLineOnly(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2", "3.3.3.3, 10.0.0.1"},
+		"Forwarded":       []string{"For=1.1.1.1, For=2.2.2.2", "For=3.3.3.3, For=10.0.0.1"},
+	}
 
-	mustParseCIDR("nope")
+	for _, headerName := range []string{"X-Forwarded-For", "Forwarded"} {
+		t.Run(headerName, func(t *testing.T) {
+			tests := []struct {
+				name  string
+				strat Strategy
+				want  string
+			}{
+				{
+					name:  "Leftmost without option",
+					strat: Must(NewLeftmostNonPrivateStrategy(headerName)),
+					want:  "1.1.1.1",
+				},
+				{
+					name:  "Leftmost with option",
+					strat: Must(NewLeftmostNonPrivateStrategy(headerName, WithLastHeaderLineOnly())),
+					want:  "3.3.3.3",
+				},
+				{
+					name:  "Rightmost trusted count without option",
+					strat: Must(NewRightmostTrustedCountStrategy(headerName, 4)),
+					want:  "1.1.1.1",
+				},
+				{
+					name:  "Rightmost trusted count with option",
+					strat: Must(NewRightmostTrustedCountStrategy(headerName, 4, WithLastHeaderLineOnly())),
+					want:  "",
+				},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					if got := tt.strat.ClientIP(headers, ""); got != tt.want {
+						t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+					}
+				})
+			}
+		})
+	}
+
+	// A single line is unaffected
+	strat := Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithLastHeaderLineOnly()))
+	if got := strat.ClientIP(http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}}, ""); got != "1.1.1.1" {
+		t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+	}
 }
 
-func Test_trimMatchedEnds(t *testing.T) {
-	// We test the non-panic paths elsewhere, but we need to specifically check the panic case
-	defer func() {
-		if r := recover(); r == nil {
-			t.Fatalf("trimMatchedEnds() did not panic")
-		}
-	}()
+func TestZonePortBracketCombinations(t *testing.T) {
+	// Proxies vary in how they format zoned IPv6 addresses, so all combinations of zone,
+	// port, brackets, and quotes are checked in each header.
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: `fe80::abcd%zone`, want: "fe80::abcd%zone"},
+		{value: `[fe80::abcd%zone]`, want: "fe80::abcd%zone"},
+		{value: `[fe80::abcd%zone]:4711`, want: "fe80::abcd%zone"},
+		{value: `[fe80::abcd]:4711`, want: "fe80::abcd"},
+		{value: `fe80::abcd`, want: "fe80::abcd"},
+		{value: `[fe80::abcd%eth0.100]:4711`, want: "fe80::abcd%eth0.100"},
+		{value: `[fe80::abcd%25]:4711`, want: "fe80::abcd%25"},
+		// The port is discarded without being checked
+		{value: `[fe80::abcd%zone]:nope`, want: "fe80::abcd%zone"},
+		{value: `[fe80::abcd%zone]:`, want: "fe80::abcd%zone"},
+		// An empty zone is dropped
+		{value: `[fe80::abcd%]:4711`, want: "fe80::abcd"},
+		// Without brackets, the port can't be reliably separated from the address
+		{value: `fe80::abcd%zone:4711`, want: ""},
+		{value: `[fe80::abcd%zo:ne]:4711`, want: ""},
+		// Malformed brackets
+		{value: `[fe80::abcd%zone]4711`, want: ""},
+		{value: `[fe80::abcd%zone:4711`, want: ""},
+		{value: `fe80::abcd%zone]:4711`, want: ""},
+	}
 
-	trimMatchedEnds("nope", "abcd")
-}
+	contexts := []struct {
+		name       string
+		headerName string
+		format     string
+	}{
+		{name: "X-Forwarded-For", headerName: "X-Forwarded-For", format: "%s"},
+		{name: "Forwarded unquoted", headerName: "Forwarded", format: "For=%s"},
+		{name: "Forwarded quoted", headerName: "Forwarded", format: `For="%s"`},
+	}
 
-func Test_parseForwardedListItem(t *testing.T) {
-	mustParseIPAddrPtr := func(ipStr string) *net.IPAddr {
-		res := MustParseIPAddr(ipStr)
-		return &res
+	for _, c := range contexts {
+		for _, tt := range tests {
+			t.Run(c.name+" "+tt.value, func(t *testing.T) {
+				headers := http.Header{c.headerName: []string{fmt.Sprintf(c.format, tt.value)}}
+				ipAddrs := getIPAddrList(headers, c.headerName, &options{})
+				if len(ipAddrs) != 1 {
+					t.Fatalf("got %d IPs, want 1", len(ipAddrs))
+				}
+
+				var got string
+				if ipAddrs[0] != nil {
+					got = ipAddrs[0].String()
+				}
+				if got != tt.want {
+					t.Fatalf("got %q, want %q", got, tt.want)
+				}
+			})
+		}
 	}
+}
 
+func TestCheckControlCharacters(t *testing.T) {
 	tests := []struct {
-		name string
-		fwd  string
-		want *net.IPAddr
+		name        string
+		headers     http.Header
+		headerNames []string
+		wantErr     string
 	}{
 		{
-			// This is the correct form for IPv6 wit port
-			name: "IPv6 with port and quotes",
-			fwd:  `For="[2607:f8b0:4004:83f::200e]:4711"`,
-			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+			name:        "Clean",
+			headers:     http.Header{"X-Forwarded-For": []string{"1.1.1.1,\t2.2.2.2"}},
+			headerNames: []string{"X-Forwarded-For", "Forwarded"},
 		},
 		{
-			// This is the correct form for IP with no port
-			name: "IPv6 with quotes, brackets and no port",
-			fwd:  `fOR="[2607:f8b0:4004:83f::200e]"`,
-			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+			name:        "CRLF",
+			headers:     http.Header{"X-Forwarded-For": []string{"1.1.1.1", "2.2.2.2\r\nX-Real-IP: 6.6.6.6"}},
+			headerNames: []string{"x-forwarded-for"},
+			wantErr:     `header value contains control character in X-Forwarded-For: "2.2.2.2\r\nX-Real-IP: 6.6.6.6"`,
 		},
 		{
-			// RFC deviation: missing brackets
-			name: "IPv6 with quotes, no brackets, and no port",
-			fwd:  `for="2607:f8b0:4004:83f::200e"`,
-			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+			name:        "NUL",
+			headers:     http.Header{"Forwarded": []string{"For=1.1.1.1\x00"}},
+			headerNames: []string{"X-Forwarded-For", "Forwarded"},
+			wantErr:     `header value contains control character in Forwarded: "For=1.1.1.1\x00"`,
 		},
 		{
-			// RFC deviation: missing quotes
-			name: "IPv6 with brackets, no quotes, and no port",
-			fwd:  `FOR=[2607:f8b0:4004:83f::200e]`,
-			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+			name:        "DEL",
+			headers:     http.Header{"X-Real-Ip": []string{"1.1.1.1\x7f"}},
+			headerNames: []string{"X-Real-IP"},
+			wantErr:     `header value contains control character in X-Real-Ip: "1.1.1.1\x7f"`,
 		},
 		{
-			// RFC deviation: missing quotes
-			name: "IPv6 with port and no quotes",
-			fwd:  `For=[2607:f8b0:4004:83f::200e]:4711`,
-			want: mustParseIPAddrPtr("2607:f8b0:4004:83f::200e"),
+			name:        "Unchecked header",
+			headers:     http.Header{"X-Real-Ip": []string{"1.1.1.1\r\n"}},
+			headerNames: []string{"X-Forwarded-For"},
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckControlCharacters(tt.headers, tt.headerNames...)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("CheckControlCharacters() error = %v, wantErr %q", err, tt.wantErr)
+			}
+
+			if err == nil {
+				return
+			}
+
+			if !errors.Is(err, ErrControlCharacter) {
+				t.Fatalf("CheckControlCharacters() error = %v, want ErrControlCharacter", err)
+			}
+			if err.Error() != tt.wantErr {
+				t.Fatalf("CheckControlCharacters() error = %q, want %q", err.Error(), tt.wantErr)
+			}
+
+			// The strategies ignore the bad value
+			strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+			if got := strat.ClientIP(http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2\r\n"}}, ""); got != "1.1.1.1" {
+				t.Fatalf("ClientIP = %q, want %q", got, "1.1.1.1")
+			}
+		})
+	}
+}
+
+func TestWithAllowUnspecified(t *testing.T) {
+	tests := []struct {
+		name       string
+		newStrat   func(opts ...Option) Strategy
+		headers    http.Header
+		remoteAddr string
+		want       string
+	}{
 		{
-			name: "IPv6 with port, quotes, and zone",
-			fwd:  `For="[fe80::abcd%zone]:4711"`,
-			want: mustParseIPAddrPtr("fe80::abcd%zone"),
+			name: "RemoteAddrStrategy IPv6",
+			newStrat: func(opts ...Option) Strategy {
+				return NewRemoteAddrStrategy(opts...)
+			},
+			remoteAddr: "[::]:4711",
+			want:       "::",
 		},
 		{
-			// RFC deviation: missing brackets
-			name: "IPv6 with zone, no quotes, no port",
-			fwd:  `For="fe80::abcd%zone"`,
-			want: mustParseIPAddrPtr("fe80::abcd%zone"),
+			name: "RemoteAddrStrategy IPv4",
+			newStrat: func(opts ...Option) Strategy {
+				return NewRemoteAddrStrategy(opts...)
+			},
+			remoteAddr: "0.0.0.0:4711",
+			want:       "0.0.0.0",
 		},
 		{
-			// RFC deviation: missing quotes
-			name: "IPv4 with port",
-			fwd:  `FoR=192.0.2.60:4711`,
-			want: mustParseIPAddrPtr("192.0.2.60"),
+			name: "SingleIPHeaderStrategy",
+			newStrat: func(opts ...Option) Strategy {
+				return Must(NewSingleIPHeaderStrategy("X-Real-IP", opts...))
+			},
+			headers: http.Header{"X-Real-Ip": []string{"::"}},
+			want:    "::",
 		},
 		{
-			name: "IPv4 with no port",
-			fwd:  `for=192.0.2.60`,
-			want: mustParseIPAddrPtr("192.0.2.60"),
+			name: "RightmostTrustedCountStrategy",
+			newStrat: func(opts ...Option) Strategy {
+				return Must(NewRightmostTrustedCountStrategy("Forwarded", 1, opts...))
+			},
+			headers: http.Header{"Forwarded": []string{`For="[::]:4711"`}},
+			want:    "::",
 		},
-		{
-			name: "IPv4 with quotes",
-			fwd:  `for="192.0.2.60"`,
-			want: mustParseIPAddrPtr("192.0.2.60"),
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.newStrat(WithAllowUnspecified()).ClientIP(tt.headers, tt.remoteAddr); got != tt.want {
+				t.Fatalf("ClientIP with option = %q, want %q", got, tt.want)
+			}
+
+			if got := tt.newStrat().ClientIP(tt.headers, tt.remoteAddr); got != "" {
+				t.Fatalf("ClientIP without option = %q, want empty", got)
+			}
+		})
+	}
+}
+
+func TestWithAllowBroadRanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranges    []string
+		wantBroad bool
+	}{
+		{name: "IPv4 default route", ranges: []string{"10.0.0.0/8", "0.0.0.0/0"}, wantBroad: true},
+		{name: "IPv6 default route", ranges: []string{"::/0"}, wantBroad: true},
+		{name: "IPv4-mapped default route", ranges: []string{"::ffff:0.0.0.0/96"}, wantBroad: true},
+		{name: "IPv4 /7", ranges: []string{"2.0.0.0/7"}, wantBroad: true},
+		{name: "IPv6 /15", ranges: []string{"2600::/15"}, wantBroad: true},
+		{name: "IPv4 /8", ranges: []string{"3.0.0.0/8"}, wantBroad: false},
+		{name: "IPv6 /16", ranges: []string{"2600::/16"}, wantBroad: false},
+		{name: "Broad but private", ranges: []string{"fc00::/7", "224.0.0.0/4"}, wantBroad: false},
+		{name: "Private set", ranges: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fe80::/10"}, wantBroad: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedRanges, err := AddressesAndRangesToIPNets(tt.ranges...)
+			if err != nil {
+				t.Fatalf("AddressesAndRangesToIPNets failed; bad test input: %v", err)
+			}
+
+			_, err = NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges)
+			if (err != nil) != tt.wantBroad {
+				t.Fatalf("NewRightmostTrustedRangeStrategy error = %v, wantBroad %v", err, tt.wantBroad)
+			}
+
+			_, err = NewContiguousTrustedRangeStrategy("X-Forwarded-For", trustedRanges)
+			if (err != nil) != tt.wantBroad {
+				t.Fatalf("NewContiguousTrustedRangeStrategy error = %v, wantBroad %v", err, tt.wantBroad)
+			}
+
+			// The option allows anything
+			if _, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, WithAllowBroadRanges()); err != nil {
+				t.Fatalf("NewRightmostTrustedRangeStrategy with WithAllowBroadRanges error = %v", err)
+			}
+		})
+	}
+}
+
+func TestWithIgnoreHeadersFromLoopback(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For": []string{"6.6.6.6"},
+		"X-Real-Ip":       []string{"6.6.6.6"},
+	}
+	trustedRanges, _ := AddressesAndRangesToIPNets("127.0.0.0/8", "::1", "10.0.0.0/8")
+
+	newStrats := map[string]func(opts ...Option) Strategy{
+		"SingleIPHeaderStrategy": func(opts ...Option) Strategy {
+			return Must(NewSingleIPHeaderStrategy("X-Real-IP", opts...))
 		},
-		{
-			name: "IPv4 with port and quotes",
-			fwd:  `for="192.0.2.60:4823"`,
-			want: mustParseIPAddrPtr("192.0.2.60"),
+		"LeftmostNonPrivateStrategy": func(opts ...Option) Strategy {
+			return Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", opts...))
 		},
-		{
-			name: "Error: invalid IPv4",
-			fwd:  `for=192.0.2.999`,
-			want: nil,
+		"RightmostNonPrivateStrategy": func(opts ...Option) Strategy {
+			return Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", opts...))
+		},
+		"RightmostTrustedCountStrategy": func(opts ...Option) Strategy {
+			return Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 1, opts...))
+		},
+		"RightmostTrustedRangeStrategy": func(opts ...Option) Strategy {
+			return Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...))
+		},
+		"ContiguousTrustedRangeStrategy": func(opts ...Option) Strategy {
+			return Must(NewContiguousTrustedRangeStrategy("X-Forwarded-For", trustedRanges, opts...))
 		},
+	}
+
+	for name, newStrat := range newStrats {
+		t.Run(name, func(t *testing.T) {
+			// By default the spoofed header is used
+			if got := newStrat().ClientIP(headers, "127.0.0.1:4711"); got != "6.6.6.6" {
+				t.Fatalf("ClientIP without option = %q, want %q", got, "6.6.6.6")
+			}
+
+			strat := newStrat(WithIgnoreHeadersFromLoopback())
+			if got := strat.ClientIP(headers, "127.0.0.1:4711"); got != "127.0.0.1" {
+				t.Fatalf("ClientIP from IPv4 loopback = %q, want %q", got, "127.0.0.1")
+			}
+			if got := strat.ClientIP(headers, "[::1]:4711"); got != "::1" {
+				t.Fatalf("ClientIP from IPv6 loopback = %q, want %q", got, "::1")
+			}
+
+			// Headers from other addresses are still used
+			if got := strat.ClientIP(headers, "10.0.0.1:4711"); got != "6.6.6.6" {
+				t.Fatalf("ClientIP from non-loopback = %q, want %q", got, "6.6.6.6")
+			}
+
+			// The result must still satisfy the other options
+			strat = newStrat(WithIgnoreHeadersFromLoopback(), WithRequirePublicClient())
+			if got := strat.ClientIP(headers, "127.0.0.1:4711"); got != "" {
+				t.Fatalf("ClientIP with WithRequirePublicClient = %q, want empty", got)
+			}
+		})
+	}
+
+	batchStrat := newStrats["RightmostTrustedRangeStrategy"](WithIgnoreHeadersFromLoopback())
+	got := ClientIPBatch(batchStrat, []Input{{Headers: headers, RemoteAddr: "127.0.0.1:4711"}})
+	if got[0] != "127.0.0.1" {
+		t.Fatalf("ClientIPBatch = %q, want %q", got[0], "127.0.0.1")
+	}
+}
+
+func TestWithListSeparator(t *testing.T) {
+	headers := http.Header{
+		"X-Forwarded-For": []string{"1.1.1.1; 2.2.2.2;3.3.3.3 ;; 10.0.0.1"},
+		"Forwarded":       []string{"For=4.4.4.4, For=5.5.5.5"},
+	}
+
+	tests := []struct {
+		name  string
+		strat Strategy
+		want  string
+	}{
 		{
-			name: "Error: invalid IPv6",
-			fwd:  `for="2607:f8b0:4004:83f::999999"`,
-			want: nil,
+			name:  "Leftmost",
+			strat: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator(';'))),
+			want:  "1.1.1.1",
 		},
 		{
-			name: "Error: non-IP identifier",
-			fwd:  `for="_test"`,
-			want: nil,
+			name:  "Rightmost",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator(';'))),
+			want:  "3.3.3.3",
 		},
 		{
-			name: "Error: empty IP value",
-			fwd:  `for=`,
-			want: nil,
+			name:  "Rightmost trusted count",
+			strat: Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 3, WithListSeparator(';'))),
+			want:  "2.2.2.2",
 		},
 		{
-			name: "Multiple IPv4 directives",
-			fwd:  `by=1.1.1.1; for=2.2.2.2;host=myhost; proto=https`,
-			want: mustParseIPAddrPtr("2.2.2.2"),
+			name:  "Without option",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			want:  "",
 		},
 		{
-			// RFC deviation: missing quotes around IPv6
-			name: "Multiple IPv6 directives",
-			fwd:  `by=1::1;host=myhost;for=2::2;proto=https`,
-			want: mustParseIPAddrPtr("2::2"),
+			name:  "Forwarded is always split on comma",
+			strat: Must(NewRightmostNonPrivateStrategy("Forwarded", WithListSeparator(';'))),
+			want:  "5.5.5.5",
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Multi-byte separators are supported
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator('·')))
+	if got := strat.ClientIP(http.Header{"X-Forwarded-For": []string{"1.1.1.1·2.2.2.2 · 10.0.0.1"}}, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+
+	// Invalid UTF-8 in the header must not cause a panic
+	if got := Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator(';'))).ClientIP(http.Header{"X-Forwarded-For": []string{"1.1.1.1\xff;2.2.2.2"}}, ""); got != "2.2.2.2" {
+		t.Fatalf("ClientIP = %q, want %q", got, "2.2.2.2")
+	}
+
+	// Zones, which can contain letters and digits, are not split
+	zoneStrat := Must(NewRightmostTrustedRangeStrategy("X-Forwarded-For", mustParseCIDRs(t, "2.2.2.2"), WithListSeparator(';')))
+	if got, want := zoneStrat.ClientIP(http.Header{"X-Forwarded-For": []string{"2607:f8b0:4004:83f::200e%eth0;2.2.2.2"}}, ""), "2607:f8b0:4004:83f::200e%eth0"; got != want {
+		t.Fatalf("ClientIP = %q, want %q", got, want)
+	}
+
+	// Separators that would break IP parsing or matching are rejected
+	for _, sep := range []rune{utf8.RuneError, -1, 0x10FFFF + 1, ' ', '\t', ':', '.', '[', ']', '%', '-', '_', '"', '0', '9', 'a', 'F', 't', 'h', 'Z', '\u00e9', '\u00a0'} {
+		if _, err := NewRightmostNonPrivateStrategy("X-Forwarded-For", WithListSeparator(sep)); err == nil {
+			t.Fatalf("NewRightmostNonPrivateStrategy with separator %q should have returned an error", sep)
+		}
+		if _, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", nil, WithListSeparator(sep)); err == nil {
+			t.Fatalf("NewRightmostTrustedRangeStrategy with separator %q should have returned an error", sep)
+		}
+	}
+}
+
+func Test_listScanner_invalidUTF8(t *testing.T) {
+	// strings.IndexRune matches any invalid byte to utf8.RuneError, which is 3 bytes long
+	// when encoded, so the scanner must skip only the byte that matched. This separator
+	// can't be set through the options.
+	scanner := listScanner{values: []string{"1.1.1.1\xff"}, sep: utf8.RuneError}
+	var items []string
+	for item, ok := scanner.next(); ok; item, ok = scanner.next() {
+		items = append(items, item)
+	}
+	if want := []string{"1.1.1.1"}; !reflect.DeepEqual(items, want) {
+		t.Fatalf("items = %q, want %q", items, want)
+	}
+}
+
+func TestXOriginalForwardedFor(t *testing.T) {
+	if !IsListHeaderName("x-original-forwarded-for") {
+		t.Fatalf("IsListHeaderName(%q) = false, want true", "x-original-forwarded-for")
+	}
+
+	headers := http.Header{
+		"X-Original-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 10.0.0.1"},
+		"X-Forwarded-For":          []string{"3.3.3.3"},
+	}
+
+	strat, err := NewRightmostNonPrivateStrategy("X-Original-Forwarded-For")
+	if err != nil {
+		t.Fatalf("NewRightmostNonPrivateStrategy error: %v", err)
+	}
+	if got, want := strat.String(), "RightmostNonPrivateStrategy{header=X-Original-Forwarded-For}"; got != want {
+		t.Fatalf("String() = %q, want %q", got, want)
+	}
+	if got, want := strat.ClientIP(headers, ""), "2.2.2.2"; got != want {
+		t.Fatalf("ClientIP = %q, want %q", got, want)
+	}
+
+	// It was accepted as a single-IP header before it was accepted as a list header, so it
+	// still is
+	singleStrat, err := NewSingleIPHeaderStrategy("X-Original-Forwarded-For")
+	if err != nil {
+		t.Fatalf("NewSingleIPHeaderStrategy error: %v", err)
+	}
+	if got, want := singleStrat.ClientIP(http.Header{"X-Original-Forwarded-For": []string{"1.1.1.1"}}, ""), "1.1.1.1"; got != want {
+		t.Fatalf("ClientIP = %q, want %q", got, want)
+	}
+	if _, err := NewProxyProtocolHeaderStrategy("X-Original-Forwarded-For"); err != nil {
+		t.Fatalf("NewProxyProtocolHeaderStrategy error: %v", err)
+	}
+}
+
+func TestWithDedupeConsecutive(t *testing.T) {
+	tests := []struct {
+		name       string
+		headerName string
+		value      string
+		count      int
+		opts       []Option
+		want       string
+	}{
 		{
-			// RFC deviation: missing quotes around IPv6
-			name: "Multiple mixed directives",
-			fwd:  `by=1::1;host=myhost;proto=https;for=2.2.2.2`,
-			want: mustParseIPAddrPtr("2.2.2.2"),
+			name:       "Count 1 with duplicated client",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1, 1.1.1.1, 2.2.2.2",
+			count:      1,
+			opts:       []Option{WithDedupeConsecutive()},
+			want:       "2.2.2.2",
 		},
 		{
-			name: "IPv4-mapped IPv6",
-			fwd:  `for="[::ffff:188.0.2.128]"`,
-			want: mustParseIPAddrPtr("188.0.2.128"),
+			name:       "Count 2 with duplicated client",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1, 1.1.1.1, 2.2.2.2",
+			count:      2,
+			opts:       []Option{WithDedupeConsecutive()},
+			want:       "1.1.1.1",
 		},
 		{
-			name: "IPv4-mapped IPv6 with port and quotes",
-			fwd:  `for="[::ffff:188.0.2.128]:49428"`,
-			want: mustParseIPAddrPtr("188.0.2.128"),
+			name:       "Count 2 with duplicated proxy",
+			headerName: "X-Forwarded-For",
+			value:      "3.3.3.3, 1.1.1.1, 1.1.1.1",
+			count:      2,
+			opts:       []Option{WithDedupeConsecutive()},
+			want:       "3.3.3.3",
 		},
 		{
-			name: "IPv4-mapped IPv6 in IPv6 form",
-			fwd:  `for="[0:0:0:0:0:ffff:bc15:0006]"`,
-			want: mustParseIPAddrPtr("188.21.0.6"),
+			name:       "Count 2 with duplicated proxy without option",
+			headerName: "X-Forwarded-For",
+			value:      "3.3.3.3, 1.1.1.1, 1.1.1.1",
+			count:      2,
+			want:       "1.1.1.1",
 		},
 		{
-			name: "NAT64 IPv4-mapped IPv6",
-			fwd:  `for="[64:ff9b::188.0.2.128]"`,
-			want: mustParseIPAddrPtr("64:ff9b::188.0.2.128"),
+			name:       "Non-adjacent duplicates are kept",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1, 2.2.2.2, 1.1.1.1",
+			count:      3,
+			opts:       []Option{WithDedupeConsecutive()},
+			want:       "1.1.1.1",
 		},
 		{
-			name: "IPv4 loopback",
-			fwd:  `for=127.0.0.1`,
-			want: mustParseIPAddrPtr("127.0.0.1"),
+			name:       "Invalid entries are not collapsed",
+			headerName: "X-Forwarded-For",
+			value:      "1.1.1.1, nope, nope, 2.2.2.2",
+			count:      3,
+			opts:       []Option{WithDedupeConsecutive()},
+			want:       "",
 		},
 		{
-			name: "IPv6 loopback",
-			fwd:  `for="[::1]"`,
-			want: mustParseIPAddrPtr("::1"),
+			name:       "Equivalent forms are collapsed",
+			headerName: "Forwarded",
+			value:      `For=3.3.3.3, For=1.1.1.1, For="::ffff:1.1.1.1"`,
+			count:      2,
+			opts:       []Option{WithDedupeConsecutive()},
+			want:       "3.3.3.3",
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strat := Must(NewRightmostTrustedCountStrategy(tt.headerName, tt.count, tt.opts...))
+			headers := http.Header{tt.headerName: []string{tt.value}}
+			if got := strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMaxHeaderValueLen(t *testing.T) {
+	long := "1.1.1.1" + strings.Repeat(", 2.2.2.2", 20)
+
+	tests := []struct {
+		name    string
+		strat   Strategy
+		headers http.Header
+		want    string
+	}{
 		{
-			// RFC deviation: quotes must be matched
-			name: "Error: Unmatched quote",
-			fwd:  `for="1.1.1.1`,
-			want: nil,
+			name:    "Normal value is honoured",
+			strat:   Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithMaxHeaderValueLen(64))),
+			headers: http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2"}},
+			want:    "1.1.1.1",
 		},
 		{
-			// RFC deviation: brackets must be matched
-			name: "Error: IPv6 loopback",
-			fwd:  `for="::1]"`,
-			want: nil,
+			name:    "Overlong value is ignored",
+			strat:   Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithMaxHeaderValueLen(64))),
+			headers: http.Header{"X-Forwarded-For": []string{long}},
+			want:    "",
 		},
 		{
-			name: "Error: misplaced quote",
-			fwd:  `for="[0:0:0:0:0:ffff:bc15:0006"]`,
-			want: nil,
+			name:    "Only the overlong line is ignored",
+			strat:   Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithMaxHeaderValueLen(64))),
+			headers: http.Header{"X-Forwarded-For": []string{long, "3.3.3.3"}},
+			want:    "3.3.3.3",
 		},
 		{
-			name: "Error: garbage",
-			fwd:  "ads\x00jkl&#*(383fdljk",
-			want: nil,
+			name:    "Overlong Forwarded",
+			strat:   Must(NewRightmostNonPrivateStrategy("Forwarded", WithMaxHeaderValueLen(16))),
+			headers: http.Header{"Forwarded": []string{"For=4.4.4.4", "For=5.5.5.5;proto=https"}},
+			want:    "4.4.4.4",
 		},
 		{
-			// Per RFC 7230 section 3.2.6, this should not be an error, but we don't have
-			// full syntax support yet.
-			name: "RFC deviation: quoted pair",
-			fwd:  `for=1.1.1.\1`,
-			want: nil,
+			name:    "Overlong single-IP header",
+			strat:   Must(NewSingleIPHeaderStrategy("X-Real-IP", WithMaxHeaderValueLen(16))),
+			headers: http.Header{"X-Real-Ip": []string{"2001:db8:cafe::99%eth0"}},
+			want:    "",
 		},
 		{
-			// Per RFC 7239, this extraneous whitespace should be an error, but we don't
-			// have full syntax support yet.
-			name: "RFC deviation: Incorrect whitespace",
-			fwd:  `for= 1.1.1.1`,
-			want: mustParseIPAddrPtr("1.1.1.1"),
+			name:    "Without option",
+			strat:   Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{"X-Forwarded-For": []string{long}},
+			want:    "1.1.1.1",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := parseForwardedListItem(tt.fwd)
-
-			if got == nil || tt.want == nil {
-				if got != tt.want {
-					t.Fatalf("parseForwardedListItem() = %v, want %v", got, tt.want)
-				}
-				return
-			}
-
-			if !ipAddrsEqual(*got, *tt.want) {
-				t.Fatalf("parseForwardedListItem() = %v, want %v", got, tt.want)
+			if got := tt.strat.ClientIP(tt.headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-// Demonstrate parsing deviations from Forwarded header syntax RFCs, particularly
-// RFC 7239 (Forwarded header) and RFC 7230 (HTTP/1.1 syntax) section 3.2.6.
-func Test_forwardedHeaderRFCDeviations(t *testing.T) {
-	mustParseIPAddrPtr := func(s string) *net.IPAddr {
-		res := MustParseIPAddr(s)
-		return &res
-	}
+func TestWithRoutableCheck(t *testing.T) {
+	// Pretend that this public range is unallocated
+	bogons, _ := AddressesAndRangesToIPNets("5.0.0.0/8")
+	notBogon := WithRoutableCheck(func(ip net.IP) bool {
+		return !IPInRanges(ip, bogons)
+	})
+	trustedRanges, _ := AddressesAndRangesToIPNets("10.0.0.0/8")
 
-	type args struct {
-		headers    http.Header
-		headerName string
+	headers := http.Header{
+		"X-Forwarded-For": []string{"10.1.1.1, 5.5.5.5, 1.1.1.1, 10.0.0.1"},
+		"Forwarded":       []string{"For=5.5.5.5, For=1.1.1.1, For=10.0.0.1"},
 	}
+
 	tests := []struct {
-		name string
-		args args
-		want []*net.IPAddr
+		name  string
+		strat Strategy
+		want  string
 	}{
 		{
-			// The value in quotes should be a single value but we split by comma, so it's not.
-			// The first and third "For=" bits have one double-quote in them, so they are
-			// considered invalid by our parser. The second is still in the quoted-string,
-			// but doesn't have any quotes in it, so it parses okay.
-			name: "Comma in quotes",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For="1.1.1.1, For=2.2.2.2, For=3.3.3.3", For="4.4.4.4"`}},
-				headerName: "Forwarded",
-			},
-			// There are really only two values, so we actually want: {nil, "4.4.4.4"}
-			want: []*net.IPAddr{nil, mustParseIPAddrPtr("2.2.2.2"), nil, mustParseIPAddrPtr("4.4.4.4")},
+			name:  "Without option",
+			strat: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For")),
+			want:  "5.5.5.5",
 		},
 		{
-			// Per 7239, the opening unmatched quote makes the whole rest of the header invalid.
-			// But that would mean that an attacker can invalidate the whole header with a
-			// quote character early on, even the trusted IPs added by our reverse proxies.
-			// Our actual behaviour is probably the best approach.
-			name: "Unmatched quote",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For="1.1.1.1, For=2.2.2.2`}},
-				headerName: "Forwarded",
-			},
-			// There are really only two values, so the RFC would require: {nil} (or empty slice?)
-			want: []*net.IPAddr{nil, mustParseIPAddrPtr("2.2.2.2")},
+			name:  "LeftmostNonPrivateStrategy",
+			strat: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", notBogon)),
+			want:  "1.1.1.1",
 		},
 		{
-			// The invalid non-For parameter should invalidate the whole item, but we're
-			// not checking anything but the "For=" part.
-			name: "Invalid characters",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For=1.1.1.1;@!=😀, For=2.2.2.2`}},
-				headerName: "Forwarded",
-			},
-			// Only the last value is valid, so it should be: {nil, "2.2.2.2"}
-			want: []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("2.2.2.2")},
+			name:  "LeftmostNonPrivateWithinStrategy",
+			strat: Must(NewLeftmostNonPrivateWithinStrategy("X-Forwarded-For", 3, notBogon)),
+			want:  "1.1.1.1",
 		},
 		{
-			// The duplicate "For=" parameter should invalidate the whole item but we don't check for it
-			name: "Duplicate token",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For=1.1.1.1;For=2.2.2.2, For=3.3.3.3`}},
-				headerName: "Forwarded",
-			},
-			// Only the last value is valid, so it should be: {nil, "3.3.3.3"}
-			want: []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1"), mustParseIPAddrPtr("3.3.3.3")},
+			name:  "LeftmostNonPrivateWithinStrategy beyond depth",
+			strat: Must(NewLeftmostNonPrivateWithinStrategy("X-Forwarded-For", 2, notBogon)),
+			want:  "",
 		},
 		{
-			// An escaped character in quotes should be unescaped, but we're not doing it.
-			// (And if we do end up doing it, make sure that `\\` becomes `\` after escaping.
-			// And escaping is only allowed in quoted strings.)
-			// There is no good reason for any part of an IP address to be escaped anyway.
-			name: "Escaped character",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For="3.3.3.\3"`}},
-				headerName: "Forwarded",
-			},
-			// The value is valid, so it should be: {nil, "3.3.3.3"}
-			want: []*net.IPAddr{nil},
+			name:  "LeftmostNonPrivateTrustedStrategy",
+			strat: Must(NewLeftmostNonPrivateTrustedStrategy("X-Forwarded-For", trustedRanges, notBogon)),
+			want:  "1.1.1.1",
 		},
 		{
-			// Spaces are not allowed around the equal signs, but due to the way we parse
-			// a space after the equal will pass but one before won't.
-			name: "Equal sign spaces",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For =1.1.1.1, For= 3.3.3.3`}},
-				headerName: "Forwarded",
-			},
-			// Neither value is valid, so it should be: {nil, nil}
-			want: []*net.IPAddr{nil, mustParseIPAddrPtr("3.3.3.3")},
+			name:  "ForwardedLeftmostTrustedStrategy",
+			strat: Must(NewForwardedLeftmostTrustedStrategy(trustedRanges, notBogon)),
+			want:  "1.1.1.1",
 		},
 		{
-			// Disallowed characters are only allowed in quoted strings. This means
-			// that IPv6 addresses must be quoted.
-			name: "Disallowed characters in unquoted value (like colons and square brackets",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For=[2607:f8b0:4004:83f::200e]`}},
-				headerName: "Forwarded",
-			},
-			// Value is invalid without quotes, so should be {nil}
-			want: []*net.IPAddr{mustParseIPAddrPtr("2607:f8b0:4004:83f::200e")},
+			name: "All rejected",
+			strat: Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", WithRoutableCheck(func(net.IP) bool {
+				return false
+			}))),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strat.ClientIP(headers, ""); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStrategiesComparable(t *testing.T) {
+	lower := WithNormalizeZone(strings.ToLower)
+	allowed := WithAllowedRanges([]net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}})
+	routable := WithRoutableCheck(func(net.IP) bool { return true })
+
+	tests := []struct {
+		name string
+		a, b Strategy
+	}{
+		{
+			name: "RemoteAddrStrategy",
+			a:    NewRemoteAddrStrategy(lower),
+			b:    NewRemoteAddrStrategy(lower),
 		},
 		{
-			// IPv6 addresses are required to be contained in square brackets. We don't
-			// require this simply to be more flexible in what is accepted.
-			name: "IPv6 brackets",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For="2607:f8b0:4004:83f::200e"`}},
-				headerName: "Forwarded",
-			},
-			// IPv6 is invalid without brackets, so should be {nil}
-			want: []*net.IPAddr{mustParseIPAddrPtr("2607:f8b0:4004:83f::200e")},
+			name: "SingleIPHeaderStrategy",
+			a:    Must(NewSingleIPHeaderStrategy("X-Real-IP", allowed)),
+			b:    Must(NewSingleIPHeaderStrategy("X-Real-IP", allowed)),
 		},
 		{
-			// IPv4 addresses are _not_ supposed to be in square brackets, but we trim
-			// them unconditionally.
-			name: "IPv4 brackets",
-			args: args{
-				headers:    http.Header{"Forwarded": []string{`For="[1.1.1.1]"`}},
-				headerName: "Forwarded",
-			},
-			// IPv4 is invalid with brackets, so should be {nil}
-			want: []*net.IPAddr{mustParseIPAddrPtr("1.1.1.1")},
+			name: "LeftmostNonPrivateStrategy",
+			a:    Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", routable)),
+			b:    Must(NewLeftmostNonPrivateStrategy("X-Forwarded-For", routable)),
+		},
+		{
+			name: "RightmostNonPrivateStrategy",
+			a:    Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", lower)),
+			b:    Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", lower)),
+		},
+		{
+			name: "RightmostTrustedCountStrategy",
+			a:    Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, lower)),
+			b:    Must(NewRightmostTrustedCountStrategy("X-Forwarded-For", 2, lower)),
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getIPAddrList(tt.args.headers, tt.args.headerName); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("getIPAddrList() = %v, want %v", got, tt.want)
+			// Comparing through the interface panics if the dynamic type isn't comparable
+			if tt.a != tt.a {
+				t.Fatalf("strategy is not equal to itself")
+			}
+			if tt.a == tt.b {
+				t.Fatalf("strategies with separately set func or slice options are equal")
 			}
 		})
 	}
+
+	// Without func or slice options, separately created strategies are equal
+	var a, b Strategy = Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithRejectBracketedIPv4())), Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithRejectBracketedIPv4()))
+	if a != b {
+		t.Fatalf("identical strategies are not equal")
+	}
 }
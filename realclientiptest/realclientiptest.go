@@ -0,0 +1,64 @@
+// SPDX: 0BSD
+
+// Package realclientiptest provides helpers for building the request headers that
+// reverse proxies produce, for use in tests of code that uses realclientip strategies.
+package realclientiptest
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// BuildXFF returns an http.Header with a single X-Forwarded-For header containing ips, in
+// order, comma-space separated. ips are used verbatim, so they may include ports or be
+// deliberately invalid.
+func BuildXFF(ips ...string) http.Header {
+	return http.Header{"X-Forwarded-For": []string{strings.Join(ips, ", ")}}
+}
+
+// BuildForwarded returns an http.Header with a single Forwarded header containing
+// elements, in order, comma-space separated.
+// If an element contains an equal sign, it is used verbatim (like `for=1.1.1.1;proto=https`).
+// Otherwise it is treated as an IP address, optionally with a port, and is formatted as
+// a "for=" parameter per RFC 7239: IPv6 addresses are enclosed in square brackets, and
+// the value is quoted if it contains characters that aren't allowed in a token.
+func BuildForwarded(elements ...string) http.Header {
+	formatted := make([]string, len(elements))
+	for i, e := range elements {
+		if strings.Contains(e, "=") {
+			formatted[i] = e
+		} else {
+			formatted[i] = "for=" + forwardedNodeValue(e)
+		}
+	}
+
+	return http.Header{"Forwarded": []string{strings.Join(formatted, ", ")}}
+}
+
+// forwardedNodeValue formats an IP address, optionally with a port, as a Forwarded header
+// node value.
+func forwardedNodeValue(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// There's no port (or addr is bad, in which case we'll do our best with it)
+		host, port = strings.Trim(addr, "[]"), ""
+	}
+
+	if strings.Contains(host, ":") {
+		// IPv6 must be in brackets, and therefore quoted
+		host = "[" + host + "]"
+	}
+
+	value := host
+	if port != "" {
+		value += ":" + port
+	}
+
+	if strings.ContainsAny(value, `:[]%`) {
+		// These aren't allowed in an RFC 7230 token, so the value must be a quoted-string
+		value = `"` + value + `"`
+	}
+
+	return value
+}
@@ -0,0 +1,81 @@
+// SPDX: 0BSD
+
+package realclientiptest
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/realclientip/realclientip-go"
+)
+
+func TestBuildXFF(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want http.Header
+	}{
+		{
+			name: "Multiple IPs",
+			ips:  []string{"1.1.1.1", "2.2.2.2:4747", "2607:f8b0:4004:83f::200e"},
+			want: http.Header{"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2:4747, 2607:f8b0:4004:83f::200e"}},
+		},
+		{
+			name: "Single IP",
+			ips:  []string{"1.1.1.1"},
+			want: http.Header{"X-Forwarded-For": []string{"1.1.1.1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildXFF(tt.ips...); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("BuildXFF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildForwarded(t *testing.T) {
+	tests := []struct {
+		name     string
+		elements []string
+		want     http.Header
+	}{
+		{
+			name:     "IPv4",
+			elements: []string{"1.1.1.1", "2.2.2.2:4747"},
+			want:     http.Header{"Forwarded": []string{`for=1.1.1.1, for="2.2.2.2:4747"`}},
+		},
+		{
+			name:     "IPv6",
+			elements: []string{"2607:f8b0:4004:83f::200e", "[2607:f8b0:4004:83f::200e]:4747", "fe80::abcd%eth0"},
+			want:     http.Header{"Forwarded": []string{`for="[2607:f8b0:4004:83f::200e]", for="[2607:f8b0:4004:83f::200e]:4747", for="[fe80::abcd%eth0]"`}},
+		},
+		{
+			name:     "Verbatim elements",
+			elements: []string{"for=1.1.1.1;proto=https", "3.3.3.3"},
+			want:     http.Header{"Forwarded": []string{`for=1.1.1.1;proto=https, for=3.3.3.3`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildForwarded(tt.elements...); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("BuildForwarded() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltHeadersParse(t *testing.T) {
+	// The built headers must be understood by the strategies
+	xffStrat := realclientip.Must(realclientip.NewRightmostTrustedCountStrategy("X-Forwarded-For", 2))
+	if got := xffStrat.ClientIP(BuildXFF("1.1.1.1", "[2607:f8b0:4004:83f::200e]:4747", "3.3.3.3"), ""); got != "2607:f8b0:4004:83f::200e" {
+		t.Fatalf("X-Forwarded-For ClientIP = %q", got)
+	}
+
+	fwdStrat := realclientip.Must(realclientip.NewRightmostTrustedCountStrategy("Forwarded", 2))
+	if got := fwdStrat.ClientIP(BuildForwarded("1.1.1.1", "[fe80::abcd%eth0]:4747", "3.3.3.3"), ""); got != "fe80::abcd%eth0" {
+		t.Fatalf("Forwarded ClientIP = %q", got)
+	}
+}
@@ -0,0 +1,151 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultFetchTimeout is the limit on each fetch by RefreshableRanges, if a fetch
+	// timeout of zero or less is given.
+	defaultFetchTimeout = 30 * time.Second
+
+	// defaultRefreshInterval is the interval used by RefreshableRanges.Run, if an interval
+	// of zero or less is given.
+	defaultRefreshInterval = time.Hour
+)
+
+// RangesFetcher retrieves a set of trusted ranges, such as from a CDN provider's API.
+// It should return promptly when ctx is done.
+type RangesFetcher func(ctx context.Context) ([]net.IPNet, error)
+
+// RefreshableRanges holds a set of trusted ranges that is periodically refreshed with a
+// RangesFetcher, such as to keep up with changes to a CDN provider's published ranges.
+// Fetching never blocks Current, and a failed fetch leaves the last-good ranges in use.
+// To use the ranges with RightmostTrustedRangeStrategy, pass them to its SetRanges after
+// each refresh (see Run).
+// It is safe for concurrent use.
+type RefreshableRanges struct {
+	// failures is first to guarantee 64-bit alignment for atomic access
+	failures     uint64
+	fetch        RangesFetcher
+	fetchTimeout time.Duration
+	ranges       *trustedRangesHolder
+	opts         options
+}
+
+// NewRefreshableRanges creates a RefreshableRanges that uses fetch to refresh its ranges.
+// initial is used until the first successful refresh; it may be empty, such as if the
+// ranges will be fetched before use. Each fetch is limited to fetchTimeout; a fetch that
+// takes longer is abandoned and counted as a failure. fetchTimeout of zero or less means
+// the default of 30 seconds. Fetched ranges are validated as trusted ranges passed to a
+// strategy constructor would be, using opts.
+func NewRefreshableRanges(fetch RangesFetcher, initial []net.IPNet, fetchTimeout time.Duration, opts ...Option) (*RefreshableRanges, error) {
+	if fetch == nil {
+		return nil, fmt.Errorf("RefreshableRanges fetch must not be nil")
+	}
+
+	o := newOptions(opts)
+	if err := validateTrustedRanges("RefreshableRanges", initial, &o); err != nil {
+		return nil, err
+	}
+
+	if fetchTimeout <= 0 {
+		fetchTimeout = defaultFetchTimeout
+	}
+
+	return &RefreshableRanges{
+		fetch:        fetch,
+		fetchTimeout: fetchTimeout,
+		ranges:       newTrustedRangesHolder(copyIPNets(initial)),
+		opts:         o,
+	}, nil
+}
+
+// Current returns the last-good ranges. They must not be modified.
+func (r *RefreshableRanges) Current() []net.IPNet {
+	return r.ranges.load()
+}
+
+// Failures returns the number of refreshes that have failed.
+func (r *RefreshableRanges) Failures() uint64 {
+	return atomic.LoadUint64(&r.failures)
+}
+
+// Refresh fetches the ranges and, if successful, replaces the current ranges with them.
+// The fetch is limited by the timeout given to NewRefreshableRanges; if the fetch doesn't
+// return in time, it is abandoned (but may continue to run in the background, if it
+// doesn't honour its context). A fetch fails if it returns an error, times out, or
+// returns no ranges or invalid ranges. On failure, the current ranges are kept, the
+// failure count is incremented, and an error is returned.
+func (r *RefreshableRanges) Refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.fetchTimeout)
+	defer cancel()
+
+	type fetchResult struct {
+		ranges []net.IPNet
+		err    error
+	}
+
+	// Buffered, so that an abandoned fetch doesn't block forever
+	resultChan := make(chan fetchResult, 1)
+	go func() {
+		ranges, err := r.fetch(ctx)
+		resultChan <- fetchResult{ranges, err}
+	}()
+
+	var result fetchResult
+	select {
+	case result = <-resultChan:
+	case <-ctx.Done():
+		result.err = ctx.Err()
+	}
+
+	if result.err == nil && len(result.ranges) == 0 {
+		// This is far more likely to be a problem with the source than a real change
+		result.err = errors.New("no ranges were fetched")
+	}
+	if result.err == nil {
+		result.err = validateTrustedRanges("RefreshableRanges", result.ranges, &r.opts)
+	}
+	if result.err != nil {
+		atomic.AddUint64(&r.failures, 1)
+		return fmt.Errorf("RefreshableRanges refresh failed: %w", result.err)
+	}
+
+	r.ranges.store(copyIPNets(result.ranges))
+	return nil
+}
+
+// Run calls Refresh immediately and then every interval, until ctx is done. After each
+// successful refresh, onRefresh (if not nil) is called with the new ranges, which must not
+// be modified; this can be used to pass them to RightmostTrustedRangeStrategy.SetRanges.
+// Failed refreshes are counted (see Failures) and otherwise ignored. interval of zero or
+// less means the default of one hour. Run blocks, so it will usually be called in its own
+// goroutine.
+func (r *RefreshableRanges) Run(ctx context.Context, interval time.Duration, onRefresh func(ranges []net.IPNet)) {
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Refresh(ctx); err == nil && onRefresh != nil {
+			onRefresh(r.Current())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
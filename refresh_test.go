@@ -0,0 +1,234 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRefreshableRanges(t *testing.T) {
+	initial := mustParseCIDRs(t, "10.0.0.0/8")
+	fetched := mustParseCIDRs(t, "173.245.48.0/20", "2400:cb00::/32")
+
+	tests := []struct {
+		name         string
+		fetch        RangesFetcher
+		wantErr      bool
+		wantRanges   []net.IPNet
+		wantFailures uint64
+	}{
+		{
+			name: "Success",
+			fetch: func(ctx context.Context) ([]net.IPNet, error) {
+				return fetched, nil
+			},
+			wantRanges: fetched,
+		},
+		{
+			name: "Fetch error",
+			fetch: func(ctx context.Context) ([]net.IPNet, error) {
+				return nil, errors.New("connection refused")
+			},
+			wantErr:      true,
+			wantRanges:   initial,
+			wantFailures: 1,
+		},
+		{
+			name: "Slow fetch that honours context",
+			fetch: func(ctx context.Context) ([]net.IPNet, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			wantErr:      true,
+			wantRanges:   initial,
+			wantFailures: 1,
+		},
+		{
+			name: "No ranges",
+			fetch: func(ctx context.Context) ([]net.IPNet, error) {
+				return nil, nil
+			},
+			wantErr:      true,
+			wantRanges:   initial,
+			wantFailures: 1,
+		},
+		{
+			name: "Invalid ranges",
+			fetch: func(ctx context.Context) ([]net.IPNet, error) {
+				return []net.IPNet{{}}, nil
+			},
+			wantErr:      true,
+			wantRanges:   initial,
+			wantFailures: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr, err := NewRefreshableRanges(tt.fetch, initial, 10*time.Millisecond)
+			if err != nil {
+				t.Fatalf("NewRefreshableRanges error: %v", err)
+			}
+
+			err = rr.Refresh(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Refresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := rr.Current(); !reflect.DeepEqual(got, tt.wantRanges) {
+				t.Fatalf("Current() = %v, want %v", got, tt.wantRanges)
+			}
+
+			if got := rr.Failures(); got != tt.wantFailures {
+				t.Fatalf("Failures() = %d, want %d", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRefreshableRanges_hungFetch(t *testing.T) {
+	initial := mustParseCIDRs(t, "10.0.0.0/8")
+
+	// This fetch ignores its context, so it must be abandoned
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	fetch := func(ctx context.Context) ([]net.IPNet, error) {
+		close(started)
+		<-release
+		return nil, nil
+	}
+
+	rr, err := NewRefreshableRanges(fetch, initial, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewRefreshableRanges error: %v", err)
+	}
+
+	refreshDone := make(chan error, 1)
+	go func() {
+		refreshDone <- rr.Refresh(context.Background())
+	}()
+
+	// Current is not blocked by the fetch
+	<-started
+	if got := rr.Current(); !reflect.DeepEqual(got, initial) {
+		t.Fatalf("Current() = %v, want %v", got, initial)
+	}
+
+	select {
+	case err := <-refreshDone:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Refresh() error = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Refresh() did not time out")
+	}
+
+	if got := rr.Current(); !reflect.DeepEqual(got, initial) {
+		t.Fatalf("Current() = %v, want %v", got, initial)
+	}
+	if got := rr.Failures(); got != 1 {
+		t.Fatalf("Failures() = %d, want 1", got)
+	}
+}
+
+func TestRefreshableRanges_Run(t *testing.T) {
+	fetched := mustParseCIDRs(t, "173.245.48.0/20")
+	fetch := func(ctx context.Context) ([]net.IPNet, error) {
+		return fetched, nil
+	}
+
+	rr, err := NewRefreshableRanges(fetch, nil, 0)
+	if err != nil {
+		t.Fatalf("NewRefreshableRanges error: %v", err)
+	}
+
+	strat, err := NewRightmostTrustedRangeStrategy("X-Forwarded-For", rr.Current())
+	if err != nil {
+		t.Fatalf("NewRightmostTrustedRangeStrategy error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	refreshed := make(chan struct{}, 1)
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		rr.Run(ctx, time.Hour, func(ranges []net.IPNet) {
+			if err := strat.SetRanges(ranges); err != nil {
+				t.Errorf("SetRanges error: %v", err)
+			}
+			refreshed <- struct{}{}
+		})
+	}()
+
+	<-refreshed
+	cancel()
+	<-runDone
+
+	headers := map[string][]string{"X-Forwarded-For": {"1.1.1.1, 173.245.48.1"}}
+	if got, want := strat.ClientIP(headers, ""), "1.1.1.1"; got != want {
+		t.Fatalf("ClientIP = %q, want %q", got, want)
+	}
+}
+
+func TestRefreshableRanges_Run_defaultInterval(t *testing.T) {
+	fetched := mustParseCIDRs(t, "173.245.48.0/20")
+	fetch := func(ctx context.Context) ([]net.IPNet, error) {
+		return fetched, nil
+	}
+
+	rr, err := NewRefreshableRanges(fetch, nil, 0)
+	if err != nil {
+		t.Fatalf("NewRefreshableRanges error: %v", err)
+	}
+
+	// An interval of zero or less must not panic, and must not cause a busy loop
+	for _, interval := range []time.Duration{0, -time.Second} {
+		ctx, cancel := context.WithCancel(context.Background())
+		refreshes := make(chan struct{}, 10)
+		runDone := make(chan struct{})
+		go func() {
+			defer close(runDone)
+			rr.Run(ctx, interval, func(ranges []net.IPNet) {
+				refreshes <- struct{}{}
+			})
+		}()
+
+		<-refreshes
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		<-runDone
+
+		if got := len(refreshes); got != 0 {
+			t.Fatalf("Run with interval %v refreshed %d extra times", interval, got)
+		}
+	}
+
+	if got := rr.Current(); !reflect.DeepEqual(got, fetched) {
+		t.Fatalf("Current() = %v, want %v", got, fetched)
+	}
+}
+
+func TestNewRefreshableRanges_errors(t *testing.T) {
+	if _, err := NewRefreshableRanges(nil, nil, 0); err == nil {
+		t.Fatalf("NewRefreshableRanges with nil fetch should have returned an error")
+	}
+
+	fetch := func(ctx context.Context) ([]net.IPNet, error) { return nil, nil }
+	if _, err := NewRefreshableRanges(fetch, []net.IPNet{{}}, 0); err == nil {
+		t.Fatalf("NewRefreshableRanges with invalid initial ranges should have returned an error")
+	}
+}
+
+func mustParseCIDRs(t *testing.T, ranges ...string) []net.IPNet {
+	t.Helper()
+	ipNets, err := AddressesAndRangesToIPNets(ranges...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipNets
+}
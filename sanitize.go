@@ -0,0 +1,67 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+)
+
+// SanitizeHeaders derives the client IP of r using strat, and then removes the
+// client-controllable IP headers from r, so that handlers further down the chain can't be
+// confused by them into using a spoofed IP. The removed headers are X-Forwarded-For,
+// Forwarded, X-Real-IP, any header used by strat (including by the strategies in a
+// ChainStrategy), and extraHeaders.
+// If setXRealIP is true and a client IP was derived, X-Real-IP is then set to it, so that
+// downstream code that reads that header gets the correct value.
+// The derived client IP is returned; it is empty string if none could be derived.
+// This should be called before r is passed to any other handler.
+func SanitizeHeaders(r *http.Request, strat Strategy, setXRealIP bool, extraHeaders ...string) string {
+	clientIP := strat.ClientIP(r.Header, r.RemoteAddr)
+
+	r.Header.Del(xForwardedForHdr)
+	r.Header.Del(forwardedHdr)
+	r.Header.Del(HeaderXRealIP)
+	for _, headerName := range strategyHeaderNames(strat) {
+		r.Header.Del(headerName)
+	}
+	for _, headerName := range extraHeaders {
+		r.Header.Del(headerName)
+	}
+
+	if setXRealIP && clientIP != "" {
+		r.Header.Set(HeaderXRealIP, clientIP)
+	}
+
+	return clientIP
+}
+
+// strategyHeaderNames returns the names of the headers used by strat, including by the
+// strategies in a ChainStrategy and by both strategies of a CrossCheckStrategy.
+func strategyHeaderNames(strat Strategy) []string {
+	var subStrats []Strategy
+	switch s := strat.(type) {
+	case ChainStrategy:
+		subStrats = s.strategies
+	case CrossCheckStrategy:
+		subStrats = []Strategy{s.primary, s.verify}
+	case ExactProxyStrategy:
+		subStrats = []Strategy{s.inner}
+	case MemoizedStrategy:
+		subStrats = []Strategy{s.inner}
+	default:
+		if headerName := strategyHeaderName(strat); headerName != "" {
+			return []string{headerName}
+		}
+		return nil
+	}
+
+	var headerNames []string
+	for _, subStrat := range subStrats {
+		for _, headerName := range strategyHeaderNames(subStrat) {
+			if !containsString(headerNames, headerName) {
+				headerNames = append(headerNames, headerName)
+			}
+		}
+	}
+	return headerNames
+}
@@ -0,0 +1,84 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeHeaders(t *testing.T) {
+	strat := NewChainStrategy(
+		Must(NewSingleIPHeaderStrategy("Cf-Connecting-IP")),
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		RemoteAddrStrategy{},
+	)
+
+	tests := []struct {
+		name         string
+		setXRealIP   bool
+		extraHeaders []string
+		headers      http.Header
+		want         string
+		wantHeaders  http.Header
+	}{
+		{
+			name:       "Strip and set X-Real-IP",
+			setXRealIP: true,
+			headers: http.Header{
+				"X-Forwarded-For": []string{"1.1.1.1, 2.2.2.2, 10.0.0.1"},
+				"Forwarded":       []string{"For=6.6.6.6"},
+				"X-Real-Ip":       []string{"6.6.6.6"},
+				"Accept":          []string{"*/*"},
+			},
+			want: "2.2.2.2",
+			wantHeaders: http.Header{
+				"X-Real-Ip": []string{"2.2.2.2"},
+				"Accept":    []string{"*/*"},
+			},
+		},
+		{
+			name: "Strip strategy and extra headers",
+			headers: http.Header{
+				"Cf-Connecting-Ip": []string{"1.1.1.1"},
+				"X-Real-Ip":        []string{"6.6.6.6"},
+				"True-Client-Ip":   []string{"6.6.6.6"},
+				"Accept":           []string{"*/*"},
+			},
+			extraHeaders: []string{"True-Client-IP"},
+			want:         "1.1.1.1",
+			wantHeaders: http.Header{
+				"Accept": []string{"*/*"},
+			},
+		},
+		{
+			name:       "No client IP",
+			setXRealIP: true,
+			headers: http.Header{
+				"X-Real-Ip": []string{"6.6.6.6"},
+			},
+			want:        "",
+			wantHeaders: http.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "https://example.com", nil)
+			r.Header = tt.headers
+			if tt.want == "" {
+				r.RemoteAddr = "@"
+			} else {
+				r.RemoteAddr = "10.0.0.2:4711"
+			}
+
+			if got := SanitizeHeaders(r, strat, tt.setXRealIP, tt.extraHeaders...); got != tt.want {
+				t.Fatalf("SanitizeHeaders() = %q, want %q", got, tt.want)
+			}
+
+			if !reflect.DeepEqual(r.Header, tt.wantHeaders) {
+				t.Fatalf("headers = %v, want %v", r.Header, tt.wantHeaders)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// SelectionStats counts the IP families of the client IPs derived by strategies, such as
+// to track IPv6 adoption. It is enabled for a strategy with WithSelectionStats, and may be
+// shared by multiple strategies. The zero value is ready to use. The counts may be read
+// while the strategies are in use.
+type SelectionStats struct {
+	ipv4   uint64
+	ipv6   uint64
+	mapped uint64
+}
+
+// IPv4Selected returns the number of client IPs that were plain IPv4 addresses.
+func (s *SelectionStats) IPv4Selected() uint64 {
+	return atomic.LoadUint64(&s.ipv4)
+}
+
+// IPv6Selected returns the number of client IPs that were IPv6 addresses, not including
+// IPv4-mapped addresses.
+func (s *SelectionStats) IPv6Selected() uint64 {
+	return atomic.LoadUint64(&s.ipv6)
+}
+
+// MappedSelected returns the number of client IPs that were IPv4-mapped IPv6 addresses,
+// like "::ffff:1.2.3.4". These are returned by the strategies in IPv4 form.
+func (s *SelectionStats) MappedSelected() uint64 {
+	return atomic.LoadUint64(&s.mapped)
+}
+
+// record counts ip. It must have been parsed by optionsIPAddr, which keeps plain IPv4
+// addresses in their 4-byte form when stats are enabled, so that a 16-byte IPv4 address
+// was in the IPv4-mapped form.
+func (s *SelectionStats) record(ip net.IP) {
+	switch {
+	case len(ip) == net.IPv4len:
+		atomic.AddUint64(&s.ipv4, 1)
+	case ip.To4() != nil:
+		atomic.AddUint64(&s.mapped, 1)
+	default:
+		atomic.AddUint64(&s.ipv6, 1)
+	}
+}
@@ -0,0 +1,46 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSelectionStats(t *testing.T) {
+	var stats SelectionStats
+	strat := NewChainStrategy(
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For", WithSelectionStats(&stats))),
+		NewRemoteAddrStrategy(WithSelectionStats(&stats)),
+	)
+
+	requests := []struct {
+		xff        string
+		remoteAddr string
+		want       string
+	}{
+		{xff: "1.1.1.1, 10.0.0.1", want: "1.1.1.1"},
+		{xff: "2607:f8b0:4004:83f::200e", want: "2607:f8b0:4004:83f::200e"},
+		{xff: "::ffff:2.2.2.2", want: "2.2.2.2"},
+		{xff: "[::ffff:3.3.3.3]:4711", want: "3.3.3.3"},
+		{xff: "10.0.0.1", remoteAddr: "4.4.4.4:4711", want: "4.4.4.4"},
+		{xff: "10.0.0.1", remoteAddr: "[::ffff:5.5.5.5]:4711", want: "5.5.5.5"},
+		{xff: "10.0.0.1", remoteAddr: "@", want: ""},
+	}
+	for _, r := range requests {
+		headers := http.Header{"X-Forwarded-For": []string{r.xff}}
+		if got := strat.ClientIP(headers, r.remoteAddr); got != r.want {
+			t.Fatalf("ClientIP(%q, %q) = %q, want %q", r.xff, r.remoteAddr, got, r.want)
+		}
+	}
+
+	if got := stats.IPv4Selected(); got != 2 {
+		t.Fatalf("IPv4Selected() = %d, want 2", got)
+	}
+	if got := stats.IPv6Selected(); got != 1 {
+		t.Fatalf("IPv6Selected() = %d, want 1", got)
+	}
+	if got := stats.MappedSelected(); got != 3 {
+		t.Fatalf("MappedSelected() = %d, want 3", got)
+	}
+}
@@ -0,0 +1,53 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+)
+
+// ClientIPWithTrailers derives the client IP of r using strat, also consulting r.Trailer
+// for any header used by strat that is absent from r.Header.
+//
+// WARNING: Trailers are sent after the body, so a header in r.Header can't be supplemented
+// or overridden by a trailer: if a proxy added X-Forwarded-For, a trailer appended to it
+// would become the rightmost entry, and the client could choose it. So a trailer is only
+// used for a header that is entirely absent from r.Header. Even so, this is only safe if
+// every reverse proxy in front of the server either adds the header as a trailer or
+// strips trailers that the client sent -- otherwise the client can supply the whole value.
+// Proxies very rarely put forwarding information in trailers, so only use this if yours
+// are known to.
+//
+// Trailers are only populated after the request body has been fully read, so this must
+// be called after that has happened; before then it behaves like strat.ClientIP.
+func ClientIPWithTrailers(r *http.Request, strat Strategy) string {
+	if len(r.Trailer) == 0 {
+		return strat.ClientIP(r.Header, r.RemoteAddr)
+	}
+
+	var headers http.Header
+	for _, headerName := range strategyHeaderNames(strat) {
+		// Note that Go's Header map uses canonicalized keys
+		trailerValues := r.Trailer[headerName]
+		if len(trailerValues) == 0 || len(r.Header[headerName]) > 0 {
+			// Trailers must not add to a header that is present
+			continue
+		}
+
+		if headers == nil {
+			// Don't modify the request's headers
+			headers = r.Header.Clone()
+			if headers == nil {
+				headers = http.Header{}
+			}
+		}
+
+		headers[headerName] = append([]string(nil), trailerValues...)
+	}
+
+	if headers == nil {
+		headers = r.Header
+	}
+
+	return strat.ClientIP(headers, r.RemoteAddr)
+}
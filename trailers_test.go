@@ -0,0 +1,137 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClientIPWithTrailers(t *testing.T) {
+	tests := []struct {
+		name    string
+		strat   Strategy
+		headers http.Header
+		trailer http.Header
+		want    string
+	}{
+		{
+			name:  "No trailers",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{
+				"X-Forwarded-For": []string{"1.1.1.1"},
+			},
+			want: "1.1.1.1",
+		},
+		{
+			name:  "Only in trailer",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			trailer: http.Header{
+				"X-Forwarded-For": []string{"2.2.2.2, 10.0.0.1"},
+			},
+			want: "2.2.2.2",
+		},
+		{
+			name:  "Spoofed XFF trailer is ignored",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{
+				"X-Forwarded-For": []string{"1.1.1.1"},
+			},
+			trailer: http.Header{
+				"X-Forwarded-For": []string{"3.3.3.3"},
+			},
+			want: "1.1.1.1",
+		},
+		{
+			name:  "Spoofed X-Real-IP trailer is ignored",
+			strat: Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+			headers: http.Header{
+				"X-Real-Ip": []string{"1.1.1.1"},
+			},
+			trailer: http.Header{
+				"X-Real-Ip": []string{"3.3.3.3"},
+			},
+			want: "1.1.1.1",
+		},
+		{
+			name: "Trailer for header in chain",
+			strat: NewChainStrategy(
+				Must(NewSingleIPHeaderStrategy("X-Real-IP")),
+				RemoteAddrStrategy{},
+			),
+			trailer: http.Header{
+				"X-Real-Ip": []string{"4.4.4.4"},
+			},
+			want: "4.4.4.4",
+		},
+		{
+			name:  "Unrelated trailer",
+			strat: Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+			headers: http.Header{
+				"X-Forwarded-For": []string{"1.1.1.1"},
+			},
+			trailer: http.Header{
+				"X-Real-Ip": []string{"4.4.4.4"},
+			},
+			want: "1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "https://example.com", nil)
+			if tt.headers != nil {
+				r.Header = tt.headers
+			}
+			r.Trailer = tt.trailer
+			r.RemoteAddr = "10.0.0.2:4711"
+
+			headersBefore := r.Header.Clone()
+
+			if got := ClientIPWithTrailers(r, tt.strat); got != tt.want {
+				t.Fatalf("ClientIPWithTrailers() = %q, want %q", got, tt.want)
+			}
+
+			if !reflect.DeepEqual(r.Header, headersBefore) {
+				t.Fatalf("headers were modified: %v, want %v", r.Header, headersBefore)
+			}
+		})
+	}
+}
+
+func TestClientIPWithTrailers_chunked(t *testing.T) {
+	rawReq := "POST / HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Trailer: X-Forwarded-For\r\n" +
+		"\r\n" +
+		"5\r\nhello\r\n" +
+		"0\r\n" +
+		"X-Forwarded-For: 1.1.1.1, 10.0.0.1\r\n" +
+		"\r\n"
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(rawReq)))
+	if err != nil {
+		t.Fatalf("http.ReadRequest error: %v", err)
+	}
+	r.RemoteAddr = "10.0.0.2:4711"
+
+	strat := Must(NewRightmostNonPrivateStrategy("X-Forwarded-For"))
+
+	// The trailer isn't available until the body has been read
+	if got := ClientIPWithTrailers(r, strat); got != "" {
+		t.Fatalf("ClientIPWithTrailers() before body read = %q, want %q", got, "")
+	}
+
+	if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+		t.Fatalf("reading body error: %v", err)
+	}
+
+	if got, want := ClientIPWithTrailers(r, strat), "1.1.1.1"; got != want {
+		t.Fatalf("ClientIPWithTrailers() = %q, want %q", got, want)
+	}
+}
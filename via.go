@@ -0,0 +1,106 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ViaHop is one element of the Via header, describing a proxy that the request passed
+// through. See RFC 7230 section 5.7.1.
+type ViaHop struct {
+	// ProtocolName is the name of the received protocol, like "HTTP". It is often omitted,
+	// in which case it is empty and HTTP is implied.
+	ProtocolName string
+	// ProtocolVersion is the version of the received protocol, like "1.1".
+	ProtocolVersion string
+	// ReceivedBy is the host (and optional port) or pseudonym of the proxy, like
+	// "proxy1.example.com:8080" or "varnish".
+	ReceivedBy string
+	// Comment is the optional comment following ReceivedBy, without parentheses, like
+	// "Apache/2.4". It is often used to identify the proxy software.
+	Comment string
+}
+
+// ParseVia parses all instances of the Via header in headers, in order. Elements that
+// are empty or malformed (missing the protocol or received-by) are skipped.
+// The Via header rarely contains the client IP, and is no more trustworthy than
+// X-Forwarded-For, but its length can be used to sanity-check an expected count of
+// trusted proxies.
+func ParseVia(headers http.Header) []ViaHop {
+	var result []ViaHop
+	for _, h := range headers["Via"] {
+		for _, element := range splitViaElements(h) {
+			if hop, ok := parseViaElement(element); ok {
+				result = append(result, hop)
+			}
+		}
+	}
+	return result
+}
+
+// ViaHopCount returns the number of valid hops in the Via header. It is equivalent to
+// len(ParseVia(headers)).
+func ViaHopCount(headers http.Header) int {
+	return len(ParseVia(headers))
+}
+
+// splitViaElements splits a Via header value on the commas that separate list elements.
+// Commas within comments (which are in parentheses) do not separate elements.
+func splitViaElements(h string) []string {
+	var result []string
+	depth, start := 0, 0
+	for i := 0; i < len(h); i++ {
+		switch h[i] {
+		case '\\':
+			if depth > 0 {
+				// Skip the quoted-pair within the comment
+				i++
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				result = append(result, h[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, h[start:])
+}
+
+// parseViaElement parses a single Via list element, like "1.1 proxy1 (comment)".
+// ok is false if the element is malformed.
+func parseViaElement(element string) (hop ViaHop, ok bool) {
+	element = trimOWS(element)
+
+	if i := strings.IndexByte(element, '('); i >= 0 {
+		hop.Comment = trimMatchedEnds(trimOWS(element[i:]), "()")
+		element = trimOWS(element[:i])
+	}
+
+	fields := strings.Fields(element)
+	if len(fields) != 2 {
+		return ViaHop{}, false
+	}
+
+	protocol := fields[0]
+	if i := strings.IndexByte(protocol, '/'); i >= 0 {
+		hop.ProtocolName, protocol = protocol[:i], protocol[i+1:]
+		if hop.ProtocolName == "" {
+			return ViaHop{}, false
+		}
+	}
+	if protocol == "" {
+		return ViaHop{}, false
+	}
+	hop.ProtocolVersion = protocol
+	hop.ReceivedBy = fields[1]
+
+	return hop, true
+}
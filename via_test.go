@@ -0,0 +1,63 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseVia(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers http.Header
+		want    []ViaHop
+	}{
+		{
+			name:    "Two hops",
+			headers: http.Header{"Via": []string{"1.1 proxy1, 1.1 proxy2"}},
+			want: []ViaHop{
+				{ProtocolVersion: "1.1", ReceivedBy: "proxy1"},
+				{ProtocolVersion: "1.1", ReceivedBy: "proxy2"},
+			},
+		},
+		{
+			name: "Protocol names, ports, comments, and multiple headers",
+			headers: http.Header{"Via": []string{
+				"HTTP/1.0 fred:8080 (Apache/1.1, really), 1.1 p.example.net",
+				"2 varnish (Varnish/6.0)",
+			}},
+			want: []ViaHop{
+				{ProtocolName: "HTTP", ProtocolVersion: "1.0", ReceivedBy: "fred:8080", Comment: "Apache/1.1, really"},
+				{ProtocolVersion: "1.1", ReceivedBy: "p.example.net"},
+				{ProtocolVersion: "2", ReceivedBy: "varnish", Comment: "Varnish/6.0"},
+			},
+		},
+		{
+			name:    "Empty and malformed elements",
+			headers: http.Header{"Via": []string{"1.1 proxy1,, 1.1, /1.1 proxy3, HTTP/ proxy4, 1.1 proxy5 extra, 1.1 proxy6"}},
+			want: []ViaHop{
+				{ProtocolVersion: "1.1", ReceivedBy: "proxy1"},
+				{ProtocolVersion: "1.1", ReceivedBy: "proxy6"},
+			},
+		},
+		{
+			name:    "No header",
+			headers: http.Header{},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseVia(tt.headers)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseVia() = %+v, want %+v", got, tt.want)
+			}
+
+			if gotCount := ViaHopCount(tt.headers); gotCount != len(tt.want) {
+				t.Fatalf("ViaHopCount() = %d, want %d", gotCount, len(tt.want))
+			}
+		})
+	}
+}
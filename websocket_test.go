@@ -0,0 +1,103 @@
+// SPDX: 0BSD
+
+package realclientip
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientIP_websocketUpgrade(t *testing.T) {
+	strat := NewChainStrategy(
+		Must(NewRightmostNonPrivateStrategy("X-Forwarded-For")),
+		RemoteAddrStrategy{},
+	)
+
+	// The handler reports the client IP derived from the handshake request, as a
+	// WebSocket server would before upgrading
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "not an upgrade", http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(strat.ClientIP(r.Header, r.RemoteAddr)))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		extraHeader string
+		want        string
+	}{
+		{
+			name:        "Lowercase header",
+			extraHeader: "x-forwarded-for: 1.1.1.1, 2.2.2.2, 192.168.1.1\r\n",
+			want:        "2.2.2.2",
+		},
+		{
+			name:        "Uppercase header",
+			extraHeader: "X-FORWARDED-FOR: 3.3.3.3\r\n",
+			want:        "3.3.3.3",
+		},
+		{
+			name:        "No header falls back to RemoteAddr",
+			extraHeader: "",
+			want:        "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatalf("net.Dial error: %v", err)
+			}
+			defer conn.Close()
+
+			// Write a raw handshake so that the header casing is exactly as given
+			handshake := "GET /ws HTTP/1.1\r\n" +
+				"Host: example.com\r\n" +
+				"Connection: Upgrade\r\n" +
+				"Upgrade: websocket\r\n" +
+				"Sec-WebSocket-Version: 13\r\n" +
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+				tt.extraHeader +
+				"\r\n"
+			if _, err := conn.Write([]byte(handshake)); err != nil {
+				t.Fatalf("conn.Write error: %v", err)
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("http.ReadResponse error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("ioutil.ReadAll error: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, body = %q", resp.StatusCode, body)
+			}
+
+			if got := string(body); got != tt.want {
+				t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The same applies to a handshake request constructed directly
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("x-forwarded-for", "4.4.4.4")
+	if got := strat.ClientIP(req.Header, req.RemoteAddr); got != "4.4.4.4" {
+		t.Fatalf("ClientIP = %q, want %q", got, "4.4.4.4")
+	}
+}